@@ -0,0 +1,77 @@
+package attachments
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/raynine/go-chatroom/utils"
+)
+
+// Extensions of the content types that can be stored.
+var extensions = map[string]string{
+	"image/svg+xml": ".svg",
+	"image/png":     ".png",
+}
+
+var namePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{22}\.(svg|png)$`)
+
+// Stores the attachments in a local directory and serves them under the base URL.
+type LocalStore struct {
+	Dir     string
+	BaseURL string
+}
+
+// Creates the store, making sure the directory exists. The base URL is the public URL of the ServeHTTP handler.
+func NewLocalStore(dir, baseURL string) (*LocalStore, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+
+	return &LocalStore{
+		Dir:     dir,
+		BaseURL: strings.TrimSuffix(baseURL, "/"),
+	}, nil
+}
+
+// Writes the file with a random name, so the URLs of the attachments can't be guessed.
+func (s *LocalStore) Save(contentType string, data []byte) (string, error) {
+	extension, ok := extensions[contentType]
+	if !ok {
+		return "", fmt.Errorf("unsupported attachment content type %s", contentType)
+	}
+
+	token, err := utils.GenerateToken(16)
+	if err != nil {
+		return "", err
+	}
+
+	name := token + extension
+
+	err = os.WriteFile(filepath.Join(s.Dir, name), data, 0o644)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%s/%s", s.BaseURL, name), nil
+}
+
+// Serves the file named by the last segment of the path. Only names generated by Save are accepted.
+func (s *LocalStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+	if !namePattern.MatchString(name) {
+		http.NotFound(w, r)
+		return
+	}
+
+	// SVGs can carry scripts, the attachments are only meant to be displayed.
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+
+	http.ServeFile(w, r, filepath.Join(s.Dir, name))
+}
@@ -0,0 +1,41 @@
+package attachments
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocalStore(t *testing.T) {
+	store, err := NewLocalStore(t.TempDir(), "http://localhost:8080/attachments/")
+	assert.NoError(t, err)
+
+	url, err := store.Save("image/svg+xml", []byte("<svg></svg>"))
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(url, "http://localhost:8080/attachments/"))
+	assert.True(t, strings.HasSuffix(url, ".svg"))
+
+	t.Run("Serves saved files", func(t *testing.T) {
+		res := httptest.NewRecorder()
+		store.ServeHTTP(res, httptest.NewRequest(http.MethodGet, strings.TrimPrefix(url, "http://localhost:8080"), nil))
+
+		assert.Equal(t, http.StatusOK, res.Code)
+		assert.Equal(t, "image/svg+xml", res.Header().Get("Content-Type"))
+		assert.Equal(t, "<svg></svg>", res.Body.String())
+	})
+
+	t.Run("Rejects other names", func(t *testing.T) {
+		res := httptest.NewRecorder()
+		store.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/attachments/..%2Fsecret.svg", nil))
+
+		assert.Equal(t, http.StatusNotFound, res.Code)
+	})
+
+	t.Run("Rejects unsupported content types", func(t *testing.T) {
+		_, err := store.Save("text/html", []byte("<html></html>"))
+		assert.Error(t, err)
+	})
+}
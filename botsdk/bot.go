@@ -0,0 +1,172 @@
+// Package botsdk runs chatroom bots as separate processes. A bot registers its commands through the
+// bot_registrations topic, receives the commands invoked in the chatrooms from its own bot_requests.<name> queue
+// and posts its replies through the bot_replies queue. See models.BotRegistration for the message contract.
+package botsdk
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/raynine/go-chatroom/broker"
+	"github.com/raynine/go-chatroom/chatbot"
+	"github.com/raynine/go-chatroom/models"
+	"github.com/raynine/go-chatroom/utils"
+)
+
+// External bot. The commands it handles are the ones added with Handle, they are invoked and replied the same
+// way as the built-in commands of the chatroom.
+type Bot struct {
+	Name     string
+	UserName string
+	// API token of the service account with the models.ScopeBotsRegister scope.
+	Token  string
+	broker broker.Broker
+	// How many times the requests that fail are retried before moving them to the dead letters.
+	Retries  broker.RetryPolicy
+	registry *chatbot.Registry
+}
+
+// Creates a bot named name that posts as the userName service account, authenticated with one of its API tokens. The
+// name is part of the queue name, it may only contain lowercase letters, digits, dots, dashes and underscores.
+func New(b broker.Broker, name string, userName string, token string) *Bot {
+	return &Bot{
+		Name:     name,
+		UserName: userName,
+		Token:    token,
+		broker:   b,
+		Retries:  broker.DefaultRetryPolicy,
+		registry: chatbot.NewRegistry(),
+	}
+}
+
+// Adds a command handled by the bot. Fails if another command already uses the same name.
+func (b *Bot) Handle(command chatbot.Command) error {
+	return b.registry.Register(command)
+}
+
+// Registration published to the chatroom. The /help command is served by the chatroom itself.
+func (b *Bot) Registration() *models.BotRegistration {
+	registration := &models.BotRegistration{
+		BotName:  b.Name,
+		UserName: b.UserName,
+		Commands: []models.BotCommand{},
+	}
+
+	for _, command := range b.registry.Commands() {
+		if command.Name() == "help" {
+			continue
+		}
+
+		registration.Commands = append(registration.Commands, models.BotCommand{
+			Name:        command.Name(),
+			Usage:       command.Usage(),
+			Description: command.Description(),
+		})
+	}
+
+	return registration
+}
+
+// Executes the command of the request. Returns nil if there's nothing to reply.
+func (b *Bot) HandleRequest(ctx context.Context, request *models.BotRequest) *models.BotReply {
+	if request.Message == nil {
+		return nil
+	}
+
+	reply := b.registry.Execute(ctx, request.Message, nil)
+	if reply == nil {
+		return nil
+	}
+
+	return &models.BotReply{
+		BotName:    b.Name,
+		ChatroomID: request.Message.ChatroomID,
+		Invocation: request.Invocation,
+		Message:    reply,
+	}
+}
+
+// Registers the bot and serves its commands until the context is cancelled. The registration is published again
+// every models.BotRegistrationInterval, otherwise the chatroom stops routing the commands to the bot.
+func (b *Bot) Run(ctx context.Context) error {
+	queue := models.BotRequestsQueue(b.Name)
+
+	err := b.broker.DeclareQueues(queue, models.BotRepliesQueue)
+	if err != nil {
+		return err
+	}
+
+	// Commands may call slow upstream services, they must not delay the registrations. The requests being handled
+	// when ctx is cancelled are finished, see broker.Broker.Drain.
+	go b.broker.Consume(queue, b.Retries, b.handleRequest(context.WithoutCancel(ctx)))
+
+	registration := b.Registration()
+
+	err = b.register(registration)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Bot %s started, serving %d commands", b.Name, len(registration.Commands))
+
+	ticker := time.NewTicker(models.BotRegistrationInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			err := b.register(registration)
+			if err != nil {
+				log.Printf("An error ocurred while registering bot %s: %s", b.Name, err.Error())
+			}
+		}
+	}
+}
+
+// Signs the registration with the token every time, the chatroom ignores the old signatures. The token itself is never
+// published.
+func (b *Bot) register(registration *models.BotRegistration) error {
+	registration.Sign(utils.HashToken(b.Token), time.Now())
+
+	body, err := json.Marshal(registration)
+	if err != nil {
+		return err
+	}
+
+	return b.broker.Broadcast(models.BotRegistrationsTopic, "", body)
+}
+
+// Replies the requests of the queue. Requests that can't be parsed go to the dead letters, the commands are not
+// retried once executed.
+func (b *Bot) handleRequest(ctx context.Context) broker.Handler {
+	return func(body []byte) error {
+		request := &models.BotRequest{}
+		err := json.Unmarshal(body, request)
+		if err != nil {
+			return broker.Permanent(err)
+		}
+
+		b.reply(ctx, request)
+		return nil
+	}
+}
+
+func (b *Bot) reply(ctx context.Context, request *models.BotRequest) {
+	reply := b.HandleRequest(ctx, request)
+	if reply == nil {
+		return
+	}
+
+	body, err := json.Marshal(reply)
+	if err == nil {
+		err = b.broker.Publish(models.BotRepliesQueue, body)
+	}
+
+	if err != nil {
+		log.Printf("Error while publishing to %s: %s", models.BotRepliesQueue, err.Error())
+	}
+}
@@ -0,0 +1,136 @@
+package botsdk
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/raynine/go-chatroom/broker"
+
+	"github.com/raynine/go-chatroom/chatbot"
+	"github.com/raynine/go-chatroom/models"
+	"github.com/raynine/go-chatroom/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+type echoCommand struct{}
+
+func (c *echoCommand) Name() string        { return "echo" }
+func (c *echoCommand) Usage() string       { return "/echo <text>" }
+func (c *echoCommand) Description() string { return "Repeats the text" }
+
+func (c *echoCommand) ParseArgs(args string) (any, error) {
+	if args == "" {
+		return nil, chatbot.NewValidationError("missing text")
+	}
+
+	return args, nil
+}
+
+func (c *echoCommand) Execute(ctx context.Context, request *chatbot.CommandRequest, args any) (*models.ChatMessage, error) {
+	return &models.ChatMessage{Message: args.(string)}, nil
+}
+
+func TestRegistration(t *testing.T) {
+	bot := New(nil, "echobot", "echo", "gct_test")
+	bot.Handle(&echoCommand{})
+
+	assert.Equal(t, &models.BotRegistration{
+		BotName:  "echobot",
+		UserName: "echo",
+		Commands: []models.BotCommand{{Name: "echo", Usage: "/echo <text>", Description: "Repeats the text"}},
+	}, bot.Registration())
+}
+
+func TestHandleRequest(t *testing.T) {
+	bot := New(nil, "echobot", "echo", "gct_test")
+	bot.Handle(&echoCommand{})
+
+	t.Run("Success", func(t *testing.T) {
+		reply := bot.HandleRequest(context.Background(), &models.BotRequest{
+			Command:    "echo",
+			Args:       "hello",
+			Invocation: "1735689600.abc",
+			Message:    &models.ChatMessage{ChatroomID: "room", UserName: "ray", Message: "/echo hello"},
+		})
+
+		assert.Equal(t, "echobot", reply.BotName)
+		assert.Equal(t, "room", reply.ChatroomID)
+		assert.Equal(t, "1735689600.abc", reply.Invocation)
+		assert.Equal(t, "hello", reply.Message.Message)
+	})
+
+	t.Run("Invalid arguments", func(t *testing.T) {
+		reply := bot.HandleRequest(context.Background(), &models.BotRequest{
+			Command: "echo",
+			Message: &models.ChatMessage{ChatroomID: "room", UserName: "ray", Message: "/echo"},
+		})
+
+		assert.Equal(t, "@ray Invalid arguments for /echo: missing text. Usage: /echo <text>", reply.Message.Message)
+	})
+
+	t.Run("Unknown command", func(t *testing.T) {
+		reply := bot.HandleRequest(context.Background(), &models.BotRequest{
+			Command: "stock",
+			Message: &models.ChatMessage{ChatroomID: "room", Message: "/stock=aapl.us"},
+		})
+
+		assert.Nil(t, reply)
+	})
+}
+
+func TestRun(t *testing.T) {
+	b := broker.NewMemory()
+	defer b.Close()
+
+	registrations, err := b.Subscribe(models.BotRegistrationsTopic, "chatroom")
+	assert.NoError(t, err)
+
+	registered := make(chan []byte, 1)
+	go registrations.Receive(func(body []byte) {
+		registered <- body
+	})
+
+	replies := make(chan *models.BotReply, 1)
+	go b.Consume(models.BotRepliesQueue, broker.DefaultRetryPolicy, func(body []byte) error {
+		reply := &models.BotReply{}
+		json.Unmarshal(body, reply)
+		replies <- reply
+		return nil
+	})
+
+	bot := New(b, "echobot", "echo", "gct_test")
+	bot.Handle(&echoCommand{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go bot.Run(ctx)
+
+	select {
+	case body := <-registered:
+		registration := &models.BotRegistration{}
+		json.Unmarshal(body, registration)
+
+		assert.Equal(t, "echobot", registration.BotName)
+		assert.True(t, registration.Verify(utils.HashToken("gct_test")))
+		assert.NotContains(t, string(body), "gct_test")
+	case <-time.After(time.Second):
+		t.Fatal("bot was not registered")
+	}
+
+	body, _ := json.Marshal(&models.BotRequest{
+		Command: "echo",
+		Args:    "hello",
+		Message: &models.ChatMessage{ChatroomID: "room", UserName: "ray", Message: "/echo hello"},
+	})
+	assert.NoError(t, b.Publish(models.BotRequestsQueue("echobot"), body))
+
+	select {
+	case reply := <-replies:
+		assert.Equal(t, "room", reply.ChatroomID)
+		assert.Equal(t, "hello", reply.Message.Message)
+	case <-time.After(time.Second):
+		t.Fatal("bot did not reply")
+	}
+}
@@ -0,0 +1,143 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// How long a publish waits for the broker to confirm it.
+const PublishTimeout = 5 * time.Second
+
+var ErrNotConfirmed = errors.New("message was not confirmed by the broker")
+
+// Declares the dead letters queue. Must be declared before the work queues that route to it.
+func declareDeadLetters(ch *amqp.Channel) error {
+	_, err := ch.QueueDeclare(
+		DeadLettersQueue, // name
+		true,             // durable
+		false,            // delete when unused
+		false,            // exclusive
+		false,            // no-wait
+		nil,              // arguments
+	)
+
+	return err
+}
+
+// Declares a durable work queue. Messages rejected by the consumers are moved to the dead letters queue.
+func declareQueue(ch *amqp.Channel, name string) error {
+	_, err := ch.QueueDeclare(
+		name,  // name
+		true,  // durable
+		false, // delete when unused
+		false, // exclusive
+		false, // no-wait
+		amqp.Table{
+			"x-dead-letter-exchange":    "",
+			"x-dead-letter-routing-key": DeadLettersQueue,
+		}, // arguments
+	)
+
+	return err
+}
+
+// Name of the queue where the failed messages of queue wait delay before being retried.
+func retryQueue(queue string, delay time.Duration) string {
+	return fmt.Sprintf("%s.retry.%d", queue, delay.Milliseconds())
+}
+
+// Declares the retry queue of queue for the delay. It has no consumers, its messages expire after the delay and the
+// broker moves them back to queue, so the consumer doesn't wait for them.
+func declareRetryQueue(ch *amqp.Channel, queue string, delay time.Duration) error {
+	_, err := ch.QueueDeclare(
+		retryQueue(queue, delay), // name
+		true,                     // durable
+		false,                    // delete when unused
+		false,                    // exclusive
+		false,                    // no-wait
+		amqp.Table{
+			"x-message-ttl":             delay.Milliseconds(),
+			"x-dead-letter-exchange":    "",
+			"x-dead-letter-routing-key": queue,
+		}, // arguments
+	)
+
+	return err
+}
+
+// Topology with the dead letters queue and the provided work queues.
+func workQueues(names ...string) topology {
+	return func(ch *amqp.Channel) error {
+		err := declareDeadLetters(ch)
+		if err != nil {
+			return err
+		}
+
+		for _, name := range names {
+			err = declareQueue(ch, name)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+}
+
+// Declares the exchange of the topic.
+func declareExchange(ch *amqp.Channel, topic Topic) error {
+	kind := "direct"
+	if topic.Fanout {
+		kind = "fanout"
+	}
+
+	return ch.ExchangeDeclare(
+		topic.Name, // name
+		kind,       // kind
+		true,       // durable
+		false,      // delete when unused
+		false,      // internal
+		false,      // no-wait
+		nil,        // arguments
+	)
+}
+
+// Publishes a persistent JSON message. When the channel is in confirm mode it waits until the broker confirms the
+// message was stored.
+func publishJSON(ch *amqp.Channel, exchange string, key string, body []byte) error {
+	return publish(ch, exchange, key, amqp.Publishing{
+		ContentType:  "application/json",
+		DeliveryMode: amqp.Persistent,
+		Body:         body,
+	})
+}
+
+func publish(ch *amqp.Channel, exchange string, key string, msg amqp.Publishing) error {
+	ctx, cancel := context.WithTimeout(context.Background(), PublishTimeout)
+	defer cancel()
+
+	confirmation, err := ch.PublishWithDeferredConfirmWithContext(ctx, exchange, key, false, false, msg)
+	if err != nil {
+		return err
+	}
+
+	// The channel is not in confirm mode.
+	if confirmation == nil {
+		return nil
+	}
+
+	acked, err := confirmation.WaitContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	if !acked {
+		return ErrNotConfirmed
+	}
+
+	return nil
+}
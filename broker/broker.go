@@ -0,0 +1,85 @@
+// Package broker moves the messages between the chatroom and the bots. Work queues are consumed by a single
+// subscriber and retried until they're processed or moved to the dead letters, topics are broadcasted to every
+// subscription. RabbitMQ is used when running more than one process, Memory keeps everything in-process.
+package broker
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	// Queue where the messages that could not be processed end up. See Broker.DeadLetters and Broker.ReplayDeadLetters.
+	DeadLettersQueue = "dead_letters"
+)
+
+var (
+	ErrNotConnected = errors.New("not connected to the broker")
+	ErrClosed       = errors.New("broker connection closed")
+)
+
+type Broker interface {
+	// Declares the work queues, they keep the messages until they're consumed.
+	DeclareQueues(names ...string) error
+	// Publishes the message in the work queue.
+	Publish(queue string, body []byte) error
+	// Processes the messages of the work queue with the retry policy. Blocks until the broker is closed.
+	Consume(queue string, policy RetryPolicy, handle Handler)
+	// Sends the message to the subscriptions of the topic bound to the key, or to all of them if it's a fanout
+	// topic. Broadcasts are not kept for the subscriptions created later.
+	Broadcast(topic Topic, key string, body []byte) error
+	// Creates the subscription of the topic named name. Only one subscription may use a name at the same time.
+	Subscribe(topic Topic, name string) (Subscription, error)
+	// Gets up to limit dead letters without removing them.
+	DeadLetters(limit int) ([]*DeadLetter, error)
+	// Publishes up to limit dead letters again in their original queues with the retries reset.
+	ReplayDeadLetters(limit int) ([]*DeadLetter, error)
+	Status() Status
+	// Stops the consumers and subscriptions from taking new messages and waits for the ones being processed, until
+	// ctx is done. Publishing still works until Close.
+	Drain(ctx context.Context) error
+	Close() error
+}
+
+// Receives the broadcasts of a topic.
+type Subscription interface {
+	// Starts receiving the broadcasts sent with the key. Ignored for the fanout topics.
+	Bind(key string) error
+	// Stops receiving the broadcasts sent with the key. Ignored for the fanout topics.
+	Unbind(key string) error
+	// Passes the broadcasts to handle. Blocks until the broker is closed.
+	Receive(handle func(body []byte))
+}
+
+// Waits for the wait group until ctx is done.
+func wait(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Broadcasts are routed by key unless the topic is a fanout.
+type Topic struct {
+	Name   string
+	Fanout bool
+}
+
+// State of the broker reported by the health checks.
+type Status struct {
+	Connected bool       `json:"broker_connected"`
+	Since     *time.Time `json:"broker_since"`
+	// Amount of times the connection was established again after dropping.
+	Reconnects int    `json:"broker_reconnects"`
+	LastError  string `json:"broker_last_error,omitempty"`
+}
@@ -0,0 +1,145 @@
+package broker
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeAcknowledger struct {
+	acked   bool
+	nacked  bool
+	requeue bool
+}
+
+func (a *fakeAcknowledger) Ack(tag uint64, multiple bool) error {
+	a.acked = true
+	return nil
+}
+
+func (a *fakeAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	a.nacked = true
+	a.requeue = requeue
+	return nil
+}
+
+func (a *fakeAcknowledger) Reject(tag uint64, requeue bool) error {
+	return a.Nack(tag, false, requeue)
+}
+
+func newDelivery(ack *fakeAcknowledger, headers amqp.Table) amqp.Delivery {
+	return amqp.Delivery{Acknowledger: ack, Headers: headers, Body: []byte(`{}`)}
+}
+
+var noDelay = RetryPolicy{MaxRetries: 2}
+
+func TestProcessAcksHandledMessage(t *testing.T) {
+	ack := &fakeAcknowledger{}
+
+	process(newDelivery(ack, nil), noDelay, func(body []byte) error { return nil }, func(amqp.Publishing, time.Duration) error {
+		t.Fatal("message should not be retried")
+		return nil
+	})
+
+	assert.True(t, ack.acked)
+	assert.False(t, ack.nacked)
+}
+
+func TestProcessRetriesFailedMessage(t *testing.T) {
+	ack := &fakeAcknowledger{}
+	var retried *amqp.Publishing
+	var retryDelay time.Duration
+
+	headers := amqp.Table{RetriesHeader: int32(1), "x-death": []any{amqp.Table{"queue": "work.retry.1000", "reason": "expired"}}}
+	policy := RetryPolicy{MaxRetries: 2, RetryDelay: time.Second}
+
+	process(newDelivery(ack, headers), policy, func(body []byte) error {
+		return errors.New("database is down")
+	}, func(msg amqp.Publishing, delay time.Duration) error {
+		retried = &msg
+		retryDelay = delay
+		return nil
+	})
+
+	assert.True(t, ack.acked)
+	assert.False(t, ack.nacked)
+	assert.NotNil(t, retried)
+	assert.Equal(t, int32(2), retried.Headers[RetriesHeader])
+	assert.NotContains(t, retried.Headers, "x-death")
+	assert.Equal(t, []byte(`{}`), retried.Body)
+	assert.Equal(t, 2*time.Second, retryDelay)
+}
+
+func TestProcessRequeuesWhenRetryFails(t *testing.T) {
+	ack := &fakeAcknowledger{}
+
+	process(newDelivery(ack, nil), noDelay, func(body []byte) error {
+		return errors.New("database is down")
+	}, func(msg amqp.Publishing, delay time.Duration) error {
+		return errors.New("channel closed")
+	})
+
+	assert.False(t, ack.acked)
+	assert.True(t, ack.nacked)
+	assert.True(t, ack.requeue)
+}
+
+func TestProcessDeadLettersAfterMaxRetries(t *testing.T) {
+	ack := &fakeAcknowledger{}
+
+	process(newDelivery(ack, amqp.Table{RetriesHeader: int64(2)}), noDelay, func(body []byte) error {
+		return errors.New("database is down")
+	}, func(msg amqp.Publishing, delay time.Duration) error {
+		t.Fatal("message should not be retried")
+		return nil
+	})
+
+	assert.True(t, ack.nacked)
+	assert.False(t, ack.requeue)
+}
+
+func TestProcessDeadLettersPermanentError(t *testing.T) {
+	ack := &fakeAcknowledger{}
+
+	process(newDelivery(ack, nil), noDelay, func(body []byte) error {
+		return Permanent(errors.New("invalid message"))
+	}, func(msg amqp.Publishing, delay time.Duration) error {
+		t.Fatal("message should not be retried")
+		return nil
+	})
+
+	assert.True(t, ack.nacked)
+	assert.False(t, ack.requeue)
+}
+
+func TestNewDeadLetter(t *testing.T) {
+	deadAt := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+
+	deadLetter := newDeadLetter(amqp.Delivery{
+		Headers: amqp.Table{
+			RetriesHeader: int32(3),
+			"x-death": []any{
+				amqp.Table{"queue": "chatroom_messages", "reason": "rejected", "time": deadAt},
+				amqp.Table{"queue": "command_requests", "reason": "rejected", "time": deadAt.Add(-time.Hour)},
+			},
+		},
+		Body: []byte(`{"message":"hi"}`),
+	})
+
+	assert.Equal(t, "chatroom_messages", deadLetter.Queue)
+	assert.Equal(t, "rejected", deadLetter.Reason)
+	assert.Equal(t, 3, deadLetter.Retries)
+	assert.Equal(t, &deadAt, deadLetter.DeadAt)
+	assert.Equal(t, `{"message":"hi"}`, deadLetter.Body)
+}
+
+func TestNewDeadLetterWithoutDeathHeader(t *testing.T) {
+	deadLetter := newDeadLetter(amqp.Delivery{Body: []byte(`{}`)})
+
+	assert.Empty(t, deadLetter.Queue)
+	assert.Nil(t, deadLetter.DeadAt)
+	assert.Equal(t, 0, deadLetter.Retries)
+}
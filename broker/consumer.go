@@ -0,0 +1,151 @@
+package broker
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	// Header with the amount of times a message was retried.
+	RetriesHeader = "x-retries"
+	// Messages sent to a consumer before it acknowledges them.
+	prefetch = 10
+)
+
+// Error that is not solved by retrying, e.g. a message that can't be parsed. The message goes straight to the
+// dead letters.
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
+func Permanent(err error) error {
+	return &PermanentError{Err: err}
+}
+
+// How many times a failed message is retried, waiting RetryDelay times the attempt before each retry. The retries
+// wait in the broker, the consumer keeps processing the other messages meanwhile.
+type RetryPolicy struct {
+	MaxRetries int
+	RetryDelay time.Duration
+}
+
+var DefaultRetryPolicy = RetryPolicy{MaxRetries: 3, RetryDelay: time.Second}
+
+// Reports if the message that failed with err after the retries goes to the dead letters instead of being retried.
+func (p RetryPolicy) deadLetter(err error, retries int) bool {
+	var permanent *PermanentError
+	return errors.As(err, &permanent) || retries >= p.MaxRetries
+}
+
+// Time waited before retrying a message that failed after the retries.
+func (p RetryPolicy) delay(retries int) time.Duration {
+	return p.RetryDelay * time.Duration(retries+1)
+}
+
+// Processes the body of a message. The message is acknowledged when it returns nil.
+type Handler func(body []byte) error
+
+// Consumes the queue acknowledging the messages once they are processed. Failed messages are published to a retry
+// queue, which moves them back to the end of the queue after the delay, until the max retries is reached. Then they
+// are moved to the dead letters. Blocks until the channel is closed.
+func consume(ch *amqp.Channel, tag string, queue string, policy RetryPolicy, handle Handler) error {
+	err := ch.Qos(prefetch, 0, false)
+	if err != nil {
+		return err
+	}
+
+	msgs, err := ch.Consume(queue, tag, false, false, false, false, nil)
+	if err != nil {
+		return err
+	}
+
+	// Retry queues declared on this channel, by delay.
+	declared := make(map[time.Duration]bool)
+
+	retry := func(msg amqp.Publishing, delay time.Duration) error {
+		if delay <= 0 {
+			return publish(ch, "", queue, msg)
+		}
+
+		if !declared[delay] {
+			err := declareRetryQueue(ch, queue, delay)
+			if err != nil {
+				return err
+			}
+
+			declared[delay] = true
+		}
+
+		return publish(ch, "", retryQueue(queue, delay), msg)
+	}
+
+	for d := range msgs {
+		process(d, policy, handle, retry)
+	}
+
+	return nil
+}
+
+func process(d amqp.Delivery, policy RetryPolicy, handle Handler, retry func(amqp.Publishing, time.Duration) error) {
+	err := handle(d.Body)
+	if err == nil {
+		d.Ack(false)
+		return
+	}
+
+	retries := retryCount(d.Headers)
+
+	if policy.deadLetter(err, retries) {
+		log.Printf("Moving message of %s to %s after %d retries: %s", d.RoutingKey, DeadLettersQueue, retries, err.Error())
+		d.Nack(false, false)
+		return
+	}
+
+	// The broker adds x-death when the retry expires, it's left out so it only describes the last time.
+	headers := amqp.Table{}
+	for key, value := range d.Headers {
+		if key != "x-death" {
+			headers[key] = value
+		}
+	}
+	headers[RetriesHeader] = int32(retries + 1)
+
+	err = retry(amqp.Publishing{
+		Headers:      headers,
+		ContentType:  d.ContentType,
+		DeliveryMode: amqp.Persistent,
+		Body:         d.Body,
+	}, policy.delay(retries))
+	if err != nil {
+		log.Printf("An error ocurred while retrying message of %s: %s", d.RoutingKey, err.Error())
+		d.Nack(false, true)
+		return
+	}
+
+	d.Ack(false)
+}
+
+// Reads the retries header, which may come back as any integer type.
+func retryCount(headers amqp.Table) int {
+	switch value := headers[RetriesHeader].(type) {
+	case int32:
+		return int(value)
+	case int64:
+		return int(value)
+	case int:
+		return value
+	default:
+		return 0
+	}
+}
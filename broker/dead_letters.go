@@ -0,0 +1,112 @@
+package broker
+
+import (
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Message moved to the dead letters queue.
+type DeadLetter struct {
+	Queue   string     `json:"dead_letter_queue"`
+	Reason  string     `json:"dead_letter_reason"`
+	Retries int        `json:"dead_letter_retries"`
+	DeadAt  *time.Time `json:"dead_letter_dead_at"`
+	Body    string     `json:"dead_letter_body"`
+}
+
+func newDeadLetter(d amqp.Delivery) *DeadLetter {
+	deadLetter := &DeadLetter{
+		Retries: retryCount(d.Headers),
+		Body:    string(d.Body),
+	}
+
+	death := lastDeath(d.Headers)
+	if death != nil {
+		deadLetter.Queue, _ = death["queue"].(string)
+		deadLetter.Reason, _ = death["reason"].(string)
+
+		deadAt, ok := death["time"].(time.Time)
+		if ok {
+			deadLetter.DeadAt = &deadAt
+		}
+	}
+
+	return deadLetter
+}
+
+// Gets the x-death entry added by the broker when the message was dead lettered. The most recent one comes first.
+func lastDeath(headers amqp.Table) amqp.Table {
+	deaths, ok := headers["x-death"].([]any)
+	if !ok || len(deaths) == 0 {
+		return nil
+	}
+
+	death, _ := deaths[0].(amqp.Table)
+	return death
+}
+
+// Gets up to limit dead letters without removing them from the queue.
+func peekDeadLetters(ch *amqp.Channel, limit int) ([]*DeadLetter, error) {
+	deliveries, err := getDeadLetters(ch, limit)
+
+	deadLetters := []*DeadLetter{}
+	for _, d := range deliveries {
+		deadLetters = append(deadLetters, newDeadLetter(d))
+		d.Nack(false, true)
+	}
+
+	return deadLetters, err
+}
+
+// Publishes up to limit dead letters again in their original queues with the retries reset. Returns the replayed
+// dead letters, the ones whose original queue is unknown are kept in the dead letters queue.
+func replayDeadLetters(ch *amqp.Channel, limit int) ([]*DeadLetter, error) {
+	deliveries, err := getDeadLetters(ch, limit)
+
+	replayed := []*DeadLetter{}
+	for _, d := range deliveries {
+		deadLetter := newDeadLetter(d)
+
+		// Once a publish fails the rest are kept for the next replay.
+		if err != nil || deadLetter.Queue == "" {
+			d.Nack(false, true)
+			continue
+		}
+
+		err = publish(ch, "", deadLetter.Queue, amqp.Publishing{
+			ContentType:  d.ContentType,
+			DeliveryMode: amqp.Persistent,
+			Body:         d.Body,
+		})
+		if err != nil {
+			d.Nack(false, true)
+			continue
+		}
+
+		d.Ack(false)
+		replayed = append(replayed, deadLetter)
+	}
+
+	return replayed, err
+}
+
+// Gets up to limit dead letters without acknowledging them, so the same message is not returned twice.
+func getDeadLetters(ch *amqp.Channel, limit int) ([]amqp.Delivery, error) {
+	deliveries := []amqp.Delivery{}
+
+	for len(deliveries) < limit {
+		d, ok, err := ch.Get(DeadLettersQueue, false)
+		if err != nil {
+			return deliveries, err
+		}
+
+		if !ok {
+			break
+		}
+
+		deliveries = append(deliveries, d)
+	}
+
+	return deliveries, nil
+}
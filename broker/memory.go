@@ -0,0 +1,318 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Reason of the dead letters rejected by the consumers, the same RabbitMQ uses.
+const rejectedReason = "rejected"
+
+// Broker that keeps the queues in memory, for running the chatroom and its bots in a single process. Messages are
+// lost when the process stops.
+type Memory struct {
+	mu            sync.Mutex
+	queues        map[string]*memoryQueue
+	subscriptions map[string]*memorySubscription
+	deadLetters   []*DeadLetter
+	startedAt     time.Time
+	closed        chan struct{}
+
+	// Closed to stop the consumers, see Drain.
+	stopping  chan struct{}
+	stopOnce  sync.Once
+	consumers sync.WaitGroup
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		queues:        make(map[string]*memoryQueue),
+		subscriptions: make(map[string]*memorySubscription),
+		startedAt:     time.Now(),
+		closed:        make(chan struct{}),
+		stopping:      make(chan struct{}),
+	}
+}
+
+func (m *Memory) DeclareQueues(names ...string) error {
+	for _, name := range names {
+		m.queue(name)
+	}
+
+	return nil
+}
+
+func (m *Memory) Publish(queue string, body []byte) error {
+	if m.isClosed() {
+		return ErrClosed
+	}
+
+	m.queue(queue).push(&memoryMessage{body: body})
+	return nil
+}
+
+// Processes the messages one at a time. Failed messages are pushed again at the end of the queue after the delay,
+// without holding the other messages, until the max retries is reached. Then they are moved to the dead letters.
+func (m *Memory) Consume(queue string, policy RetryPolicy, handle Handler) {
+	m.consumers.Add(1)
+	defer m.consumers.Done()
+
+	q := m.queue(queue)
+
+	for {
+		msg, ok := q.pop(m.stopping)
+		if !ok {
+			return
+		}
+
+		err := handle(msg.body)
+		if err == nil {
+			continue
+		}
+
+		if policy.deadLetter(err, msg.retries) {
+			log.Printf("Moving message of %s to %s after %d retries: %s", queue, DeadLettersQueue, msg.retries, err.Error())
+			m.addDeadLetter(queue, msg)
+			continue
+		}
+
+		retried := &memoryMessage{body: msg.body, retries: msg.retries + 1}
+		time.AfterFunc(policy.delay(msg.retries), func() {
+			q.push(retried)
+		})
+	}
+}
+
+func (m *Memory) Broadcast(topic Topic, key string, body []byte) error {
+	if m.isClosed() {
+		return ErrClosed
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, sub := range m.subscriptions {
+		if sub.topic.Name == topic.Name && (topic.Fanout || sub.bound(key)) {
+			sub.messages.push(&memoryMessage{body: body})
+		}
+	}
+
+	return nil
+}
+
+func (m *Memory) Subscribe(topic Topic, name string) (Subscription, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	id := topic.Name + "." + name
+	if _, ok := m.subscriptions[id]; ok {
+		return nil, fmt.Errorf("subscription %s already exists", id)
+	}
+
+	sub := &memorySubscription{
+		broker:   m,
+		topic:    topic,
+		keys:     make(map[string]bool),
+		messages: newMemoryQueue(),
+	}
+	m.subscriptions[id] = sub
+
+	return sub, nil
+}
+
+func (m *Memory) DeadLetters(limit int) ([]*DeadLetter, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	deadLetters := m.deadLetters[:min(limit, len(m.deadLetters))]
+	return append([]*DeadLetter{}, deadLetters...), nil
+}
+
+func (m *Memory) ReplayDeadLetters(limit int) ([]*DeadLetter, error) {
+	m.mu.Lock()
+	replayed := append([]*DeadLetter{}, m.deadLetters[:min(limit, len(m.deadLetters))]...)
+	m.deadLetters = m.deadLetters[len(replayed):]
+	m.mu.Unlock()
+
+	for _, deadLetter := range replayed {
+		m.queue(deadLetter.Queue).push(&memoryMessage{body: []byte(deadLetter.Body)})
+	}
+
+	return replayed, nil
+}
+
+// Always connected until it's closed.
+func (m *Memory) Status() Status {
+	return Status{
+		Connected: !m.isClosed(),
+		Since:     &m.startedAt,
+	}
+}
+
+// Stops the consumers once they finish the message they're processing and waits for them until ctx is done. The
+// messages left in the queues are lost.
+func (m *Memory) Drain(ctx context.Context) error {
+	m.stop()
+	return wait(ctx, &m.consumers)
+}
+
+func (m *Memory) Close() error {
+	m.stop()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.isClosed() {
+		close(m.closed)
+	}
+
+	return nil
+}
+
+func (m *Memory) stop() {
+	m.stopOnce.Do(func() {
+		close(m.stopping)
+	})
+}
+
+func (m *Memory) isClosed() bool {
+	select {
+	case <-m.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Gets the queue, creating it if it doesn't exist.
+func (m *Memory) queue(name string) *memoryQueue {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	q, ok := m.queues[name]
+	if !ok {
+		q = newMemoryQueue()
+		m.queues[name] = q
+	}
+
+	return q
+}
+
+func (m *Memory) addDeadLetter(queue string, msg *memoryMessage) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	m.deadLetters = append(m.deadLetters, &DeadLetter{
+		Queue:   queue,
+		Reason:  rejectedReason,
+		Retries: msg.retries,
+		DeadAt:  &now,
+		Body:    string(msg.body),
+	})
+}
+
+type memoryMessage struct {
+	body    []byte
+	retries int
+}
+
+// Unbounded FIFO queue, publishing never blocks.
+type memoryQueue struct {
+	mu       sync.Mutex
+	messages []*memoryMessage
+	// Receives a value when a message is pushed to wake up a consumer.
+	pushed chan struct{}
+}
+
+func newMemoryQueue() *memoryQueue {
+	return &memoryQueue{
+		pushed: make(chan struct{}, 1),
+	}
+}
+
+func (q *memoryQueue) push(msg *memoryMessage) {
+	q.mu.Lock()
+	q.messages = append(q.messages, msg)
+	q.mu.Unlock()
+
+	select {
+	case q.pushed <- struct{}{}:
+	default:
+	}
+}
+
+// Waits for the next message. Returns false once closed is closed.
+func (q *memoryQueue) pop(closed <-chan struct{}) (*memoryMessage, bool) {
+	for {
+		q.mu.Lock()
+		if len(q.messages) > 0 {
+			msg := q.messages[0]
+			q.messages = q.messages[1:]
+			more := len(q.messages) > 0
+			q.mu.Unlock()
+
+			// Another consumer may be waiting for the rest.
+			if more {
+				select {
+				case q.pushed <- struct{}{}:
+				default:
+				}
+			}
+
+			return msg, true
+		}
+		q.mu.Unlock()
+
+		select {
+		case <-closed:
+			return nil, false
+		case <-q.pushed:
+		}
+	}
+}
+
+type memorySubscription struct {
+	broker   *Memory
+	topic    Topic
+	keys     map[string]bool
+	messages *memoryQueue
+}
+
+// Must be called with the lock of the broker held.
+func (s *memorySubscription) bound(key string) bool {
+	return s.keys[key]
+}
+
+func (s *memorySubscription) Bind(key string) error {
+	s.broker.mu.Lock()
+	defer s.broker.mu.Unlock()
+
+	s.keys[key] = true
+	return nil
+}
+
+func (s *memorySubscription) Unbind(key string) error {
+	s.broker.mu.Lock()
+	defer s.broker.mu.Unlock()
+
+	delete(s.keys, key)
+	return nil
+}
+
+func (s *memorySubscription) Receive(handle func(body []byte)) {
+	s.broker.consumers.Add(1)
+	defer s.broker.consumers.Done()
+
+	for {
+		msg, ok := s.messages.pop(s.broker.stopping)
+		if !ok {
+			return
+		}
+
+		handle(msg.body)
+	}
+}
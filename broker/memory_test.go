@@ -0,0 +1,224 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Receives from the channel or fails after a second.
+func receive[T any](t *testing.T, values <-chan T) T {
+	t.Helper()
+
+	select {
+	case value := <-values:
+		return value
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for a message")
+		var zero T
+		return zero
+	}
+}
+
+func TestMemoryConsume(t *testing.T) {
+	m := NewMemory()
+	defer m.Close()
+
+	bodies := make(chan string, 10)
+	go m.Consume("work", noDelay, func(body []byte) error {
+		bodies <- string(body)
+		return nil
+	})
+
+	assert.NoError(t, m.Publish("work", []byte("first")))
+	assert.NoError(t, m.Publish("work", []byte("second")))
+
+	assert.Equal(t, "first", receive(t, bodies))
+	assert.Equal(t, "second", receive(t, bodies))
+}
+
+func TestMemoryRetriesAndDeadLetters(t *testing.T) {
+	m := NewMemory()
+	defer m.Close()
+
+	attempts := make(chan int, 10)
+	attempt := 0
+	go m.Consume("work", noDelay, func(body []byte) error {
+		attempt++
+		attempts <- attempt
+		return errors.New("database is down")
+	})
+
+	assert.NoError(t, m.Publish("work", []byte(`{"message":"hi"}`)))
+
+	// The first attempt plus the max retries.
+	for i := 1; i <= noDelay.MaxRetries+1; i++ {
+		assert.Equal(t, i, receive(t, attempts))
+	}
+
+	assert.Eventually(t, func() bool {
+		deadLetters, _ := m.DeadLetters(10)
+		return len(deadLetters) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	deadLetters, err := m.DeadLetters(10)
+	assert.NoError(t, err)
+	assert.Equal(t, "work", deadLetters[0].Queue)
+	assert.Equal(t, noDelay.MaxRetries, deadLetters[0].Retries)
+	assert.Equal(t, `{"message":"hi"}`, deadLetters[0].Body)
+}
+
+func TestMemoryRetriesDoNotHoldTheQueue(t *testing.T) {
+	m := NewMemory()
+	defer m.Close()
+
+	bodies := make(chan string, 10)
+	go m.Consume("work", RetryPolicy{MaxRetries: 1, RetryDelay: time.Hour}, func(body []byte) error {
+		bodies <- string(body)
+		if string(body) == "first" {
+			return errors.New("database is down")
+		}
+
+		return nil
+	})
+
+	assert.NoError(t, m.Publish("work", []byte("first")))
+	assert.NoError(t, m.Publish("work", []byte("second")))
+
+	assert.Equal(t, "first", receive(t, bodies))
+	assert.Equal(t, "second", receive(t, bodies))
+}
+
+func TestMemoryReplayDeadLetters(t *testing.T) {
+	m := NewMemory()
+	defer m.Close()
+
+	m.addDeadLetter("work", &memoryMessage{body: []byte("first"), retries: 3})
+	m.addDeadLetter("work", &memoryMessage{body: []byte("second"), retries: 3})
+
+	replayed, err := m.ReplayDeadLetters(1)
+	assert.NoError(t, err)
+	assert.Len(t, replayed, 1)
+
+	remaining, _ := m.DeadLetters(10)
+	assert.Len(t, remaining, 1)
+	assert.Equal(t, "second", remaining[0].Body)
+
+	bodies := make(chan string, 1)
+	go m.Consume("work", noDelay, func(body []byte) error {
+		bodies <- string(body)
+		return nil
+	})
+
+	assert.Equal(t, "first", receive(t, bodies))
+}
+
+func TestMemoryBroadcast(t *testing.T) {
+	m := NewMemory()
+	defer m.Close()
+
+	rooms := Topic{Name: "rooms"}
+	bots := Topic{Name: "bots", Fanout: true}
+
+	subscribe := func(topic Topic, name string) <-chan string {
+		sub, err := m.Subscribe(topic, name)
+		assert.NoError(t, err)
+
+		bodies := make(chan string, 10)
+		go sub.Receive(func(body []byte) { bodies <- string(body) })
+
+		if !topic.Fanout {
+			sub.Bind(name)
+		}
+
+		return bodies
+	}
+
+	lobby := subscribe(rooms, "lobby")
+	general := subscribe(rooms, "general")
+	first := subscribe(bots, "first")
+	second := subscribe(bots, "second")
+
+	assert.NoError(t, m.Broadcast(rooms, "lobby", []byte("to lobby")))
+	assert.NoError(t, m.Broadcast(bots, "", []byte("to every bot")))
+
+	assert.Equal(t, "to lobby", receive(t, lobby))
+	assert.Equal(t, "to every bot", receive(t, first))
+	assert.Equal(t, "to every bot", receive(t, second))
+	assert.Empty(t, general)
+
+	_, err := m.Subscribe(rooms, "lobby")
+	assert.Error(t, err)
+}
+
+func TestMemoryClose(t *testing.T) {
+	m := NewMemory()
+
+	done := make(chan bool)
+	go func() {
+		m.Consume("work", noDelay, func(body []byte) error { return nil })
+		done <- true
+	}()
+
+	assert.True(t, m.Status().Connected)
+	assert.NoError(t, m.Close())
+
+	assert.True(t, receive(t, done))
+	assert.False(t, m.Status().Connected)
+	assert.ErrorIs(t, m.Publish("work", []byte("late")), ErrClosed)
+}
+
+func TestMemoryDrain(t *testing.T) {
+	m := NewMemory()
+	defer m.Close()
+
+	started := make(chan bool)
+	finish := make(chan bool)
+	go m.Consume("work", noDelay, func(body []byte) error {
+		started <- true
+		<-finish
+		return nil
+	})
+
+	assert.NoError(t, m.Publish("work", []byte("slow")))
+	receive(t, started)
+
+	drained := make(chan error)
+	go func() {
+		drained <- m.Drain(context.Background())
+	}()
+
+	select {
+	case <-drained:
+		t.Fatal("drain should wait for the message being processed")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	finish <- true
+	assert.NoError(t, receive(t, drained))
+
+	// Publishing works until the broker is closed.
+	assert.NoError(t, m.Publish("work", []byte("late")))
+}
+
+func TestMemoryDrainTimeout(t *testing.T) {
+	m := NewMemory()
+	defer m.Close()
+
+	started := make(chan bool)
+	go m.Consume("work", noDelay, func(body []byte) error {
+		started <- true
+		select {}
+	})
+
+	assert.NoError(t, m.Publish("work", []byte("stuck")))
+	receive(t, started)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	assert.ErrorIs(t, m.Drain(ctx), context.DeadlineExceeded)
+}
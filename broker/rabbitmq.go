@@ -0,0 +1,540 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Declares the exchanges, queues and bindings used on a channel. Topologies are declared again on every reconnection,
+// they must be idempotent.
+type topology func(ch *amqp.Channel) error
+
+// Waits Delay before the first reconnection attempt, doubling it on every failed attempt up to MaxDelay.
+type ReconnectPolicy struct {
+	Delay    time.Duration
+	MaxDelay time.Duration
+}
+
+var DefaultReconnectPolicy = ReconnectPolicy{Delay: time.Second, MaxDelay: 30 * time.Second}
+
+// Broker backed by RabbitMQ that reconnects when the connection drops. Every reconnection opens a new channel in
+// confirm mode, declares the topologies again and restarts the consumers.
+type RabbitMQ struct {
+	url    string
+	policy ReconnectPolicy
+
+	mu         sync.RWMutex
+	conn       *amqp.Connection
+	ch         *amqp.Channel
+	topologies []topology
+	status     Status
+	// Closed and replaced every time the channel changes, to wake up the consumers waiting for a new one.
+	changed chan struct{}
+	closed  chan struct{}
+
+	// Tags of the running consumers, cancelled when draining.
+	tags      map[string]bool
+	nextTag   atomic.Int64
+	consumers sync.WaitGroup
+	draining  chan struct{}
+	drainOnce sync.Once
+}
+
+// Connects to the broker, failing if the first attempt does. The connection is watched in the background from then on.
+func DialRabbitMQ(url string, policy ReconnectPolicy) (*RabbitMQ, error) {
+	if policy.Delay <= 0 {
+		policy = DefaultReconnectPolicy
+	}
+
+	c := &RabbitMQ{
+		url:      url,
+		policy:   policy,
+		changed:  make(chan struct{}),
+		closed:   make(chan struct{}),
+		tags:     make(map[string]bool),
+		draining: make(chan struct{}),
+	}
+
+	err := c.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	go c.watch()
+
+	return c, nil
+}
+
+// Declares the topology on the current channel and remembers it for the reconnections.
+func (c *RabbitMQ) declare(topology topology) error {
+	c.mu.Lock()
+	c.topologies = append(c.topologies, topology)
+	ch := c.ch
+	c.mu.Unlock()
+
+	// Declared on the next reconnection.
+	if ch == nil {
+		return nil
+	}
+
+	return topology(ch)
+}
+
+// Declares the durable work queues, along with the dead letters queue.
+func (c *RabbitMQ) DeclareQueues(names ...string) error {
+	return c.declare(workQueues(names...))
+}
+
+// Gets the current channel. Fails while the connection is down.
+func (c *RabbitMQ) channel() (*amqp.Channel, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.ch == nil {
+		return nil, ErrNotConnected
+	}
+
+	return c.ch, nil
+}
+
+// Publishes a persistent JSON message in the queue, waiting until the broker confirms it was stored.
+func (c *RabbitMQ) Publish(queue string, body []byte) error {
+	ch, err := c.channel()
+	if err != nil {
+		return err
+	}
+
+	return publishJSON(ch, "", queue, body)
+}
+
+// Consumes the queue acknowledging the messages once they are processed, starting again on the new channel after
+// every reconnection. Failed messages are published again at the end of the queue until the max retries is reached,
+// then they are moved to the dead letters.
+func (c *RabbitMQ) Consume(queue string, policy RetryPolicy, handle Handler) {
+	c.serve(queue, func(ch *amqp.Channel, tag string) error {
+		return consume(ch, tag, queue, policy, handle)
+	})
+}
+
+// Publishes a transient message in the exchange of the topic without waiting for the confirmation, the broadcasts
+// are not worth the latency.
+func (c *RabbitMQ) Broadcast(topic Topic, key string, body []byte) error {
+	ch, err := c.channel()
+	if err != nil {
+		return err
+	}
+
+	return ch.Publish(topic.Name, key, false, false, amqp.Publishing{ContentType: "application/json", Body: body})
+}
+
+// Declares the exchange of the topic and an exclusive queue named topic.name, removed when the process
+// disconnects and declared again on the reconnection along with its bindings.
+func (c *RabbitMQ) Subscribe(topic Topic, name string) (Subscription, error) {
+	sub := &rabbitSubscription{
+		conn:  c,
+		topic: topic,
+		queue: topic.Name + "." + name,
+		keys:  make(map[string]bool),
+	}
+
+	err := c.declare(sub.declare)
+	if err != nil {
+		return nil, err
+	}
+
+	return sub, nil
+}
+
+func (c *RabbitMQ) DeadLetters(limit int) ([]*DeadLetter, error) {
+	ch, err := c.channel()
+	if err != nil {
+		return nil, err
+	}
+
+	return peekDeadLetters(ch, limit)
+}
+
+func (c *RabbitMQ) ReplayDeadLetters(limit int) ([]*DeadLetter, error) {
+	ch, err := c.channel()
+	if err != nil {
+		return nil, err
+	}
+
+	return replayDeadLetters(ch, limit)
+}
+
+// Runs consume with the current channel, and again with the new one after every reconnection. consume must use the
+// tag and block until its deliveries channel is closed. Blocks until the connection is closed or drained.
+func (c *RabbitMQ) serve(name string, consume func(ch *amqp.Channel, tag string) error) {
+	c.consumers.Add(1)
+	defer c.consumers.Done()
+
+	tag := fmt.Sprintf("%s.%d", name, c.nextTag.Add(1))
+
+	c.mu.Lock()
+	c.tags[tag] = true
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.tags, tag)
+		c.mu.Unlock()
+	}()
+
+	var prev *amqp.Channel
+
+	for {
+		ch, err := c.next(prev)
+		if err != nil {
+			return
+		}
+
+		err = consume(ch, tag)
+		if err != nil {
+			log.Printf("An error ocurred while consuming %s: %s", name, err.Error())
+		}
+
+		prev = ch
+
+		// The consumer was cancelled by the broker, e.g. the queue was deleted, but the channel still works.
+		if !ch.IsClosed() {
+			select {
+			case <-c.closed:
+				return
+			case <-c.draining:
+				return
+			case <-time.After(c.policy.Delay):
+				prev = nil
+			}
+		}
+	}
+}
+
+// Gets the current channel once it's not prev, waiting for the reconnection if needed.
+func (c *RabbitMQ) next(prev *amqp.Channel) (*amqp.Channel, error) {
+	for {
+		c.mu.RLock()
+		ch, changed := c.ch, c.changed
+		c.mu.RUnlock()
+
+		if ch != nil && ch != prev {
+			return ch, nil
+		}
+
+		select {
+		case <-c.closed:
+			return nil, ErrClosed
+		case <-c.draining:
+			return nil, ErrClosed
+		case <-changed:
+		}
+	}
+}
+
+// Gets the current state of the connection.
+func (c *RabbitMQ) Status() Status {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.status
+}
+
+// Cancels the consumers, which finish processing the messages already delivered to them, and waits for them to
+// return until ctx is done. The messages that are not acknowledged are delivered again once another consumer starts.
+func (c *RabbitMQ) Drain(ctx context.Context) error {
+	c.drainOnce.Do(func() {
+		close(c.draining)
+	})
+
+	c.mu.RLock()
+	ch := c.ch
+	tags := make([]string, 0, len(c.tags))
+	for tag := range c.tags {
+		tags = append(tags, tag)
+	}
+	c.mu.RUnlock()
+
+	if ch != nil {
+		for _, tag := range tags {
+			err := ch.Cancel(tag, false)
+			if err != nil {
+				log.Printf("An error ocurred while cancelling consumer %s: %s", tag, err.Error())
+			}
+		}
+	}
+
+	return wait(ctx, &c.consumers)
+}
+
+// Closes the connection for good, the consumers return once their deliveries are closed.
+func (c *RabbitMQ) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	select {
+	case <-c.closed:
+		return nil
+	default:
+	}
+
+	close(c.closed)
+
+	if c.conn == nil {
+		return nil
+	}
+
+	return c.conn.Close()
+}
+
+// Opens the connection and the channel, then declares the topologies.
+func (c *RabbitMQ) connect() error {
+	conn, err := amqp.Dial(c.url)
+	if err != nil {
+		return err
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	// Publishes wait until the broker stores the message, see publish.
+	err = ch.Confirm(false)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	select {
+	case <-c.closed:
+		conn.Close()
+		return ErrClosed
+	default:
+	}
+
+	for _, topology := range c.topologies {
+		err = topology(ch)
+		if err != nil {
+			conn.Close()
+			return err
+		}
+	}
+
+	c.conn = conn
+	c.ch = ch
+
+	now := time.Now()
+	c.status.Connected = true
+	c.status.Since = &now
+	c.notifyChanged()
+
+	return nil
+}
+
+// Waits for the connection or the channel to close and reconnects, until Close is called.
+func (c *RabbitMQ) watch() {
+	for {
+		c.mu.RLock()
+		conn, ch := c.conn, c.ch
+		c.mu.RUnlock()
+
+		connClosed := conn.NotifyClose(make(chan *amqp.Error, 1))
+		chClosed := ch.NotifyClose(make(chan *amqp.Error, 1))
+
+		var reason *amqp.Error
+		select {
+		case <-c.closed:
+			return
+		case reason = <-connClosed:
+		case reason = <-chClosed:
+		}
+
+		select {
+		case <-c.closed:
+			return
+		default:
+		}
+
+		c.disconnected(reason)
+
+		if !c.reconnect() {
+			return
+		}
+	}
+}
+
+// Drops the current channel so the publishers fail fast until the reconnection.
+func (c *RabbitMQ) disconnected(reason *amqp.Error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	c.status.Connected = false
+	c.status.Since = &now
+	c.status.LastError = "connection closed"
+	if reason != nil {
+		c.status.LastError = reason.Error()
+	}
+
+	log.Printf("Lost connection to the broker: %s", c.status.LastError)
+
+	// The connection may still be open when only the channel was closed.
+	c.conn.Close()
+	c.conn = nil
+	c.ch = nil
+	c.notifyChanged()
+}
+
+// Tries to connect again with exponential backoff. Returns false if the connection was closed meanwhile.
+func (c *RabbitMQ) reconnect() bool {
+	delay := c.policy.Delay
+
+	for {
+		select {
+		case <-c.closed:
+			return false
+		case <-time.After(delay):
+		}
+
+		err := c.connect()
+		if err == nil {
+			c.mu.Lock()
+			c.status.Reconnects++
+			c.mu.Unlock()
+
+			log.Println("Reconnected to the broker")
+			return true
+		}
+
+		if errors.Is(err, ErrClosed) {
+			return false
+		}
+
+		delay = min(delay*2, c.policy.MaxDelay)
+		log.Printf("An error ocurred while reconnecting to the broker, retrying in %s: %s", delay, err.Error())
+
+		c.mu.Lock()
+		c.status.LastError = err.Error()
+		c.mu.Unlock()
+	}
+}
+
+// Must be called with the lock held.
+func (c *RabbitMQ) notifyChanged() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+type rabbitSubscription struct {
+	conn  *RabbitMQ
+	topic Topic
+	queue string
+	// Keys bound to the queue, bound again on the reconnections.
+	mu   sync.Mutex
+	keys map[string]bool
+}
+
+func (s *rabbitSubscription) declare(ch *amqp.Channel) error {
+	err := declareExchange(ch, s.topic)
+	if err != nil {
+		return err
+	}
+
+	_, err = ch.QueueDeclare(
+		s.queue, // name
+		false,   // durable
+		true,    // delete when unused
+		true,    // exclusive
+		false,   // no-wait
+		nil,     // arguments
+	)
+	if err != nil {
+		return err
+	}
+
+	if s.topic.Fanout {
+		return ch.QueueBind(s.queue, "", s.topic.Name, false, nil)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key := range s.keys {
+		err = ch.QueueBind(s.queue, key, s.topic.Name, false, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *rabbitSubscription) Bind(key string) error {
+	if s.topic.Fanout {
+		return nil
+	}
+
+	s.mu.Lock()
+	s.keys[key] = true
+	s.mu.Unlock()
+
+	ch, err := s.conn.channel()
+	// Bound on the reconnection.
+	if errors.Is(err, ErrNotConnected) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return ch.QueueBind(s.queue, key, s.topic.Name, false, nil)
+}
+
+func (s *rabbitSubscription) Unbind(key string) error {
+	if s.topic.Fanout {
+		return nil
+	}
+
+	s.mu.Lock()
+	delete(s.keys, key)
+	s.mu.Unlock()
+
+	ch, err := s.conn.channel()
+	// Not bound again on the reconnection.
+	if errors.Is(err, ErrNotConnected) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return ch.QueueUnbind(s.queue, key, s.topic.Name, nil)
+}
+
+func (s *rabbitSubscription) Receive(handle func(body []byte)) {
+	s.conn.serve(s.queue, func(ch *amqp.Channel, tag string) error {
+		msgs, err := ch.Consume(s.queue, tag, true, true, false, false, nil)
+		if err != nil {
+			return err
+		}
+
+		for d := range msgs {
+			handle(d.Body)
+		}
+
+		return nil
+	})
+}
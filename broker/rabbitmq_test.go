@@ -0,0 +1,99 @@
+package broker
+
+import (
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestRabbitMQ() *RabbitMQ {
+	return &RabbitMQ{
+		policy:  DefaultReconnectPolicy,
+		changed: make(chan struct{}),
+		closed:  make(chan struct{}),
+	}
+}
+
+// Sets the channel the same way a reconnection does.
+func (c *RabbitMQ) setChannel(ch *amqp.Channel) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.ch = ch
+	c.notifyChanged()
+}
+
+func TestNextWaitsForNewChannel(t *testing.T) {
+	c := newTestRabbitMQ()
+	old := &amqp.Channel{}
+	c.setChannel(old)
+
+	next := make(chan *amqp.Channel)
+	go func() {
+		ch, _ := c.next(old)
+		next <- ch
+	}()
+
+	select {
+	case <-next:
+		t.Fatal("next should wait until the channel changes")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// Dropped while reconnecting, then the new one is set.
+	c.setChannel(nil)
+	reconnected := &amqp.Channel{}
+	c.setChannel(reconnected)
+
+	select {
+	case ch := <-next:
+		assert.Same(t, reconnected, ch)
+	case <-time.After(time.Second):
+		t.Fatal("next should return the new channel")
+	}
+}
+
+func TestNextReturnsWhenClosed(t *testing.T) {
+	c := newTestRabbitMQ()
+
+	errs := make(chan error)
+	go func() {
+		_, err := c.next(nil)
+		errs <- err
+	}()
+
+	assert.NoError(t, c.Close())
+
+	select {
+	case err := <-errs:
+		assert.ErrorIs(t, err, ErrClosed)
+	case <-time.After(time.Second):
+		t.Fatal("next should return once the connection is closed")
+	}
+}
+
+func TestChannelWhileDisconnected(t *testing.T) {
+	c := newTestRabbitMQ()
+
+	_, err := c.channel()
+	assert.ErrorIs(t, err, ErrNotConnected)
+
+	err = c.Publish("queue", []byte(`{}`))
+	assert.ErrorIs(t, err, ErrNotConnected)
+}
+
+func TestDeclareWhileDisconnected(t *testing.T) {
+	c := newTestRabbitMQ()
+	declared := false
+
+	err := c.declare(func(ch *amqp.Channel) error {
+		declared = true
+		return nil
+	})
+
+	assert.NoError(t, err)
+	assert.False(t, declared)
+	assert.Len(t, c.topologies, 1)
+}
@@ -0,0 +1,297 @@
+package chatbot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/raynine/go-chatroom/interfaces"
+	"github.com/raynine/go-chatroom/models"
+)
+
+// Max amount of active alerts a user can have in a chatroom.
+const maxAlertsPerUser = 20
+
+var alertPattern = regexp.MustCompile(`^([a-z0-9^][a-z0-9._^-]{0,19})\s*(>=|<=|>|<)\s*([0-9]+(?:\.[0-9]+)?)$`)
+
+// Creates a price alert that gets announced in the chatroom: /alert=aapl.us>200
+type alertCommand struct {
+	alerts interfaces.PriceAlertRepo
+	quotes QuoteProvider
+}
+
+func NewAlertCommand(alerts interfaces.PriceAlertRepo, quotes QuoteProvider) Command {
+	return &alertCommand{
+		alerts: alerts,
+		quotes: quotes,
+	}
+}
+
+func (c *alertCommand) Name() string {
+	return "alert"
+}
+
+func (c *alertCommand) Usage() string {
+	return "/alert=<symbol><operator><price>, e.g. /alert=aapl.us>200"
+}
+
+func (c *alertCommand) Description() string {
+	return "Announces in the chatroom when the price of the stock crosses the target, operators are >, >=, < and <="
+}
+
+func (c *alertCommand) ParseArgs(args string) (any, error) {
+	matches := alertPattern.FindStringSubmatch(strings.ToLower(strings.TrimSpace(args)))
+	if matches == nil {
+		return nil, NewValidationError("%s is not a valid alert", strings.TrimSpace(args))
+	}
+
+	target, err := strconv.ParseFloat(matches[3], 64)
+	if err != nil || target <= 0 {
+		return nil, NewValidationError("%s is not a valid price", matches[3])
+	}
+
+	return &models.PriceAlert{
+		Symbol:   matches[1],
+		Operator: matches[2],
+		Target:   target,
+	}, nil
+}
+
+// Checks that the symbol can be quoted before saving the alert, so typos are reported right away.
+func (c *alertCommand) Execute(ctx context.Context, request *CommandRequest, args any) (*models.ChatMessage, error) {
+	alert := args.(*models.PriceAlert)
+	alert.UserID = request.Message.UserID
+	alert.ChatroomID = request.Message.ChatroomID
+
+	alerts, err := c.alerts.GetUserPriceAlerts(alert.UserID, alert.ChatroomID)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(alerts) >= maxAlertsPerUser {
+		return nil, NewValidationError("you can't have more than %d active alerts in a chatroom", maxAlertsPerUser)
+	}
+
+	quote, err := c.quotes.Quote(ctx, alert.Symbol)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = c.alerts.AddPriceAlert(alert, func(id int) ([]*models.OutboxMessage, error) {
+		return request.reply(&models.ChatMessage{
+			Message: mention(request.Message, fmt.Sprintf(
+				"alert #%d set: %s %s %s, the current price is $%s",
+				id,
+				quote.Symbol,
+				alert.Operator,
+				formatPrice(alert.Target),
+				quote.Close)),
+		})
+	})
+
+	return nil, err
+}
+
+// Lists the active alerts of the user in the chatroom: /alerts
+type alertsCommand struct {
+	alerts interfaces.PriceAlertRepo
+}
+
+func NewAlertsCommand(alerts interfaces.PriceAlertRepo) Command {
+	return &alertsCommand{
+		alerts: alerts,
+	}
+}
+
+func (c *alertsCommand) Name() string {
+	return "alerts"
+}
+
+func (c *alertsCommand) Usage() string {
+	return "/alerts"
+}
+
+func (c *alertsCommand) Description() string {
+	return "Lists your active alerts in the chatroom"
+}
+
+func (c *alertsCommand) ParseArgs(args string) (any, error) {
+	return nil, nil
+}
+
+func (c *alertsCommand) Execute(ctx context.Context, request *CommandRequest, args any) (*models.ChatMessage, error) {
+	alerts, err := c.alerts.GetUserPriceAlerts(request.Message.UserID, request.Message.ChatroomID)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(alerts) == 0 {
+		return &models.ChatMessage{
+			Message: mention(request.Message, "you have no active alerts in this chatroom"),
+		}, nil
+	}
+
+	lines := []string{}
+	for _, alert := range alerts {
+		lines = append(lines, fmt.Sprintf("#%d %s", alert.Id, describeAlert(alert)))
+	}
+
+	return &models.ChatMessage{
+		Message: mention(request.Message, fmt.Sprintf("your alerts: %s", strings.Join(lines, " | "))),
+	}, nil
+}
+
+// Removes an alert of the user: /unalert=3
+type unalertCommand struct {
+	alerts interfaces.PriceAlertRepo
+}
+
+func NewUnalertCommand(alerts interfaces.PriceAlertRepo) Command {
+	return &unalertCommand{
+		alerts: alerts,
+	}
+}
+
+func (c *unalertCommand) Name() string {
+	return "unalert"
+}
+
+func (c *unalertCommand) Usage() string {
+	return "/unalert=<alert id>"
+}
+
+func (c *unalertCommand) Description() string {
+	return "Removes one of your alerts, the ids are listed by /alerts"
+}
+
+func (c *unalertCommand) ParseArgs(args string) (any, error) {
+	id, err := strconv.Atoi(strings.TrimPrefix(strings.TrimSpace(args), "#"))
+	if err != nil || id <= 0 {
+		return nil, NewValidationError("%s is not a valid alert id", strings.TrimSpace(args))
+	}
+
+	return id, nil
+}
+
+func (c *unalertCommand) Execute(ctx context.Context, request *CommandRequest, args any) (*models.ChatMessage, error) {
+	id := args.(int)
+
+	outbox, err := request.reply(&models.ChatMessage{
+		Message: mention(request.Message, fmt.Sprintf("alert #%d removed", id)),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.alerts.DeletePriceAlert(id, request.Message.UserID, request.Message.ChatroomID, outbox)
+	if err != nil {
+		var customErr *models.CustomError
+		if errors.As(err, &customErr) && customErr.Code == http.StatusNotFound {
+			return nil, NewValidationError("alert #%d was not found in this chatroom", id)
+		}
+
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+func describeAlert(alert *models.PriceAlert) string {
+	return fmt.Sprintf("%s %s %s", strings.ToUpper(alert.Symbol), alert.Operator, formatPrice(alert.Target))
+}
+
+// Polls the quote provider and announces the alerts whose condition is met. Every alert is announced once, the
+// announcement is saved along with the trigger and notify is called once it's saved.
+type AlertScheduler struct {
+	alerts   interfaces.PriceAlertRepo
+	quotes   QuoteProvider
+	interval time.Duration
+	announce Announcer
+	notify   func()
+}
+
+func NewAlertScheduler(alerts interfaces.PriceAlertRepo, quotes QuoteProvider, interval time.Duration, announce Announcer, notify func()) *AlertScheduler {
+	return &AlertScheduler{
+		alerts:   alerts,
+		quotes:   quotes,
+		interval: interval,
+		announce: announce,
+		notify:   notify,
+	}
+}
+
+// Checks the alerts every interval until the context is cancelled.
+func (s *AlertScheduler) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.check(ctx)
+		}
+	}
+}
+
+// Quotes every symbol with active alerts once and announces the alerts that match.
+func (s *AlertScheduler) check(ctx context.Context) {
+	alerts, err := s.alerts.GetActivePriceAlerts()
+	if err != nil {
+		log.Printf("An error ocurred while getting active price alerts: %s", err.Error())
+		return
+	}
+
+	quotes := map[string]*Quote{}
+
+	for _, alert := range alerts {
+		quote, ok := quotes[alert.Symbol]
+		if !ok {
+			quote, err = s.quotes.Quote(ctx, alert.Symbol)
+			if err != nil {
+				log.Printf("Unable to quote %s for price alerts: %s", alert.Symbol, err.Error())
+			}
+
+			// Failed symbols are stored as nil so they are not requested again in this check.
+			quotes[alert.Symbol] = quote
+		}
+
+		if quote == nil {
+			continue
+		}
+
+		price, err := strconv.ParseFloat(quote.Close, 64)
+		if err != nil || !alert.Matches(price) {
+			continue
+		}
+
+		announcement, err := s.announce(alert.ChatroomID, &models.ChatMessage{
+			Message: fmt.Sprintf(
+				"@%s alert #%d triggered: %s is now $%s (%s)",
+				alert.UserName,
+				alert.Id,
+				quote.Symbol,
+				quote.Close,
+				describeAlert(alert)),
+		})
+		if err != nil {
+			log.Printf("Unable to announce price alert %d: %s", alert.Id, err.Error())
+			continue
+		}
+
+		// Another instance may have announced the alert already.
+		triggered, err := s.alerts.TriggerPriceAlert(alert.Id, []*models.OutboxMessage{announcement})
+		if err != nil || !triggered {
+			continue
+		}
+
+		s.notify()
+	}
+}
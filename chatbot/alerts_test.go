@@ -0,0 +1,118 @@
+package chatbot
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/raynine/go-chatroom/models"
+	"github.com/stretchr/testify/assert"
+)
+
+type stubAlertRepo struct {
+	alerts    []*models.PriceAlert
+	triggered map[int]bool
+	outbox    []*models.OutboxMessage
+}
+
+func (r *stubAlertRepo) AddPriceAlert(alert *models.PriceAlert, announce models.Announcement) (*int, error) {
+	alert.Id = len(r.alerts) + 1
+
+	outbox, err := announce(alert.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	r.alerts = append(r.alerts, alert)
+	r.outbox = append(r.outbox, outbox...)
+	return &alert.Id, nil
+}
+
+func (r *stubAlertRepo) GetUserPriceAlerts(userId int, chatroomId string) ([]*models.PriceAlert, error) {
+	alerts := []*models.PriceAlert{}
+	for _, alert := range r.alerts {
+		if alert.UserID == userId && alert.ChatroomID == chatroomId && !r.triggered[alert.Id] {
+			alerts = append(alerts, alert)
+		}
+	}
+	return alerts, nil
+}
+
+func (r *stubAlertRepo) GetActivePriceAlerts() ([]*models.PriceAlert, error) {
+	alerts := []*models.PriceAlert{}
+	for _, alert := range r.alerts {
+		if !r.triggered[alert.Id] {
+			alerts = append(alerts, alert)
+		}
+	}
+	return alerts, nil
+}
+
+func (r *stubAlertRepo) DeletePriceAlert(id int, userId int, chatroomId string, outbox []*models.OutboxMessage) error {
+	for i, alert := range r.alerts {
+		if alert.Id == id && alert.UserID == userId && alert.ChatroomID == chatroomId {
+			r.alerts = append(r.alerts[:i], r.alerts[i+1:]...)
+			r.outbox = append(r.outbox, outbox...)
+			return nil
+		}
+	}
+	return &models.CustomError{Message: "not found", Code: http.StatusNotFound}
+}
+
+func (r *stubAlertRepo) TriggerPriceAlert(id int, outbox []*models.OutboxMessage) (bool, error) {
+	if r.triggered[id] {
+		return false, nil
+	}
+	r.triggered[id] = true
+	r.outbox = append(r.outbox, outbox...)
+	return true, nil
+}
+
+func TestAlertCommands(t *testing.T) {
+	repo := &stubAlertRepo{triggered: map[int]bool{}}
+	quotes := &stubQuoteProvider{quote: &Quote{Symbol: "AAPL.US", Close: "243.85"}}
+
+	registry := NewRegistry()
+	registry.Register(NewAlertCommand(repo, quotes))
+	registry.Register(NewAlertsCommand(repo))
+	registry.Register(NewUnalertCommand(repo))
+	cb := &chatBot{registry: registry}
+
+	request := func(message string) string {
+		msg := &models.ChatMessage{UserID: 23, UserName: "ray", ChatroomID: "room", Message: message}
+
+		// The commands that change the alerts save their reply along with the change.
+		reply := cb.registry.Execute(context.Background(), msg, testAnnouncement)
+		if reply == nil {
+			reply = lastAnnounced(t, repo.outbox)
+		}
+
+		return reply.Message
+	}
+
+	assert.Equal(t, "@ray alert #1 set: AAPL.US > 250, the current price is $243.85", request("/alert=AAPL.US > 250"))
+	assert.Equal(t, "@ray alert #2 set: AAPL.US <= 200.5, the current price is $243.85", request("/alert=aapl.us<=200.5"))
+	assert.Equal(t, "@ray your alerts: #1 AAPL.US > 250 | #2 AAPL.US <= 200.5", request("/alerts"))
+	assert.Equal(t, "@ray Invalid arguments for /alert: aapl.us=250 is not a valid alert. Usage: /alert=<symbol><operator><price>, e.g. /alert=aapl.us>200", request("/alert=aapl.us=250"))
+	assert.Equal(t, "@ray alert #2 removed", request("/unalert=2"))
+	assert.Equal(t, "@ray Invalid arguments for /unalert: alert #2 was not found in this chatroom. Usage: /unalert=<alert id>", request("/unalert=2"))
+
+	t.Run("Scheduler announces matching alerts once", func(t *testing.T) {
+		saved := len(repo.outbox)
+		notified := 0
+		repo.alerts[0].UserName = "ray"
+		scheduler := NewAlertScheduler(repo, &stubQuoteProvider{quote: &Quote{Symbol: "AAPL.US", Close: "251.10"}}, 0,
+			testAnnouncement, func() { notified++ })
+
+		scheduler.check(context.Background())
+		scheduler.check(context.Background())
+
+		assert.Len(t, repo.outbox, saved+1)
+		assert.Equal(t, 1, notified)
+
+		announced := lastAnnounced(t, repo.outbox)
+		assert.Equal(t, "room", announced.ChatroomID)
+		assert.Equal(t, "@ray alert #1 triggered: AAPL.US is now $251.10 (AAPL.US > 250)", announced.Message)
+		assert.Equal(t, "@ray you have no active alerts in this chatroom", request("/alerts"))
+	})
+}
@@ -0,0 +1,121 @@
+package chatbot
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/raynine/go-chatroom/interfaces"
+	"github.com/raynine/go-chatroom/models"
+)
+
+const defaultChartRange = "3m"
+
+// Ranges accepted by /chart and how far back each one goes.
+var chartRanges = map[string]func(time.Time) time.Time{
+	"1m": func(t time.Time) time.Time { return t.AddDate(0, -1, 0) },
+	"3m": func(t time.Time) time.Time { return t.AddDate(0, -3, 0) },
+	"6m": func(t time.Time) time.Time { return t.AddDate(0, -6, 0) },
+	"1y": func(t time.Time) time.Time { return t.AddDate(-1, 0, 0) },
+	"5y": func(t time.Time) time.Time { return t.AddDate(-5, 0, 0) },
+}
+
+// Posts a chart with the daily close prices of a stock: /chart=aapl.us,6m
+type chartCommand struct {
+	history     HistoryProvider
+	attachments interfaces.AttachmentStore
+	now         func() time.Time
+}
+
+type chartArgs struct {
+	symbol string
+	period string
+}
+
+func NewChartCommand(history HistoryProvider, attachments interfaces.AttachmentStore) Command {
+	return &chartCommand{
+		history:     history,
+		attachments: attachments,
+		now:         time.Now,
+	}
+}
+
+func (c *chartCommand) Name() string {
+	return "chart"
+}
+
+func (c *chartCommand) Usage() string {
+	return "/chart=<symbol>[,1m|3m|6m|1y|5y]"
+}
+
+func (c *chartCommand) Description() string {
+	return "Posts a chart of the daily close prices of the stock, 3 months by default"
+}
+
+func (c *chartCommand) ParseArgs(args string) (any, error) {
+	symbol, period, _ := strings.Cut(args, ",")
+
+	symbol = strings.ToLower(strings.TrimSpace(symbol))
+	if symbol == "" {
+		return nil, NewValidationError("a stock symbol is required")
+	}
+
+	if !symbolPattern.MatchString(symbol) {
+		return nil, NewValidationError("%s is not a valid stock symbol", symbol)
+	}
+
+	period = strings.ToLower(strings.TrimSpace(period))
+	if period == "" {
+		period = defaultChartRange
+	}
+
+	if _, ok := chartRanges[period]; !ok {
+		return nil, NewValidationError("%s is not a valid range", period)
+	}
+
+	return chartArgs{symbol: symbol, period: period}, nil
+}
+
+func (c *chartCommand) Execute(ctx context.Context, request *CommandRequest, args any) (*models.ChatMessage, error) {
+	chart := args.(chartArgs)
+	to := c.now()
+
+	points, err := c.history.History(ctx, chart.symbol, chartRanges[chart.period](to), to)
+	if err != nil {
+		return nil, err
+	}
+
+	first, last := points[0].Close, points[len(points)-1].Close
+
+	change := 0.0
+	if first != 0 {
+		change = roundPrice((last - first) / first * 100)
+	}
+
+	symbol := strings.ToUpper(chart.symbol)
+	title := fmt.Sprintf("%s %s: $%s (%+.2f%%)", symbol, chart.period, formatPrice(last), change)
+
+	url, err := c.attachments.Save("image/svg+xml", RenderSparkline(title, points))
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := json.Marshal(models.AttachmentPayload{
+		URL:         url,
+		ContentType: "image/svg+xml",
+		Title:       title,
+		Width:       sparklineWidth,
+		Height:      sparklineHeight,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.ChatMessage{
+		Message: fmt.Sprintf("%s %s", title, url),
+		Type:    models.MessageTypeAttachment,
+		Payload: payload,
+	}, nil
+}
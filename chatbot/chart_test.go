@@ -0,0 +1,95 @@
+package chatbot
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/raynine/go-chatroom/models"
+	"github.com/stretchr/testify/assert"
+)
+
+const stooqHistoryResponse = "Date,Open,High,Low,Close,Volume\n2025-01-02,248.93,249.1,241.82,243.85,55740731\n2025-01-03,243.36,244.18,241.89,243.36,40244114\n2025-01-06,244.31,247.33,243.2,245,45045571\n"
+
+type stubAttachmentStore struct {
+	contentType string
+	data        []byte
+}
+
+func (s *stubAttachmentStore) Save(contentType string, data []byte) (string, error) {
+	s.contentType = contentType
+	s.data = data
+	return "http://localhost:8080/attachments/chart.svg", nil
+}
+
+func TestStooqHistoryProvider(t *testing.T) {
+	from := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2025, 1, 7, 0, 0, 0, 0, time.UTC)
+
+	t.Run("Success", func(t *testing.T) {
+		server, _ := newStooqServer(t, http.StatusOK, stooqHistoryResponse, 0)
+		provider := NewStooqHistoryProvider(server.URL+"/q/d/l/?s=%s&d1=%s&d2=%s", server.Client(), time.Second)
+
+		points, err := provider.History(context.Background(), "aapl.us", from, to)
+		assert.NoError(t, err)
+		assert.Equal(t, []PricePoint{
+			{Date: time.Date(2025, 1, 2, 0, 0, 0, 0, time.UTC), Close: 243.85},
+			{Date: time.Date(2025, 1, 3, 0, 0, 0, 0, time.UTC), Close: 243.36},
+			{Date: time.Date(2025, 1, 6, 0, 0, 0, 0, time.UTC), Close: 245},
+		}, points)
+	})
+
+	t.Run("Unknown symbol", func(t *testing.T) {
+		server, _ := newStooqServer(t, http.StatusOK, "No data", 0)
+		provider := NewStooqHistoryProvider(server.URL+"/q/d/l/?s=%s&d1=%s&d2=%s", server.Client(), time.Second)
+
+		points, err := provider.History(context.Background(), "aaplx.us", from, to)
+		assert.Nil(t, points)
+		assert.ErrorIs(t, err, ErrUnknownSymbol)
+	})
+
+	t.Run("Rate limited", func(t *testing.T) {
+		server, _ := newStooqServer(t, http.StatusTooManyRequests, "", 0)
+		provider := NewStooqHistoryProvider(server.URL+"/q/d/l/?s=%s&d1=%s&d2=%s", server.Client(), time.Second)
+
+		_, err := provider.History(context.Background(), "aapl.us", from, to)
+		assert.ErrorIs(t, err, ErrRateLimited)
+	})
+}
+
+func TestChartCommand(t *testing.T) {
+	server, _ := newStooqServer(t, http.StatusOK, stooqHistoryResponse, 0)
+	store := &stubAttachmentStore{}
+	command := NewChartCommand(
+		NewStooqHistoryProvider(server.URL+"/q/d/l/?s=%s&d1=%s&d2=%s", server.Client(), time.Second),
+		store,
+	)
+
+	t.Run("Invalid range", func(t *testing.T) {
+		_, err := command.ParseArgs("aapl.us,2w")
+		assert.EqualError(t, err, "2w is not a valid range")
+	})
+
+	t.Run("Success", func(t *testing.T) {
+		args, err := command.ParseArgs("AAPL.US")
+		assert.NoError(t, err)
+
+		reply, err := command.Execute(context.Background(), &CommandRequest{}, args)
+		assert.NoError(t, err)
+		assert.Equal(t, models.MessageTypeAttachment, reply.Type)
+		assert.Equal(t, "AAPL.US 3m: $245 (+0.47%) http://localhost:8080/attachments/chart.svg", reply.Message)
+
+		payload := models.AttachmentPayload{}
+		assert.NoError(t, json.Unmarshal(reply.Payload, &payload))
+		assert.Equal(t, "http://localhost:8080/attachments/chart.svg", payload.URL)
+		assert.Equal(t, "image/svg+xml", payload.ContentType)
+
+		assert.Equal(t, "image/svg+xml", store.contentType)
+		assert.True(t, strings.HasPrefix(string(store.data), "<svg"))
+		assert.Contains(t, string(store.data), fmt.Sprintf("stroke=%q", "#16a34a"))
+	})
+}
@@ -1,179 +1,396 @@
 package chatbot
 
 import (
-	"encoding/csv"
+	"context"
 	"encoding/json"
 	"fmt"
-	"io"
 	"log"
-	"net/http"
-
-	amqp "github.com/rabbitmq/amqp091-go"
+	"os"
+	"regexp"
+	"slices"
+	"sync"
+	"time"
 
+	"github.com/raynine/go-chatroom/broker"
 	"github.com/raynine/go-chatroom/interfaces"
 	"github.com/raynine/go-chatroom/models"
 )
 
-type chatBot struct {
-	ch   *amqp.Channel
-	Hubs map[string]*models.Hub
-	User *models.User
-	repo interfaces.DBRepo
-}
+// Bot names are part of the queue names of the external bots.
+var botNamePattern = regexp.MustCompile(`^[a-z0-9_.-]{1,50}$`)
 
-type stockInformation struct {
-	Symbol string
-	Date   string
-	Time   string
-	Open   string
-	High   string
-	Low    string
-	Close  string
-	Volume string
+type chatBot struct {
+	broker      broker.Broker
+	outbox      models.Outbox
+	broadcaster models.Broadcaster
+	User        *models.User
+	repo        interfaces.DBRepo
+	registry    *Registry
+	// Service accounts of the registered external bots, by bot name.
+	botsMu sync.RWMutex
+	bots   map[string]*models.User
+	// Signs the invocations of the external bots, shared by every instance of the chatroom.
+	invocationKey []byte
+	// Notified of the messages saved from the chatroom_messages queue.
+	Listener models.MessageListener
+	// Retries of the messages that fail to be processed before moving them to the dead letters.
+	Retries broker.RetryPolicy
+	// Called once the messages of the bot are saved in the outbox along with a change, e.g. to wake up the relay.
+	Notify func()
+
+	// Cancelled to stop the schedulers, see Close.
+	schedulersCtx  context.Context
+	stopSchedulers context.CancelFunc
+	schedulers     sync.WaitGroup
 }
 
-var ENDPOINT = "https://stooq.com/q/l/?s=%s&f=sd2t2ohlcv&h&e=csv"
-
-// Chatbot handles the reading of the commands and the writing of the stock response message.
-func NewChatBot(hubs map[string]*models.Hub, repo interfaces.DBRepo, botEmail string, ch *amqp.Channel) *chatBot {
+// Chatbot handles the reading of the commands and the writing of the responses. The commands it knows are
+// the ones added to the registry.
+func NewChatBot(broadcaster models.Broadcaster, repo interfaces.DBRepo, botEmail string, broker broker.Broker, outbox models.Outbox, registry *Registry) *chatBot {
 
 	user, err := repo.GetUserByEmail(botEmail)
 	if err != nil {
 		log.Fatalf("An error ocurred while finding bot email: %s", err.Error())
 	}
 
+	invocationKey := os.Getenv("BOT_INVOCATION_KEY")
+	if invocationKey == "" {
+		log.Fatalf("BOT_INVOCATION_KEY must be set to sign the invocations sent to the external bots")
+	}
+
+	schedulersCtx, stopSchedulers := context.WithCancel(context.Background())
+
 	return &chatBot{
-		Hubs: hubs,
-		User: user,
-		ch:   ch,
-		repo: repo,
+		broadcaster: broadcaster,
+		User:        user,
+		broker:      broker,
+		outbox:      outbox,
+		repo:        repo,
+		registry:    registry,
+		bots:        make(map[string]*models.User),
+
+		invocationKey:  []byte(invocationKey),
+		schedulersCtx:  schedulersCtx,
+		stopSchedulers: stopSchedulers,
 	}
 }
 
-// Reads messages from the stock_requests queue, then grabs the message and gives it the models.ChatMessage format, then passes it
+// Reads messages from the command_requests queue, then executes the command they invoke and passes the reply
 // to the chatroom_messages queue
-func (cb *chatBot) ConsumeStockRequests() {
-	msgs, _ := cb.ch.Consume("stock_requests", "", true, false, false, false, nil)
-	for d := range msgs {
+func (cb *chatBot) ConsumeCommandRequests() {
+	cb.broker.Consume(models.CommandRequestsQueue, cb.Retries, cb.handleCommandRequest)
+}
 
-		msg := &models.ChatMessage{}
+// Commands are not retried once executed, they may have side effects such as creating a poll.
+func (cb *chatBot) handleCommandRequest(body []byte) error {
+	msg := &models.ChatMessage{}
 
-		err := json.Unmarshal(d.Body, &msg)
-		if err != nil {
-			log.Println("Error parsing request:", err.Error())
-			continue
-		}
+	err := json.Unmarshal(body, &msg)
+	if err != nil {
+		return broker.Permanent(err)
+	}
 
-		log.Println("Stock request received: ", msg)
+	log.Println("Command request received: ", msg)
 
-		stockCode := msg.Message[7:]
+	reply := cb.registry.Execute(context.Background(), msg, cb.announcement)
+	if reply == nil {
+		cb.notify()
+		return nil
+	}
 
-		stock, err := getStockInformation(stockCode)
-		if err != nil {
-			log.Println(err.Error())
-			continue
-		}
+	cb.reply(msg.ChatroomID, reply)
+	return nil
+}
 
-		hub, ok := cb.Hubs[msg.ChatroomID]
-		if !ok {
-			log.Printf("Hub: %s does not exists", msg.ChatroomID)
-			continue
-		}
+// Publishes the reply of the bot into the chatroom_messages queue. The chatroom does not need connected clients,
+// announcements such as the price alerts are saved so they show up in the history.
+func (cb *chatBot) reply(chatroomId string, reply *models.ChatMessage) {
+	err := cb.replyAs(cb.User, chatroomId, reply)
+	if err != nil {
+		log.Printf("Error while publishing to %s: %s", models.ChatroomMessagesQueue, err.Error())
+	}
+}
+
+// Publishes the reply as the provided bot user, e.g. the service account of an external bot.
+func (cb *chatBot) replyAs(user *models.User, chatroomId string, reply *models.ChatMessage) error {
+	msg, err := cb.outboxMessage(botMessage(user, chatroomId, reply))
+	if err != nil {
+		return err
+	}
 
-		stockMessage := &models.ChatMessage{
-			Message: fmt.Sprintf(
-				"%s quote is $%s per share",
-				stock.Symbol,
-				stock.Close),
-			UserID:     cb.User.Id,
-			ChatroomID: hub.ChatroomId,
-		}
+	return cb.outbox.Publish(msg.Queue, msg.Body)
+}
+
+// Builds the outbox message that posts the message of the bot, for the repo to save it along with the change that
+// caused it. See Announcer.
+func (cb *chatBot) announcement(chatroomId string, msg *models.ChatMessage) (*models.OutboxMessage, error) {
+	return cb.outboxMessage(botMessage(cb.User, chatroomId, msg))
+}
 
-		log.Println("Bot message: ", stockMessage)
+func botMessage(user *models.User, chatroomId string, msg *models.ChatMessage) *models.ChatMessage {
+	msg.UserID = user.Id
+	msg.UserName = user.Username
+	msg.ChatroomID = chatroomId
+	msg.IsBot = true
+	msg.CreatedAt = time.Now()
 
-		body, _ := json.Marshal(stockMessage)
+	log.Println("Bot message: ", msg)
 
-		cb.ch.Publish("", "chatroom_messages", false, false, amqp.Publishing{ContentType: "application/json", Body: body})
+	return msg
+}
+
+func (cb *chatBot) notify() {
+	if cb.Notify != nil {
+		cb.Notify()
 	}
 }
 
-// Reads all the messages from the chatroom_messages queue, decodes the message to a models.ChatMessage model
-// saves it into the DB and gets broadcasted to the correct chatroom, avoiding leaking messages to others.
-func (cb *chatBot) ConsumeChatroomMessages() {
-	msgs, _ := cb.ch.Consume("chatroom_messages", "", true, false, false, false, nil)
-	for d := range msgs {
-		log.Println("Received message from bot")
-		msg := &models.ChatMessage{}
+// Posts a message from the bot into the chatroom, e.g. the replies of the chatroom webhooks.
+func (cb *chatBot) Reply(chatroomId string, msg *models.ChatMessage) {
+	cb.reply(chatroomId, msg)
+}
 
-		err := json.Unmarshal(d.Body, &msg)
-		if err != nil {
-			log.Println("Error parsing request:", err.Error())
-			continue
-		}
+// Builds the outbox message that publishes the message into the chatroom_messages queue, where it gets saved and
+// broadcasted. The message is numbered beforehand, so it's saved once even if the outbox publishes it again.
+func (cb *chatBot) outboxMessage(msg *models.ChatMessage) (*models.OutboxMessage, error) {
+	ids, err := cb.repo.ReserveMessageIds(1)
+	if err != nil {
+		return nil, err
+	}
 
-		hub := cb.Hubs[msg.ChatroomID]
+	msg.Id = ids[0]
 
-		log.Println("Publishing message: ", msg)
-		_, err = cb.repo.AddMessage(*msg)
-		if err != nil {
-			log.Printf("An error ocurred while trying to save message from WS: %s\n", err.Error())
-			continue
-		}
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.OutboxMessage{Queue: models.ChatroomMessagesQueue, Body: body}, nil
+}
 
-		hub.Broadcast <- msg
+// Reads the registrations of the external bots from the subscription to the bot_registrations topic and routes their
+// commands to them. Bots post as a service account and register with one of its API tokens, registrations without a
+// valid token or for any other user are ignored.
+func (cb *chatBot) ConsumeBotRegistrations(registrations broker.Subscription) {
+	registrations.Receive(cb.registerBot)
+}
+
+func (cb *chatBot) registerBot(body []byte) {
+	registration := &models.BotRegistration{}
 
+	err := json.Unmarshal(body, registration)
+	if err != nil {
+		log.Println("Error parsing bot registration:", err.Error())
+		return
+	}
+
+	if !botNamePattern.MatchString(registration.BotName) {
+		log.Printf("Invalid bot name: %q", registration.BotName)
+		return
+	}
+
+	user, err := cb.repo.GetUserByUsername(registration.UserName)
+	if err != nil {
+		log.Printf("An error ocurred while finding the user of bot %s: %s", registration.BotName, err.Error())
+		return
+	}
+
+	if user == nil || !user.IsServiceAccount {
+		log.Printf("Bot %s must post as a service account, %s is not one", registration.BotName, registration.UserName)
+		return
+	}
+
+	signedAt := time.Unix(registration.SignedAt, 0)
+	if time.Since(signedAt).Abs() > models.BotRegistrationTTL {
+		log.Printf("Ignoring registration of bot %s signed at %s", registration.BotName, signedAt.UTC().Format(time.RFC3339))
+		return
+	}
+
+	hashes, err := cb.repo.GetUserTokenHashes(user.Id, models.ScopeBotsRegister)
+	if err != nil {
+		log.Printf("An error ocurred while finding the tokens of bot %s: %s", registration.BotName, err.Error())
+		return
 	}
+
+	if !slices.ContainsFunc(hashes, registration.Verify) {
+		log.Printf("Bot %s must sign its registration with a token of %s with the %s scope", registration.BotName, registration.UserName, models.ScopeBotsRegister)
+		return
+	}
+
+	cb.botsMu.Lock()
+	bound, exists := cb.bots[registration.BotName]
+	if exists && bound.Id != user.Id {
+		cb.botsMu.Unlock()
+		log.Printf("Bot %s already posts as %s, ignoring its registration as %s", registration.BotName, bound.Username, user.Username)
+		return
+	}
+
+	cb.bots[registration.BotName] = user
+	cb.botsMu.Unlock()
+
+	cb.registry.RegisterBot(registration, cb.publishBotRequest)
 }
 
-func getStockInformation(stockCode string) (*stockInformation, error) {
-	res, err := http.Get(fmt.Sprintf(ENDPOINT, stockCode))
+// Reads the replies of the external bots from the bot_replies queue and posts them as the bot users.
+func (cb *chatBot) ConsumeBotReplies() {
+	cb.broker.Consume(models.BotRepliesQueue, cb.Retries, cb.handleBotReply)
+}
+
+func (cb *chatBot) handleBotReply(body []byte) error {
+	reply := &models.BotReply{}
+
+	err := json.Unmarshal(body, reply)
 	if err != nil {
-		return nil, err
+		return broker.Permanent(err)
 	}
 
-	defer res.Body.Close()
+	cb.botsMu.RLock()
+	user, ok := cb.bots[reply.BotName]
+	cb.botsMu.RUnlock()
 
-	if res.StatusCode != http.StatusOK {
-		log.Printf("Request failed with status code: %d", res.StatusCode)
-		return nil, fmt.Errorf("Request failed")
+	if !ok || reply.Message == nil {
+		log.Printf("Ignoring reply of unregistered bot %s", reply.BotName)
+		return nil
 	}
 
-	reader := csv.NewReader(res.Body)
+	if !verifyInvocation(cb.invocationKey, reply.Invocation, reply.BotName, reply.ChatroomID, time.Now()) {
+		log.Printf("Ignoring reply of bot %s to chatroom %s, it was not invoked there", reply.BotName, reply.ChatroomID)
+		return nil
+	}
 
-	_, err = reader.Read()
+	err = reply.Message.ValidateIntegration()
 	if err != nil {
-		return nil, err
+		log.Printf("Ignoring reply of bot %s: %s", reply.BotName, err.Error())
+		return nil
 	}
 
-	stockInformation := &stockInformation{}
+	return cb.replyAs(user, reply.ChatroomID, &models.ChatMessage{
+		Message: reply.Message.Message,
+		Type:    reply.Message.Type,
+		Payload: reply.Message.Payload,
+	})
+}
 
-	for {
-		record, err := reader.Read()
-		log.Println("Record", record)
-		if err == io.EOF {
-			break
-		}
+// Routes the command request to the queue of the external bot through the outbox. The request carries the invocation
+// the bot must send back with its reply.
+func (cb *chatBot) publishBotRequest(botName string, request *models.BotRequest) error {
+	if request.Message != nil {
+		request.Invocation = signInvocation(cb.invocationKey, botName, request.Message.ChatroomID, time.Now().Add(botInvocationTTL))
+	}
+
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	return cb.outbox.Publish(models.BotRequestsQueue(botName), body)
+}
 
-		if err != nil {
-			fmt.Println("Error trying to read CSV:", err.Error())
-			return nil, err
-		}
+// Reads all the messages from the chatroom_messages queue, decodes the message to a models.ChatMessage model
+// saves it into the DB and gets broadcasted to the correct chatroom, avoiding leaking messages to others. The clients
+// of the chatroom may be connected to any instance of the server.
+func (cb *chatBot) ConsumeChatroomMessages() {
+	cb.broker.Consume(models.ChatroomMessagesQueue, cb.Retries, cb.handleChatroomMessage)
+}
 
-		if len(record) < 7 {
-			log.Println(fmt.Errorf("invalid data format received"))
-			return nil, fmt.Errorf("invalid data format received")
-		}
+// Messages that can't be saved are retried, the broadcast only happens once they are saved.
+func (cb *chatBot) handleChatroomMessage(body []byte) error {
+	msg := &models.ChatMessage{}
 
-		stockInformation.Symbol = record[0]
-		stockInformation.Date = record[1]
-		stockInformation.Time = record[2]
-		stockInformation.Open = record[3]
-		stockInformation.High = record[4]
-		stockInformation.Low = record[5]
-		stockInformation.Close = record[6]
+	err := json.Unmarshal(body, &msg)
+	if err != nil {
+		return broker.Permanent(err)
+	}
 
+	log.Println("Publishing message: ", msg)
+	id, err := cb.repo.AddMessage(*msg)
+	if err != nil {
+		log.Printf("An error ocurred while trying to save message from WS: %s\n", err.Error())
+		return err
 	}
 
-	return stockInformation, nil
+	// The outbox may publish a message again, it was already saved and broadcasted the first time.
+	if id == nil {
+		log.Printf("Message %d was already saved", msg.Id)
+		return nil
+	}
+
+	msg.Id = *id
+
+	if cb.Listener != nil {
+		cb.Listener.MessagePosted(msg)
+	}
+
+	cb.broadcaster.Broadcast(msg)
+	return nil
+}
+
+// Starts polling the price alerts in the background. A zero interval disables the alerts.
+func (cb *chatBot) StartAlertScheduler(quotes QuoteProvider, interval time.Duration) {
+	if interval <= 0 {
+		log.Println("Price alerts scheduler disabled")
+		return
+	}
+
+	scheduler := NewAlertScheduler(cb.repo, quotes, interval, cb.announcement, cb.notify)
+	cb.runScheduler(scheduler.Run)
+}
+
+// Starts delivering the scheduled messages and reminders in the background. Scheduled messages can't be disabled,
+// an invalid interval falls back to the default one.
+func (cb *chatBot) StartMessageScheduler(interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultSchedulerInterval
+	}
+
+	scheduler := NewMessageScheduler(cb.repo, interval, cb.postScheduledMessage, cb.notify)
+	cb.runScheduler(scheduler.Run)
+}
+
+func (cb *chatBot) runScheduler(run func(ctx context.Context)) {
+	cb.schedulers.Add(1)
+
+	go func() {
+		defer cb.schedulers.Done()
+		run(cb.schedulersCtx)
+	}()
+}
+
+// Stops the schedulers, waiting for the ones in the middle of a run until ctx is done.
+func (cb *chatBot) Close(ctx context.Context) error {
+	cb.stopSchedulers()
+
+	stopped := make(chan struct{})
+	go func() {
+		cb.schedulers.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Builds the outbox message that posts the scheduled message as the user who scheduled it, or mentions the user from
+// the bot for reminders.
+func (cb *chatBot) postScheduledMessage(scheduled *models.ScheduledMessage) (*models.OutboxMessage, error) {
+	msg := &models.ChatMessage{
+		UserID:     scheduled.UserID,
+		UserName:   scheduled.UserName,
+		ChatroomID: scheduled.ChatroomID,
+		Message:    scheduled.Message,
+		CreatedAt:  time.Now(),
+	}
+
+	if scheduled.Kind == models.ScheduledMessageKindReminder {
+		msg.UserID = cb.User.Id
+		msg.UserName = cb.User.Username
+		msg.IsBot = true
+		msg.Message = fmt.Sprintf("@%s reminder: %s", scheduled.UserName, scheduled.Message)
+	}
 
+	return cb.outboxMessage(msg)
 }
@@ -0,0 +1,294 @@
+package chatbot
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/raynine/go-chatroom/interfaces"
+	"github.com/raynine/go-chatroom/models"
+	"github.com/raynine/go-chatroom/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+type stubQuoteProvider struct {
+	quote  *Quote
+	err    error
+	quotes map[string]*Quote
+}
+
+func (p *stubQuoteProvider) Name() string {
+	return "stub"
+}
+
+func (p *stubQuoteProvider) Quote(ctx context.Context, symbol string) (*Quote, error) {
+	if p.quotes != nil {
+		quote, ok := p.quotes[symbol]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownSymbol, symbol)
+		}
+		return quote, nil
+	}
+
+	return p.quote, p.err
+}
+
+func newTestChatBot(provider QuoteProvider) *chatBot {
+	registry := NewRegistry()
+	registry.Register(NewStockCommand(provider))
+
+	return &chatBot{registry: registry}
+}
+
+func TestExecuteCommandErrors(t *testing.T) {
+	request := &models.ChatMessage{UserName: "ray", Message: "/stock=aapl.us"}
+
+	cases := []struct {
+		name    string
+		message string
+		err     error
+		reply   string
+	}{
+		{
+			"Invalid symbol",
+			"/stock=aapl us!",
+			nil,
+			"@ray Invalid arguments for /stock: aapl us! is not a valid stock symbol. Usage: /stock=<symbol>[,<symbol>...]",
+		},
+		{
+			"Unknown symbol",
+			"/stock=aaplx.us",
+			fmt.Errorf("%w: aaplx.us", ErrUnknownSymbol),
+			"@ray I couldn't find a quote for that symbol, check it and try again. Usage: /stock=<symbol>[,<symbol>...]",
+		},
+		{
+			"Timeout",
+			"/stock=aapl.us",
+			fmt.Errorf("%w: %w", ErrUpstreamTimeout, context.DeadlineExceeded),
+			"@ray The quote service took too long to answer, please try again in a moment.",
+		},
+		{
+			"Rate limited",
+			"/stock=aapl.us",
+			ErrRateLimited,
+			"@ray The quote service is receiving too many requests, please try again in a few minutes.",
+		},
+		{
+			"Upstream unavailable",
+			"/stock=aapl.us",
+			ErrUpstreamUnavailable,
+			"@ray The quote service is unavailable right now, please try again later.",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cb := newTestChatBot(&stubQuoteProvider{err: c.err})
+			request.Message = c.message
+
+			reply := cb.registry.Execute(context.Background(), request, nil)
+			assert.Equal(t, c.reply, reply.Message)
+		})
+	}
+
+	t.Run("Success", func(t *testing.T) {
+		cb := newTestChatBot(&stubQuoteProvider{quote: &Quote{Symbol: "AAPL.US", Close: "243.85"}})
+		request.Message = "/stock=aapl.us"
+
+		reply := cb.registry.Execute(context.Background(), request, nil)
+		assert.Equal(t, "AAPL.US quote is $243.85 per share", reply.Message)
+	})
+}
+
+func TestExecuteMultiSymbolCommand(t *testing.T) {
+	cb := newTestChatBot(&stubQuoteProvider{quotes: map[string]*Quote{
+		"aapl.us": {Symbol: "AAPL.US", Date: "2025-01-02", Time: "22:00:00", Open: "240", High: "245", Low: "239.5", Close: "243.6", Volume: "1000"},
+		"msft.us": {Symbol: "MSFT.US", Date: "2025-01-02", Time: "22:00:00", Open: "420", High: "421", Low: "410", Close: "415.8", Volume: "2000"},
+	}})
+	request := &models.ChatMessage{UserName: "ray", Message: "/stock=aapl.us, msft.us,AAPL.US,tsla.us"}
+
+	reply := cb.registry.Execute(context.Background(), request, nil)
+	assert.Equal(t, models.MessageTypeQuotes, reply.Type)
+	assert.Equal(t, "AAPL.US $243.6 (+3.60, +1.50%) | MSFT.US $415.8 (-4.20, -1.00%) | TSLA.US: unknown symbol", reply.Message)
+
+	payload := models.QuoteTablePayload{}
+	err := json.Unmarshal(reply.Payload, &payload)
+	assert.Nil(t, err)
+	assert.Equal(t, models.QuoteTableColumns, payload.Columns)
+	assert.Equal(t, []models.QuoteRow{
+		{Symbol: "AAPL.US", Date: "2025-01-02", Time: "22:00:00", Open: 240, High: 245, Low: 239.5, Close: 243.6, Volume: 1000, Change: 3.6, ChangePercent: 1.5},
+		{Symbol: "MSFT.US", Date: "2025-01-02", Time: "22:00:00", Open: 420, High: 421, Low: 410, Close: 415.8, Volume: 2000, Change: -4.2, ChangePercent: -1},
+	}, payload.Quotes)
+	assert.Equal(t, []models.QuoteError{{Symbol: "TSLA.US", Message: "unknown symbol"}}, payload.Errors)
+}
+
+func TestStockCommandParseArgs(t *testing.T) {
+	command := NewStockCommand(&stubQuoteProvider{})
+
+	args, err := command.ParseArgs(" AAPL.US,msft.us,aapl.us, ")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"aapl.us", "msft.us"}, args)
+
+	_, err = command.ParseArgs(",")
+	assert.NotNil(t, err)
+
+	_, err = command.ParseArgs("a,b,c,d,e,f,g,h,i,j,k")
+	assert.NotNil(t, err)
+}
+
+// Repo with the service accounts and API tokens of the external bots, the other methods are not used.
+type stubBotRepo struct {
+	interfaces.DBRepo
+	users  map[string]*models.User
+	tokens map[string]*models.APIToken
+	nextId int
+	saved  map[int]bool
+}
+
+func (r *stubBotRepo) ReserveMessageIds(count int) ([]int, error) {
+	ids := make([]int, count)
+	for i := range ids {
+		r.nextId++
+		ids[i] = r.nextId
+	}
+
+	return ids, nil
+}
+
+func (r *stubBotRepo) AddMessage(msg models.ChatMessage) (*int, error) {
+	if r.saved[msg.Id] {
+		return nil, nil
+	}
+
+	r.saved[msg.Id] = true
+	return &msg.Id, nil
+}
+
+func (r *stubBotRepo) GetUserByUsername(username string) (*models.User, error) {
+	return r.users[username], nil
+}
+
+func (r *stubBotRepo) GetUserTokenHashes(userId int, scope string) ([]string, error) {
+	hashes := []string{}
+	for hash, token := range r.tokens {
+		if token.UserID == userId && slices.Contains(token.Scopes, scope) {
+			hashes = append(hashes, hash)
+		}
+	}
+
+	return hashes, nil
+}
+
+type stubOutbox struct {
+	published []*models.ChatMessage
+}
+
+func (o *stubOutbox) Publish(queue string, body []byte) error {
+	msg := &models.ChatMessage{}
+	json.Unmarshal(body, msg)
+	o.published = append(o.published, msg)
+	return nil
+}
+
+type stubBroadcaster struct {
+	models.Broadcaster
+	broadcasted []*models.ChatMessage
+}
+
+func (b *stubBroadcaster) Broadcast(msg *models.ChatMessage) {
+	b.broadcasted = append(b.broadcasted, msg)
+}
+
+func TestChatBotRegisterBot(t *testing.T) {
+	repo := &stubBotRepo{
+		users: map[string]*models.User{
+			"stockbot": {Id: 7, Username: "stockbot", IsServiceAccount: true},
+			"otherbot": {Id: 8, Username: "otherbot", IsServiceAccount: true},
+		},
+		tokens: map[string]*models.APIToken{
+			utils.HashToken("gct_stock"): {UserID: 7, Scopes: []string{models.ScopeBotsRegister}},
+			utils.HashToken("gct_read"):  {UserID: 7, Scopes: []string{models.ScopeChatroomsRead}},
+			utils.HashToken("gct_other"): {UserID: 8, Scopes: []string{models.ScopeBotsRegister}},
+		},
+	}
+
+	cb := &chatBot{repo: repo, registry: NewRegistry(), bots: make(map[string]*models.User)}
+	register := func(userName, token string, signedAt time.Time) {
+		registration := &models.BotRegistration{
+			BotName:  "stockbot",
+			UserName: userName,
+			Commands: []models.BotCommand{{Name: "stock"}},
+		}
+		registration.Sign(utils.HashToken(token), signedAt)
+
+		body, _ := json.Marshal(registration)
+		cb.registerBot(body)
+	}
+
+	register("stockbot", "", time.Now())
+	register("stockbot", "gct_read", time.Now())
+	register("stockbot", "gct_other", time.Now())
+	register("stockbot", "gct_stock", time.Now().Add(-2*models.BotRegistrationTTL))
+	assert.Empty(t, cb.bots)
+
+	// A registration signed with the token hash of another bot name doesn't verify.
+	registration := &models.BotRegistration{BotName: "stockbot", UserName: "stockbot"}
+	registration.Sign(utils.HashToken("gct_stock"), time.Now())
+	registration.BotName = "otherbot"
+	body, _ := json.Marshal(registration)
+	cb.registerBot(body)
+	assert.Empty(t, cb.bots)
+
+	register("stockbot", "gct_stock", time.Now())
+	assert.Equal(t, 7, cb.bots["stockbot"].Id)
+
+	// Another service account can't take the bot name.
+	register("otherbot", "gct_other", time.Now())
+	assert.Equal(t, 7, cb.bots["stockbot"].Id)
+}
+
+func TestHandleBotReply(t *testing.T) {
+	outbox := &stubOutbox{}
+	cb := &chatBot{
+		repo:          &stubBotRepo{},
+		outbox:        outbox,
+		bots:          map[string]*models.User{"stockbot": {Id: 7, Username: "stockbot"}},
+		invocationKey: []byte("secret"),
+	}
+
+	reply := func(chatroomId, invocation string, msg *models.ChatMessage) {
+		body, _ := json.Marshal(&models.BotReply{BotName: "stockbot", ChatroomID: chatroomId, Invocation: invocation, Message: msg})
+		assert.NoError(t, cb.handleBotReply(body))
+	}
+
+	invocation := signInvocation(cb.invocationKey, "stockbot", "room", time.Now().Add(time.Minute))
+	expired := signInvocation(cb.invocationKey, "stockbot", "room", time.Now().Add(-time.Minute))
+
+	reply("other-room", invocation, &models.ChatMessage{Message: "AAPL.US quote is $243.85 per share"})
+	reply("room", "", &models.ChatMessage{Message: "AAPL.US quote is $243.85 per share"})
+	reply("room", expired, &models.ChatMessage{Message: "AAPL.US quote is $243.85 per share"})
+	reply("room", invocation, &models.ChatMessage{Message: "vote", Type: models.MessageTypePoll})
+	assert.Empty(t, outbox.published)
+
+	reply("room", invocation, &models.ChatMessage{Message: "AAPL.US quote is $243.85 per share"})
+	assert.Len(t, outbox.published, 1)
+	assert.Equal(t, "room", outbox.published[0].ChatroomID)
+	assert.Equal(t, "stockbot", outbox.published[0].UserName)
+	assert.Equal(t, 1, outbox.published[0].Id)
+}
+
+func TestHandleChatroomMessage(t *testing.T) {
+	broadcaster := &stubBroadcaster{}
+	cb := &chatBot{repo: &stubBotRepo{saved: map[int]bool{}}, broadcaster: broadcaster}
+
+	body, _ := json.Marshal(&models.ChatMessage{Id: 5, ChatroomID: "room", Message: "hi"})
+
+	// The outbox published the message twice, it's only saved and broadcasted once.
+	assert.NoError(t, cb.handleChatroomMessage(body))
+	assert.NoError(t, cb.handleChatroomMessage(body))
+	assert.Len(t, broadcaster.broadcasted, 1)
+	assert.Equal(t, 5, broadcaster.broadcasted[0].Id)
+}
@@ -0,0 +1,260 @@
+package chatbot
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/raynine/go-chatroom/models"
+)
+
+// A bot command such as /stock=aapl.us. Commands are added to a Registry, which routes the chat messages that invoke
+// them to the chatbot.
+type Command interface {
+	// Name used to invoke the command, without the leading slash.
+	Name() string
+	// How to invoke the command, shown in /help and when the arguments are invalid.
+	Usage() string
+	// Short description shown in /help.
+	Description() string
+	// Parses the raw arguments of the command. The returned value is passed to Execute.
+	ParseArgs(args string) (any, error)
+	// Executes the command. The returned message is posted in the chatroom by the bot.
+	Execute(ctx context.Context, request *CommandRequest, args any) (*models.ChatMessage, error)
+}
+
+// Builds the outbox message that posts a message of the bot into the chatroom. The repo saves it in the transaction of
+// the change that caused it, so the message is posted if and only if the change is saved.
+type Announcer func(chatroomId string, msg *models.ChatMessage) (*models.OutboxMessage, error)
+
+// Chat message that invoked a command, split into the command name and its raw arguments.
+type CommandRequest struct {
+	Message *models.ChatMessage
+	Name    string
+	Args    string
+	// Commands that change the DB pass their reply to the repo through it and return no reply. Nil in the external bots.
+	Announce Announcer
+}
+
+// Builds the outbox messages that post the reply in the chatroom of the request.
+func (r *CommandRequest) reply(reply *models.ChatMessage) ([]*models.OutboxMessage, error) {
+	msg, err := r.Announce(r.Message.ChatroomID, reply)
+	if err != nil {
+		return nil, err
+	}
+
+	return []*models.OutboxMessage{msg}, nil
+}
+
+var commandPattern = regexp.MustCompile(`(?i)^/([a-z][a-z0-9_-]*)(?:[= ](.*))?$`)
+
+// Splits a chat message into the command name and its arguments. Commands look like /name, /name=args or /name args.
+func ParseCommand(message string) (string, string, bool) {
+	matches := commandPattern.FindStringSubmatch(strings.TrimSpace(message))
+	if matches == nil {
+		return "", "", false
+	}
+
+	return strings.ToLower(matches[1]), strings.TrimSpace(matches[2]), true
+}
+
+// Holds every command the chatbot knows. A /help command listing the registered commands is always included.
+// Commands of the external bots are kept while the bots keep registering them.
+type Registry struct {
+	mu       sync.RWMutex
+	commands map[string]Command
+	now      func() time.Time
+}
+
+func NewRegistry() *Registry {
+	registry := &Registry{
+		commands: make(map[string]Command),
+		now:      time.Now,
+	}
+
+	registry.commands["help"] = &helpCommand{registry: registry}
+
+	return registry
+}
+
+// Adds the command. Fails if another command already uses the same name.
+func (r *Registry) Register(command Command) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	name := strings.ToLower(command.Name())
+
+	existing, exists := r.commands[name]
+	if exists && r.active(existing) {
+		return fmt.Errorf("command /%s is already registered", name)
+	}
+
+	r.commands[name] = command
+	return nil
+}
+
+// Adds or refreshes the commands of an external bot until BotRegistrationTTL passes without a new registration.
+// Commands the bot no longer registers are removed. Names used by the built-in commands or by another bot are skipped.
+func (r *Registry) RegisterBot(registration *models.BotRegistration, publish BotRequestPublisher) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	expiresAt := r.now().Add(models.BotRegistrationTTL)
+	registered := make(map[string]bool)
+
+	for _, botCommand := range registration.Commands {
+		name := strings.ToLower(botCommand.Name)
+
+		existing, exists := r.commands[name]
+		if exists && r.active(existing) {
+			remote, ok := existing.(*remoteCommand)
+			if !ok || remote.bot != registration.BotName {
+				log.Printf("Skipping command /%s of bot %s, it's already registered", name, registration.BotName)
+				continue
+			}
+		}
+
+		botCommand.Name = name
+		r.commands[name] = &remoteCommand{
+			bot:       registration.BotName,
+			command:   botCommand,
+			expiresAt: expiresAt,
+			publish:   publish,
+		}
+		registered[name] = true
+	}
+
+	for name, command := range r.commands {
+		remote, ok := command.(*remoteCommand)
+		if ok && remote.bot == registration.BotName && !registered[name] {
+			delete(r.commands, name)
+		}
+	}
+}
+
+func (r *Registry) Lookup(name string) (Command, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	command, ok := r.commands[strings.ToLower(name)]
+	if !ok || !r.active(command) {
+		return nil, false
+	}
+
+	return command, true
+}
+
+// Reports if the command can be invoked. Only the commands of the external bots expire.
+func (r *Registry) active(command Command) bool {
+	remote, ok := command.(*remoteCommand)
+	return !ok || r.now().Before(remote.expiresAt)
+}
+
+// Gets the registered commands sorted by name.
+func (r *Registry) Commands() []Command {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	commands := make([]Command, 0, len(r.commands))
+	for _, command := range r.commands {
+		if r.active(command) {
+			commands = append(commands, command)
+		}
+	}
+
+	sort.Slice(commands, func(i, j int) bool {
+		return commands[i].Name() < commands[j].Name()
+	})
+
+	return commands
+}
+
+// Reports if the message invokes a registered command. Used by the clients to route the messages to the chatbot.
+func (r *Registry) IsCommand(message string) bool {
+	name, _, ok := ParseCommand(message)
+	if !ok {
+		return false
+	}
+
+	_, ok = r.Lookup(name)
+	return ok
+}
+
+// Finds the command invoked by the message and executes it. When the command fails the reply explains the error
+// to the user who invoked it. Returns nil if there's nothing to reply, e.g. the command is handled by an external bot
+// or its reply was saved through announce along with its change.
+func (r *Registry) Execute(ctx context.Context, msg *models.ChatMessage, announce Announcer) *models.ChatMessage {
+	name, args, ok := ParseCommand(msg.Message)
+	if !ok {
+		log.Printf("Message is not a command: %s", msg.Message)
+		return nil
+	}
+
+	command, ok := r.Lookup(name)
+	if !ok {
+		log.Printf("Command /%s is not registered", name)
+		return nil
+	}
+
+	parsedArgs, err := command.ParseArgs(args)
+	if err == nil {
+		var reply *models.ChatMessage
+		reply, err = command.Execute(ctx, &CommandRequest{Message: msg, Name: name, Args: args, Announce: announce}, parsedArgs)
+		if err == nil {
+			return reply
+		}
+	}
+
+	log.Printf("Command /%s requested by %d failed: %s", name, msg.UserID, err.Error())
+
+	return &models.ChatMessage{
+		Message: mention(msg, errorReply(command, err)),
+	}
+}
+
+// Addresses the text to the user who sent the message.
+func mention(msg *models.ChatMessage, text string) string {
+	if msg.UserName == "" {
+		return text
+	}
+
+	return fmt.Sprintf("@%s %s", msg.UserName, text)
+}
+
+// Lists every registered command with its usage and description.
+type helpCommand struct {
+	registry *Registry
+}
+
+func (c *helpCommand) Name() string {
+	return "help"
+}
+
+func (c *helpCommand) Usage() string {
+	return "/help"
+}
+
+func (c *helpCommand) Description() string {
+	return "Lists the available commands"
+}
+
+func (c *helpCommand) ParseArgs(args string) (any, error) {
+	return nil, nil
+}
+
+func (c *helpCommand) Execute(ctx context.Context, request *CommandRequest, args any) (*models.ChatMessage, error) {
+	lines := []string{"Available commands:"}
+
+	for _, command := range c.registry.Commands() {
+		lines = append(lines, fmt.Sprintf("%s - %s", command.Usage(), command.Description()))
+	}
+
+	return &models.ChatMessage{
+		Message: strings.Join(lines, "\n"),
+	}, nil
+}
@@ -0,0 +1,173 @@
+package chatbot
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/raynine/go-chatroom/models"
+	"github.com/stretchr/testify/assert"
+)
+
+type echoCommand struct{}
+
+func (c *echoCommand) Name() string        { return "echo" }
+func (c *echoCommand) Usage() string       { return "/echo <text>" }
+func (c *echoCommand) Description() string { return "Repeats the text" }
+
+func (c *echoCommand) ParseArgs(args string) (any, error) {
+	return args, nil
+}
+
+func (c *echoCommand) Execute(ctx context.Context, request *CommandRequest, args any) (*models.ChatMessage, error) {
+	return &models.ChatMessage{Message: args.(string)}, nil
+}
+
+// Builds the announcements like the chatbot, without numbering them.
+func testAnnouncement(chatroomId string, msg *models.ChatMessage) (*models.OutboxMessage, error) {
+	msg.ChatroomID = chatroomId
+
+	body, err := json.Marshal(msg)
+	return &models.OutboxMessage{Queue: models.ChatroomMessagesQueue, Body: body}, err
+}
+
+// Decodes the message posted by the last outbox message saved by a stub repo.
+func lastAnnounced(t *testing.T, outbox []*models.OutboxMessage) *models.ChatMessage {
+	if !assert.NotEmpty(t, outbox) {
+		return &models.ChatMessage{}
+	}
+
+	msg := &models.ChatMessage{}
+	assert.NoError(t, json.Unmarshal(outbox[len(outbox)-1].Body, msg))
+	return msg
+}
+
+func TestParseCommand(t *testing.T) {
+	cases := []struct {
+		message string
+		name    string
+		args    string
+		ok      bool
+	}{
+		{"/stock=aapl.us", "stock", "aapl.us", true},
+		{"/remind 10m stand up", "remind", "10m stand up", true},
+		{"/help", "help", "", true},
+		{"  /HELP  ", "help", "", true},
+		{"hello /stock=aapl.us", "", "", false},
+		{"/", "", "", false},
+		{"/1stock", "", "", false},
+	}
+
+	for _, c := range cases {
+		name, args, ok := ParseCommand(c.message)
+		assert.Equal(t, c.ok, ok, c.message)
+		assert.Equal(t, c.name, name, c.message)
+		assert.Equal(t, c.args, args, c.message)
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	registry := NewRegistry()
+
+	err := registry.Register(&echoCommand{})
+	assert.NoError(t, err)
+
+	t.Run("Duplicated command", func(t *testing.T) {
+		err := registry.Register(&echoCommand{})
+		assert.Equal(t, "command /echo is already registered", err.Error())
+	})
+
+	t.Run("Only registered commands are routed", func(t *testing.T) {
+		assert.True(t, registry.IsCommand("/echo hi"))
+		assert.True(t, registry.IsCommand("/help"))
+		assert.False(t, registry.IsCommand("/unknown"))
+		assert.False(t, registry.IsCommand("echo hi"))
+	})
+
+	t.Run("Help lists every command", func(t *testing.T) {
+		help, ok := registry.Lookup("help")
+		assert.True(t, ok)
+
+		reply, err := help.Execute(context.Background(), &CommandRequest{}, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, "Available commands:\n/echo <text> - Repeats the text\n/help - Lists the available commands", reply.Message)
+	})
+}
+
+func TestRegisterBot(t *testing.T) {
+	now := time.Date(2025, 1, 2, 10, 0, 0, 0, time.UTC)
+
+	registry := NewRegistry()
+	registry.now = func() time.Time { return now }
+	registry.Register(&echoCommand{})
+
+	requests := []*models.BotRequest{}
+	publish := func(botName string, request *models.BotRequest) error {
+		assert.Equal(t, "stockbot", botName)
+		requests = append(requests, request)
+		return nil
+	}
+
+	registry.RegisterBot(&models.BotRegistration{
+		BotName:  "stockbot",
+		UserName: "stockbot",
+		Commands: []models.BotCommand{
+			{Name: "Stock", Usage: "/stock=<symbol>", Description: "Gets a quote"},
+			{Name: "echo", Usage: "/echo <text>", Description: "Takes the built-in name"},
+			{Name: "chart"},
+		},
+	}, publish)
+
+	t.Run("Built-in commands keep their name", func(t *testing.T) {
+		command, ok := registry.Lookup("echo")
+		assert.True(t, ok)
+		assert.IsType(t, &echoCommand{}, command)
+	})
+
+	t.Run("Requests are routed to the bot", func(t *testing.T) {
+		reply := registry.Execute(context.Background(), &models.ChatMessage{ChatroomID: "room", Message: "/stock=aapl.us"}, nil)
+		assert.Nil(t, reply)
+		assert.Len(t, requests, 1)
+		assert.Equal(t, "stock", requests[0].Command)
+		assert.Equal(t, "aapl.us", requests[0].Args)
+		assert.Equal(t, "room", requests[0].Message.ChatroomID)
+	})
+
+	t.Run("Another bot can't take the commands", func(t *testing.T) {
+		registry.RegisterBot(&models.BotRegistration{
+			BotName:  "otherbot",
+			Commands: []models.BotCommand{{Name: "stock"}},
+		}, publish)
+
+		command, _ := registry.Lookup("stock")
+		assert.Equal(t, "stockbot", command.(*remoteCommand).bot)
+	})
+
+	t.Run("Commands no longer registered are removed", func(t *testing.T) {
+		registry.RegisterBot(&models.BotRegistration{
+			BotName:  "stockbot",
+			Commands: []models.BotCommand{{Name: "stock", Usage: "/stock=<symbol>"}},
+		}, publish)
+
+		_, ok := registry.Lookup("chart")
+		assert.False(t, ok)
+		assert.True(t, registry.IsCommand("/stock=aapl.us"))
+	})
+
+	t.Run("Commands expire without registrations", func(t *testing.T) {
+		now = now.Add(models.BotRegistrationTTL)
+
+		assert.False(t, registry.IsCommand("/stock=aapl.us"))
+		assert.Len(t, registry.Commands(), 2)
+
+		registry.RegisterBot(&models.BotRegistration{
+			BotName:  "otherbot",
+			Commands: []models.BotCommand{{Name: "stock"}},
+		}, publish)
+
+		command, ok := registry.Lookup("stock")
+		assert.True(t, ok)
+		assert.Equal(t, "otherbot", command.(*remoteCommand).bot)
+	})
+}
@@ -0,0 +1,59 @@
+package chatbot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// Errors returned by the quote providers. The bot replies a different message for each of them.
+var (
+	ErrUnknownSymbol       = errors.New("unknown symbol")
+	ErrUpstreamTimeout     = errors.New("quote provider timed out")
+	ErrRateLimited         = errors.New("quote provider rate limit reached")
+	ErrUpstreamUnavailable = errors.New("quote provider unavailable")
+)
+
+// Error caused by invalid command arguments. The message is shown to the user along with the command usage.
+type ValidationError struct {
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return e.Message
+}
+
+func NewValidationError(format string, args ...any) *ValidationError {
+	return &ValidationError{Message: fmt.Sprintf(format, args...)}
+}
+
+// Classifies an error of an HTTP request made to a quote provider.
+func upstreamError(err error) error {
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return fmt.Errorf("%w: %w", ErrUpstreamTimeout, err)
+	}
+
+	return fmt.Errorf("%w: %w", ErrUpstreamUnavailable, err)
+}
+
+// Builds the message shown to the user when a command fails.
+func errorReply(command Command, err error) string {
+	var validationErr *ValidationError
+
+	switch {
+	case errors.As(err, &validationErr):
+		return fmt.Sprintf("Invalid arguments for /%s: %s. Usage: %s", command.Name(), validationErr.Message, command.Usage())
+	case errors.Is(err, ErrUnknownSymbol):
+		return fmt.Sprintf("I couldn't find a quote for that symbol, check it and try again. Usage: %s", command.Usage())
+	case errors.Is(err, ErrRateLimited):
+		return "The quote service is receiving too many requests, please try again in a few minutes."
+	case errors.Is(err, ErrUpstreamTimeout):
+		return "The quote service took too long to answer, please try again in a moment."
+	case errors.Is(err, ErrUpstreamUnavailable):
+		return "The quote service is unavailable right now, please try again later."
+	default:
+		return fmt.Sprintf("Something went wrong while running /%s, please try again later.", command.Name())
+	}
+}
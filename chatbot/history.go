@@ -0,0 +1,135 @@
+package chatbot
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Daily history endpoint of stooq. The placeholders are the symbol and the first and last days in YYYYMMDD format.
+const DefaultStooqHistoryEndpoint = "https://stooq.com/q/d/l/?s=%s&d1=%s&d2=%s&i=d"
+
+// Close price of a stock in a day.
+type PricePoint struct {
+	Date  time.Time
+	Close float64
+}
+
+// Source of the daily prices used by the charts.
+type HistoryProvider interface {
+	Name() string
+	History(ctx context.Context, symbol string, from, to time.Time) ([]PricePoint, error)
+}
+
+// Gets the daily prices from the stooq CSV history endpoint.
+type StooqHistoryProvider struct {
+	client   *http.Client
+	endpoint string
+	timeout  time.Duration
+}
+
+// Creates a stooq history provider. If no client is provided the default one is used, and every request is
+// cancelled after the timeout.
+func NewStooqHistoryProvider(endpoint string, client *http.Client, timeout time.Duration) *StooqHistoryProvider {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return &StooqHistoryProvider{
+		client:   client,
+		endpoint: endpoint,
+		timeout:  timeout,
+	}
+}
+
+func (p *StooqHistoryProvider) Name() string {
+	return fmt.Sprintf("stooq-history(%s)", p.endpoint)
+}
+
+// Returns the prices sorted from the oldest day.
+func (p *StooqHistoryProvider) History(ctx context.Context, symbol string, from, to time.Time) ([]PricePoint, error) {
+	if p.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.timeout)
+		defer cancel()
+	}
+
+	endpoint := fmt.Sprintf(p.endpoint, url.QueryEscape(symbol), from.Format("20060102"), to.Format("20060102"))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return nil, upstreamError(err)
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusTooManyRequests {
+		return nil, ErrRateLimited
+	}
+
+	if res.StatusCode != http.StatusOK {
+		log.Printf("Request failed with status code: %d", res.StatusCode)
+		return nil, fmt.Errorf("%w: request failed with status code %d", ErrUpstreamUnavailable, res.StatusCode)
+	}
+
+	reader := csv.NewReader(res.Body)
+	reader.FieldsPerRecord = -1
+
+	// Stooq answers unknown symbols with a "No data" body instead of the CSV header.
+	header, err := reader.Read()
+	if err == io.EOF || (err == nil && (len(header) < 5 || !strings.EqualFold(header[0], "Date"))) {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownSymbol, symbol)
+	}
+
+	if err != nil {
+		return nil, upstreamError(err)
+	}
+
+	points := []PricePoint{}
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			log.Println("Error trying to read CSV:", err.Error())
+			return nil, upstreamError(err)
+		}
+
+		if len(record) < 5 {
+			return nil, fmt.Errorf("%w: invalid data format received", ErrUpstreamUnavailable)
+		}
+
+		date, err := time.Parse("2006-01-02", record[0])
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid date %s", ErrUpstreamUnavailable, record[0])
+		}
+
+		price, err := strconv.ParseFloat(record[4], 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid close price %s", ErrUpstreamUnavailable, record[4])
+		}
+
+		points = append(points, PricePoint{Date: date, Close: price})
+	}
+
+	if len(points) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownSymbol, symbol)
+	}
+
+	return points, nil
+}
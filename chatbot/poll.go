@@ -0,0 +1,117 @@
+package chatbot
+
+import (
+	"context"
+	"strings"
+
+	"github.com/raynine/go-chatroom/interfaces"
+	"github.com/raynine/go-chatroom/models"
+)
+
+// Flag that lets the users vote for more than one option.
+const multipleChoiceFlag = "--multi"
+
+// Creates a poll in the chatroom: /poll "Lunch?" "Pizza" "Sushi". The votes are sent over the websocket.
+type pollCommand struct {
+	polls interfaces.PollRepo
+}
+
+func NewPollCommand(polls interfaces.PollRepo) Command {
+	return &pollCommand{
+		polls: polls,
+	}
+}
+
+func (c *pollCommand) Name() string {
+	return "poll"
+}
+
+func (c *pollCommand) Usage() string {
+	return `/poll [--multi] "<question>" "<option>" "<option>"...`
+}
+
+func (c *pollCommand) Description() string {
+	return "Creates a poll, --multi allows voting for more than one option"
+}
+
+func (c *pollCommand) ParseArgs(args string) (any, error) {
+	fields, err := splitQuoted(args)
+	if err != nil {
+		return nil, err
+	}
+
+	poll := &models.Poll{}
+
+	if len(fields) > 0 && strings.EqualFold(fields[0], multipleChoiceFlag) {
+		poll.MultipleChoice = true
+		fields = fields[1:]
+	}
+
+	if len(fields) == 0 {
+		return nil, NewValidationError("a question is required")
+	}
+
+	poll.Question = strings.TrimSpace(fields[0])
+	for _, option := range fields[1:] {
+		poll.Options = append(poll.Options, strings.TrimSpace(option))
+	}
+
+	err = poll.Validate()
+	if err != nil {
+		return nil, NewValidationError("%s", err.Error())
+	}
+
+	return poll, nil
+}
+
+// Splits the arguments by spaces, keeping the text between double quotes together. Accepts the curly quotes added
+// by some keyboards.
+func splitQuoted(args string) ([]string, error) {
+	fields := []string{}
+	runes := []rune(args)
+
+	for i := 0; i < len(runes); {
+		switch {
+		case runes[i] == ' ' || runes[i] == '\t':
+			i++
+		case runes[i] == '"' || runes[i] == '“':
+			end := i + 1
+			for end < len(runes) && runes[end] != '"' && runes[end] != '”' {
+				end++
+			}
+
+			if end == len(runes) {
+				return nil, NewValidationError("missing closing quote")
+			}
+
+			fields = append(fields, string(runes[i+1:end]))
+			i = end + 1
+		default:
+			end := i
+			for end < len(runes) && runes[end] != ' ' && runes[end] != '\t' {
+				end++
+			}
+
+			fields = append(fields, string(runes[i:end]))
+			i = end
+		}
+	}
+
+	return fields, nil
+}
+
+func (c *pollCommand) Execute(ctx context.Context, request *CommandRequest, args any) (*models.ChatMessage, error) {
+	poll := args.(*models.Poll)
+	poll.ChatroomID = request.Message.ChatroomID
+	poll.CreatedBy = request.Message.UserID
+
+	// The poll is announced along with it, so it can't be created without showing up in the chatroom.
+	_, err := c.polls.AddPoll(poll, func(id int) ([]*models.OutboxMessage, error) {
+		reply := poll.ChatMessage(models.MessageTypePoll)
+		reply.Message = mention(request.Message, "started a poll\n"+reply.Message)
+
+		return request.reply(reply)
+	})
+
+	return nil, err
+}
@@ -0,0 +1,103 @@
+package chatbot
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/raynine/go-chatroom/models"
+	"github.com/stretchr/testify/assert"
+)
+
+type stubPollRepo struct {
+	added  []*models.Poll
+	outbox []*models.OutboxMessage
+}
+
+func (r *stubPollRepo) AddPoll(poll *models.Poll, announce models.Announcement) (*int, error) {
+	r.added = append(r.added, poll)
+	poll.Id = len(r.added)
+	poll.Votes = make([]int, len(poll.Options))
+
+	outbox, err := announce(poll.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	r.outbox = append(r.outbox, outbox...)
+	return &poll.Id, nil
+}
+
+func (r *stubPollRepo) GetPoll(id int, chatroomId string) (*models.Poll, error) {
+	return nil, nil
+}
+
+func (r *stubPollRepo) VotePoll(id int, chatroomId string, userId int, options []int) (*models.Poll, error) {
+	return nil, nil
+}
+
+func (r *stubPollRepo) ClosePoll(id int, chatroomId string, userId int, results func(*models.Poll) *models.ChatMessage) (*models.ChatMessage, error) {
+	return nil, nil
+}
+
+func TestPollCommandParseArgs(t *testing.T) {
+	command := NewPollCommand(&stubPollRepo{})
+
+	cases := []struct {
+		args     string
+		question string
+		options  []string
+		multi    bool
+		err      string
+	}{
+		{`"Lunch today?" "Pizza" "Sushi" Tacos`, "Lunch today?", []string{"Pizza", "Sushi", "Tacos"}, false, ""},
+		{`--multi “Which days?” “Monday” “Friday”`, "Which days?", []string{"Monday", "Friday"}, true, ""},
+		{`"Lunch today?" "Pizza"`, "", nil, false, "Poll must have between 2 and 10 options"},
+		{`"Lunch today? "Pizza" "Sushi`, "", nil, false, "missing closing quote"},
+		{`--multi`, "", nil, false, "a question is required"},
+	}
+
+	for _, c := range cases {
+		args, err := command.ParseArgs(c.args)
+		if c.err != "" {
+			assert.Equal(t, c.err, err.Error(), c.args)
+			continue
+		}
+
+		assert.NoError(t, err, c.args)
+		poll := args.(*models.Poll)
+		assert.Equal(t, c.question, poll.Question, c.args)
+		assert.Equal(t, c.options, poll.Options, c.args)
+		assert.Equal(t, c.multi, poll.MultipleChoice, c.args)
+	}
+}
+
+func TestPollCommandExecute(t *testing.T) {
+	repo := &stubPollRepo{}
+	registry := NewRegistry()
+	registry.Register(NewPollCommand(repo))
+
+	reply := registry.Execute(context.Background(), &models.ChatMessage{
+		UserID:     23,
+		UserName:   "ray",
+		ChatroomID: "room",
+		Message:    `/poll "Lunch today?" "Pizza" "Sushi"`,
+	}, testAnnouncement)
+
+	// The reply is saved along with the poll.
+	assert.Nil(t, reply)
+	reply = lastAnnounced(t, repo.outbox)
+
+	assert.Len(t, repo.added, 1)
+	assert.Equal(t, 23, repo.added[0].CreatedBy)
+	assert.Equal(t, "room", repo.added[0].ChatroomID)
+
+	assert.Equal(t, models.MessageTypePoll, reply.Type)
+	assert.Equal(t, "@ray started a poll\nPoll #1: Lunch today?\n0. Pizza (0)\n1. Sushi (0)", reply.Message)
+
+	poll := models.Poll{}
+	err := json.Unmarshal(reply.Payload, &poll)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, poll.Id)
+	assert.Equal(t, []int{0, 0}, poll.Votes)
+}
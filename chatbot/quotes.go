@@ -0,0 +1,264 @@
+package chatbot
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DefaultStooqEndpoint = "https://stooq.com/q/l/?s=%s&f=sd2t2ohlcv&h&e=csv"
+
+// Last quote of a stock. The values are kept as received from the provider.
+type Quote struct {
+	Symbol string
+	Date   string
+	Time   string
+	Open   string
+	High   string
+	Low    string
+	Close  string
+	Volume string
+}
+
+// Source of stock quotes used by the bot commands.
+type QuoteProvider interface {
+	Name() string
+	Quote(ctx context.Context, symbol string) (*Quote, error)
+}
+
+// Creates the quote provider used by the stock commands. The endpoints are tried in order, using the default one
+// when none is provided, and the quotes are cached for the TTL. A zero TTL disables the cache.
+func NewStooqQuoteProvider(endpoints []string, timeout time.Duration, cacheTTL time.Duration) QuoteProvider {
+	client := &http.Client{}
+
+	if len(endpoints) == 0 {
+		endpoints = []string{DefaultStooqEndpoint}
+	}
+
+	providers := []QuoteProvider{}
+	for _, endpoint := range endpoints {
+		providers = append(providers, NewStooqProvider(endpoint, client, timeout))
+	}
+
+	var provider QuoteProvider = NewFallbackQuoteProvider(providers...)
+	if cacheTTL > 0 {
+		provider = NewCachedQuoteProvider(provider, cacheTTL)
+	}
+
+	return provider
+}
+
+// Gets the quotes from the stooq CSV endpoint. The endpoint must contain a %s where the symbol goes.
+type StooqProvider struct {
+	client   *http.Client
+	endpoint string
+	timeout  time.Duration
+}
+
+// Creates a stooq provider. If no client is provided the default one is used, and every request is
+// cancelled after the timeout.
+func NewStooqProvider(endpoint string, client *http.Client, timeout time.Duration) *StooqProvider {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return &StooqProvider{
+		client:   client,
+		endpoint: endpoint,
+		timeout:  timeout,
+	}
+}
+
+func (p *StooqProvider) Name() string {
+	return fmt.Sprintf("stooq(%s)", p.endpoint)
+}
+
+func (p *StooqProvider) Quote(ctx context.Context, symbol string) (*Quote, error) {
+	if p.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.timeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf(p.endpoint, url.QueryEscape(symbol)), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return nil, upstreamError(err)
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusTooManyRequests {
+		return nil, ErrRateLimited
+	}
+
+	if res.StatusCode != http.StatusOK {
+		log.Printf("Request failed with status code: %d", res.StatusCode)
+		return nil, fmt.Errorf("%w: request failed with status code %d", ErrUpstreamUnavailable, res.StatusCode)
+	}
+
+	reader := csv.NewReader(res.Body)
+
+	_, err = reader.Read()
+	if err != nil {
+		return nil, upstreamError(err)
+	}
+
+	quote := &Quote{}
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			log.Println("Error trying to read CSV:", err.Error())
+			return nil, upstreamError(err)
+		}
+
+		if len(record) < 7 {
+			log.Println(fmt.Errorf("invalid data format received"))
+			return nil, fmt.Errorf("%w: invalid data format received", ErrUpstreamUnavailable)
+		}
+
+		// Stooq answers unknown symbols with N/D in every field besides the symbol.
+		if record[6] == "N/D" {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownSymbol, symbol)
+		}
+
+		quote.Symbol = record[0]
+		quote.Date = record[1]
+		quote.Time = record[2]
+		quote.Open = record[3]
+		quote.High = record[4]
+		quote.Low = record[5]
+		quote.Close = record[6]
+
+		if len(record) > 7 {
+			quote.Volume = record[7]
+		}
+	}
+
+	if quote.Symbol == "" {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownSymbol, symbol)
+	}
+
+	return quote, nil
+}
+
+type cachedQuote struct {
+	quote     *Quote
+	expiresAt time.Time
+}
+
+// Keeps the quotes of the wrapped provider for the TTL, so repeated requests for the same symbol don't hit upstream.
+type CachedQuoteProvider struct {
+	provider QuoteProvider
+	ttl      time.Duration
+	mu       sync.Mutex
+	quotes   map[string]cachedQuote
+	now      func() time.Time
+}
+
+func NewCachedQuoteProvider(provider QuoteProvider, ttl time.Duration) *CachedQuoteProvider {
+	return &CachedQuoteProvider{
+		provider: provider,
+		ttl:      ttl,
+		quotes:   make(map[string]cachedQuote),
+		now:      time.Now,
+	}
+}
+
+func (p *CachedQuoteProvider) Name() string {
+	return fmt.Sprintf("cached(%s)", p.provider.Name())
+}
+
+func (p *CachedQuoteProvider) Quote(ctx context.Context, symbol string) (*Quote, error) {
+	key := strings.ToLower(symbol)
+
+	p.mu.Lock()
+	cached, ok := p.quotes[key]
+	p.mu.Unlock()
+
+	if ok && p.now().Before(cached.expiresAt) {
+		return cached.quote, nil
+	}
+
+	quote, err := p.provider.Quote(ctx, symbol)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+
+	// Expired quotes are removed here so the cache does not grow with every symbol ever requested.
+	for cachedKey, cached := range p.quotes {
+		if !now.Before(cached.expiresAt) {
+			delete(p.quotes, cachedKey)
+		}
+	}
+
+	p.quotes[key] = cachedQuote{quote: quote, expiresAt: now.Add(p.ttl)}
+
+	return quote, nil
+}
+
+// Asks the providers in order and returns the first quote received.
+type FallbackQuoteProvider struct {
+	providers []QuoteProvider
+}
+
+func NewFallbackQuoteProvider(providers ...QuoteProvider) *FallbackQuoteProvider {
+	return &FallbackQuoteProvider{
+		providers: providers,
+	}
+}
+
+func (p *FallbackQuoteProvider) Name() string {
+	names := make([]string, 0, len(p.providers))
+	for _, provider := range p.providers {
+		names = append(names, provider.Name())
+	}
+
+	return fmt.Sprintf("fallback(%s)", strings.Join(names, ", "))
+}
+
+func (p *FallbackQuoteProvider) Quote(ctx context.Context, symbol string) (*Quote, error) {
+	if len(p.providers) == 0 {
+		return nil, fmt.Errorf("no quote providers configured")
+	}
+
+	errs := []error{}
+
+	for _, provider := range p.providers {
+		quote, err := provider.Quote(ctx, symbol)
+		if err == nil {
+			return quote, nil
+		}
+
+		log.Printf("Quote provider %s failed for %s: %s", provider.Name(), symbol, err.Error())
+		errs = append(errs, err)
+
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	return nil, errors.Join(errs...)
+}
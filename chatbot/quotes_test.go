@@ -0,0 +1,139 @@
+package chatbot
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const stooqResponse = "Symbol,Date,Time,Open,High,Low,Close,Volume\nAAPL.US,2025-01-02,22:00:09,248.93,249.1,241.82,243.85,55740731\n"
+
+// Starts a stooq stand-in that answers with the provided status and body, counting the requests received.
+func newStooqServer(t *testing.T, status int, body string, delay time.Duration) (*httptest.Server, *atomic.Int32) {
+	requests := &atomic.Int32{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+
+		if delay > 0 {
+			select {
+			case <-time.After(delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+
+		w.WriteHeader(status)
+		fmt.Fprint(w, body)
+	}))
+
+	t.Cleanup(server.Close)
+
+	return server, requests
+}
+
+func TestStooqProvider(t *testing.T) {
+	t.Run("Success", func(t *testing.T) {
+		server, _ := newStooqServer(t, http.StatusOK, stooqResponse, 0)
+		provider := NewStooqProvider(server.URL+"/q/l/?s=%s", server.Client(), time.Second)
+
+		quote, err := provider.Quote(context.Background(), "aapl.us")
+		assert.NoError(t, err)
+		assert.Equal(t, "AAPL.US", quote.Symbol)
+		assert.Equal(t, "243.85", quote.Close)
+		assert.Equal(t, "55740731", quote.Volume)
+	})
+
+	t.Run("Upstream error", func(t *testing.T) {
+		server, _ := newStooqServer(t, http.StatusInternalServerError, "", 0)
+		provider := NewStooqProvider(server.URL+"/q/l/?s=%s", server.Client(), time.Second)
+
+		quote, err := provider.Quote(context.Background(), "aapl.us")
+		assert.Nil(t, quote)
+		assert.ErrorIs(t, err, ErrUpstreamUnavailable)
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		server, _ := newStooqServer(t, http.StatusOK, stooqResponse, time.Second)
+		provider := NewStooqProvider(server.URL+"/q/l/?s=%s", server.Client(), 20*time.Millisecond)
+
+		quote, err := provider.Quote(context.Background(), "aapl.us")
+		assert.Nil(t, quote)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.ErrorIs(t, err, ErrUpstreamTimeout)
+	})
+
+	t.Run("Unknown symbol", func(t *testing.T) {
+		body := "Symbol,Date,Time,Open,High,Low,Close,Volume\nAAPLX.US,N/D,N/D,N/D,N/D,N/D,N/D,N/D\n"
+		server, _ := newStooqServer(t, http.StatusOK, body, 0)
+		provider := NewStooqProvider(server.URL+"/q/l/?s=%s", server.Client(), time.Second)
+
+		quote, err := provider.Quote(context.Background(), "aaplx.us")
+		assert.Nil(t, quote)
+		assert.ErrorIs(t, err, ErrUnknownSymbol)
+	})
+
+	t.Run("Rate limited", func(t *testing.T) {
+		server, _ := newStooqServer(t, http.StatusTooManyRequests, "", 0)
+		provider := NewStooqProvider(server.URL+"/q/l/?s=%s", server.Client(), time.Second)
+
+		quote, err := provider.Quote(context.Background(), "aapl.us")
+		assert.Nil(t, quote)
+		assert.ErrorIs(t, err, ErrRateLimited)
+	})
+}
+
+func TestCachedQuoteProvider(t *testing.T) {
+	server, requests := newStooqServer(t, http.StatusOK, stooqResponse, 0)
+
+	now := time.Date(2025, 1, 2, 12, 0, 0, 0, time.UTC)
+	provider := NewCachedQuoteProvider(NewStooqProvider(server.URL+"/q/l/?s=%s", server.Client(), time.Second), time.Minute)
+	provider.now = func() time.Time { return now }
+
+	_, err := provider.Quote(context.Background(), "aapl.us")
+	assert.NoError(t, err)
+
+	_, err = provider.Quote(context.Background(), "AAPL.US")
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), requests.Load())
+
+	now = now.Add(time.Minute)
+
+	_, err = provider.Quote(context.Background(), "aapl.us")
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), requests.Load())
+}
+
+func TestFallbackQuoteProvider(t *testing.T) {
+	failing, failingRequests := newStooqServer(t, http.StatusBadGateway, "", 0)
+	working, workingRequests := newStooqServer(t, http.StatusOK, stooqResponse, 0)
+
+	t.Run("Falls back to the next provider", func(t *testing.T) {
+		provider := NewFallbackQuoteProvider(
+			NewStooqProvider(failing.URL+"/q/l/?s=%s", failing.Client(), time.Second),
+			NewStooqProvider(working.URL+"/q/l/?s=%s", working.Client(), time.Second),
+		)
+
+		quote, err := provider.Quote(context.Background(), "aapl.us")
+		assert.NoError(t, err)
+		assert.Equal(t, "243.85", quote.Close)
+		assert.Equal(t, int32(1), failingRequests.Load())
+		assert.Equal(t, int32(1), workingRequests.Load())
+	})
+
+	t.Run("Every provider fails", func(t *testing.T) {
+		provider := NewFallbackQuoteProvider(
+			NewStooqProvider(failing.URL+"/q/l/?s=%s", failing.Client(), time.Second),
+		)
+
+		quote, err := provider.Quote(context.Background(), "aapl.us")
+		assert.Nil(t, quote)
+		assert.ErrorIs(t, err, ErrUpstreamUnavailable)
+	})
+}
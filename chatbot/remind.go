@@ -0,0 +1,206 @@
+package chatbot
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/raynine/go-chatroom/interfaces"
+	"github.com/raynine/go-chatroom/models"
+)
+
+const (
+	// Max amount of scheduled messages claimed at once.
+	scheduledMessagesBatchSize = 100
+	defaultSchedulerInterval   = 5 * time.Second
+	// Time a claimed message waits before being claimed again, in case the scheduler stops before delivering it.
+	scheduledMessagesLease = time.Minute
+)
+
+// Reminds the user in the chatroom after some time: /remind 10m check the market
+type remindCommand struct {
+	messages interfaces.ScheduledMessageRepo
+	now      func() time.Time
+}
+
+type remindArgs struct {
+	deliverAt time.Time
+	text      string
+}
+
+func NewRemindCommand(messages interfaces.ScheduledMessageRepo) Command {
+	return &remindCommand{
+		messages: messages,
+		now:      time.Now,
+	}
+}
+
+func (c *remindCommand) Name() string {
+	return "remind"
+}
+
+func (c *remindCommand) Usage() string {
+	return "/remind <when> <text>, where <when> is a duration such as 10m, 2h or 3d, or a RFC 3339 time"
+}
+
+func (c *remindCommand) Description() string {
+	return "Mentions you in the chatroom with the text at the requested time"
+}
+
+func (c *remindCommand) ParseArgs(args string) (any, error) {
+	fields := strings.Fields(args)
+	if len(fields) > 0 && strings.EqualFold(fields[0], "in") {
+		fields = fields[1:]
+	}
+
+	if len(fields) < 2 {
+		return nil, NewValidationError("a time and a text are required")
+	}
+
+	now := c.now()
+
+	deliverAt, err := parseWhen(fields[0], now)
+	if err != nil {
+		return nil, NewValidationError("%s is not a valid time", fields[0])
+	}
+
+	if !deliverAt.After(now) {
+		return nil, NewValidationError("the reminder must be in the future")
+	}
+
+	if deliverAt.After(now.Add(models.MaxScheduleAhead)) {
+		return nil, NewValidationError("the reminder can't be more than a year from now")
+	}
+
+	return remindArgs{deliverAt: deliverAt, text: strings.Join(fields[1:], " ")}, nil
+}
+
+// Parses durations, including days such as 3d, relative to now, or absolute RFC 3339 times.
+func parseWhen(when string, now time.Time) (time.Time, error) {
+	if days, ok := strings.CutSuffix(when, "d"); ok {
+		amount, err := strconv.Atoi(days)
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		return now.AddDate(0, 0, amount), nil
+	}
+
+	duration, err := time.ParseDuration(when)
+	if err == nil {
+		return now.Add(duration), nil
+	}
+
+	return time.Parse(time.RFC3339, when)
+}
+
+func (c *remindCommand) Execute(ctx context.Context, request *CommandRequest, args any) (*models.ChatMessage, error) {
+	remind := args.(remindArgs)
+
+	reminder := &models.ScheduledMessage{
+		UserID:     request.Message.UserID,
+		ChatroomID: request.Message.ChatroomID,
+		Kind:       models.ScheduledMessageKindReminder,
+		Message:    remind.text,
+		DeliverAt:  remind.deliverAt,
+	}
+
+	_, err := c.messages.AddScheduledMessage(reminder, func(id int) ([]*models.OutboxMessage, error) {
+		return request.reply(&models.ChatMessage{
+			Message: mention(request.Message, fmt.Sprintf(
+				"reminder #%d set for %s",
+				id,
+				remind.deliverAt.UTC().Format("2006-01-02 15:04 MST"))),
+		})
+	})
+
+	return nil, err
+}
+
+// Delivers the scheduled messages stored in the DB once they are due. Messages that were due while the service was
+// down are delivered on the first poll. post builds the outbox message that posts a scheduled message, it's saved
+// along with the delivery and notify is called once it's saved.
+type MessageScheduler struct {
+	messages interfaces.ScheduledMessageRepo
+	interval time.Duration
+	post     func(*models.ScheduledMessage) (*models.OutboxMessage, error)
+	notify   func()
+}
+
+func NewMessageScheduler(messages interfaces.ScheduledMessageRepo, interval time.Duration, post func(*models.ScheduledMessage) (*models.OutboxMessage, error), notify func()) *MessageScheduler {
+	return &MessageScheduler{
+		messages: messages,
+		interval: interval,
+		post:     post,
+		notify:   notify,
+	}
+}
+
+// Delivers the due messages every interval until the context is cancelled.
+func (s *MessageScheduler) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		s.deliverDue()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Claims the due messages in batches and delivers them. Messages are marked as delivered in the transaction that
+// saves their outbox message, the ones that could not be delivered are released so the next poll retries them.
+func (s *MessageScheduler) deliverDue() {
+	for {
+		messages, err := s.messages.ClaimDueScheduledMessages(scheduledMessagesBatchSize, scheduledMessagesLease)
+		if err != nil {
+			log.Printf("An error ocurred while getting due scheduled messages: %s", err.Error())
+			return
+		}
+
+		for i, message := range messages {
+			err = s.deliver(message)
+			if err == nil {
+				continue
+			}
+
+			log.Printf("Scheduled message %d could not be delivered: %s", message.Id, err.Error())
+
+			// The database is likely down, the rest of the batch is released as well and retried on the next poll.
+			for _, pending := range messages[i:] {
+				err = s.messages.ReleaseScheduledMessage(pending.Id)
+				if err != nil {
+					log.Printf("Scheduled message %d could not be released: %s", pending.Id, err.Error())
+				}
+			}
+
+			return
+		}
+
+		if len(messages) < scheduledMessagesBatchSize {
+			return
+		}
+	}
+}
+
+func (s *MessageScheduler) deliver(message *models.ScheduledMessage) error {
+	post, err := s.post(message)
+	if err != nil {
+		return err
+	}
+
+	err = s.messages.MarkScheduledMessageDelivered(message.Id, []*models.OutboxMessage{post})
+	if err != nil {
+		return err
+	}
+
+	s.notify()
+	return nil
+}
@@ -0,0 +1,108 @@
+package chatbot
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/raynine/go-chatroom/models"
+	"github.com/stretchr/testify/assert"
+)
+
+type stubScheduledMessageRepo struct {
+	added     []*models.ScheduledMessage
+	due       []*models.ScheduledMessage
+	delivered []int
+	released  []int
+	outbox    []*models.OutboxMessage
+}
+
+func (r *stubScheduledMessageRepo) AddScheduledMessage(message *models.ScheduledMessage, announce models.Announcement) (*int, error) {
+	id := len(r.added) + 1
+
+	outbox, err := announce(id)
+	if err != nil {
+		return nil, err
+	}
+
+	r.added = append(r.added, message)
+	r.outbox = append(r.outbox, outbox...)
+	return &id, nil
+}
+
+func (r *stubScheduledMessageRepo) ClaimDueScheduledMessages(limit int, lease time.Duration) ([]*models.ScheduledMessage, error) {
+	due := r.due
+	r.due = nil
+	return due, nil
+}
+
+func (r *stubScheduledMessageRepo) MarkScheduledMessageDelivered(id int, outbox []*models.OutboxMessage) error {
+	r.delivered = append(r.delivered, id)
+	r.outbox = append(r.outbox, outbox...)
+	return nil
+}
+
+func (r *stubScheduledMessageRepo) ReleaseScheduledMessage(id int) error {
+	r.released = append(r.released, id)
+	return nil
+}
+
+func TestRemindCommand(t *testing.T) {
+	now := time.Date(2025, 1, 2, 15, 0, 0, 0, time.UTC)
+	repo := &stubScheduledMessageRepo{}
+	command := &remindCommand{messages: repo, now: func() time.Time { return now }}
+
+	registry := NewRegistry()
+	registry.Register(command)
+	cb := &chatBot{registry: registry}
+
+	request := func(message string) string {
+		msg := &models.ChatMessage{UserID: 23, UserName: "ray", ChatroomID: "room", Message: message}
+
+		reply := cb.registry.Execute(context.Background(), msg, testAnnouncement)
+		if reply == nil {
+			reply = lastAnnounced(t, repo.outbox)
+		}
+
+		return reply.Message
+	}
+
+	assert.Equal(t, "@ray reminder #1 set for 2025-01-02 15:30 UTC", request("/remind in 30m check the market"))
+	assert.Equal(t, &models.ScheduledMessage{
+		UserID:     23,
+		ChatroomID: "room",
+		Kind:       models.ScheduledMessageKindReminder,
+		Message:    "check the market",
+		DeliverAt:  now.Add(30 * time.Minute),
+	}, repo.added[0])
+
+	assert.Equal(t, "@ray reminder #2 set for 2025-01-05 15:00 UTC", request("/remind 3d buy milk"))
+	assert.Equal(t, "@ray reminder #3 set for 2025-01-03 09:00 UTC", request("/remind 2025-01-03T09:00:00Z standup"))
+
+	assert.Contains(t, request("/remind 30m"), "a time and a text are required")
+	assert.Contains(t, request("/remind soon buy milk"), "soon is not a valid time")
+	assert.Contains(t, request("/remind -1h buy milk"), "the reminder must be in the future")
+	assert.Contains(t, request("/remind 400d buy milk"), "the reminder can't be more than a year from now")
+}
+
+func TestMessageSchedulerReleasesFailedDeliveries(t *testing.T) {
+	repo := &stubScheduledMessageRepo{due: []*models.ScheduledMessage{{Id: 1}, {Id: 2}, {Id: 3}}}
+	notified := 0
+
+	scheduler := NewMessageScheduler(repo, time.Second, func(message *models.ScheduledMessage) (*models.OutboxMessage, error) {
+		if message.Id == 2 {
+			return nil, errors.New("connection refused")
+		}
+
+		return &models.OutboxMessage{Queue: models.ChatroomMessagesQueue}, nil
+	}, func() { notified++ })
+
+	scheduler.deliverDue()
+
+	// The outbox message of the delivered one is saved along with the delivery.
+	assert.Equal(t, []int{1}, repo.delivered)
+	assert.Len(t, repo.outbox, 1)
+	assert.Equal(t, 1, notified)
+	assert.Equal(t, []int{2, 3}, repo.released)
+}
@@ -0,0 +1,82 @@
+package chatbot
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/raynine/go-chatroom/models"
+)
+
+// Replies of the external bots are accepted for this long after the command was invoked.
+const botInvocationTTL = 10 * time.Minute
+
+// Publishes the request into the queue of the external bot.
+type BotRequestPublisher func(botName string, request *models.BotRequest) error
+
+// Command registered by an external bot. Executing it routes the request to the queue of the bot, the bot posts
+// its reply through the bot_replies queue.
+type remoteCommand struct {
+	bot       string
+	command   models.BotCommand
+	expiresAt time.Time
+	publish   BotRequestPublisher
+}
+
+func (c *remoteCommand) Name() string {
+	return c.command.Name
+}
+
+func (c *remoteCommand) Usage() string {
+	if c.command.Usage == "" {
+		return "/" + c.command.Name
+	}
+
+	return c.command.Usage
+}
+
+func (c *remoteCommand) Description() string {
+	return c.command.Description
+}
+
+// The arguments are parsed by the external bot.
+func (c *remoteCommand) ParseArgs(args string) (any, error) {
+	return args, nil
+}
+
+// Signs the invocation of the bot from the chatroom, valid until expiresAt. Every instance of the chatroom signs with
+// the same key, so the reply can be handled by any of them.
+func signInvocation(key []byte, bot, chatroomId string, expiresAt time.Time) string {
+	expires := strconv.FormatInt(expiresAt.Unix(), 10)
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(bot + "\n" + chatroomId + "\n" + expires))
+
+	return expires + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Checks the invocation was signed for the bot and the chatroom and has not expired.
+func verifyInvocation(key []byte, invocation, bot, chatroomId string, now time.Time) bool {
+	expires, _, _ := strings.Cut(invocation, ".")
+
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || now.Unix() > unix {
+		return false
+	}
+
+	return hmac.Equal([]byte(invocation), []byte(signInvocation(key, bot, chatroomId, time.Unix(unix, 0))))
+}
+
+func (c *remoteCommand) Execute(ctx context.Context, request *CommandRequest, args any) (*models.ChatMessage, error) {
+	err := c.publish(c.bot, &models.BotRequest{
+		Command: request.Name,
+		Args:    request.Args,
+		Message: request.Message,
+	})
+
+	return nil, err
+}
@@ -0,0 +1,69 @@
+package chatbot
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"strings"
+)
+
+const (
+	sparklineWidth   = 600
+	sparklineHeight  = 160
+	sparklinePadding = 8
+	// Room left over the line for the title.
+	sparklineHeader = 28
+)
+
+// Renders the close prices as a SVG line chart, green when the price went up in the period and red otherwise.
+func RenderSparkline(title string, points []PricePoint) []byte {
+	first, last := points[0].Close, points[len(points)-1].Close
+
+	low, high := first, first
+	for _, point := range points {
+		low = min(low, point.Close)
+		high = max(high, point.Close)
+	}
+
+	color := "#16a34a"
+	if last < first {
+		color = "#dc2626"
+	}
+
+	top := float64(sparklineHeader)
+	bottom := float64(sparklineHeight - sparklinePadding)
+	left := float64(sparklinePadding)
+	right := float64(sparklineWidth - sparklinePadding)
+
+	coordinates := make([]string, 0, len(points))
+	for i, point := range points {
+		x := left
+		if len(points) > 1 {
+			x += (right - left) * float64(i) / float64(len(points)-1)
+		}
+
+		// Flat histories are drawn in the middle of the chart.
+		y := (top + bottom) / 2
+		if high > low {
+			y = bottom - (bottom-top)*(point.Close-low)/(high-low)
+		}
+
+		coordinates = append(coordinates, fmt.Sprintf("%.1f,%.1f", x, y))
+	}
+
+	line := strings.Join(coordinates, " ")
+
+	svg := &bytes.Buffer{}
+	fmt.Fprintf(svg, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d">`,
+		sparklineWidth, sparklineHeight, sparklineWidth, sparklineHeight)
+	fmt.Fprintf(svg, `<rect width="100%%" height="100%%" fill="#ffffff"/>`)
+	fmt.Fprintf(svg, `<text x="%d" y="18" font-family="sans-serif" font-size="14" fill="#111827">%s</text>`,
+		sparklinePadding, html.EscapeString(title))
+	fmt.Fprintf(svg, `<polygon points="%.1f,%.1f %s %.1f,%.1f" fill="%s" fill-opacity="0.12"/>`,
+		left, bottom, line, right, bottom, color)
+	fmt.Fprintf(svg, `<polyline points="%s" fill="none" stroke="%s" stroke-width="2" stroke-linejoin="round"/>`,
+		line, color)
+	svg.WriteString(`</svg>`)
+
+	return svg.Bytes()
+}
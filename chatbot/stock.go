@@ -0,0 +1,206 @@
+package chatbot
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/raynine/go-chatroom/models"
+)
+
+// Max amount of symbols that can be requested in a single command.
+const maxStockSymbols = 10
+
+// Posts the last quote of one or more stocks: /stock=aapl.us,msft.us
+type stockCommand struct {
+	quotes QuoteProvider
+}
+
+func NewStockCommand(quotes QuoteProvider) Command {
+	return &stockCommand{
+		quotes: quotes,
+	}
+}
+
+func (c *stockCommand) Name() string {
+	return "stock"
+}
+
+func (c *stockCommand) Usage() string {
+	return "/stock=<symbol>[,<symbol>...]"
+}
+
+func (c *stockCommand) Description() string {
+	return "Posts the last quote of the stocks"
+}
+
+var symbolPattern = regexp.MustCompile(`^[a-z0-9^][a-z0-9._^-]{0,19}$`)
+
+// Returns the requested symbols in order, without duplicates.
+func (c *stockCommand) ParseArgs(args string) (any, error) {
+	symbols := []string{}
+	seen := map[string]bool{}
+
+	for _, symbol := range strings.Split(args, ",") {
+		symbol = strings.ToLower(strings.TrimSpace(symbol))
+		if symbol == "" {
+			continue
+		}
+
+		if !symbolPattern.MatchString(symbol) {
+			return nil, NewValidationError("%s is not a valid stock symbol", symbol)
+		}
+
+		if seen[symbol] {
+			continue
+		}
+
+		seen[symbol] = true
+		symbols = append(symbols, symbol)
+	}
+
+	if len(symbols) == 0 {
+		return nil, NewValidationError("a stock symbol is required")
+	}
+
+	if len(symbols) > maxStockSymbols {
+		return nil, NewValidationError("at most %d stock symbols can be requested at once", maxStockSymbols)
+	}
+
+	return symbols, nil
+}
+
+type quoteResult struct {
+	quote *Quote
+	err   error
+}
+
+// Gets the quotes concurrently. The reply has a quotes table payload, symbols that failed are listed in its errors,
+// and the command only fails when none of the symbols could be quoted.
+func (c *stockCommand) Execute(ctx context.Context, request *CommandRequest, args any) (*models.ChatMessage, error) {
+	symbols := args.([]string)
+	results := make([]quoteResult, len(symbols))
+
+	var wg sync.WaitGroup
+	for i, symbol := range symbols {
+		wg.Add(1)
+		go func(i int, symbol string) {
+			defer wg.Done()
+			quote, err := c.quotes.Quote(ctx, symbol)
+			results[i] = quoteResult{quote: quote, err: err}
+		}(i, symbol)
+	}
+	wg.Wait()
+
+	payload := models.QuoteTablePayload{
+		Columns: models.QuoteTableColumns,
+		Quotes:  []models.QuoteRow{},
+	}
+	errs := []error{}
+
+	for i, result := range results {
+		if result.err != nil {
+			errs = append(errs, result.err)
+			payload.Errors = append(payload.Errors, models.QuoteError{
+				Symbol:  strings.ToUpper(symbols[i]),
+				Message: quoteErrorMessage(result.err),
+			})
+			continue
+		}
+
+		payload.Quotes = append(payload.Quotes, quoteRow(result.quote))
+	}
+
+	if len(payload.Quotes) == 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.ChatMessage{
+		Message: quotesText(payload),
+		Type:    models.MessageTypeQuotes,
+		Payload: body,
+	}, nil
+}
+
+// Converts the quote to a table row, the change is calculated from the open price.
+func quoteRow(quote *Quote) models.QuoteRow {
+	row := models.QuoteRow{
+		Symbol: quote.Symbol,
+		Date:   quote.Date,
+		Time:   quote.Time,
+		Open:   parseFloat(quote.Open),
+		High:   parseFloat(quote.High),
+		Low:    parseFloat(quote.Low),
+		Close:  parseFloat(quote.Close),
+	}
+	row.Volume, _ = strconv.ParseInt(quote.Volume, 10, 64)
+
+	row.Change = roundPrice(row.Close - row.Open)
+	if row.Open != 0 {
+		row.ChangePercent = roundPrice(row.Change / row.Open * 100)
+	}
+
+	return row
+}
+
+func parseFloat(value string) float64 {
+	number, _ := strconv.ParseFloat(value, 64)
+	return number
+}
+
+func roundPrice(value float64) float64 {
+	rounded, _ := strconv.ParseFloat(strconv.FormatFloat(value, 'f', 2, 64), 64)
+	return rounded
+}
+
+// Text shown by clients that can't render the payload.
+func quotesText(payload models.QuoteTablePayload) string {
+	if len(payload.Quotes) == 1 && len(payload.Errors) == 0 {
+		quote := payload.Quotes[0]
+		return fmt.Sprintf("%s quote is $%s per share", quote.Symbol, formatPrice(quote.Close))
+	}
+
+	lines := []string{}
+	for _, quote := range payload.Quotes {
+		lines = append(lines, fmt.Sprintf(
+			"%s $%s (%+.2f, %+.2f%%)",
+			quote.Symbol,
+			formatPrice(quote.Close),
+			quote.Change,
+			quote.ChangePercent))
+	}
+
+	for _, quoteErr := range payload.Errors {
+		lines = append(lines, fmt.Sprintf("%s: %s", quoteErr.Symbol, quoteErr.Message))
+	}
+
+	return strings.Join(lines, " | ")
+}
+
+func formatPrice(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// Short explanation of why a symbol could not be quoted.
+func quoteErrorMessage(err error) string {
+	switch {
+	case errors.Is(err, ErrUnknownSymbol):
+		return "unknown symbol"
+	case errors.Is(err, ErrUpstreamTimeout):
+		return "the quote service took too long to answer"
+	case errors.Is(err, ErrRateLimited):
+		return "the quote service is rate limited"
+	default:
+		return "the quote service is unavailable"
+	}
+}
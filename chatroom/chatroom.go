@@ -1,22 +1,36 @@
 package chatroom
 
 import (
+	"context"
+	"crypto/rand"
 	"database/sql"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	muxhandlers "github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 	_ "github.com/lib/pq"
-	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/raynine/go-chatroom/attachments"
+	"github.com/raynine/go-chatroom/broker"
 	"github.com/raynine/go-chatroom/chatbot"
 	"github.com/raynine/go-chatroom/chatroom/handlers"
+	"github.com/raynine/go-chatroom/fanout"
 	"github.com/raynine/go-chatroom/interfaces"
+	"github.com/raynine/go-chatroom/mailer"
 	"github.com/raynine/go-chatroom/models"
+	"github.com/raynine/go-chatroom/outbox"
+	"github.com/raynine/go-chatroom/persistence"
 	"github.com/raynine/go-chatroom/repos"
 	"github.com/raynine/go-chatroom/utils"
+	"github.com/raynine/go-chatroom/webhooks"
 )
 
 type ChatroomService struct {
@@ -24,9 +38,61 @@ type ChatroomService struct {
 	PORT          string
 	CHATBOT_EMAIL string
 	RABBIT_MQ_URL string
+	APP_URL       string
+	SMTP_HOST     string
+	SMTP_PORT     string
+	SMTP_USERNAME string
+	SMTP_PASSWORD string
+	SMTP_FROM     string
+
+	LOGIN_MAX_ATTEMPTS     int
+	LOGIN_IP_MAX_ATTEMPTS  int
+	LOGIN_LOCKOUT_DURATION time.Duration
+	LOGIN_BACKOFF_BASE     time.Duration
+	TRUST_X_FORWARDED_FOR  bool
+
+	PASSWORD_HASHING utils.HashingPolicy
+
+	QUOTE_ENDPOINTS []string
+	QUOTE_TIMEOUT   time.Duration
+	QUOTE_CACHE_TTL time.Duration
+
+	CHART_HISTORY_ENDPOINT string
+	ATTACHMENTS_DIR        string
+
+	ALERT_POLL_INTERVAL     time.Duration
+	SCHEDULER_POLL_INTERVAL time.Duration
+
+	WEBHOOK_TIMEOUT      time.Duration
+	WEBHOOK_MAX_ATTEMPTS int
+	WEBHOOK_BACKOFF_BASE time.Duration
+	WEBHOOK_WORKERS      int
+
+	// Built-in commands that are not registered, e.g. the ones served by an external bot.
+	DISABLED_COMMANDS []string
+
+	// Either rabbitmq or memory.
+	BROKER             string
+	BROKER_MAX_RETRIES int
+	BROKER_RETRY_DELAY time.Duration
+
+	BROKER_RECONNECT_DELAY     time.Duration
+	BROKER_RECONNECT_MAX_DELAY time.Duration
+
+	HUBS     models.HubConfig
+	MESSAGES persistence.Config
+	OUTBOX   outbox.Config
+	// Time given to close the connections and finish the work in progress when stopping.
+	SHUTDOWN_TIMEOUT time.Duration
+
+	// Identifies the instance when running more than one, defaults to the hostname plus a random suffix.
+	INSTANCE_ID string
 }
 
-var hubs = make(map[string]*models.Hub)
+const (
+	BrokerRabbitMQ = "rabbitmq"
+	BrokerMemory   = "memory"
+)
 
 // Entry point of the backend server. Initiates all the endpoints, DB connection and RabbitMQ broker.
 func (s *ChatroomService) Main() {
@@ -43,72 +109,307 @@ func (s *ChatroomService) Main() {
 
 	repo := repos.NewChatRepo(db)
 
+	err = utils.SetHashingPolicy(s.PASSWORD_HASHING)
+	if err != nil {
+		log.Fatalf("Invalid password hashing policy: %s", err.Error())
+	}
+
+	attachmentStore, err := attachments.NewLocalStore(s.ATTACHMENTS_DIR, fmt.Sprintf("%s/attachments", s.APP_URL))
+	if err != nil {
+		log.Fatalf("unable to create attachments directory: %s", err.Error())
+	}
+
 	log.Println("Starting bot...")
-	ch := s.startBroker(repo, s.CHATBOT_EMAIL)
+	quotes := chatbot.NewStooqQuoteProvider(s.QUOTE_ENDPOINTS, s.QUOTE_TIMEOUT, s.QUOTE_CACHE_TTL)
+	registry := s.newCommandRegistry(repo, quotes, attachmentStore)
+	dispatcher := webhooks.NewDispatcher(repo, webhooks.NewClient(s.WEBHOOK_TIMEOUT), s.WEBHOOK_MAX_ATTEMPTS, s.WEBHOOK_BACKOFF_BASE)
+	hubs, err := models.NewHubManager(repo, s.HUBS)
+	if err != nil {
+		log.Fatalf("Invalid hub config: %s", err.Error())
+	}
+
+	b, broadcaster, relay, stopBot := s.startBroker(repo, hubs, s.CHATBOT_EMAIL, registry, quotes, dispatcher)
+
+	writer, err := persistence.NewWriter(repo, s.MESSAGES)
+	if err != nil {
+		log.Fatalf("Invalid message persistence config: %s", err.Error())
+	}
 
-	handler := handlers.NewHandler(repo, ch, hubs)
+	writer.Notify = relay.Wake
+	go writer.Run()
 
+	loginGuard := utils.NewLoginGuard(
+		utils.NewLoginThrottler(s.LOGIN_MAX_ATTEMPTS, s.LOGIN_LOCKOUT_DURATION, s.LOGIN_BACKOFF_BASE),
+		utils.NewLoginThrottler(s.LOGIN_IP_MAX_ATTEMPTS, s.LOGIN_LOCKOUT_DURATION, s.LOGIN_BACKOFF_BASE),
+	)
+
+	handler := handlers.NewHandler(repo, b, hubs, writer, relay, registry, dispatcher, broadcaster, s.newMailer(), loginGuard, s.APP_URL, s.TRUST_X_FORWARDED_FOR)
+
+	r.HandleFunc("/health", handler.Health).Methods("GET")
 	r.HandleFunc("/user/", handler.AddUser).Methods("POST")
 	r.HandleFunc("/login", handler.LoginUser).Methods("POST")
+	r.HandleFunc("/verify-email", handler.VerifyEmail).Methods("GET")
+	r.PathPrefix("/attachments/").Handler(attachmentStore).Methods("GET")
+	r.HandleFunc("/hooks/{token}", handler.PostIncomingWebhook).Methods("POST")
+
+	s.protectedEndpoints(r, handler, repo)
+
+	server := &http.Server{
+		Addr:    fmt.Sprintf(":%s", s.PORT),
+		Handler: muxhandlers.CombinedLoggingHandler(os.Stdout, r),
+	}
+
+	go func() {
+		log.Printf("Starting server in PORT %s", s.PORT)
+		err := server.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("An error ocurred while starting server: %s\n", err.Error())
+		}
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	<-ctx.Done()
+	s.shutdown(server, hubs, writer, stopBot, dispatcher, relay, b, db)
+}
+
+// Stops the server within SHUTDOWN_TIMEOUT. New connections are refused, the WebSocket clients are told the server
+// is going away so they reconnect to another instance, the queued messages are saved, the broker consumers finish the
+// messages they took, the schedulers and the webhook deliveries in progress finish and the outbox relay publishes its
+// batch. The database pool is closed last.
+func (s *ChatroomService) shutdown(
+	server *http.Server,
+	hubs *models.HubManager,
+	writer *persistence.Writer,
+	stopBot func(context.Context) error,
+	dispatcher *webhooks.Dispatcher,
+	relay *outbox.Relay,
+	b broker.Broker,
+	db *sql.DB,
+) {
+	log.Printf("Shutting down, waiting up to %s", s.SHUTDOWN_TIMEOUT)
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.SHUTDOWN_TIMEOUT)
+	defer cancel()
+
+	err := server.Shutdown(ctx)
+	if err != nil {
+		log.Printf("An error ocurred while stopping the server: %s", err.Error())
+	}
+
+	err = hubs.Shutdown(ctx)
+	if err != nil {
+		log.Printf("An error ocurred while closing the chatrooms: %s", err.Error())
+	}
+
+	err = writer.Close(ctx)
+	if err != nil {
+		log.Printf("An error ocurred while saving the queued messages: %s", err.Error())
+	}
+
+	err = b.Drain(ctx)
+	if err != nil {
+		log.Printf("An error ocurred while draining the broker consumers: %s", err.Error())
+	}
 
-	s.protectedEndpoints(r, handler)
+	err = stopBot(ctx)
+	if err != nil {
+		log.Printf("An error ocurred while stopping the schedulers: %s", err.Error())
+	}
+
+	err = dispatcher.Close(ctx)
+	if err != nil {
+		log.Printf("An error ocurred while stopping the webhook deliveries: %s", err.Error())
+	}
+
+	err = relay.Close(ctx)
+	if err != nil {
+		log.Printf("An error ocurred while stopping the outbox relay: %s", err.Error())
+	}
+
+	err = b.Close()
+	if err != nil {
+		log.Printf("An error ocurred while closing the broker: %s", err.Error())
+	}
 
-	log.Printf("Starting server in PORT %s", s.PORT)
-	err = http.ListenAndServe(fmt.Sprintf(":%s", s.PORT), muxhandlers.CombinedLoggingHandler(os.Stdout, r))
+	err = db.Close()
 	if err != nil {
-		log.Fatalf("An error ocurred while starting server: %s\n", err.Error())
+		log.Printf("An error ocurred while closing the database: %s", err.Error())
+	}
+
+	log.Println("Server stopped")
+}
+
+// Creates the registry with every command the chatbot handles.
+func (s *ChatroomService) newCommandRegistry(repo interfaces.DBRepo, quotes chatbot.QuoteProvider, attachmentStore interfaces.AttachmentStore) *chatbot.Registry {
+	registry := chatbot.NewRegistry()
+	history := chatbot.NewStooqHistoryProvider(s.CHART_HISTORY_ENDPOINT, &http.Client{}, s.QUOTE_TIMEOUT)
+
+	commands := []chatbot.Command{
+		chatbot.NewStockCommand(quotes),
+		chatbot.NewChartCommand(history, attachmentStore),
+		chatbot.NewAlertCommand(repo, quotes),
+		chatbot.NewAlertsCommand(repo),
+		chatbot.NewUnalertCommand(repo),
+		chatbot.NewRemindCommand(repo),
+		chatbot.NewPollCommand(repo),
+	}
+
+	disabled := make(map[string]bool)
+	for _, name := range s.DISABLED_COMMANDS {
+		disabled[strings.ToLower(name)] = true
 	}
+
+	for _, command := range commands {
+		if disabled[command.Name()] {
+			log.Printf("Command /%s is disabled", command.Name())
+			continue
+		}
+
+		err := registry.Register(command)
+		if err != nil {
+			log.Fatalf("An error ocurred while registering bot commands: %s\n", err.Error())
+		}
+	}
+
+	return registry
 }
 
-// Starts the RabbitMQ broker and spins up two goroutines that manages the stock and chatrooms queues.
-func (s *ChatroomService) startBroker(repo interfaces.DBRepo, botEmail string) *amqp.Channel {
-	conn, err := amqp.Dial(s.RABBIT_MQ_URL)
+// Connects to the broker and spins up the goroutines that manage the command requests, chatrooms and external
+// bots queues, plus the price alerts and scheduled messages schedulers. The webhook replies are posted by the bot.
+// The bot publishes through the outbox relay. Returns the function that stops the schedulers.
+func (s *ChatroomService) startBroker(
+	repo interfaces.DBRepo,
+	hubs *models.HubManager,
+	botEmail string,
+	registry *chatbot.Registry,
+	quotes chatbot.QuoteProvider,
+	dispatcher *webhooks.Dispatcher,
+) (broker.Broker, *fanout.Fanout, *outbox.Relay, func(context.Context) error) {
+	b, err := s.newBroker()
 	if err != nil {
-		log.Fatalf("An error ocurred while starting rabbit mq: %s\n", err.Error())
+		log.Fatalf("An error ocurred while starting the broker: %s\n", err.Error())
 	}
 
-	ch, err := conn.Channel()
+	err = b.DeclareQueues(models.CommandRequestsQueue, models.ChatroomMessagesQueue, models.BotRepliesQueue)
 	if err != nil {
-		log.Fatalf("An error ocurred while starting rabbit mq channel: %s\n", err.Error())
+		log.Fatalf("An error ocurred while declaring queues: %s\n", err.Error())
 	}
 
-	_, err = ch.QueueDeclare(
-		"stock_requests", // name
-		false,            // durable
-		false,            // delete when unused
-		false,            // exclusive
-		false,            // no-wait
-		nil,              // arguments
-	)
+	instanceId := s.instanceID()
+
+	registrations, err := b.Subscribe(models.BotRegistrationsTopic, instanceId)
 	if err != nil {
-		log.Fatalf("An error ocurred while declaring stock requests queue: %s\n", err.Error())
+		log.Fatalf("An error ocurred while subscribing to bot registrations: %s\n", err.Error())
 	}
 
-	_, err = ch.QueueDeclare(
-		"chatroom_messages", // name
-		false,               // durable
-		false,               // delete when unused
-		false,               // exclusive
-		false,               // no-wait
-		nil,                 // arguments
-	)
+	broadcaster, err := fanout.New(b, instanceId, hubs)
+	if err != nil {
+		log.Fatalf("An error ocurred while subscribing to chatroom broadcasts: %s\n", err.Error())
+	}
+
+	hubs.Broadcaster = broadcaster
+
+	log.Printf("Receiving chatroom broadcasts as instance %s", instanceId)
+	go broadcaster.Run()
+
+	relay, err := outbox.NewRelay(repo, b, s.OUTBOX)
 	if err != nil {
-		log.Fatalf("An error ocurred while declaring chatroom messages queue: %s\n", err.Error())
+		log.Fatalf("Invalid outbox config: %s", err.Error())
 	}
 
-	chatBot := chatbot.NewChatBot(hubs, repo, botEmail, ch)
+	go relay.Run()
 
-	go chatBot.ConsumeStockRequests()
+	chatBot := chatbot.NewChatBot(broadcaster, repo, botEmail, b, relay, registry)
+	chatBot.Listener = dispatcher
+	chatBot.Notify = relay.Wake
+	chatBot.Retries = broker.RetryPolicy{MaxRetries: s.BROKER_MAX_RETRIES, RetryDelay: s.BROKER_RETRY_DELAY}
+	dispatcher.Start(s.WEBHOOK_WORKERS, chatBot.Reply)
+
+	go chatBot.ConsumeCommandRequests()
 	go chatBot.ConsumeChatroomMessages()
+	go chatBot.ConsumeBotRegistrations(registrations)
+	go chatBot.ConsumeBotReplies()
+	chatBot.StartAlertScheduler(quotes, s.ALERT_POLL_INTERVAL)
+	chatBot.StartMessageScheduler(s.SCHEDULER_POLL_INTERVAL)
+
+	return b, broadcaster, relay, chatBot.Close
+}
+
+// Uses RabbitMQ unless the in-process broker is configured, which only works with a single instance and the
+// built-in commands.
+func (s *ChatroomService) newBroker() (broker.Broker, error) {
+	switch s.BROKER {
+	case BrokerMemory:
+		log.Println("Using the in-process broker, messages are lost when the server stops")
+		return broker.NewMemory(), nil
+	case BrokerRabbitMQ, "":
+		return broker.DialRabbitMQ(s.RABBIT_MQ_URL, broker.ReconnectPolicy{Delay: s.BROKER_RECONNECT_DELAY, MaxDelay: s.BROKER_RECONNECT_MAX_DELAY})
+	default:
+		return nil, fmt.Errorf("unknown broker %q, use %s or %s", s.BROKER, BrokerRabbitMQ, BrokerMemory)
+	}
+}
 
-	return ch
+// Gets the configured instance ID. The default one is unique even if two instances run in the same host.
+func (s *ChatroomService) instanceID() string {
+	if s.INSTANCE_ID != "" {
+		return s.INSTANCE_ID
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "chatroom"
+	}
+
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+
+	return fmt.Sprintf("%s-%s", hostname, hex.EncodeToString(suffix))
 }
 
-func (service *ChatroomService) protectedEndpoints(router *mux.Router, handler *handlers.Handler) {
+func (service *ChatroomService) protectedEndpoints(router *mux.Router, handler *handlers.Handler, repo interfaces.DBRepo) {
 	subRouter := router.PathPrefix("/").Subrouter()
-	subRouter.Use(utils.AuthMiddleware)
+	subRouter.Use(utils.AuthMiddleware(repo))
+
+	subRouter.HandleFunc("/chatrooms/", utils.RequireScope(models.ScopeChatroomsWrite, handler.AddChatroom)).Methods("POST")
+	subRouter.HandleFunc("/chatrooms", utils.RequireScope(models.ScopeChatroomsRead, handler.GetAllChatrooms)).Methods("GET")
+	subRouter.HandleFunc("/chatrooms/{id}/polls/{pollId:[0-9]+}", utils.RequireScope(models.ScopeChatroomsRead, handler.GetPoll)).Methods("GET")
+	subRouter.HandleFunc("/chatrooms/{id}/scheduled-messages", utils.RequireScope(models.ScopeChatroomsConnect, handler.AddScheduledMessage)).Methods("POST")
+	subRouter.HandleFunc("/chatrooms/{id}/webhooks", utils.RequireScope(models.ScopeChatroomsWrite, handler.AddChatroomWebhook)).Methods("POST")
+	subRouter.HandleFunc("/chatrooms/{id}/webhooks", utils.RequireScope(models.ScopeChatroomsWrite, handler.GetChatroomWebhooks)).Methods("GET")
+	subRouter.HandleFunc("/chatrooms/{id}/webhooks/{webhookId:[0-9]+}", utils.RequireScope(models.ScopeChatroomsWrite, handler.DeleteChatroomWebhook)).Methods("DELETE")
+	subRouter.HandleFunc("/chatrooms/{id}/webhooks/{webhookId:[0-9]+}/deliveries", utils.RequireScope(models.ScopeChatroomsWrite, handler.GetWebhookDeliveries)).Methods("GET")
+	subRouter.HandleFunc("/chatrooms/{id}/incoming-webhooks", utils.RequireScope(models.ScopeChatroomsWrite, handler.AddIncomingWebhook)).Methods("POST")
+	subRouter.HandleFunc("/chatrooms/{id}/incoming-webhooks", utils.RequireScope(models.ScopeChatroomsWrite, handler.GetIncomingWebhooks)).Methods("GET")
+	subRouter.HandleFunc("/chatrooms/{id}/incoming-webhooks/{webhookId:[0-9]+}", utils.RequireScope(models.ScopeChatroomsWrite, handler.RevokeIncomingWebhook)).Methods("DELETE")
+	subRouter.HandleFunc("/ws/chatroom/{id}", utils.RequireScope(models.ScopeChatroomsConnect, handler.ConnectToChatroomWS))
+	subRouter.HandleFunc("/verify-email/resend", utils.RequireScope(models.ScopeUsersWrite, handler.ResendVerificationEmail)).Methods("POST")
+	subRouter.HandleFunc("/users/me", utils.RequireScope(models.ScopeUsersRead, handler.GetMe)).Methods("GET")
+	subRouter.HandleFunc("/users/me", utils.RequireScope(models.ScopeUsersWrite, handler.UpdateMe)).Methods("PATCH")
+	subRouter.HandleFunc("/users/me/password", utils.RequireScope(models.ScopeUsersWrite, handler.ChangePassword)).Methods("PUT")
+	subRouter.HandleFunc("/users/{id:[0-9]+}", utils.RequireScope(models.ScopeUsersRead, handler.GetUser)).Methods("GET")
+
+	adminRouter := subRouter.PathPrefix("/admin").Subrouter()
+	adminRouter.Use(utils.AdminMiddleware)
+
+	adminRouter.HandleFunc("/users/{id}/verify", handler.AdminVerifyUser).Methods("POST")
+	adminRouter.HandleFunc("/users/{id}/unlock", handler.AdminUnlockUser).Methods("POST")
+	adminRouter.HandleFunc("/users/{id}/lockouts", handler.AdminGetUserLockouts).Methods("GET")
+	adminRouter.HandleFunc("/service-accounts", handler.AddServiceAccount).Methods("POST")
+	adminRouter.HandleFunc("/service-accounts/{id}/tokens", handler.AddAPIToken).Methods("POST")
+	adminRouter.HandleFunc("/service-accounts/{id}/tokens", handler.GetAPITokens).Methods("GET")
+	adminRouter.HandleFunc("/tokens/{id}", handler.RevokeAPIToken).Methods("DELETE")
+	adminRouter.HandleFunc("/dead-letters", handler.GetDeadLetters).Methods("GET")
+	adminRouter.HandleFunc("/dead-letters/replay", handler.ReplayDeadLetters).Methods("POST")
+}
+
+// Uses the SMTP mailer when a SMTP host is configured, otherwise the emails are only logged.
+func (s *ChatroomService) newMailer() interfaces.Mailer {
+	if s.SMTP_HOST == "" {
+		log.Println("SMTP_HOST not provided, emails will be written to the logs")
+		return mailer.NewLogMailer()
+	}
 
-	subRouter.HandleFunc("/chatrooms/", handler.AddChatroom).Methods("POST")
-	subRouter.HandleFunc("/chatrooms", handler.GetAllChatrooms).Methods("GET")
-	subRouter.HandleFunc("/ws/chatroom/{id}", handler.ConnectToChatroomWS)
+	return mailer.NewSMTPMailer(s.SMTP_HOST, s.SMTP_PORT, s.SMTP_USERNAME, s.SMTP_PASSWORD, s.SMTP_FROM)
 }
@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/raynine/go-chatroom/broker"
+	"github.com/raynine/go-chatroom/models"
+	"github.com/raynine/go-chatroom/utils"
+)
+
+const (
+	defaultDeadLettersLimit = 50
+	maxDeadLettersLimit     = 500
+)
+
+// Lists the oldest dead letters without removing them.
+func (handler *Handler) GetDeadLetters(w http.ResponseWriter, r *http.Request) {
+	deadLetters, err := handler.broker.DeadLetters(deadLettersLimit(r))
+	if errors.Is(err, broker.ErrNotConnected) {
+		utils.EncodeErrorResponse(w, &models.CustomError{
+			Message: "the broker is not available, try again later",
+			Code:    http.StatusServiceUnavailable,
+		})
+		return
+	}
+
+	if err != nil {
+		log.Printf("An error ocurred while reading dead letters: %s", err.Error())
+		utils.EncodeErrorResponse(w, &models.CustomError{
+			Message: "error while reading dead letters",
+		})
+		return
+	}
+
+	utils.EncodeResponse(w, models.ServerResponse{Code: http.StatusOK, Data: deadLetters})
+}
+
+// Publishes the oldest dead letters again in the queues they came from.
+func (handler *Handler) ReplayDeadLetters(w http.ResponseWriter, r *http.Request) {
+	replayed, err := handler.broker.ReplayDeadLetters(deadLettersLimit(r))
+	if errors.Is(err, broker.ErrNotConnected) {
+		utils.EncodeErrorResponse(w, &models.CustomError{
+			Message: "the broker is not available, try again later",
+			Code:    http.StatusServiceUnavailable,
+		})
+		return
+	}
+
+	if err != nil {
+		log.Printf("An error ocurred while replaying dead letters: %s", err.Error())
+		utils.EncodeErrorResponse(w, &models.CustomError{
+			Message: "error while replaying dead letters",
+		})
+		return
+	}
+
+	utils.EncodeResponse(w, models.ServerResponse{Code: http.StatusOK, Data: replayed})
+}
+
+// Reads the limit query param, falling back to the default one if it's missing or invalid.
+func deadLettersLimit(r *http.Request) int {
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		return defaultDeadLettersLimit
+	}
+
+	return min(limit, maxDeadLettersLimit)
+}
@@ -1,12 +1,15 @@
 package handlers
 
 import (
+	"fmt"
 	"log"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
-	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/raynine/go-chatroom/broker"
 	"github.com/raynine/go-chatroom/interfaces"
 	"github.com/raynine/go-chatroom/models"
 
@@ -14,19 +17,61 @@ import (
 )
 
 type Handler struct {
-	repo interfaces.DBRepo
-	hubs map[string]*models.Hub
-	ch   *amqp.Channel
+	repo              interfaces.DBRepo
+	hubs              *models.HubManager
+	writer            models.MessageWriter
+	outbox            models.Outbox
+	broker            broker.Broker
+	commands          models.CommandRouter
+	listener          models.MessageListener
+	broadcaster       models.Broadcaster
+	mailer            interfaces.Mailer
+	loginGuard        *utils.LoginGuard
+	appURL            string
+	trustForwardedFor bool
+	dummyHash         string
 }
 
-func NewHandler(repo interfaces.DBRepo, ch *amqp.Channel, hubs map[string]*models.Hub) *Handler {
+func NewHandler(
+	repo interfaces.DBRepo,
+	broker broker.Broker,
+	hubs *models.HubManager,
+	writer models.MessageWriter,
+	outbox models.Outbox,
+	commands models.CommandRouter,
+	listener models.MessageListener,
+	broadcaster models.Broadcaster,
+	mailer interfaces.Mailer,
+	loginGuard *utils.LoginGuard,
+	appURL string,
+	trustForwardedFor bool,
+) *Handler {
+	// Compared against when the email does not exist, so unknown emails take as long as wrong passwords.
+	dummyHash, err := utils.HashPassword("not-a-real-password")
+	if err != nil {
+		log.Fatalf("An error ocurred while creating dummy password hash: %s", err.Error())
+	}
+
 	return &Handler{
-		repo: repo,
-		hubs: hubs,
-		ch:   ch,
+		repo:              repo,
+		hubs:              hubs,
+		writer:            writer,
+		outbox:            outbox,
+		broker:            broker,
+		commands:          commands,
+		listener:          listener,
+		broadcaster:       broadcaster,
+		mailer:            mailer,
+		loginGuard:        loginGuard,
+		appURL:            appURL,
+		trustForwardedFor: trustForwardedFor,
+		dummyHash:         dummyHash,
 	}
 }
 
+// Time a verification link stays valid after being sent.
+const verificationTokenTTL = 24 * time.Hour
+
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
@@ -44,6 +89,15 @@ func (handler *Handler) AddChatroom(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The creator owns the chatroom and is the one who can manage its webhooks.
+	userId, _, err := utils.GetUserDataFromContext(r.Context())
+	if err != nil {
+		utils.EncodeErrorResponse(w, err)
+		return
+	}
+
+	chatroom.OwnerID = &userId
+
 	id, err := handler.repo.AddChatroom(chatroom)
 	if err != nil {
 		utils.EncodeErrorResponse(w, err)
@@ -103,37 +157,44 @@ func (handler *Handler) ConnectToChatroomWS(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	conn, err := upgrader.Upgrade(w, r, nil)
+	userId, userName, err := utils.GetUserDataFromContext(r.Context())
 	if err != nil {
-		log.Printf("An error ocurred while upgrading connection to WS: %s\n", err.Error())
+		utils.EncodeErrorResponse(w, err)
 		return
 	}
 
-	hub := &models.Hub{}
+	user, err := handler.repo.GetUserByID(userId)
+	if err != nil {
+		utils.EncodeErrorResponse(w, err)
+		return
+	}
 
-	hub, ok = handler.hubs[id]
-	if !ok {
-		hub = models.NewHub(id, handler.repo)
-		handler.hubs[id] = hub
-		go hub.Run()
+	if user == nil || !user.EmailVerified {
+		utils.EncodeErrorResponse(w, &models.CustomError{
+			Message: "Email must be verified before joining a chatroom",
+			Code:    http.StatusForbidden,
+		})
+		return
 	}
 
-	userId, userName, err := utils.GetUserDataFromContext(r.Context())
+	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		utils.EncodeErrorResponse(w, err)
+		log.Printf("An error ocurred while upgrading connection to WS: %s\n", err.Error())
 		return
 	}
 
 	client := &models.Client{
-		Id:       userId,
-		UserName: userName,
-		Hub:      hub,
-		Conn:     conn,
-		Ch:       handler.ch,
-		Send:     make(chan *models.ChatMessage),
+		Id:          userId,
+		UserName:    userName,
+		IsBot:       user.IsServiceAccount,
+		Conn:        conn,
+		Writer:      handler.writer,
+		Commands:    handler.commands,
+		Listener:    handler.listener,
+		Broadcaster: handler.broadcaster,
 	}
 
-	client.Hub.Register <- client
+	handler.hubs.Join(id, client)
 
 	go client.WritePump()
 	go client.ReadPump()
@@ -170,8 +231,10 @@ func (handler *Handler) AddUser(w http.ResponseWriter, r *http.Request) {
 	}
 
 	user.Password = hashedPassword
+	user.EmailVerified = false
+	user.IsAdmin = false
 
-	_, err = handler.repo.AddUser(user)
+	id, err := handler.repo.AddUser(user)
 	if err != nil {
 		utils.EncodeErrorResponse(w, &models.CustomError{
 			Message: err.Error(),
@@ -180,9 +243,240 @@ func (handler *Handler) AddUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The account is already created, if the email fails the user can ask for a new one.
+	err = handler.sendVerificationEmail(*id, user.Email)
+	if err != nil {
+		log.Printf("An error ocurred while sending verification email to %s: %s\n", user.Email, err.Error())
+	}
+
 	utils.EncodeResponse(w, models.ServerResponse{Code: http.StatusCreated})
 }
 
+// Hashes the password again with the current hashing policy. Failing to do so does not affect the login,
+// the rehash will be retried on the next one.
+func (handler *Handler) rehashPassword(userId int, password string) {
+	hashedPassword, err := utils.HashPassword(password)
+	if err != nil {
+		log.Printf("An error ocurred while rehashing password of user %d: %s\n", userId, err.Error())
+		return
+	}
+
+	err = handler.repo.UpdateUserPassword(userId, hashedPassword)
+	if err != nil {
+		log.Printf("An error ocurred while saving rehashed password of user %d: %s\n", userId, err.Error())
+		return
+	}
+
+	log.Printf("Password of user %d rehashed with the current hashing policy", userId)
+}
+
+// Records the failed login and stores a lockout event if the failure locked the account or the IP address.
+func (handler *Handler) recordLoginFailure(email, ip string, user *models.User) {
+	lockouts := handler.loginGuard.Failure(email, ip)
+
+	var userId *int
+	if user != nil {
+		userId = &user.Id
+	}
+
+	for reason, lockedUntil := range lockouts {
+		log.Printf("Login locked by %s for email %s from %s", reason, email, ip)
+
+		_, err := handler.repo.AddLoginLockout(&models.LoginLockout{
+			UserID:      userId,
+			Email:       email,
+			IPAddress:   ip,
+			Reason:      reason,
+			LockedUntil: lockedUntil,
+		})
+		if err != nil {
+			log.Printf("An error ocurred while recording login lockout: %s\n", err.Error())
+		}
+	}
+}
+
+// Lets an admin unlock an account locked after too many failed logins.
+func (handler *Handler) AdminUnlockUser(w http.ResponseWriter, r *http.Request) {
+	userId, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		utils.EncodeErrorResponse(w, &models.CustomError{
+			Message: "Invalid user ID",
+			Code:    http.StatusBadRequest,
+		})
+		return
+	}
+
+	adminId, _, err := utils.GetUserDataFromContext(r.Context())
+	if err != nil {
+		utils.EncodeErrorResponse(w, err)
+		return
+	}
+
+	user, err := handler.repo.GetUserByID(userId)
+	if err != nil {
+		utils.EncodeErrorResponse(w, err)
+		return
+	}
+
+	if user == nil {
+		utils.EncodeErrorResponse(w, &models.CustomError{
+			Message: "User not found",
+			Code:    http.StatusNotFound,
+		})
+		return
+	}
+
+	handler.loginGuard.Unlock(user.Email)
+
+	err = handler.repo.UnlockLoginLockouts(user.Id, adminId)
+	if err != nil {
+		utils.EncodeErrorResponse(w, err)
+		return
+	}
+
+	utils.EncodeResponse(w, models.ServerResponse{
+		Code: http.StatusOK,
+		Data: map[string]any{
+			"message": "User unlocked",
+		},
+	})
+}
+
+// Lists the last lockouts of the user for admins.
+func (handler *Handler) AdminGetUserLockouts(w http.ResponseWriter, r *http.Request) {
+	userId, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		utils.EncodeErrorResponse(w, &models.CustomError{
+			Message: "Invalid user ID",
+			Code:    http.StatusBadRequest,
+		})
+		return
+	}
+
+	lockouts, err := handler.repo.GetUserLoginLockouts(userId)
+	if err != nil {
+		utils.EncodeErrorResponse(w, err)
+		return
+	}
+
+	utils.EncodeResponse(w, models.ServerResponse{Code: http.StatusOK, Data: lockouts})
+}
+
+// Verifies the email of the user that owns the token sent in the verification link.
+func (handler *Handler) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		utils.EncodeErrorResponse(w, &models.CustomError{
+			Message: "Invalid verification token",
+			Code:    http.StatusBadRequest,
+		})
+		return
+	}
+
+	_, err := handler.repo.VerifyEmail(utils.HashToken(token))
+	if err != nil {
+		utils.EncodeErrorResponse(w, err)
+		return
+	}
+
+	utils.EncodeResponse(w, models.ServerResponse{
+		Code: http.StatusOK,
+		Data: map[string]any{
+			"message": "Email verified",
+		},
+	})
+}
+
+// Sends a new verification link to the logged in user.
+func (handler *Handler) ResendVerificationEmail(w http.ResponseWriter, r *http.Request) {
+	userId, _, err := utils.GetUserDataFromContext(r.Context())
+	if err != nil {
+		utils.EncodeErrorResponse(w, err)
+		return
+	}
+
+	user, err := handler.repo.GetUserByID(userId)
+	if err != nil {
+		utils.EncodeErrorResponse(w, err)
+		return
+	}
+
+	if user == nil {
+		utils.EncodeErrorResponse(w, &models.CustomError{
+			Message: "User not found",
+			Code:    http.StatusNotFound,
+		})
+		return
+	}
+
+	if user.EmailVerified {
+		utils.EncodeErrorResponse(w, &models.CustomError{
+			Message: "Email is already verified",
+			Code:    http.StatusBadRequest,
+		})
+		return
+	}
+
+	err = handler.sendVerificationEmail(user.Id, user.Email)
+	if err != nil {
+		log.Printf("An error ocurred while sending verification email to %s: %s\n", user.Email, err.Error())
+		utils.EncodeErrorResponse(w, &models.CustomError{
+			Message: "Error while sending verification email",
+			Code:    http.StatusInternalServerError,
+		})
+		return
+	}
+
+	utils.EncodeResponse(w, models.ServerResponse{Code: http.StatusAccepted})
+}
+
+// Lets an admin mark the email of any user as verified without the verification link.
+func (handler *Handler) AdminVerifyUser(w http.ResponseWriter, r *http.Request) {
+	userId, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		utils.EncodeErrorResponse(w, &models.CustomError{
+			Message: "Invalid user ID",
+			Code:    http.StatusBadRequest,
+		})
+		return
+	}
+
+	err = handler.repo.SetEmailVerified(userId, true)
+	if err != nil {
+		utils.EncodeErrorResponse(w, err)
+		return
+	}
+
+	utils.EncodeResponse(w, models.ServerResponse{
+		Code: http.StatusOK,
+		Data: map[string]any{
+			"message": "Email verified",
+		},
+	})
+}
+
+// Creates a verification token, stores its hash and sends the verification link to the provided email.
+func (handler *Handler) sendVerificationEmail(userId int, email string) error {
+	token, err := utils.GenerateToken(32)
+	if err != nil {
+		return err
+	}
+
+	err = handler.repo.AddEmailVerification(userId, utils.HashToken(token), time.Now().Add(verificationTokenTTL))
+	if err != nil {
+		return err
+	}
+
+	link := fmt.Sprintf("%s/verify-email?token=%s", handler.appURL, token)
+	body := fmt.Sprintf(
+		"Welcome to Go Chatroom!\n\nPlease verify your email address by opening the following link:\n\n%s\n\nThe link expires in %d hours.",
+		link,
+		int(verificationTokenTTL.Hours()),
+	)
+
+	return handler.mailer.Send(email, "Verify your email address", body)
+}
+
 func (handler *Handler) LoginUser(w http.ResponseWriter, r *http.Request) {
 	user := &models.User{}
 
@@ -201,21 +495,46 @@ func (handler *Handler) LoginUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	existingUser, err := handler.repo.GetUserByEmail(user.Email)
+	ip := utils.GetClientIP(r, handler.trustForwardedFor)
+
+	wait, ok := handler.loginGuard.Allow(user.Email, ip)
+	if !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		utils.EncodeErrorResponse(w, &models.CustomError{
+			Message: "Too many failed login attempts, try again later",
+			Code:    http.StatusTooManyRequests,
+		})
+		return
+	}
+
+	existingUser, err := handler.repo.FindUserByEmail(user.Email)
 	if err != nil {
+		handler.loginGuard.Release(user.Email, ip)
 		utils.EncodeErrorResponse(w, err)
 		return
 	}
 
-	match := utils.CheckPassword(user.Password, existingUser.Password)
-	if !match {
+	hash := handler.dummyHash
+	if existingUser != nil {
+		hash = existingUser.Password
+	}
+
+	match := utils.CheckPassword(user.Password, hash)
+	if existingUser == nil || !match {
+		handler.recordLoginFailure(user.Email, ip, existingUser)
 		utils.EncodeErrorResponse(w, &models.CustomError{
-			Message: "Provided password does not match",
-			Code:    http.StatusBadRequest,
+			Message: "Invalid email or password",
+			Code:    http.StatusUnauthorized,
 		})
 		return
 	}
 
+	handler.loginGuard.Success(user.Email, ip)
+
+	if utils.NeedsRehash(existingUser.Password) {
+		handler.rehashPassword(existingUser.Id, user.Password)
+	}
+
 	token, err := utils.CreateJWTToken(existingUser)
 	if err != nil {
 		utils.EncodeErrorResponse(w, &models.CustomError{
@@ -0,0 +1,47 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/raynine/go-chatroom/broker"
+	"github.com/raynine/go-chatroom/models"
+	"github.com/raynine/go-chatroom/utils"
+)
+
+const (
+	healthOK       = "ok"
+	healthDegraded = "degraded"
+)
+
+type healthStatus struct {
+	Status   string          `json:"health_status"`
+	Database bool            `json:"health_database"`
+	Broker   broker.Status   `json:"health_broker"`
+	Hubs     models.HubStats `json:"health_hubs"`
+}
+
+// Reports if the database and the broker are reachable, along with the counters of the chatrooms. Responds 503 while
+// any of them is down, so load balancers stop routing to the instance.
+func (handler *Handler) Health(w http.ResponseWriter, r *http.Request) {
+	health := &healthStatus{
+		Status:   healthOK,
+		Database: true,
+		Broker:   handler.broker.Status(),
+		Hubs:     handler.hubs.Stats(),
+	}
+
+	err := handler.repo.Ping()
+	if err != nil {
+		log.Printf("Health check failed to ping the database: %s", err.Error())
+		health.Database = false
+	}
+
+	code := http.StatusOK
+	if !health.Database || !health.Broker.Connected {
+		health.Status = healthDegraded
+		code = http.StatusServiceUnavailable
+	}
+
+	utils.EncodeResponse(w, models.ServerResponse{Code: code, Data: health})
+}
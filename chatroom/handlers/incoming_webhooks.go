@@ -0,0 +1,213 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"github.com/raynine/go-chatroom/models"
+	"github.com/raynine/go-chatroom/utils"
+)
+
+// Prefix of the incoming webhook tokens, makes them easy to spot if they get leaked.
+const incomingWebhookTokenPrefix = "whk_"
+
+// Max size of the requests received by the incoming webhooks.
+const maxIncomingWebhookBody = 64 << 10
+
+// Creates an incoming webhook in the chatroom and the service account it posts as. The token is only returned here.
+func (handler *Handler) AddIncomingWebhook(w http.ResponseWriter, r *http.Request) {
+	chatroom, err := handler.getManagedChatroom(r)
+	if err != nil {
+		utils.EncodeErrorResponse(w, err)
+		return
+	}
+
+	webhook := &models.IncomingWebhook{}
+
+	err = utils.DecodePayload(r, &webhook)
+	if err != nil {
+		utils.EncodeErrorResponse(w, &models.CustomError{
+			Message: "Invalid incoming webhook",
+			Code:    http.StatusBadRequest,
+		})
+		return
+	}
+
+	err = webhook.Validate()
+	if err != nil {
+		utils.EncodeErrorResponse(w, err)
+		return
+	}
+
+	token, err := utils.GenerateToken(32)
+	if err != nil {
+		utils.EncodeErrorResponse(w, &models.CustomError{
+			Message: "Error while creating token",
+			Code:    http.StatusInternalServerError,
+		})
+		return
+	}
+
+	userId, _, _ := utils.GetUserDataFromContext(r.Context())
+
+	token = incomingWebhookTokenPrefix + token
+	webhook.ChatroomID = chatroom.Id
+	webhook.CreatedBy = userId
+	webhook.TokenHash = utils.HashToken(token)
+
+	id, err := handler.repo.AddIncomingWebhook(webhook)
+	if err != nil {
+		utils.EncodeErrorResponse(w, err)
+		return
+	}
+
+	utils.EncodeResponse(w, models.ServerResponse{
+		Code: http.StatusCreated,
+		Data: map[string]any{
+			"incoming_webhook_id":      id,
+			"incoming_webhook_user_id": webhook.UserID,
+			"token":                    token,
+			"url":                      fmt.Sprintf("%s/hooks/%s", handler.appURL, token),
+		},
+	})
+}
+
+// Lists the incoming webhooks of the chatroom. The tokens themselves are never returned.
+func (handler *Handler) GetIncomingWebhooks(w http.ResponseWriter, r *http.Request) {
+	chatroom, err := handler.getManagedChatroom(r)
+	if err != nil {
+		utils.EncodeErrorResponse(w, err)
+		return
+	}
+
+	webhooks, err := handler.repo.GetChatroomIncomingWebhooks(chatroom.Id)
+	if err != nil {
+		utils.EncodeErrorResponse(w, err)
+		return
+	}
+
+	utils.EncodeResponse(w, models.ServerResponse{Code: http.StatusOK, Data: webhooks})
+}
+
+func (handler *Handler) RevokeIncomingWebhook(w http.ResponseWriter, r *http.Request) {
+	chatroom, err := handler.getManagedChatroom(r)
+	if err != nil {
+		utils.EncodeErrorResponse(w, err)
+		return
+	}
+
+	webhookId, _ := strconv.Atoi(mux.Vars(r)["webhookId"])
+
+	err = handler.repo.RevokeIncomingWebhook(webhookId, chatroom.Id)
+	if err != nil {
+		utils.EncodeErrorResponse(w, err)
+		return
+	}
+
+	utils.EncodeResponse(w, models.ServerResponse{
+		Code: http.StatusOK,
+		Data: map[string]any{
+			"message": "Incoming webhook revoked",
+		},
+	})
+}
+
+// Posts the message of an integration into the chatroom of the token. The message goes through the chatroom_messages
+// queue, where it gets saved and broadcasted.
+func (handler *Handler) PostIncomingWebhook(w http.ResponseWriter, r *http.Request) {
+	webhook, err := handler.repo.GetIncomingWebhookByHash(utils.HashToken(mux.Vars(r)["token"]))
+	if err != nil {
+		utils.EncodeErrorResponse(w, err)
+		return
+	}
+
+	if webhook == nil {
+		utils.EncodeErrorResponse(w, &models.CustomError{
+			Message: "Incoming webhook not found",
+			Code:    http.StatusNotFound,
+		})
+		return
+	}
+
+	request := &models.ChatMessage{}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxIncomingWebhookBody)
+
+	err = utils.DecodePayload(r, &request)
+	if err != nil {
+		utils.EncodeErrorResponse(w, &models.CustomError{
+			Message: "Invalid message",
+			Code:    http.StatusBadRequest,
+		})
+		return
+	}
+
+	text := strings.TrimSpace(request.Message)
+	if (text == "" && len(request.Payload) == 0) || utf8.RuneCountInString(text) > models.MaxIncomingMessageLength {
+		utils.EncodeErrorResponse(w, &models.CustomError{
+			Message: fmt.Sprintf("Message must have between 1 and %d characters", models.MaxIncomingMessageLength),
+			Code:    http.StatusBadRequest,
+		})
+		return
+	}
+
+	err = request.ValidateIntegration()
+	if err != nil {
+		utils.EncodeErrorResponse(w, err)
+		return
+	}
+
+	// Numbered beforehand, so the message is saved once even if the outbox publishes it again.
+	ids, err := handler.repo.ReserveMessageIds(1)
+	if err != nil {
+		utils.EncodeErrorResponse(w, &models.CustomError{
+			Message: "Message could not be posted, please try again later",
+			Code:    http.StatusServiceUnavailable,
+		})
+		return
+	}
+
+	// Only the content is taken from the request, the author is always the integration user.
+	message := &models.ChatMessage{
+		Id:         ids[0],
+		UserID:     webhook.UserID,
+		UserName:   webhook.UserName,
+		ChatroomID: webhook.ChatroomID,
+		Message:    text,
+		Type:       request.Type,
+		Payload:    request.Payload,
+		IsBot:      true,
+		CreatedAt:  time.Now(),
+	}
+
+	body, _ := json.Marshal(message)
+
+	err = handler.outbox.Publish(models.ChatroomMessagesQueue, body)
+	if err != nil {
+		log.Printf("Error while publishing to %s: %s", models.ChatroomMessagesQueue, err.Error())
+		utils.EncodeErrorResponse(w, &models.CustomError{
+			Message: "Message could not be posted, please try again later",
+			Code:    http.StatusServiceUnavailable,
+		})
+		return
+	}
+
+	err = handler.repo.TouchIncomingWebhook(webhook.Id)
+	if err != nil {
+		log.Printf("Unable to update last use of incoming webhook %d: %s", webhook.Id, err.Error())
+	}
+
+	utils.EncodeResponse(w, models.ServerResponse{
+		Code: http.StatusAccepted,
+		Data: map[string]any{
+			"message": "Message accepted",
+		},
+	})
+}
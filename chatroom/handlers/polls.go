@@ -0,0 +1,33 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/raynine/go-chatroom/models"
+	"github.com/raynine/go-chatroom/utils"
+)
+
+// Gets the poll with its current votes. The poll messages in the history keep the votes they were posted with.
+func (handler *Handler) GetPoll(w http.ResponseWriter, r *http.Request) {
+	chatroomId := mux.Vars(r)["id"]
+	pollId, _ := strconv.Atoi(mux.Vars(r)["pollId"])
+
+	poll, err := handler.repo.GetPoll(pollId, chatroomId)
+	if err != nil {
+		utils.EncodeErrorResponse(w, err)
+		return
+	}
+
+	if poll == nil {
+		utils.EncodeErrorResponse(w, &models.CustomError{
+			Message: fmt.Sprintf("Poll with ID: %d does not exists", pollId),
+			Code:    http.StatusNotFound,
+		})
+		return
+	}
+
+	utils.EncodeResponse(w, models.ServerResponse{Code: http.StatusOK, Data: poll})
+}
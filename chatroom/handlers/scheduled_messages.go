@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/raynine/go-chatroom/models"
+	"github.com/raynine/go-chatroom/utils"
+)
+
+// Schedules a message that gets posted in the chatroom as the logged in user at the requested time.
+func (handler *Handler) AddScheduledMessage(w http.ResponseWriter, r *http.Request) {
+	chatroomId := mux.Vars(r)["id"]
+
+	chatroom, err := handler.repo.GetChatroomByID(chatroomId)
+	if err != nil {
+		utils.EncodeErrorResponse(w, err)
+		return
+	}
+
+	if chatroom == nil {
+		utils.EncodeErrorResponse(w, &models.CustomError{
+			Message: "Chatroom not found",
+			Code:    http.StatusNotFound,
+		})
+		return
+	}
+
+	user, err := handler.getCurrentUser(r)
+	if err != nil {
+		utils.EncodeErrorResponse(w, err)
+		return
+	}
+
+	if !user.EmailVerified {
+		utils.EncodeErrorResponse(w, &models.CustomError{
+			Message: "Email must be verified before sending messages",
+			Code:    http.StatusForbidden,
+		})
+		return
+	}
+
+	scheduled := &models.ScheduledMessage{}
+
+	err = utils.DecodePayload(r, &scheduled)
+	if err != nil {
+		utils.EncodeErrorResponse(w, &models.CustomError{
+			Message: "Invalid scheduled message",
+			Code:    http.StatusBadRequest,
+		})
+		return
+	}
+
+	err = scheduled.Validate(time.Now())
+	if err != nil {
+		utils.EncodeErrorResponse(w, err)
+		return
+	}
+
+	scheduled.UserID = user.Id
+	scheduled.ChatroomID = chatroom.Id
+	scheduled.Kind = models.ScheduledMessageKindMessage
+
+	id, err := handler.repo.AddScheduledMessage(scheduled, nil)
+	if err != nil {
+		utils.EncodeErrorResponse(w, err)
+		return
+	}
+
+	utils.EncodeResponse(w, models.ServerResponse{
+		Code: http.StatusCreated,
+		Data: map[string]any{
+			"scheduled_message_id":         id,
+			"scheduled_message_deliver_at": scheduled.DeliverAt,
+		},
+	})
+}
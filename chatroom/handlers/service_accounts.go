@@ -0,0 +1,156 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/raynine/go-chatroom/models"
+	"github.com/raynine/go-chatroom/utils"
+)
+
+// Creates a service account. Service accounts can not login with a password, they use API tokens instead.
+func (handler *Handler) AddServiceAccount(w http.ResponseWriter, r *http.Request) {
+	user := &models.User{}
+
+	err := utils.DecodePayload(r, &user)
+	if err != nil {
+		utils.EncodeErrorResponse(w, &models.CustomError{
+			Message: "Invalid service account",
+			Code:    http.StatusBadRequest,
+		})
+		return
+	}
+
+	id, err := handler.repo.AddServiceAccount(user.Username)
+	if err != nil {
+		utils.EncodeErrorResponse(w, err)
+		return
+	}
+
+	utils.EncodeResponse(w, models.ServerResponse{
+		Code: http.StatusCreated,
+		Data: map[string]any{
+			"user_id": id,
+		},
+	})
+}
+
+// Creates an API token for the service account. The plain token is only returned in this response.
+func (handler *Handler) AddAPIToken(w http.ResponseWriter, r *http.Request) {
+	user, err := handler.getServiceAccount(r)
+	if err != nil {
+		utils.EncodeErrorResponse(w, err)
+		return
+	}
+
+	apiToken := &models.APIToken{}
+
+	err = utils.DecodePayload(r, &apiToken)
+	if err != nil {
+		utils.EncodeErrorResponse(w, &models.CustomError{
+			Message: "Invalid API token",
+			Code:    http.StatusBadRequest,
+		})
+		return
+	}
+
+	err = apiToken.Validate()
+	if err != nil {
+		utils.EncodeErrorResponse(w, err)
+		return
+	}
+
+	token, err := utils.GenerateToken(32)
+	if err != nil {
+		utils.EncodeErrorResponse(w, &models.CustomError{
+			Message: "Error while creating token",
+			Code:    http.StatusInternalServerError,
+		})
+		return
+	}
+
+	token = utils.APITokenPrefix + token
+	apiToken.UserID = user.Id
+	apiToken.TokenHash = utils.HashToken(token)
+
+	id, err := handler.repo.AddAPIToken(apiToken)
+	if err != nil {
+		utils.EncodeErrorResponse(w, err)
+		return
+	}
+
+	utils.EncodeResponse(w, models.ServerResponse{
+		Code: http.StatusCreated,
+		Data: map[string]any{
+			"api_token_id": id,
+			"token":        token,
+		},
+	})
+}
+
+// Lists the API tokens of the service account. The tokens themselves are never returned.
+func (handler *Handler) GetAPITokens(w http.ResponseWriter, r *http.Request) {
+	user, err := handler.getServiceAccount(r)
+	if err != nil {
+		utils.EncodeErrorResponse(w, err)
+		return
+	}
+
+	tokens, err := handler.repo.GetUserAPITokens(user.Id)
+	if err != nil {
+		utils.EncodeErrorResponse(w, err)
+		return
+	}
+
+	utils.EncodeResponse(w, models.ServerResponse{Code: http.StatusOK, Data: tokens})
+}
+
+func (handler *Handler) RevokeAPIToken(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		utils.EncodeErrorResponse(w, &models.CustomError{
+			Message: "Invalid API token ID",
+			Code:    http.StatusBadRequest,
+		})
+		return
+	}
+
+	err = handler.repo.RevokeAPIToken(id)
+	if err != nil {
+		utils.EncodeErrorResponse(w, err)
+		return
+	}
+
+	utils.EncodeResponse(w, models.ServerResponse{
+		Code: http.StatusOK,
+		Data: map[string]any{
+			"message": "API token revoked",
+		},
+	})
+}
+
+// Gets the service account with the ID provided in the route.
+func (handler *Handler) getServiceAccount(r *http.Request) (*models.User, error) {
+	userId, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return nil, &models.CustomError{
+			Message: "Invalid user ID",
+			Code:    http.StatusBadRequest,
+		}
+	}
+
+	user, err := handler.repo.GetUserByID(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	if user == nil || !user.IsServiceAccount {
+		return nil, &models.CustomError{
+			Message: "Service account not found",
+			Code:    http.StatusNotFound,
+		}
+	}
+
+	return user, nil
+}
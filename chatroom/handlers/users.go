@@ -0,0 +1,207 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/raynine/go-chatroom/models"
+	"github.com/raynine/go-chatroom/utils"
+)
+
+// Gets the profile of the logged in user, including the private fields.
+func (handler *Handler) GetMe(w http.ResponseWriter, r *http.Request) {
+	user, err := handler.getCurrentUser(r)
+	if err != nil {
+		utils.EncodeErrorResponse(w, err)
+		return
+	}
+
+	user.Password = ""
+
+	utils.EncodeResponse(w, models.ServerResponse{Code: http.StatusOK, Data: user})
+}
+
+// Gets the public profile of any user.
+func (handler *Handler) GetUser(w http.ResponseWriter, r *http.Request) {
+	userId, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		utils.EncodeErrorResponse(w, &models.CustomError{
+			Message: "Invalid user ID",
+			Code:    http.StatusBadRequest,
+		})
+		return
+	}
+
+	user, err := handler.repo.GetUserByID(userId)
+	if err != nil {
+		utils.EncodeErrorResponse(w, err)
+		return
+	}
+
+	if user == nil {
+		utils.EncodeErrorResponse(w, &models.CustomError{
+			Message: "User not found",
+			Code:    http.StatusNotFound,
+		})
+		return
+	}
+
+	utils.EncodeResponse(w, models.ServerResponse{Code: http.StatusOK, Data: user.PublicProfile()})
+}
+
+// Updates the profile of the logged in user. Changing the username returns a new JWT, since the
+// username is part of the token claims.
+func (handler *Handler) UpdateMe(w http.ResponseWriter, r *http.Request) {
+	user, err := handler.getCurrentUser(r)
+	if err != nil {
+		utils.EncodeErrorResponse(w, err)
+		return
+	}
+
+	update := &models.UserProfileUpdate{}
+
+	err = utils.DecodePayload(r, &update)
+	if err != nil {
+		utils.EncodeErrorResponse(w, &models.CustomError{
+			Message: "Invalid profile",
+			Code:    http.StatusBadRequest,
+		})
+		return
+	}
+
+	err = update.Validate()
+	if err != nil {
+		utils.EncodeErrorResponse(w, err)
+		return
+	}
+
+	previousUsername := user.Username
+	update.Apply(user)
+
+	err = handler.repo.UpdateUserProfile(user)
+	if err != nil {
+		utils.EncodeErrorResponse(w, err)
+		return
+	}
+
+	user.Password = ""
+	data := map[string]any{
+		"user": user,
+	}
+
+	if user.Username != previousUsername && !user.IsServiceAccount {
+		token, err := utils.CreateJWTToken(user)
+		if err != nil {
+			utils.EncodeErrorResponse(w, &models.CustomError{
+				Message: "Error while creating token",
+				Code:    http.StatusInternalServerError,
+			})
+			return
+		}
+
+		data["token"] = token
+	}
+
+	utils.EncodeResponse(w, models.ServerResponse{Code: http.StatusOK, Data: data})
+}
+
+// Changes the password of the logged in user. The current password is required and wrong guesses
+// count as failed logins.
+func (handler *Handler) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	user, err := handler.getCurrentUser(r)
+	if err != nil {
+		utils.EncodeErrorResponse(w, err)
+		return
+	}
+
+	passwordChange := &models.PasswordChange{}
+
+	err = utils.DecodePayload(r, &passwordChange)
+	if err != nil {
+		utils.EncodeErrorResponse(w, &models.CustomError{
+			Message: "Invalid password change",
+			Code:    http.StatusBadRequest,
+		})
+		return
+	}
+
+	err = passwordChange.Validate()
+	if err != nil {
+		utils.EncodeErrorResponse(w, err)
+		return
+	}
+
+	ip := utils.GetClientIP(r, handler.trustForwardedFor)
+
+	wait, ok := handler.loginGuard.Allow(user.Email, ip)
+	if !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		utils.EncodeErrorResponse(w, &models.CustomError{
+			Message: "Too many failed login attempts, try again later",
+			Code:    http.StatusTooManyRequests,
+		})
+		return
+	}
+
+	if !utils.CheckPassword(passwordChange.CurrentPassword, user.Password) {
+		handler.recordLoginFailure(user.Email, ip, user)
+		utils.EncodeErrorResponse(w, &models.CustomError{
+			Message: "Current password does not match",
+			Code:    http.StatusUnauthorized,
+		})
+		return
+	}
+
+	handler.loginGuard.Success(user.Email, ip)
+
+	err = user.ValidatePassword(passwordChange.NewPassword)
+	if err != nil {
+		utils.EncodeErrorResponse(w, err)
+		return
+	}
+
+	hashedPassword, err := utils.HashPassword(passwordChange.NewPassword)
+	if err != nil {
+		utils.EncodeErrorResponse(w, &models.CustomError{
+			Message: err.Error(),
+			Code:    http.StatusBadRequest,
+		})
+		return
+	}
+
+	err = handler.repo.UpdateUserPassword(user.Id, hashedPassword)
+	if err != nil {
+		utils.EncodeErrorResponse(w, err)
+		return
+	}
+
+	utils.EncodeResponse(w, models.ServerResponse{
+		Code: http.StatusOK,
+		Data: map[string]any{
+			"message": "Password updated",
+		},
+	})
+}
+
+// Gets the logged in user from the DB.
+func (handler *Handler) getCurrentUser(r *http.Request) (*models.User, error) {
+	userId, _, err := utils.GetUserDataFromContext(r.Context())
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := handler.repo.GetUserByID(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	if user == nil {
+		return nil, &models.CustomError{
+			Message: "User not found",
+			Code:    http.StatusNotFound,
+		}
+	}
+
+	return user, nil
+}
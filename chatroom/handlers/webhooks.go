@@ -0,0 +1,159 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/raynine/go-chatroom/models"
+	"github.com/raynine/go-chatroom/utils"
+)
+
+// Prefix of the webhook secrets, makes them easy to spot if they get leaked.
+const webhookSecretPrefix = "whsec_"
+
+// Max amount of deliveries returned by the delivery log.
+const webhookDeliveriesLimit = 50
+
+// Registers a webhook in the chatroom. The secret used to sign the deliveries is only returned here.
+func (handler *Handler) AddChatroomWebhook(w http.ResponseWriter, r *http.Request) {
+	chatroom, err := handler.getManagedChatroom(r)
+	if err != nil {
+		utils.EncodeErrorResponse(w, err)
+		return
+	}
+
+	webhook := &models.ChatroomWebhook{}
+
+	err = utils.DecodePayload(r, &webhook)
+	if err != nil {
+		utils.EncodeErrorResponse(w, &models.CustomError{
+			Message: "Invalid webhook",
+			Code:    http.StatusBadRequest,
+		})
+		return
+	}
+
+	err = webhook.Validate()
+	if err != nil {
+		utils.EncodeErrorResponse(w, err)
+		return
+	}
+
+	secret, err := utils.GenerateToken(32)
+	if err != nil {
+		utils.EncodeErrorResponse(w, &models.CustomError{
+			Message: "Error while creating webhook secret",
+			Code:    http.StatusInternalServerError,
+		})
+		return
+	}
+
+	userId, _, _ := utils.GetUserDataFromContext(r.Context())
+
+	webhook.ChatroomID = chatroom.Id
+	webhook.CreatedBy = userId
+	webhook.Secret = webhookSecretPrefix + secret
+
+	id, err := handler.repo.AddChatroomWebhook(webhook)
+	if err != nil {
+		utils.EncodeErrorResponse(w, err)
+		return
+	}
+
+	utils.EncodeResponse(w, models.ServerResponse{
+		Code: http.StatusCreated,
+		Data: map[string]any{
+			"chatroom_webhook_id":     id,
+			"chatroom_webhook_secret": webhook.Secret,
+		},
+	})
+}
+
+// Lists the webhooks of the chatroom, without their secrets.
+func (handler *Handler) GetChatroomWebhooks(w http.ResponseWriter, r *http.Request) {
+	chatroom, err := handler.getManagedChatroom(r)
+	if err != nil {
+		utils.EncodeErrorResponse(w, err)
+		return
+	}
+
+	webhooks, err := handler.repo.GetChatroomWebhooks(chatroom.Id)
+	if err != nil {
+		utils.EncodeErrorResponse(w, err)
+		return
+	}
+
+	utils.EncodeResponse(w, models.ServerResponse{Code: http.StatusOK, Data: webhooks})
+}
+
+func (handler *Handler) DeleteChatroomWebhook(w http.ResponseWriter, r *http.Request) {
+	chatroom, err := handler.getManagedChatroom(r)
+	if err != nil {
+		utils.EncodeErrorResponse(w, err)
+		return
+	}
+
+	webhookId, _ := strconv.Atoi(mux.Vars(r)["webhookId"])
+
+	err = handler.repo.DeleteChatroomWebhook(webhookId, chatroom.Id)
+	if err != nil {
+		utils.EncodeErrorResponse(w, err)
+		return
+	}
+
+	utils.EncodeResponse(w, models.ServerResponse{
+		Code: http.StatusOK,
+		Data: map[string]any{
+			"message": "Webhook deleted",
+		},
+	})
+}
+
+// Gets the latest deliveries of the webhook.
+func (handler *Handler) GetWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	chatroom, err := handler.getManagedChatroom(r)
+	if err != nil {
+		utils.EncodeErrorResponse(w, err)
+		return
+	}
+
+	webhookId, _ := strconv.Atoi(mux.Vars(r)["webhookId"])
+
+	deliveries, err := handler.repo.GetWebhookDeliveries(webhookId, chatroom.Id, webhookDeliveriesLimit)
+	if err != nil {
+		utils.EncodeErrorResponse(w, err)
+		return
+	}
+
+	utils.EncodeResponse(w, models.ServerResponse{Code: http.StatusOK, Data: deliveries})
+}
+
+// Gets the chatroom of the route, making sure the logged in user owns it or is an admin.
+func (handler *Handler) getManagedChatroom(r *http.Request) (*models.Chatroom, error) {
+	userId, _, err := utils.GetUserDataFromContext(r.Context())
+	if err != nil {
+		return nil, err
+	}
+
+	chatroom, err := handler.repo.GetChatroomByID(mux.Vars(r)["id"])
+	if err != nil {
+		return nil, err
+	}
+
+	if chatroom == nil {
+		return nil, &models.CustomError{
+			Message: "Chatroom not found",
+			Code:    http.StatusNotFound,
+		}
+	}
+
+	if !chatroom.CanManage(userId, utils.IsAdminFromContext(r.Context())) {
+		return nil, &models.CustomError{
+			Message: "Only the chatroom owner can manage its webhooks",
+			Code:    http.StatusForbidden,
+		}
+	}
+
+	return chatroom, nil
+}
@@ -3,9 +3,17 @@ package main
 import (
 	"log"
 	"os"
+	"time"
+	// Embedded time zone database, the production image does not ship one and profiles validate time zones.
+	_ "time/tzdata"
 
 	"github.com/joho/godotenv"
+	"github.com/raynine/go-chatroom/chatbot"
 	"github.com/raynine/go-chatroom/chatroom"
+	"github.com/raynine/go-chatroom/models"
+	"github.com/raynine/go-chatroom/outbox"
+	"github.com/raynine/go-chatroom/persistence"
+	"github.com/raynine/go-chatroom/utils"
 )
 
 func init() {
@@ -27,13 +35,117 @@ func main() {
 	port := os.Getenv("PORT")
 	chatbotEmail := os.Getenv("CHATBOT_EMAIL")
 	rabbitMQUrl := os.Getenv("RABBIT_MQ_URL")
+	appUrl := os.Getenv("APP_URL")
+	smtpHost := os.Getenv("SMTP_HOST")
+	smtpPort := os.Getenv("SMTP_PORT")
+	smtpUsername := os.Getenv("SMTP_USERNAME")
+	smtpPassword := os.Getenv("SMTP_PASSWORD")
+	smtpFrom := os.Getenv("SMTP_FROM")
 
 	service := chatroom.ChatroomService{
 		DB_URL:        dbUrl,
 		PORT:          port,
 		CHATBOT_EMAIL: chatbotEmail,
 		RABBIT_MQ_URL: rabbitMQUrl,
+		APP_URL:       appUrl,
+		SMTP_HOST:     smtpHost,
+		SMTP_PORT:     smtpPort,
+		SMTP_USERNAME: smtpUsername,
+		SMTP_PASSWORD: smtpPassword,
+		SMTP_FROM:     smtpFrom,
+
+		LOGIN_MAX_ATTEMPTS:     utils.GetEnvInt("LOGIN_MAX_ATTEMPTS", 5),
+		LOGIN_IP_MAX_ATTEMPTS:  utils.GetEnvInt("LOGIN_IP_MAX_ATTEMPTS", 20),
+		LOGIN_LOCKOUT_DURATION: utils.GetEnvDuration("LOGIN_LOCKOUT_DURATION", 15*time.Minute),
+		LOGIN_BACKOFF_BASE:     utils.GetEnvDuration("LOGIN_BACKOFF_BASE", time.Second),
+		TRUST_X_FORWARDED_FOR:  utils.GetEnvBool("TRUST_X_FORWARDED_FOR", false),
+
+		PASSWORD_HASHING: hashingPolicy(),
+
+		QUOTE_ENDPOINTS: utils.GetEnvList("QUOTE_ENDPOINTS"),
+		QUOTE_TIMEOUT:   utils.GetEnvDuration("QUOTE_TIMEOUT", 5*time.Second),
+		QUOTE_CACHE_TTL: utils.GetEnvDuration("QUOTE_CACHE_TTL", time.Minute),
+
+		CHART_HISTORY_ENDPOINT: utils.GetEnvString("CHART_HISTORY_ENDPOINT", chatbot.DefaultStooqHistoryEndpoint),
+		ATTACHMENTS_DIR:        utils.GetEnvString("ATTACHMENTS_DIR", "data/attachments"),
+
+		ALERT_POLL_INTERVAL:     utils.GetEnvDuration("ALERT_POLL_INTERVAL", time.Minute),
+		SCHEDULER_POLL_INTERVAL: utils.GetEnvDuration("SCHEDULER_POLL_INTERVAL", 5*time.Second),
+
+		WEBHOOK_TIMEOUT:      utils.GetEnvDuration("WEBHOOK_TIMEOUT", 10*time.Second),
+		WEBHOOK_MAX_ATTEMPTS: utils.GetEnvInt("WEBHOOK_MAX_ATTEMPTS", 5),
+		WEBHOOK_BACKOFF_BASE: utils.GetEnvDuration("WEBHOOK_BACKOFF_BASE", 5*time.Second),
+		WEBHOOK_WORKERS:      utils.GetEnvInt("WEBHOOK_WORKERS", 4),
+
+		DISABLED_COMMANDS: utils.GetEnvList("DISABLED_COMMANDS"),
+
+		BROKER:             utils.GetEnvString("BROKER", chatroom.BrokerRabbitMQ),
+		BROKER_MAX_RETRIES: utils.GetEnvInt("BROKER_MAX_RETRIES", 3),
+		BROKER_RETRY_DELAY: utils.GetEnvDuration("BROKER_RETRY_DELAY", time.Second),
+
+		BROKER_RECONNECT_DELAY:     utils.GetEnvDuration("BROKER_RECONNECT_DELAY", time.Second),
+		BROKER_RECONNECT_MAX_DELAY: utils.GetEnvDuration("BROKER_RECONNECT_MAX_DELAY", 30*time.Second),
+
+		HUBS:             hubConfig(),
+		MESSAGES:         messagesConfig(),
+		OUTBOX:           outboxConfig(),
+		SHUTDOWN_TIMEOUT: utils.GetEnvDuration("SHUTDOWN_TIMEOUT", 30*time.Second),
+
+		INSTANCE_ID: os.Getenv("INSTANCE_ID"),
 	}
 
 	service.Main()
 }
+
+// Builds the hub config from the envs, using the defaults for the missing ones.
+func hubConfig() models.HubConfig {
+	config := models.DefaultHubConfig()
+
+	config.IdleTimeout = utils.GetEnvDuration("HUB_IDLE_TIMEOUT", config.IdleTimeout)
+	config.SendQueueSize = utils.GetEnvInt("SEND_QUEUE_SIZE", config.SendQueueSize)
+	config.SlowClientPolicy = utils.GetEnvString("SLOW_CLIENT_POLICY", config.SlowClientPolicy)
+
+	return config
+}
+
+// Builds the message persistence config from the envs, using the defaults for the missing ones.
+func messagesConfig() persistence.Config {
+	config := persistence.DefaultConfig()
+
+	config.BatchSize = utils.GetEnvInt("MESSAGE_BATCH_SIZE", config.BatchSize)
+	config.FlushInterval = utils.GetEnvDuration("MESSAGE_FLUSH_INTERVAL", config.FlushInterval)
+	config.Durability = utils.GetEnvString("MESSAGE_DURABILITY", config.Durability)
+
+	return config
+}
+
+// Builds the outbox relay config from the envs, using the defaults for the missing ones.
+func outboxConfig() outbox.Config {
+	config := outbox.DefaultConfig()
+
+	config.PollInterval = utils.GetEnvDuration("OUTBOX_POLL_INTERVAL", config.PollInterval)
+	config.BatchSize = utils.GetEnvInt("OUTBOX_BATCH_SIZE", config.BatchSize)
+	config.ClaimLease = utils.GetEnvDuration("OUTBOX_CLAIM_LEASE", config.ClaimLease)
+	config.RetryDelay = utils.GetEnvDuration("OUTBOX_RETRY_DELAY", config.RetryDelay)
+	config.MaxRetryDelay = utils.GetEnvDuration("OUTBOX_MAX_RETRY_DELAY", config.MaxRetryDelay)
+	config.Retention = utils.GetEnvDuration("OUTBOX_RETENTION", config.Retention)
+
+	return config
+}
+
+// Builds the password hashing policy from the envs, using the defaults for the missing ones.
+func hashingPolicy() utils.HashingPolicy {
+	policy := utils.DefaultHashingPolicy()
+
+	algorithm := os.Getenv("PASSWORD_HASH_ALGORITHM")
+	if algorithm != "" {
+		policy.Algorithm = algorithm
+	}
+
+	policy.BcryptCost = utils.GetEnvInt("BCRYPT_COST", policy.BcryptCost)
+	policy.Argon2Memory = uint32(utils.GetEnvInt("ARGON2_MEMORY_KB", int(policy.Argon2Memory)))
+	policy.Argon2Iterations = uint32(utils.GetEnvInt("ARGON2_ITERATIONS", int(policy.Argon2Iterations)))
+	policy.Argon2Parallelism = uint8(utils.GetEnvInt("ARGON2_PARALLELISM", int(policy.Argon2Parallelism)))
+
+	return policy
+}
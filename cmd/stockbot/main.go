@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/joho/godotenv"
+	"github.com/raynine/go-chatroom/botsdk"
+	"github.com/raynine/go-chatroom/broker"
+	"github.com/raynine/go-chatroom/chatbot"
+	"github.com/raynine/go-chatroom/utils"
+)
+
+func init() {
+	environment := os.Getenv("ENVIRONMENT")
+	if environment != "" && environment == "prod" {
+		log.Println("Stock bot started in PROD environment")
+		return
+	}
+
+	log.Println("Stock bot started in DEV environment")
+	err := godotenv.Load()
+	if err != nil {
+		log.Fatal("Error loading .env file")
+	}
+}
+
+// Serves the /stock command as an external bot. Set DISABLED_COMMANDS=stock on the chatroom so the built-in
+// command does not take the name.
+func main() {
+	conn, err := broker.DialRabbitMQ(os.Getenv("RABBIT_MQ_URL"), broker.ReconnectPolicy{
+		Delay:    utils.GetEnvDuration("BROKER_RECONNECT_DELAY", time.Second),
+		MaxDelay: utils.GetEnvDuration("BROKER_RECONNECT_MAX_DELAY", 30*time.Second),
+	})
+	if err != nil {
+		log.Fatalf("An error ocurred while starting rabbit mq: %s\n", err.Error())
+	}
+	defer conn.Close()
+
+	bot := botsdk.New(
+		conn,
+		utils.GetEnvString("STOCKBOT_NAME", "stockbot"),
+		utils.GetEnvString("STOCKBOT_USER_NAME", "stockbot"),
+		os.Getenv("STOCKBOT_TOKEN"),
+	)
+
+	quotes := chatbot.NewStooqQuoteProvider(
+		utils.GetEnvList("QUOTE_ENDPOINTS"),
+		utils.GetEnvDuration("QUOTE_TIMEOUT", 5*time.Second),
+		utils.GetEnvDuration("QUOTE_CACHE_TTL", time.Minute),
+	)
+
+	err = bot.Handle(chatbot.NewStockCommand(quotes))
+	if err != nil {
+		log.Fatalf("An error ocurred while registering bot commands: %s\n", err.Error())
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	err = bot.Run(ctx)
+	if err != nil {
+		log.Fatalf("Stock bot stopped: %s\n", err.Error())
+	}
+
+	// Finishes the requests already taken before closing the connection.
+	drainCtx, cancel := context.WithTimeout(context.Background(), utils.GetEnvDuration("SHUTDOWN_TIMEOUT", 30*time.Second))
+	defer cancel()
+
+	err = conn.Drain(drainCtx)
+	if err != nil {
+		log.Printf("An error ocurred while draining the bot requests: %s", err.Error())
+	}
+}
@@ -0,0 +1,161 @@
+// Package fanout shares the hub broadcasts between the instances of the server, so the clients connected to any
+// instance receive the messages of their chatrooms.
+package fanout
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"sync"
+
+	"github.com/raynine/go-chatroom/broker"
+	"github.com/raynine/go-chatroom/models"
+)
+
+// Topic where every broadcast is published, with the chatroom ID as key.
+var Topic = broker.Topic{Name: "chatroom_broadcasts"}
+
+const (
+	// Amount of event IDs remembered to drop the repeated broadcasts.
+	seenEventsSize = 1024
+)
+
+// Broadcast published for the other instances.
+type envelope struct {
+	InstanceID string              `json:"instance_id"`
+	EventID    string              `json:"event_id"`
+	Message    *models.ChatMessage `json:"chat_message"`
+}
+
+// Hubs running in this instance, see models.HubManager.
+type Hubs interface {
+	// Sends the message to the hub of its chatroom, if there's one running.
+	Deliver(msg *models.ChatMessage) bool
+}
+
+// Delivers the broadcasts to the local hubs and publishes them for the other instances. Every instance has its own
+// subscription, bound to the chatrooms it has a hub for.
+type Fanout struct {
+	InstanceID string
+	broker     broker.Broker
+	sub        broker.Subscription
+	hubs       Hubs
+	seen       *recentIDs
+}
+
+// Subscribes the instance to the broadcasts topic.
+func New(b broker.Broker, instanceID string, hubs Hubs) (*Fanout, error) {
+	sub, err := b.Subscribe(Topic, instanceID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Fanout{
+		InstanceID: instanceID,
+		broker:     b,
+		sub:        sub,
+		hubs:       hubs,
+		seen:       newRecentIDs(seenEventsSize),
+	}, nil
+}
+
+// Starts receiving the broadcasts of the chatroom from the other instances. Called when the instance creates the
+// hub of the chatroom.
+func (f *Fanout) Subscribe(chatroomId string) error {
+	return f.sub.Bind(chatroomId)
+}
+
+// Stops receiving the broadcasts of the chatroom. Called when the hub of the chatroom stops.
+func (f *Fanout) Unsubscribe(chatroomId string) error {
+	return f.sub.Unbind(chatroomId)
+}
+
+// Delivers the message to the clients of the chatroom connected to this instance and publishes it for the others.
+func (f *Fanout) Broadcast(msg *models.ChatMessage) {
+	f.deliver(msg)
+
+	body, err := json.Marshal(&envelope{
+		InstanceID: f.InstanceID,
+		EventID:    newEventID(),
+		Message:    msg,
+	})
+	if err != nil {
+		log.Printf("An error ocurred while encoding broadcast: %s", err.Error())
+		return
+	}
+
+	err = f.broker.Broadcast(Topic, msg.ChatroomID, body)
+	if err != nil {
+		log.Printf("Error while publishing to %s: %s", Topic.Name, err.Error())
+	}
+}
+
+// Reads the broadcasts of the other instances and delivers them to the local hubs, until the broker is closed.
+func (f *Fanout) Run() {
+	f.sub.Receive(f.receive)
+}
+
+// Delivers the broadcast unless it was published by this instance, which delivered it already, or was received
+// before.
+func (f *Fanout) receive(body []byte) {
+	broadcast := &envelope{}
+
+	err := json.Unmarshal(body, broadcast)
+	if err != nil {
+		log.Println("Error parsing broadcast:", err.Error())
+		return
+	}
+
+	if broadcast.Message == nil {
+		return
+	}
+
+	if broadcast.InstanceID == f.InstanceID || f.seen.Seen(broadcast.EventID) {
+		return
+	}
+
+	f.deliver(broadcast.Message)
+}
+
+func (f *Fanout) deliver(msg *models.ChatMessage) {
+	f.hubs.Deliver(msg)
+}
+
+func newEventID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Remembers the last IDs seen, forgetting the oldest ones once the size is reached.
+type recentIDs struct {
+	mu    sync.Mutex
+	ids   map[string]bool
+	order []string
+	next  int
+}
+
+func newRecentIDs(size int) *recentIDs {
+	return &recentIDs{
+		ids:   make(map[string]bool, size),
+		order: make([]string, size),
+	}
+}
+
+// Reports if the ID was seen before, remembering it otherwise.
+func (r *recentIDs) Seen(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.ids[id] {
+		return true
+	}
+
+	delete(r.ids, r.order[r.next])
+	r.order[r.next] = id
+	r.ids[id] = true
+	r.next = (r.next + 1) % len(r.order)
+
+	return false
+}
@@ -0,0 +1,66 @@
+package fanout
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/raynine/go-chatroom/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecentIDs(t *testing.T) {
+	seen := newRecentIDs(2)
+
+	assert.False(t, seen.Seen("a"))
+	assert.False(t, seen.Seen("b"))
+	assert.True(t, seen.Seen("a"))
+
+	// c takes the place of a, the oldest one.
+	assert.False(t, seen.Seen("c"))
+	assert.False(t, seen.Seen("a"))
+	assert.True(t, seen.Seen("c"))
+}
+
+// Has a hub running for a single chatroom.
+type fakeHubs struct {
+	chatroomId string
+	delivered  []*models.ChatMessage
+}
+
+func (h *fakeHubs) Deliver(msg *models.ChatMessage) bool {
+	if msg.ChatroomID != h.chatroomId {
+		return false
+	}
+
+	h.delivered = append(h.delivered, msg)
+	return true
+}
+
+func TestReceive(t *testing.T) {
+	hubs := &fakeHubs{chatroomId: "room"}
+	fanout := &Fanout{
+		InstanceID: "api-1",
+		hubs:       hubs,
+		seen:       newRecentIDs(10),
+	}
+
+	broadcast := func(instanceId string, eventId string, chatroomId string) []byte {
+		body, _ := json.Marshal(&envelope{
+			InstanceID: instanceId,
+			EventID:    eventId,
+			Message:    &models.ChatMessage{ChatroomID: chatroomId, Message: eventId},
+		})
+		return body
+	}
+
+	fanout.receive(broadcast("api-2", "1", "room"))
+	fanout.receive(broadcast("api-2", "1", "room"))
+	fanout.receive(broadcast("api-1", "2", "room"))
+	fanout.receive(broadcast("api-2", "3", "other-room"))
+	fanout.receive(broadcast("api-3", "4", "room"))
+	fanout.receive([]byte("not json"))
+
+	assert.Len(t, hubs.delivered, 2)
+	assert.Equal(t, "1", hubs.delivered[0].Message)
+	assert.Equal(t, "4", hubs.delivered[1].Message)
+}
@@ -0,0 +1,6 @@
+package interfaces
+
+type AttachmentStore interface {
+	// Stores the file and returns the URL where clients can download it.
+	Save(contentType string, data []byte) (string, error)
+}
@@ -1,14 +1,97 @@
 package interfaces
 
-import "github.com/raynine/go-chatroom/models"
+import (
+	"time"
+
+	"github.com/raynine/go-chatroom/models"
+)
 
 type DBRepo interface {
+	Ping() error
 	GetChatroomByID(string) (*models.Chatroom, error)
 	FindUserByEmail(string) (*models.User, error)
 	GetUserByEmail(string) (*models.User, error)
+	GetUserByID(int) (*models.User, error)
+	GetUserByUsername(string) (*models.User, error)
+	UpdateUserProfile(*models.User) error
+	UpdateUserPassword(int, string) error
+	SetEmailVerified(int, bool) error
+	AddEmailVerification(int, string, time.Time) error
+	VerifyEmail(string) (int, error)
+	AddLoginLockout(*models.LoginLockout) (*int, error)
+	UnlockLoginLockouts(int, int) error
+	GetUserLoginLockouts(int) ([]*models.LoginLockout, error)
+	AddServiceAccount(string) (*int, error)
+	AddAPIToken(*models.APIToken) (*int, error)
+	GetAPITokenByHash(string) (*models.APIToken, error)
+	GetUserAPITokens(int) ([]*models.APIToken, error)
+	GetUserTokenHashes(int, string) ([]string, error)
+	TouchAPIToken(int) error
+	RevokeAPIToken(int) error
 	AddMessage(models.ChatMessage) (*int, error)
+	MessageRepo
+	OutboxRepo
 	AddUser(*models.User) (*int, error)
 	GetAllChatRooms() ([]*models.Chatroom, error)
 	GetChatroomMessages(string) ([]*models.ChatMessage, error)
 	AddChatroom(*models.Chatroom) (*string, error)
+	PriceAlertRepo
+	ScheduledMessageRepo
+	WebhookRepo
+	PollRepo
+	AddIncomingWebhook(*models.IncomingWebhook) (*int, error)
+	GetIncomingWebhookByHash(string) (*models.IncomingWebhook, error)
+	GetChatroomIncomingWebhooks(string) ([]*models.IncomingWebhook, error)
+	TouchIncomingWebhook(int) error
+	RevokeIncomingWebhook(int, string) error
+}
+
+// Subset of the repository used by the price alert commands and scheduler.
+type PriceAlertRepo interface {
+	AddPriceAlert(*models.PriceAlert, models.Announcement) (*int, error)
+	GetUserPriceAlerts(int, string) ([]*models.PriceAlert, error)
+	GetActivePriceAlerts() ([]*models.PriceAlert, error)
+	DeletePriceAlert(int, int, string, []*models.OutboxMessage) error
+	TriggerPriceAlert(int, []*models.OutboxMessage) (bool, error)
+}
+
+// Subset of the repository used by the reminders and the scheduled messages delivery.
+type ScheduledMessageRepo interface {
+	AddScheduledMessage(*models.ScheduledMessage, models.Announcement) (*int, error)
+	ClaimDueScheduledMessages(int, time.Duration) ([]*models.ScheduledMessage, error)
+	MarkScheduledMessageDelivered(int, []*models.OutboxMessage) error
+	ReleaseScheduledMessage(int) error
+}
+
+// Subset of the repository used to manage and deliver the chatroom webhooks.
+type WebhookRepo interface {
+	AddChatroomWebhook(*models.ChatroomWebhook) (*int, error)
+	GetChatroomWebhooks(string) ([]*models.ChatroomWebhook, error)
+	DeleteChatroomWebhook(int, string) error
+	AddWebhookDelivery(*models.WebhookDelivery) (*int, error)
+	UpdateWebhookDelivery(*models.WebhookDelivery) error
+	GetWebhookDeliveries(int, string, int) ([]*models.WebhookDelivery, error)
+}
+
+// Subset of the repository used to save the chat messages in batches, along with the outbox messages they cause.
+type MessageRepo interface {
+	ReserveMessageIds(int) ([]int, error)
+	AddMessages([]*models.ChatMessage, []*models.OutboxMessage) error
+}
+
+// Subset of the repository used to publish the outbox messages.
+type OutboxRepo interface {
+	AddOutboxMessages([]*models.OutboxMessage) error
+	ClaimOutboxMessages(int, time.Duration) ([]*models.OutboxMessage, error)
+	MarkOutboxMessagesSent([]int) error
+	RetryOutboxMessage(int, time.Time, string) error
+	DeleteSentOutboxMessages(time.Time) (int64, error)
+}
+
+// Subset of the repository used by the polls.
+type PollRepo interface {
+	AddPoll(*models.Poll, models.Announcement) (*int, error)
+	GetPoll(int, string) (*models.Poll, error)
+	VotePoll(int, string, int, []int) (*models.Poll, error)
+	ClosePoll(int, string, int, func(*models.Poll) *models.ChatMessage) (*models.ChatMessage, error)
 }
@@ -0,0 +1,5 @@
+package interfaces
+
+type Mailer interface {
+	Send(to, subject, body string) error
+}
@@ -3,24 +3,30 @@ package models
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"log"
-	"strings"
+	"slices"
 	"time"
 
-	amqp "github.com/rabbitmq/amqp091-go"
-
 	"github.com/gorilla/websocket"
 )
 
 // A client connected to a chatroom. It holds the hub(chatroom) to be able to broadcast to all the users.
 // Handles the reads and writes to the chatroom.
 type Client struct {
-	Id       int
-	UserName string
-	Hub      *Hub
-	Conn     *websocket.Conn
-	Send     chan *ChatMessage
-	Ch       *amqp.Channel
+	Id          int
+	UserName    string
+	IsBot       bool
+	Hub         *Hub
+	Conn        *websocket.Conn
+	Send        chan *ChatMessage
+	Writer      MessageWriter
+	Commands    CommandRouter
+	Listener    MessageListener
+	Broadcaster Broadcaster
+
+	// Receives the history of the chatroom once, see HubManager.Join.
+	history chan []*ChatMessage
 }
 
 const (
@@ -39,13 +45,42 @@ var (
 	space   = []byte{' '}
 )
 
+// Actions the clients send over the websocket instead of a chat message.
+const (
+	ActionPollVote  = "poll_vote"
+	ActionPollClose = "poll_close"
+)
+
+// Action sent over the websocket as a JSON object, e.g. {"ws_action": "poll_vote", "poll_id": 1, "poll_options": [0]}.
+type ClientAction struct {
+	Action  string `json:"ws_action"`
+	PollID  int    `json:"poll_id"`
+	Options []int  `json:"poll_options"`
+}
+
+// Parses the message as an action. Anything that is not a JSON object with a ws_action is a chat message.
+func parseClientAction(message []byte) (*ClientAction, bool) {
+	if len(message) == 0 || message[0] != '{' {
+		return nil, false
+	}
+
+	action := &ClientAction{}
+
+	err := json.Unmarshal(message, action)
+	if err != nil || action.Action == "" {
+		return nil, false
+	}
+
+	return action, true
+}
+
 // Reads the messages sent in the websocket connection. The message gets formatted to a models.ChatMessage struct,
 // gets validated to see if its a command. If it is, we dont save it in the DB, broadcast it to the chatroom
-// and send it to the chatbot to retrieve the stock information and sends it into the chatroom. If it isn't, we save it
+// and send it to the chatbot, which executes the command and sends the reply into the chatroom. If it isn't, we save it
 // in the DB and broadcast it.
 func (c *Client) ReadPump() {
 	defer func() {
-		c.Hub.Unregister <- c
+		c.Hub.Leave(c)
 		c.Conn.Close()
 	}()
 
@@ -67,40 +102,126 @@ func (c *Client) ReadPump() {
 		}
 
 		message = bytes.TrimSpace(bytes.Replace(message, newline, space, -1))
+
+		action, ok := parseClientAction(message)
+		if ok {
+			c.handleAction(action)
+			continue
+		}
+
 		userMessage := string(message)
 
 		chatMessage := &ChatMessage{
 			Message:    userMessage,
 			UserID:     c.Id,
+			UserName:   c.UserName,
 			ChatroomID: c.Hub.ChatroomId,
 			CreatedAt:  time.Now(),
+			IsBot:      c.IsBot,
 		}
 
-		isCommand := strings.HasPrefix(userMessage, "/stock=")
+		isCommand := c.Commands != nil && c.Commands.IsCommand(userMessage)
 
 		if !isCommand {
-			_, err = c.Hub.repo.AddMessage(*chatMessage)
+			err = c.save(chatMessage)
 			if err != nil {
 				log.Printf("An error ocurred while trying to save message from WS: %s\n", err.Error())
 				break
 			}
 		}
 
-		c.Hub.Broadcast <- chatMessage
+		c.Broadcaster.Broadcast(chatMessage)
 
 		log.Println("Received message:", chatMessage)
 
 		if isCommand {
 			body, _ := json.Marshal(&chatMessage)
-			err = c.Ch.Publish("", "stock_requests", false, false, amqp.Publishing{ContentType: "application/json", Body: body})
+			err = c.Writer.Publish(CommandRequestsQueue, body)
 			if err != nil {
-				log.Printf("Error while publishing to stock_requests: %s", err.Error())
+				log.Printf("Error while publishing to %s: %s", CommandRequestsQueue, err.Error())
+				c.notifyError(&CustomError{Message: "The command could not be sent, please try again"})
 			}
 		}
 	}
 }
 
-// Writes all the received messages to the websockets for visualization of the clients.
+// Saves the message and notifies the listener.
+func (c *Client) save(chatMessage *ChatMessage) error {
+	err := c.Writer.Save(chatMessage)
+	if err != nil {
+		return err
+	}
+
+	if c.Listener != nil {
+		c.Listener.MessagePosted(chatMessage)
+	}
+
+	return nil
+}
+
+// Runs the action sent by the client. Votes broadcast the current tally of the poll, closing a poll posts its final
+// results as the user who closed it, they are saved along with the poll. Errors are only sent to the client.
+func (c *Client) handleAction(action *ClientAction) {
+	switch action.Action {
+	case ActionPollVote:
+		poll, err := c.Hub.repo.VotePoll(action.PollID, c.Hub.ChatroomId, c.Id, action.Options)
+		if err != nil {
+			c.notifyError(err)
+			return
+		}
+
+		c.Broadcaster.Broadcast(poll.ChatMessage(MessageTypePollTally))
+	case ActionPollClose:
+		results, err := c.Hub.repo.ClosePoll(action.PollID, c.Hub.ChatroomId, c.Id, c.pollResults)
+		if err != nil {
+			c.notifyError(err)
+			return
+		}
+
+		if c.Listener != nil {
+			c.Listener.MessagePosted(results)
+		}
+
+		c.Broadcaster.Broadcast(results)
+	default:
+		c.notifyError(&CustomError{Message: fmt.Sprintf("Unknown action: %s", action.Action)})
+	}
+}
+
+// Message with the final votes of the poll, posted by the client.
+func (c *Client) pollResults(poll *Poll) *ChatMessage {
+	results := poll.ChatMessage(MessageTypePoll)
+	results.UserID = c.Id
+	results.UserName = c.UserName
+	results.IsBot = c.IsBot
+
+	return results
+}
+
+func (c *Client) notifyError(err error) {
+	c.Hub.Notify(c, &ChatMessage{
+		ChatroomID: c.Hub.ChatroomId,
+		Message:    err.Error(),
+		Type:       MessageTypeError,
+		CreatedAt:  time.Now(),
+	})
+}
+
+// Sends the close frame telling the peer the server is going away, then closes the connection, which stops the pumps.
+func (c *Client) closeGoingAway() {
+	msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server is shutting down")
+
+	err := c.Conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(writeWait))
+	if err != nil {
+		log.Printf("An error ocurred while closing the WS of %s: %s\n", c.UserName, err.Error())
+	}
+
+	c.Conn.Close()
+	close(c.Send)
+}
+
+// Writes all the received messages to the websockets for visualization of the clients. The history of the
+// chatroom goes first, the messages broadcasted meanwhile wait in Send and the ones already in the history are skipped.
 func (c *Client) WritePump() {
 	ticker := time.NewTicker(pingPeriod)
 	defer func() {
@@ -108,46 +229,47 @@ func (c *Client) WritePump() {
 		c.Conn.Close()
 	}()
 
+	inHistory := make(map[int]bool)
+	if c.history != nil {
+		history := <-c.history
+
+		for _, message := range history {
+			inHistory[message.Id] = true
+		}
+
+		if len(history) > 0 && !c.write(history) {
+			return
+		}
+	}
+
 	for {
 		select {
 		case message, ok := <-c.Send:
-			c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if !ok {
+				c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
 				c.Conn.WriteMessage(websocket.CloseMessage, []byte{})
 				return
 			}
 
-			w, err := c.Conn.NextWriter(websocket.TextMessage)
-			if err != nil {
-				log.Printf("An error ocurred while trying get WS next writer: %s\n", err.Error())
-				return
-			}
-
-			messageBytes, err := json.Marshal(message)
-			if err != nil {
-				log.Printf("An error ocurred while encoding user message: %s\n", err.Error())
-				return
-			}
-
-			w.Write(messageBytes)
-
-			n := len(c.Send)
-			for range n {
-				w.Write(newline)
-
-				nextMessage := <-c.Send
-				messageBytes, err := json.Marshal(nextMessage)
-				if err != nil {
-					log.Printf("An error ocurred while encoding user message: %s\n", err.Error())
-					return
+			// Send the pending messages in the same frame.
+			messages := []*ChatMessage{message}
+			for pending := true; pending; {
+				select {
+				case next, ok := <-c.Send:
+					if ok {
+						messages = append(messages, next)
+					}
+					pending = ok
+				default:
+					pending = false
 				}
-
-				w.Write(messageBytes)
 			}
 
-			err = w.Close()
-			if err != nil {
-				log.Printf("An error ocurred while trying to close WS Writer: %s\n", err.Error())
+			messages = slices.DeleteFunc(messages, func(message *ChatMessage) bool {
+				return message.Id != 0 && inHistory[message.Id]
+			})
+
+			if len(messages) > 0 && !c.write(messages) {
 				return
 			}
 		case <-ticker.C:
@@ -160,3 +282,36 @@ func (c *Client) WritePump() {
 		}
 	}
 }
+
+// Writes the messages in a single frame, separated by new lines. Returns false if the connection failed.
+func (c *Client) write(messages []*ChatMessage) bool {
+	c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+
+	w, err := c.Conn.NextWriter(websocket.TextMessage)
+	if err != nil {
+		log.Printf("An error ocurred while trying get WS next writer: %s\n", err.Error())
+		return false
+	}
+
+	for i, message := range messages {
+		messageBytes, err := json.Marshal(message)
+		if err != nil {
+			log.Printf("An error ocurred while encoding user message: %s\n", err.Error())
+			return false
+		}
+
+		if i > 0 {
+			w.Write(newline)
+		}
+
+		w.Write(messageBytes)
+	}
+
+	err = w.Close()
+	if err != nil {
+		log.Printf("An error ocurred while trying to close WS Writer: %s\n", err.Error())
+		return false
+	}
+
+	return true
+}
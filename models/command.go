@@ -0,0 +1,116 @@
+package models
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"github.com/raynine/go-chatroom/broker"
+)
+
+// Queues used between the chatroom and the chatbot.
+const (
+	CommandRequestsQueue  = "command_requests"
+	ChatroomMessagesQueue = "chatroom_messages"
+	// External bots publish their BotReply here, the chatbot posts them in the chatroom as the bot user.
+	BotRepliesQueue = "bot_replies"
+)
+
+// Fanout topic where the external bots broadcast their BotRegistration, so every instance of the chatroom gets it.
+var BotRegistrationsTopic = broker.Topic{Name: "bot_registrations", Fanout: true}
+
+// External bots publish their registration again every BotRegistrationInterval. The commands of a bot that misses
+// the registrations for BotRegistrationTTL are removed.
+const (
+	BotRegistrationInterval = 30 * time.Second
+	BotRegistrationTTL      = 3 * BotRegistrationInterval
+)
+
+// Queue where the chatbot routes the BotRequest of the commands registered by the external bot.
+func BotRequestsQueue(botName string) string {
+	return "bot_requests." + botName
+}
+
+// Decides which chat messages are bot commands. Commands are not saved in the DB, they get sent to the chatbot instead.
+type CommandRouter interface {
+	IsCommand(message string) bool
+}
+
+// Publishes messages to the broker through the outbox table, so they are not lost while the broker is down.
+type Outbox interface {
+	Publish(queue string, body []byte) error
+}
+
+// Saves the messages posted by the clients, setting their ID and creation time. The messages published through it
+// are saved in the outbox along with the messages posted before them.
+type MessageWriter interface {
+	Save(msg *ChatMessage) error
+	Outbox
+}
+
+// Gets notified of every message saved in a chatroom, e.g. to forward it to the chatroom webhooks.
+type MessageListener interface {
+	MessagePosted(msg *ChatMessage)
+}
+
+// Commands handled by an external bot. UserName is the service account the bot posts as. Every broker client can read
+// the registrations, so instead of an API token of the account they carry a signature made with the hash of one that
+// has the ScopeBotsRegister scope.
+type BotRegistration struct {
+	BotName  string `json:"bot_name"`
+	UserName string `json:"bot_user_name"`
+	// Unix time of the signature. Registrations signed more than BotRegistrationTTL away from now are ignored.
+	SignedAt  int64        `json:"bot_signed_at"`
+	Signature string       `json:"bot_signature"`
+	Commands  []BotCommand `json:"bot_commands"`
+}
+
+// Signs the registration with the hash of the API token, see utils.HashToken.
+func (r *BotRegistration) Sign(tokenHash string, signedAt time.Time) {
+	r.SignedAt = signedAt.Unix()
+	r.Signature = r.signature(tokenHash)
+}
+
+// Checks the registration was signed with the hash of the API token.
+func (r *BotRegistration) Verify(tokenHash string) bool {
+	return hmac.Equal([]byte(r.Signature), []byte(r.signature(tokenHash)))
+}
+
+// HMAC-SHA256 of the JSON of the registration without its signature.
+func (r *BotRegistration) signature(key string) string {
+	unsigned := *r
+	unsigned.Signature = ""
+
+	body, _ := json.Marshal(unsigned)
+
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+type BotCommand struct {
+	Name        string `json:"bot_command_name"`
+	Usage       string `json:"bot_command_usage"`
+	Description string `json:"bot_command_description"`
+}
+
+// Command invoked in a chatroom, routed to the queue of the bot that registered it. The invocation binds the request
+// to the bot and the chatroom, the bot sends it back with its reply.
+type BotRequest struct {
+	Command    string       `json:"bot_request_command"`
+	Args       string       `json:"bot_request_args"`
+	Invocation string       `json:"bot_request_invocation"`
+	Message    *ChatMessage `json:"chat_message"`
+}
+
+// Reply of an external bot. Only the text, type and payload of the message are used, the chatbot fills in the
+// bot user. Replies are only posted in the chatroom of the invocation of the request.
+type BotReply struct {
+	BotName    string       `json:"bot_name"`
+	ChatroomID string       `json:"bot_reply_chatroom_id"`
+	Invocation string       `json:"bot_reply_invocation"`
+	Message    *ChatMessage `json:"chat_message"`
+}
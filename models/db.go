@@ -1,19 +1,209 @@
 package models
 
 import (
+	"encoding/json"
+	"fmt"
 	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
 type User struct {
-	Id       int    `json:"user_id,omitempty"`
-	Username string `json:"user_user_name,omitempty"`
-	Email    string `json:"user_email,omitempty"`
-	Password string `json:"user_password,omitempty"`
+	Id            int    `json:"user_id,omitempty"`
+	Username      string `json:"user_user_name,omitempty"`
+	Email         string `json:"user_email,omitempty"`
+	Password      string `json:"user_password,omitempty"`
+	EmailVerified bool   `json:"user_email_verified"`
+	IsAdmin       bool   `json:"user_is_admin,omitempty"`
+
+	IsServiceAccount bool `json:"user_is_service_account,omitempty"`
+
+	DisplayName string `json:"user_display_name,omitempty"`
+	AvatarURL   string `json:"user_avatar_url,omitempty"`
+	StatusText  string `json:"user_status_text,omitempty"`
+	TimeZone    string `json:"user_time_zone,omitempty"`
+}
+
+// Returns a copy of the user without the private fields, to be shown to other users.
+func (u *User) PublicProfile() *User {
+	return &User{
+		Id:               u.Id,
+		Username:         u.Username,
+		IsServiceAccount: u.IsServiceAccount,
+		DisplayName:      u.DisplayName,
+		AvatarURL:        u.AvatarURL,
+		StatusText:       u.StatusText,
+		TimeZone:         u.TimeZone,
+	}
+}
+
+const (
+	maxUsernameLength    = 50
+	maxDisplayNameLength = 50
+	maxAvatarURLLength   = 500
+	maxStatusTextLength  = 140
+)
+
+// Fields a user can change in their own profile. Empty fields are left as they are.
+type UserProfileUpdate struct {
+	Username    *string `json:"user_user_name,omitempty"`
+	DisplayName *string `json:"user_display_name,omitempty"`
+	AvatarURL   *string `json:"user_avatar_url,omitempty"`
+	StatusText  *string `json:"user_status_text,omitempty"`
+	TimeZone    *string `json:"user_time_zone,omitempty"`
+}
+
+// Validates the provided profile fields. The avatar must be an http(s) URL and the time zone an IANA name.
+func (p *UserProfileUpdate) Validate() error {
+	appContext := "UserProfileUpdate.Validate"
+
+	if p.Username != nil {
+		username := strings.TrimSpace(*p.Username)
+		if username == "" || utf8.RuneCountInString(username) > maxUsernameLength {
+			return &CustomError{
+				Code:       http.StatusBadRequest,
+				Message:    fmt.Sprintf("Username must have between 1 and %d characters", maxUsernameLength),
+				AppContext: appContext,
+			}
+		}
+	}
+
+	if p.DisplayName != nil && utf8.RuneCountInString(*p.DisplayName) > maxDisplayNameLength {
+		return &CustomError{
+			Code:       http.StatusBadRequest,
+			Message:    fmt.Sprintf("Display name can not have more than %d characters", maxDisplayNameLength),
+			AppContext: appContext,
+		}
+	}
+
+	if p.AvatarURL != nil && *p.AvatarURL != "" {
+		avatarURL, err := url.Parse(*p.AvatarURL)
+		isHTTP := err == nil && (avatarURL.Scheme == "http" || avatarURL.Scheme == "https") && avatarURL.Host != ""
+		if !isHTTP || len(*p.AvatarURL) > maxAvatarURLLength {
+			return &CustomError{
+				Code:       http.StatusBadRequest,
+				Message:    "Invalid avatar URL",
+				AppContext: appContext,
+			}
+		}
+	}
+
+	if p.StatusText != nil && utf8.RuneCountInString(*p.StatusText) > maxStatusTextLength {
+		return &CustomError{
+			Code:       http.StatusBadRequest,
+			Message:    fmt.Sprintf("Status text can not have more than %d characters", maxStatusTextLength),
+			AppContext: appContext,
+		}
+	}
+
+	if p.TimeZone != nil && *p.TimeZone != "" {
+		_, err := time.LoadLocation(*p.TimeZone)
+		if err != nil {
+			return &CustomError{
+				Code:       http.StatusBadRequest,
+				Message:    fmt.Sprintf("Invalid time zone: %s", *p.TimeZone),
+				AppContext: appContext,
+			}
+		}
+	}
+
+	return nil
+}
+
+// Copies the provided fields into the user.
+func (p *UserProfileUpdate) Apply(user *User) {
+	if p.Username != nil {
+		user.Username = strings.TrimSpace(*p.Username)
+	}
+
+	if p.DisplayName != nil {
+		user.DisplayName = *p.DisplayName
+	}
+
+	if p.AvatarURL != nil {
+		user.AvatarURL = *p.AvatarURL
+	}
+
+	if p.StatusText != nil {
+		user.StatusText = *p.StatusText
+	}
+
+	if p.TimeZone != nil {
+		user.TimeZone = *p.TimeZone
+	}
+}
+
+// Payload to change the password. The current password is required to re-authenticate the user.
+type PasswordChange struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+func (p *PasswordChange) Validate() error {
+	appContext := "PasswordChange.Validate"
+	if p.CurrentPassword == "" {
+		return &CustomError{
+			Code:       http.StatusBadRequest,
+			Message:    "Current password is required",
+			AppContext: appContext,
+		}
+	}
+
+	if p.NewPassword == "" {
+		return &CustomError{
+			Code:       http.StatusBadRequest,
+			Message:    "Invalid password",
+			AppContext: appContext,
+		}
+	}
+
+	if p.NewPassword == p.CurrentPassword {
+		return &CustomError{
+			Code:       http.StatusBadRequest,
+			Message:    "New password must be different from the current password",
+			AppContext: appContext,
+		}
+	}
+
+	return nil
+}
+
+const (
+	minPasswordLength = 8
+	maxPasswordLength = 128
+)
+
+// Passwords rejected even if they follow the rest of the rules.
+var commonPasswords = []string{
+	"password1", "password123", "passw0rd", "12345678a", "qwerty123", "abc12345", "letmein1", "welcome1", "iloveyou1",
 }
 
-// Validates if the user email, username or password is valid. Will only validate the username if the user is registering.
+// Validates if the user email, username or password is valid. Will only validate the username and the
+// password strength if the user is registering.
 func (u *User) Validate(isLogin bool) error {
+	err := u.validateRequiredFields(isLogin)
+	if err != nil {
+		return err
+	}
+
+	if !isLogin {
+		return u.ValidatePassword(u.Password)
+	}
+
+	return nil
+}
+
+// Validates the required fields only. Used when the password is already hashed.
+func (u *User) ValidateRequiredFields() error {
+	return u.validateRequiredFields(false)
+}
+
+func (u *User) validateRequiredFields(isLogin bool) error {
 	appContext := "User.Validate"
 	if u.Email == "" {
 		return &CustomError{
@@ -44,9 +234,153 @@ func (u *User) Validate(isLogin bool) error {
 	return nil
 }
 
+// Validates the username of a service account, it is also used as the local part of its email.
+func (u *User) ValidateServiceAccount() error {
+	if !integrationNamePattern.MatchString(u.Username) {
+		return &CustomError{
+			Code:       http.StatusBadRequest,
+			Message:    "Invalid username, it must have between 1 and 50 letters, numbers, dots, dashes or underscores",
+			AppContext: "User.ValidateServiceAccount",
+		}
+	}
+
+	return nil
+}
+
+// Validates the strength of a plain text password for this user. The password must have between 8 and 128
+// characters, contain letters and numbers, and not contain the username or the email.
+func (u *User) ValidatePassword(password string) error {
+	appContext := "User.ValidatePassword"
+
+	length := utf8.RuneCountInString(password)
+	if length < minPasswordLength || length > maxPasswordLength {
+		return &CustomError{
+			Code:       http.StatusBadRequest,
+			Message:    fmt.Sprintf("Password must have between %d and %d characters", minPasswordLength, maxPasswordLength),
+			AppContext: appContext,
+		}
+	}
+
+	hasLetter := strings.IndexFunc(password, unicode.IsLetter) >= 0
+	hasNumber := strings.IndexFunc(password, unicode.IsDigit) >= 0
+	if !hasLetter || !hasNumber {
+		return &CustomError{
+			Code:       http.StatusBadRequest,
+			Message:    "Password must contain at least one letter and one number",
+			AppContext: appContext,
+		}
+	}
+
+	lowerPassword := strings.ToLower(password)
+
+	emailName, _, _ := strings.Cut(strings.ToLower(u.Email), "@")
+	for _, personal := range []string{strings.ToLower(u.Username), emailName} {
+		if len(personal) >= 3 && strings.Contains(lowerPassword, personal) {
+			return &CustomError{
+				Code:       http.StatusBadRequest,
+				Message:    "Password must not contain the username or email",
+				AppContext: appContext,
+			}
+		}
+	}
+
+	if slices.Contains(commonPasswords, lowerPassword) {
+		return &CustomError{
+			Code:       http.StatusBadRequest,
+			Message:    "Password is too common",
+			AppContext: appContext,
+		}
+	}
+
+	return nil
+}
+
+const (
+	LockoutReasonAccount = "account"
+	LockoutReasonIP      = "ip"
+)
+
+// Record of an account or IP address being locked after too many failed logins.
+type LoginLockout struct {
+	Id          int        `json:"login_lockout_id,omitempty"`
+	UserID      *int       `json:"login_lockout_user_id,omitempty"`
+	Email       string     `json:"login_lockout_email,omitempty"`
+	IPAddress   string     `json:"login_lockout_ip_address,omitempty"`
+	Reason      string     `json:"login_lockout_reason,omitempty"`
+	LockedUntil time.Time  `json:"login_lockout_locked_until"`
+	CreatedAt   time.Time  `json:"login_lockout_created_at"`
+	UnlockedAt  *time.Time `json:"login_lockout_unlocked_at,omitempty"`
+	UnlockedBy  *int       `json:"login_lockout_unlocked_by,omitempty"`
+}
+
+// Scopes that can be granted to API tokens. Users logged in with a JWT are not limited by scopes.
+const (
+	ScopeChatroomsRead    = "chatrooms:read"
+	ScopeChatroomsWrite   = "chatrooms:write"
+	ScopeChatroomsConnect = "chatrooms:connect"
+	ScopeUsersRead        = "users:read"
+	ScopeUsersWrite       = "users:write"
+	// Lets an external bot register its commands and post as the service account.
+	ScopeBotsRegister = "bots:register"
+)
+
+var APITokenScopes = []string{ScopeChatroomsRead, ScopeChatroomsWrite, ScopeChatroomsConnect, ScopeUsersRead, ScopeUsersWrite, ScopeBotsRegister}
+
+// Token used by service accounts to authenticate. Only the hash of the token is stored.
+type APIToken struct {
+	Id         int        `json:"api_token_id,omitempty"`
+	UserID     int        `json:"api_token_user_id,omitempty"`
+	UserName   string     `json:"api_token_user_name,omitempty"`
+	Name       string     `json:"api_token_name,omitempty"`
+	TokenHash  string     `json:"-"`
+	Scopes     []string   `json:"api_token_scopes"`
+	CreatedAt  time.Time  `json:"api_token_created_at"`
+	LastUsedAt *time.Time `json:"api_token_last_used_at,omitempty"`
+	RevokedAt  *time.Time `json:"api_token_revoked_at,omitempty"`
+}
+
+// Validates the token name and that every scope is a known one.
+func (t *APIToken) Validate() error {
+	appContext := "APIToken.Validate"
+	if t.Name == "" {
+		return &CustomError{
+			Code:       http.StatusBadRequest,
+			Message:    "Invalid token name",
+			AppContext: appContext,
+		}
+	}
+
+	if len(t.Scopes) == 0 {
+		return &CustomError{
+			Code:       http.StatusBadRequest,
+			Message:    "At least one scope is required",
+			AppContext: appContext,
+		}
+	}
+
+	for _, scope := range t.Scopes {
+		if !slices.Contains(APITokenScopes, scope) {
+			return &CustomError{
+				Code:       http.StatusBadRequest,
+				Message:    fmt.Sprintf("Invalid scope: %s", scope),
+				AppContext: appContext,
+			}
+		}
+	}
+
+	return nil
+}
+
 type Chatroom struct {
-	Id   string `json:"chatroom_id,omitempty"`
-	Name string `json:"chatroom_name,omitempty"`
+	Id      string `json:"chatroom_id,omitempty"`
+	Name    string `json:"chatroom_name,omitempty"`
+	OwnerID *int   `json:"chatroom_owner_id,omitempty"`
+}
+
+// Checks if the user can manage the chatroom settings, such as its webhooks. Chatrooms without owner can only be
+// managed by admins.
+func (cr *Chatroom) CanManage(userId int, isAdmin bool) bool {
+	return isAdmin || (cr.OwnerID != nil && *cr.OwnerID == userId)
 }
 
 // Validates if the chatroom name is valid
@@ -68,6 +402,374 @@ type ChatMessage struct {
 	Message    string    `json:"chat_message_message,omitempty"`
 	CreatedAt  time.Time `json:"chat_message_created_at,omitempty"`
 	UserName   string    `json:"chat_message_users_user_name,omitempty"`
+	IsBot      bool      `json:"chat_message_is_bot,omitempty"`
+	// Tells clients how to render the payload. Plain text messages have no payload.
+	Type    string          `json:"chat_message_type,omitempty"`
+	Payload json.RawMessage `json:"chat_message_payload,omitempty"`
+	// Webhook whose response generated the message. It's not stored, webhooks don't receive these messages so two
+	// webhooks can't reply to each other forever.
+	WebhookID int `json:"chat_message_webhook_id,omitempty"`
+}
+
+// Max size of the payloads of the messages posted by integrations, such as webhooks and external bots.
+const MaxIntegrationPayloadSize = 16 << 10
+
+// Checks the type and payload of a message posted by an integration. Integrations can only post text and quotes, the
+// other types are posted by the chatroom itself.
+func (m *ChatMessage) ValidateIntegration() error {
+	appContext := "ChatMessage.ValidateIntegration"
+
+	if m.Type != "" && m.Type != MessageTypeText && m.Type != MessageTypeQuotes {
+		return &CustomError{
+			Code:       http.StatusBadRequest,
+			Message:    fmt.Sprintf("Invalid message type, it must be %s or %s", MessageTypeText, MessageTypeQuotes),
+			AppContext: appContext,
+		}
+	}
+
+	if len(m.Payload) > MaxIntegrationPayloadSize {
+		return &CustomError{
+			Code:       http.StatusBadRequest,
+			Message:    fmt.Sprintf("Message payload can't be larger than %d bytes", MaxIntegrationPayloadSize),
+			AppContext: appContext,
+		}
+	}
+
+	return nil
+}
+
+// Operators of the price alerts.
+const (
+	AlertAbove        = ">"
+	AlertAboveOrEqual = ">="
+	AlertBelow        = "<"
+	AlertBelowOrEqual = "<="
+)
+
+// Alert of a user that gets announced in the chatroom once the price of the stock crosses the target.
+type PriceAlert struct {
+	Id          int        `json:"price_alert_id"`
+	UserID      int        `json:"price_alert_user_id"`
+	ChatroomID  string     `json:"price_alert_chatroom_id"`
+	Symbol      string     `json:"price_alert_symbol"`
+	Operator    string     `json:"price_alert_operator"`
+	Target      float64    `json:"price_alert_target"`
+	CreatedAt   time.Time  `json:"price_alert_created_at"`
+	TriggeredAt *time.Time `json:"price_alert_triggered_at,omitempty"`
+	UserName    string     `json:"price_alert_users_user_name,omitempty"`
+}
+
+// Checks if the price satisfies the condition of the alert.
+func (a *PriceAlert) Matches(price float64) bool {
+	switch a.Operator {
+	case AlertAbove:
+		return price > a.Target
+	case AlertAboveOrEqual:
+		return price >= a.Target
+	case AlertBelow:
+		return price < a.Target
+	case AlertBelowOrEqual:
+		return price <= a.Target
+	default:
+		return false
+	}
+}
+
+// Kinds of scheduled messages. Messages are posted as the user who scheduled them, reminders are posted by the bot
+// mentioning the user.
+const (
+	ScheduledMessageKindMessage  = "message"
+	ScheduledMessageKindReminder = "reminder"
+)
+
+// Message waiting in the outbox table to be published to the broker. It's written in the same transaction as the
+// changes that caused it, so it's published even if the broker is down at the time.
+type OutboxMessage struct {
+	Id        int       `json:"outbox_id"`
+	Queue     string    `json:"outbox_queue"`
+	Body      []byte    `json:"outbox_body"`
+	Attempts  int       `json:"outbox_attempts"`
+	CreatedAt time.Time `json:"outbox_created_at"`
+}
+
+// Builds the outbox messages announcing a new row from its ID. They are saved in the transaction of the row, so they
+// are published if and only if the row is saved.
+type Announcement func(id int) ([]*OutboxMessage, error)
+
+// How far in the future a message can be scheduled.
+const MaxScheduleAhead = 365 * 24 * time.Hour
+
+type ScheduledMessage struct {
+	Id          int        `json:"scheduled_message_id"`
+	UserID      int        `json:"scheduled_message_user_id"`
+	ChatroomID  string     `json:"scheduled_message_chatroom_id"`
+	Kind        string     `json:"scheduled_message_kind"`
+	Message     string     `json:"scheduled_message_message"`
+	DeliverAt   time.Time  `json:"scheduled_message_deliver_at"`
+	CreatedAt   time.Time  `json:"scheduled_message_created_at"`
+	DeliveredAt *time.Time `json:"scheduled_message_delivered_at,omitempty"`
+	UserName    string     `json:"scheduled_message_users_user_name,omitempty"`
+}
+
+// Validates the message has content and is delivered in the future, but not after MaxScheduleAhead.
+func (m *ScheduledMessage) Validate(now time.Time) error {
+	if strings.TrimSpace(m.Message) == "" {
+		return &CustomError{
+			Message: "Scheduled message can't be empty",
+			Code:    http.StatusBadRequest,
+		}
+	}
+
+	if !m.DeliverAt.After(now) {
+		return &CustomError{
+			Message: "Scheduled message must be delivered in the future",
+			Code:    http.StatusBadRequest,
+		}
+	}
+
+	if m.DeliverAt.After(now.Add(MaxScheduleAhead)) {
+		return &CustomError{
+			Message: "Scheduled message can't be delivered more than a year from now",
+			Code:    http.StatusBadRequest,
+		}
+	}
+
+	return nil
+}
+
+// Statuses of the webhook deliveries.
+const (
+	WebhookDeliveryPending   = "pending"
+	WebhookDeliverySucceeded = "succeeded"
+	WebhookDeliveryFailed    = "failed"
+)
+
+var triggerWordPattern = regexp.MustCompile(`^\S{1,50}$`)
+
+// HTTP endpoint that receives the messages posted in a chatroom. When a trigger word is set, only the messages
+// starting with it are sent.
+type ChatroomWebhook struct {
+	Id          int       `json:"chatroom_webhook_id"`
+	ChatroomID  string    `json:"chatroom_webhook_chatroom_id"`
+	CreatedBy   int       `json:"chatroom_webhook_created_by"`
+	URL         string    `json:"chatroom_webhook_url"`
+	Secret      string    `json:"-"`
+	TriggerWord string    `json:"chatroom_webhook_trigger_word,omitempty"`
+	CreatedAt   time.Time `json:"chatroom_webhook_created_at"`
+}
+
+// Validates the URL is an absolute http(s) URL and the trigger word is a single word.
+func (w *ChatroomWebhook) Validate() error {
+	appContext := "ChatroomWebhook.Validate"
+
+	parsed, err := url.Parse(w.URL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" || len(w.URL) > 500 {
+		return &CustomError{
+			Code:       http.StatusBadRequest,
+			Message:    "Invalid webhook URL",
+			AppContext: appContext,
+		}
+	}
+
+	if w.TriggerWord != "" && !triggerWordPattern.MatchString(w.TriggerWord) {
+		return &CustomError{
+			Code:       http.StatusBadRequest,
+			Message:    "Invalid trigger word, it must be a single word of up to 50 characters",
+			AppContext: appContext,
+		}
+	}
+
+	return nil
+}
+
+// Checks if the message has to be sent to the webhook.
+func (w *ChatroomWebhook) Matches(message string) bool {
+	if w.TriggerWord == "" {
+		return true
+	}
+
+	word, _, _ := strings.Cut(strings.TrimSpace(message), " ")
+	return strings.EqualFold(word, w.TriggerWord)
+}
+
+// Record of a message sent to a webhook.
+type WebhookDelivery struct {
+	Id             int       `json:"webhook_delivery_id"`
+	WebhookID      int       `json:"webhook_delivery_webhook_id"`
+	MessageID      int       `json:"webhook_delivery_message_id,omitempty"`
+	Status         string    `json:"webhook_delivery_status"`
+	Attempts       int       `json:"webhook_delivery_attempts"`
+	ResponseStatus *int      `json:"webhook_delivery_response_status,omitempty"`
+	Error          string    `json:"webhook_delivery_error,omitempty"`
+	CreatedAt      time.Time `json:"webhook_delivery_created_at"`
+	UpdatedAt      time.Time `json:"webhook_delivery_updated_at"`
+}
+
+var integrationNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,50}$`)
+
+// Max length of the messages posted through the incoming webhooks.
+const MaxIncomingMessageLength = 4000
+
+// Token that lets an integration post into a chatroom. Each webhook posts as its own service account, named after
+// the integration. Only the hash of the token is stored.
+type IncomingWebhook struct {
+	Id         int        `json:"incoming_webhook_id"`
+	ChatroomID string     `json:"incoming_webhook_chatroom_id"`
+	UserID     int        `json:"incoming_webhook_user_id"`
+	UserName   string     `json:"incoming_webhook_user_name"`
+	CreatedBy  int        `json:"incoming_webhook_created_by"`
+	TokenHash  string     `json:"-"`
+	CreatedAt  time.Time  `json:"incoming_webhook_created_at"`
+	LastUsedAt *time.Time `json:"incoming_webhook_last_used_at,omitempty"`
+	RevokedAt  *time.Time `json:"incoming_webhook_revoked_at,omitempty"`
+}
+
+// Validates the name of the integration, which becomes the username of its service account.
+func (w *IncomingWebhook) Validate() error {
+	if !integrationNamePattern.MatchString(w.UserName) {
+		return &CustomError{
+			Code:       http.StatusBadRequest,
+			Message:    "Invalid integration name, it must have between 1 and 50 letters, numbers, dots, dashes or underscores",
+			AppContext: "IncomingWebhook.Validate",
+		}
+	}
+
+	return nil
+}
+
+// Limits of the polls.
+const (
+	MaxPollQuestionLength = 300
+	MaxPollOptionLength   = 100
+	MinPollOptions        = 2
+	MaxPollOptions        = 10
+)
+
+// Poll created with the /poll command. Votes has the number of votes of each option, in the same order as the options,
+// and Voters the number of users that voted.
+type Poll struct {
+	Id             int        `json:"poll_id"`
+	ChatroomID     string     `json:"poll_chatroom_id"`
+	CreatedBy      int        `json:"poll_created_by"`
+	Question       string     `json:"poll_question"`
+	Options        []string   `json:"poll_options"`
+	MultipleChoice bool       `json:"poll_multiple_choice"`
+	CreatedAt      time.Time  `json:"poll_created_at"`
+	ClosedAt       *time.Time `json:"poll_closed_at"`
+	Votes          []int      `json:"poll_votes"`
+	Voters         int        `json:"poll_voters"`
+}
+
+func (p *Poll) Validate() error {
+	question := strings.TrimSpace(p.Question)
+	if question == "" || utf8.RuneCountInString(question) > MaxPollQuestionLength {
+		return &CustomError{
+			Message: fmt.Sprintf("Poll question must have between 1 and %d characters", MaxPollQuestionLength),
+			Code:    http.StatusBadRequest,
+		}
+	}
+
+	if len(p.Options) < MinPollOptions || len(p.Options) > MaxPollOptions {
+		return &CustomError{
+			Message: fmt.Sprintf("Poll must have between %d and %d options", MinPollOptions, MaxPollOptions),
+			Code:    http.StatusBadRequest,
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, option := range p.Options {
+		option = strings.TrimSpace(option)
+		if option == "" || utf8.RuneCountInString(option) > MaxPollOptionLength {
+			return &CustomError{
+				Message: fmt.Sprintf("Poll options must have between 1 and %d characters", MaxPollOptionLength),
+				Code:    http.StatusBadRequest,
+			}
+		}
+
+		if seen[strings.ToLower(option)] {
+			return &CustomError{
+				Message: fmt.Sprintf("Poll option %q is repeated", option),
+				Code:    http.StatusBadRequest,
+			}
+		}
+		seen[strings.ToLower(option)] = true
+	}
+
+	return nil
+}
+
+// Validates the options chosen by a user, as indexes of the poll options. Single choice polls take exactly one option.
+func (p *Poll) ValidateVote(options []int) error {
+	if p.ClosedAt != nil {
+		return &CustomError{
+			Message: fmt.Sprintf("Poll %d is closed", p.Id),
+			Code:    http.StatusConflict,
+		}
+	}
+
+	if len(options) == 0 || (!p.MultipleChoice && len(options) > 1) {
+		message := "Choose at least one option"
+		if !p.MultipleChoice {
+			message = "Choose one option"
+		}
+
+		return &CustomError{
+			Message: message,
+			Code:    http.StatusBadRequest,
+		}
+	}
+
+	seen := make(map[int]bool)
+	for _, option := range options {
+		if option < 0 || option >= len(p.Options) {
+			return &CustomError{
+				Message: fmt.Sprintf("Invalid option %d", option),
+				Code:    http.StatusBadRequest,
+			}
+		}
+
+		if seen[option] {
+			return &CustomError{
+				Message: fmt.Sprintf("Option %d is repeated", option),
+				Code:    http.StatusBadRequest,
+			}
+		}
+		seen[option] = true
+	}
+
+	return nil
+}
+
+// Text version of the poll, for clients that don't render the poll payload.
+func (p *Poll) Summary() string {
+	lines := []string{fmt.Sprintf("Poll #%d: %s", p.Id, p.Question)}
+	if p.ClosedAt != nil {
+		lines[0] = fmt.Sprintf("Poll #%d closed: %s", p.Id, p.Question)
+	}
+
+	for i, option := range p.Options {
+		votes := 0
+		if i < len(p.Votes) {
+			votes = p.Votes[i]
+		}
+
+		lines = append(lines, fmt.Sprintf("%d. %s (%d)", i, option, votes))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// Chat message showing the poll with its current votes.
+func (p *Poll) ChatMessage(messageType string) *ChatMessage {
+	payload, _ := json.Marshal(p)
+
+	return &ChatMessage{
+		ChatroomID: p.ChatroomID,
+		Message:    p.Summary(),
+		Type:       messageType,
+		Payload:    payload,
+		CreatedAt:  time.Now(),
+	}
 }
 
 // Repository created in the models/db.go to avoid circular dependency between the models and repo packages
@@ -79,4 +781,6 @@ type ChatRepository interface {
 	AddUser(*User) (*int, error)
 	GetAllChatRooms() ([]*Chatroom, error)
 	GetChatroomMessages(string) ([]*ChatMessage, error)
+	VotePoll(pollId int, chatroomId string, userId int, options []int) (*Poll, error)
+	ClosePoll(pollId int, chatroomId string, userId int, results func(*Poll) *ChatMessage) (*ChatMessage, error)
 }
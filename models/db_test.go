@@ -0,0 +1,152 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUserValidatePassword(t *testing.T) {
+	user := &User{
+		Username: "Raytest",
+		Email:    "ray.dev@example.com",
+	}
+
+	cases := []struct {
+		name     string
+		password string
+		message  string
+	}{
+		{"Too short", "abc123", "Password must have between 8 and 128 characters"},
+		{"Only letters", "abcdefghij", "Password must contain at least one letter and one number"},
+		{"Only numbers", "1234567890", "Password must contain at least one letter and one number"},
+		{"Contains username", "myRAYTEST42", "Password must not contain the username or email"},
+		{"Contains email", "ray.dev2025", "Password must not contain the username or email"},
+		{"Common password", "Password123", "Password is too common"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := user.ValidatePassword(c.password)
+			assert.Equal(t, c.message, err.Error())
+		})
+	}
+
+	t.Run("Strong password", func(t *testing.T) {
+		err := user.ValidatePassword("correct horse 42")
+		assert.NoError(t, err)
+	})
+}
+
+func TestUserValidate(t *testing.T) {
+	t.Run("Registration checks the password strength", func(t *testing.T) {
+		user := &User{Username: "Raytest", Email: "test@example.com", Password: "short1"}
+
+		err := user.Validate(false)
+		assert.Equal(t, "Password must have between 8 and 128 characters", err.Error())
+	})
+
+	t.Run("Login does not check the password strength", func(t *testing.T) {
+		user := &User{Email: "test@example.com", Password: "short1"}
+
+		err := user.Validate(true)
+		assert.NoError(t, err)
+	})
+}
+
+func TestChatroomWebhook(t *testing.T) {
+	t.Run("Validate", func(t *testing.T) {
+		webhook := &ChatroomWebhook{URL: "ftp://example.com/hook"}
+		assert.Equal(t, "Invalid webhook URL", webhook.Validate().Error())
+
+		webhook = &ChatroomWebhook{URL: "https://example.com/hook", TriggerWord: "two words"}
+		assert.Equal(t, "Invalid trigger word, it must be a single word of up to 50 characters", webhook.Validate().Error())
+
+		webhook = &ChatroomWebhook{URL: "https://example.com/hook", TriggerWord: "deploy"}
+		assert.NoError(t, webhook.Validate())
+	})
+
+	t.Run("Matches", func(t *testing.T) {
+		webhook := &ChatroomWebhook{TriggerWord: "deploy"}
+		assert.True(t, webhook.Matches("Deploy api"))
+		assert.False(t, webhook.Matches("please deploy api"))
+
+		webhook = &ChatroomWebhook{}
+		assert.True(t, webhook.Matches("anything"))
+	})
+}
+
+func TestChatMessageValidateIntegration(t *testing.T) {
+	msg := &ChatMessage{Message: "deployed", Type: MessageTypePoll}
+	assert.Equal(t, "Invalid message type, it must be text or quotes", msg.ValidateIntegration().Error())
+
+	msg = &ChatMessage{Type: MessageTypeQuotes, Payload: make([]byte, MaxIntegrationPayloadSize+1)}
+	assert.Equal(t, "Message payload can't be larger than 16384 bytes", msg.ValidateIntegration().Error())
+
+	msg = &ChatMessage{Type: MessageTypeQuotes, Payload: []byte(`{"quote_table_quotes":[]}`)}
+	assert.NoError(t, msg.ValidateIntegration())
+	assert.NoError(t, (&ChatMessage{Message: "deployed"}).ValidateIntegration())
+}
+
+func TestChatroomCanManage(t *testing.T) {
+	ownerId := 23
+	chatroom := &Chatroom{OwnerID: &ownerId}
+
+	assert.True(t, chatroom.CanManage(23, false))
+	assert.False(t, chatroom.CanManage(24, false))
+	assert.True(t, chatroom.CanManage(24, true))
+	assert.False(t, (&Chatroom{}).CanManage(23, false))
+}
+
+func TestIncomingWebhookValidate(t *testing.T) {
+	webhook := &IncomingWebhook{UserName: "ci bot"}
+	assert.Error(t, webhook.Validate())
+
+	webhook = &IncomingWebhook{UserName: "ci-bot"}
+	assert.NoError(t, webhook.Validate())
+}
+
+func TestPollValidate(t *testing.T) {
+	poll := &Poll{Question: "Lunch?", Options: []string{"Pizza"}}
+	assert.Equal(t, "Poll must have between 2 and 10 options", poll.Validate().Error())
+
+	poll = &Poll{Question: "Lunch?", Options: []string{"Pizza", "pizza"}}
+	assert.Equal(t, `Poll option "pizza" is repeated`, poll.Validate().Error())
+
+	poll = &Poll{Question: " ", Options: []string{"Pizza", "Sushi"}}
+	assert.Error(t, poll.Validate())
+
+	poll = &Poll{Question: "Lunch?", Options: []string{"Pizza", "Sushi"}}
+	assert.NoError(t, poll.Validate())
+}
+
+func TestPollValidateVote(t *testing.T) {
+	poll := &Poll{Id: 3, Options: []string{"Pizza", "Sushi", "Tacos"}}
+
+	assert.NoError(t, poll.ValidateVote([]int{1}))
+	assert.Equal(t, "Choose one option", poll.ValidateVote([]int{0, 1}).Error())
+	assert.Equal(t, "Choose one option", poll.ValidateVote(nil).Error())
+	assert.Equal(t, "Invalid option 3", poll.ValidateVote([]int{3}).Error())
+
+	poll.MultipleChoice = true
+	assert.NoError(t, poll.ValidateVote([]int{0, 2}))
+	assert.Equal(t, "Option 0 is repeated", poll.ValidateVote([]int{0, 0}).Error())
+	assert.Equal(t, "Choose at least one option", poll.ValidateVote([]int{}).Error())
+
+	closedAt := time.Now()
+	poll.ClosedAt = &closedAt
+	assert.Equal(t, "Poll 3 is closed", poll.ValidateVote([]int{0}).Error())
+}
+
+func TestParseClientAction(t *testing.T) {
+	action, ok := parseClientAction([]byte(`{"ws_action": "poll_vote", "poll_id": 3, "poll_options": [0, 2]}`))
+	assert.True(t, ok)
+	assert.Equal(t, &ClientAction{Action: ActionPollVote, PollID: 3, Options: []int{0, 2}}, action)
+
+	_, ok = parseClientAction([]byte(`{"message": "not an action"}`))
+	assert.False(t, ok)
+
+	_, ok = parseClientAction([]byte(`{ws_action is just text`))
+	assert.False(t, ok)
+}
@@ -1,10 +1,22 @@
 package models
 
 import (
+	"encoding/json"
+	"fmt"
 	"log"
 	"sync"
+	"time"
 )
 
+// Delivers the messages to the clients connected to the chatroom, in this instance of the server and the others.
+type Broadcaster interface {
+	Broadcast(msg *ChatMessage)
+	// Starts receiving the messages of the chatroom published by the other instances.
+	Subscribe(chatroomId string) error
+	// Stops receiving the messages of the chatroom, once the instance has no clients in it.
+	Unsubscribe(chatroomId string) error
+}
+
 type Hub struct {
 	repo       ChatRepository
 	ChatroomId string
@@ -12,9 +24,24 @@ type Hub struct {
 
 	Clients map[*Client]bool
 
-	Broadcast  chan *ChatMessage
-	Register   chan *Client
-	Unregister chan *Client
+	broadcast  chan *ChatMessage
+	register   chan *Client
+	unregister chan *Client
+
+	// Removes the hub once it has been idle for idleTimeout and counts the dropped messages, nil if the hub is not
+	// managed.
+	manager     *HubManager
+	idleTimeout time.Duration
+	// What to do when a client queue is full, the client is disconnected by default.
+	slowClientPolicy string
+	// Closed to stop the hub, see HubManager.Shutdown.
+	quit chan struct{}
+	// Closed once Run returns.
+	done chan struct{}
+	// Closed once the manager subscribed to the broadcasts of the chatroom, and once it unsubscribed after removing
+	// the hub.
+	bound   chan struct{}
+	unbound chan struct{}
 }
 
 // A hub is considered a chatroom. It handles the logic to broadcast the messages to all the clients connected to itself
@@ -23,39 +50,37 @@ func NewHub(chatroomId string, repo ChatRepository) *Hub {
 		mu:         sync.RWMutex{},
 		repo:       repo,
 		ChatroomId: chatroomId,
-		Broadcast:  make(chan *ChatMessage),
-		Register:   make(chan *Client),
-		Unregister: make(chan *Client),
+		broadcast:  make(chan *ChatMessage),
+		register:   make(chan *Client),
+		unregister: make(chan *Client),
 		Clients:    make(map[*Client]bool),
+		quit:       make(chan struct{}),
+		done:       make(chan struct{}),
 	}
 }
 
 /*
 Run method is a goroutine that gets launched when the first user connects to the chatroom.
-Manages all the clients register, unregister and broadcast logic
+Manages all the clients register, unregister and broadcast logic. Managed hubs return once they have no clients for
+the idle timeout.
 */
 func (h *Hub) Run() {
+	defer close(h.done)
+
+	idle := h.idleTimer(nil)
+
 	for {
 		select {
-		case client := <-h.Register:
+		case client := <-h.register:
 			log.Printf("New client registered: %s", client.UserName)
 			h.mu.Lock()
 			h.Clients[client] = true
 			h.mu.Unlock()
 
-			chatMessages, err := h.repo.GetChatroomMessages(h.ChatroomId)
-			if err != nil {
-				log.Println("An error ocurred while getting chatroom messages:", err.Error())
-				delete(h.Clients, client)
-				close(client.Send)
-				client.Conn.Close()
-			}
-
-			for _, chatMessage := range chatMessages {
-				client.Send <- chatMessage
-			}
+			// Loading the history doesn't stop the hub, the messages broadcasted meanwhile wait in the client queue.
+			go h.replay(client)
 
-		case client := <-h.Unregister:
+		case client := <-h.unregister:
 			h.mu.Lock()
 			_, ok := h.Clients[client]
 			if ok {
@@ -63,17 +88,214 @@ func (h *Hub) Run() {
 				close(client.Send)
 			}
 			h.mu.Unlock()
-		case message := <-h.Broadcast:
+		case message := <-h.broadcast:
 			h.mu.Lock()
 			for client := range h.Clients {
-				select {
-				case client.Send <- message:
-				default:
-					delete(h.Clients, client)
-					close(client.Send)
-				}
+				h.deliver(client, message)
 			}
 			h.mu.Unlock()
+		case <-h.quit:
+			h.goAway()
+			return
+		case <-idle:
+			idle = nil
+
+			if h.manager.removeIdle(h) {
+				log.Printf("Stopping idle hub of chatroom %s", h.ChatroomId)
+				return
+			}
+		}
+
+		idle = h.idleTimer(idle)
+	}
+}
+
+// Loads the history of the chatroom and hands it to the client. If it fails the connection is closed, so the client
+// leaves the hub and can try again.
+func (h *Hub) replay(client *Client) {
+	if client.history == nil {
+		return
+	}
+
+	chatMessages, err := h.repo.GetChatroomMessages(h.ChatroomId)
+	if err != nil {
+		log.Println("An error ocurred while getting chatroom messages:", err.Error())
+		client.history <- nil
+		client.Conn.Close()
+		return
+	}
+
+	client.history <- chatMessages
+}
+
+// Queues the message for the client without blocking the hub, applying the slow client policy when the queue is full.
+// Must be called with the lock held.
+func (h *Hub) deliver(client *Client, msg *ChatMessage) {
+	select {
+	case client.Send <- msg:
+		return
+	default:
+	}
+
+	switch h.slowClientPolicy {
+	case SlowClientDropOldest:
+		select {
+		case <-client.Send:
+			h.countDropped(1)
+		default:
+		}
+
+		select {
+		case client.Send <- msg:
+		default:
+			h.countDropped(1)
 		}
+	case SlowClientCoalesce:
+		skipped, dropped := 0, 0
+		for draining := true; draining; {
+			select {
+			case queued := <-client.Send:
+				count, ok := skippedCount(queued)
+				if !ok {
+					count = 1
+					dropped++
+				}
+				skipped += count
+			default:
+				draining = false
+			}
+		}
+		h.countDropped(dropped)
+
+		// The queue is empty and only the hub sends to it while holding the lock, so both fit.
+		client.Send <- newSkippedMessage(h.ChatroomId, skipped)
+		client.Send <- msg
+	default:
+		log.Printf("Disconnecting slow client %s from chatroom %s", client.UserName, h.ChatroomId)
+		delete(h.Clients, client)
+		close(client.Send)
+		h.countDropped(1)
+
+		if h.manager != nil {
+			h.manager.disconnected.Add(1)
+		}
+	}
+}
+
+func (h *Hub) countDropped(count int) {
+	if h.manager != nil && count > 0 {
+		h.manager.dropped.Add(int64(count))
+	}
+}
+
+// Tells the client how many messages it missed.
+func newSkippedMessage(chatroomId string, count int) *ChatMessage {
+	payload, _ := json.Marshal(&SkippedPayload{Count: count})
+
+	return &ChatMessage{
+		ChatroomID: chatroomId,
+		Message:    fmt.Sprintf("%d messages were skipped, reload the chatroom to see them", count),
+		Type:       MessageTypeSkipped,
+		Payload:    payload,
+		CreatedAt:  time.Now(),
+	}
+}
+
+// Gets the count of a skipped message, or false if it's another kind of message.
+func skippedCount(msg *ChatMessage) (int, bool) {
+	if msg.Type != MessageTypeSkipped {
+		return 0, false
+	}
+
+	payload := &SkippedPayload{}
+	err := json.Unmarshal(msg.Payload, payload)
+	if err != nil {
+		return 0, false
+	}
+
+	return payload.Count, true
+}
+
+// Disconnects every client telling them the server is going away, so they reconnect to another instance.
+func (h *Hub) goAway() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	wg := sync.WaitGroup{}
+	for client := range h.Clients {
+		delete(h.Clients, client)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client.closeGoingAway()
+		}()
+	}
+
+	wg.Wait()
+}
+
+// Starts counting the idle time when the hub has no clients, keeping the current count if it already started.
+// Returns nil while there are clients or if the hub never goes idle.
+func (h *Hub) idleTimer(current <-chan time.Time) <-chan time.Time {
+	if h.manager == nil || h.idleTimeout <= 0 {
+		return nil
+	}
+
+	h.mu.RLock()
+	empty := len(h.Clients) == 0
+	h.mu.RUnlock()
+
+	if !empty {
+		return nil
+	}
+
+	if current != nil {
+		return current
+	}
+
+	return time.After(h.idleTimeout)
+}
+
+// Adds the client to the hub. Returns false if the hub stopped.
+func (h *Hub) join(client *Client) bool {
+	select {
+	case h.register <- client:
+		return true
+	case <-h.done:
+		return false
+	}
+}
+
+// Removes the client from the hub, closing its Send channel.
+func (h *Hub) Leave(client *Client) {
+	select {
+	case h.unregister <- client:
+	case <-h.done:
+	}
+}
+
+// Sends the message to every client of the hub. Dropped if the hub stopped.
+func (h *Hub) Send(msg *ChatMessage) {
+	select {
+	case h.broadcast <- msg:
+	case <-h.done:
+	}
+}
+
+// Sends the message only to the client, e.g. the errors of its actions. The message is dropped if the client is
+// gone or not ready to receive it.
+func (h *Hub) Notify(client *Client, msg *ChatMessage) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if !h.Clients[client] {
+		return
+	}
+
+	select {
+	case client.Send <- msg:
+	default:
+		h.countDropped(1)
 	}
 }
@@ -0,0 +1,284 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// What a hub does with a message for a client whose send queue is full.
+const (
+	// Disconnects the client, which reconnects and gets the history again.
+	SlowClientDisconnect = "disconnect"
+	// Drops the oldest queued message to make room for the new one.
+	SlowClientDropOldest = "drop_oldest"
+	// Replaces the queued messages with a single skipped notice, followed by the new one.
+	SlowClientCoalesce = "coalesce"
+)
+
+type HubConfig struct {
+	// Hubs without clients are stopped after the idle timeout, 0 keeps them running.
+	IdleTimeout time.Duration
+	// Messages queued for each client while its connection is busy.
+	SendQueueSize    int
+	SlowClientPolicy string
+}
+
+func DefaultHubConfig() HubConfig {
+	return HubConfig{
+		IdleTimeout:      5 * time.Minute,
+		SendQueueSize:    64,
+		SlowClientPolicy: SlowClientDisconnect,
+	}
+}
+
+func (c HubConfig) Validate() error {
+	if c.IdleTimeout < 0 {
+		return fmt.Errorf("hub idle timeout can't be negative")
+	}
+
+	// The coalesce policy needs room for the skipped notice and the new message.
+	if c.SendQueueSize < 2 {
+		return fmt.Errorf("send queue size must be at least 2")
+	}
+
+	switch c.SlowClientPolicy {
+	case SlowClientDisconnect, SlowClientDropOldest, SlowClientCoalesce:
+		return nil
+	default:
+		return fmt.Errorf("unknown slow client policy: %s", c.SlowClientPolicy)
+	}
+}
+
+// Counters of the hubs of the instance, reported by the health check.
+type HubStats struct {
+	Hubs                int   `json:"hub_stats_hubs"`
+	Clients             int   `json:"hub_stats_clients"`
+	DroppedMessages     int64 `json:"hub_stats_dropped_messages"`
+	DisconnectedClients int64 `json:"hub_stats_disconnected_clients"`
+}
+
+// Keeps the running hubs of this instance by chatroom ID. Hubs are started by the first client that joins and stopped
+// after being idle, without clients, for the idle timeout.
+type HubManager struct {
+	repo   ChatRepository
+	config HubConfig
+
+	mu   sync.Mutex
+	hubs map[string]*Hub
+	// Last hub removed from each chatroom, its replacement subscribes once it's unsubscribed.
+	removed map[string]*Hub
+
+	// Messages that didn't reach a client because it was too slow, and slow clients disconnected.
+	dropped      atomic.Int64
+	disconnected atomic.Int64
+
+	// Subscribed to the chatrooms while they have a hub. Optional.
+	Broadcaster Broadcaster
+}
+
+func NewHubManager(repo ChatRepository, config HubConfig) (*HubManager, error) {
+	err := config.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return &HubManager{
+		repo:    repo,
+		config:  config,
+		hubs:    make(map[string]*Hub),
+		removed: make(map[string]*Hub),
+	}, nil
+}
+
+// Gets the running hub of the chatroom, or false if no client joined it.
+func (m *HubManager) Get(chatroomId string) (*Hub, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	hub, ok := m.hubs[chatroomId]
+	return hub, ok
+}
+
+// Gets the running hub of the chatroom, creating and starting it if needed. Returns once the instance is subscribed
+// to the broadcasts of the chatroom. The subscription happens outside the lock, so a slow broker only holds the
+// clients of that chatroom.
+func (m *HubManager) GetOrCreate(chatroomId string) *Hub {
+	m.mu.Lock()
+	hub, ok := m.hubs[chatroomId]
+	if ok {
+		m.mu.Unlock()
+		<-hub.bound
+		return hub
+	}
+
+	hub = NewHub(chatroomId, m.repo)
+	hub.manager = m
+	hub.idleTimeout = m.config.IdleTimeout
+	hub.slowClientPolicy = m.config.SlowClientPolicy
+	hub.bound = make(chan struct{})
+	hub.unbound = make(chan struct{})
+	m.hubs[chatroomId] = hub
+	previous := m.removed[chatroomId]
+	m.mu.Unlock()
+
+	go hub.Run()
+
+	m.bind(hub, previous)
+	return hub
+}
+
+// Subscribes to the broadcasts of the chatroom of the hub. Waits for the previous hub of the chatroom to unsubscribe
+// first, so its unsubscribe can't undo this subscription.
+func (m *HubManager) bind(hub *Hub, previous *Hub) {
+	defer close(hub.bound)
+
+	if previous != nil {
+		<-previous.unbound
+	}
+
+	if m.Broadcaster == nil {
+		return
+	}
+
+	err := m.Broadcaster.Subscribe(hub.ChatroomId)
+	if err != nil {
+		log.Printf("An error ocurred while subscribing to the broadcasts of chatroom %s: %s", hub.ChatroomId, err.Error())
+	}
+}
+
+// Unsubscribes from the broadcasts of the chatroom of the removed hub, once its subscription is done.
+func (m *HubManager) unbind(hub *Hub) {
+	defer func() {
+		close(hub.unbound)
+
+		m.mu.Lock()
+		if m.removed[hub.ChatroomId] == hub {
+			delete(m.removed, hub.ChatroomId)
+		}
+		m.mu.Unlock()
+	}()
+
+	<-hub.bound
+
+	if m.Broadcaster == nil {
+		return
+	}
+
+	err := m.Broadcaster.Unsubscribe(hub.ChatroomId)
+	if err != nil {
+		log.Printf("An error ocurred while unsubscribing from the broadcasts of chatroom %s: %s", hub.ChatroomId, err.Error())
+	}
+}
+
+// Registers the client in the hub of the chatroom, giving it a bounded send queue. The history of the chatroom is
+// sent to the client once it's loaded. A hub that stops while joining is replaced by a new one.
+func (m *HubManager) Join(chatroomId string, client *Client) *Hub {
+	client.Send = make(chan *ChatMessage, m.config.SendQueueSize)
+	client.history = make(chan []*ChatMessage, 1)
+
+	for {
+		hub := m.GetOrCreate(chatroomId)
+		client.Hub = hub
+
+		if hub.join(client) {
+			return hub
+		}
+	}
+}
+
+// Sends the message to the hub of the chatroom. Returns false if there's no hub running for it.
+func (m *HubManager) Deliver(msg *ChatMessage) bool {
+	hub, ok := m.Get(msg.ChatroomID)
+	if !ok {
+		return false
+	}
+
+	hub.Send(msg)
+	return true
+}
+
+// Stops every hub, disconnecting their clients with a going away close frame. Waits for the hubs to stop until ctx
+// is done.
+func (m *HubManager) Shutdown(ctx context.Context) error {
+	m.mu.Lock()
+	hubs := m.hubs
+	m.hubs = make(map[string]*Hub)
+	m.mu.Unlock()
+
+	for _, hub := range hubs {
+		close(hub.quit)
+	}
+
+	for _, hub := range hubs {
+		select {
+		case <-hub.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+// Gets the running hubs.
+func (m *HubManager) Hubs() []*Hub {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	hubs := make([]*Hub, 0, len(m.hubs))
+	for _, hub := range m.hubs {
+		hubs = append(hubs, hub)
+	}
+
+	return hubs
+}
+
+// Gets the counters of the hubs.
+func (m *HubManager) Stats() HubStats {
+	stats := HubStats{
+		DroppedMessages:     m.dropped.Load(),
+		DisconnectedClients: m.disconnected.Load(),
+	}
+
+	for _, hub := range m.Hubs() {
+		hub.mu.RLock()
+		stats.Clients += len(hub.Clients)
+		hub.mu.RUnlock()
+
+		stats.Hubs++
+	}
+
+	return stats
+}
+
+// Removes the hub if it still has no clients, unsubscribing outside the lock. Called by the hub, which stops when it
+// returns true.
+func (m *HubManager) removeIdle(hub *Hub) bool {
+	m.mu.Lock()
+
+	hub.mu.RLock()
+	empty := len(hub.Clients) == 0
+	hub.mu.RUnlock()
+
+	if !empty {
+		m.mu.Unlock()
+		return false
+	}
+
+	removed := m.hubs[hub.ChatroomId] == hub
+	if removed {
+		delete(m.hubs, hub.ChatroomId)
+		m.removed[hub.ChatroomId] = hub
+	}
+	m.mu.Unlock()
+
+	if removed {
+		m.unbind(hub)
+	}
+
+	return true
+}
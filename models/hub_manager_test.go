@@ -0,0 +1,199 @@
+package models
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeChatRepository struct {
+	ChatRepository
+	messages []*ChatMessage
+	// Holds the history until it's closed, if set.
+	release chan struct{}
+}
+
+func (r *fakeChatRepository) GetChatroomMessages(chatroomId string) ([]*ChatMessage, error) {
+	if r.release != nil {
+		<-r.release
+	}
+
+	return r.messages, nil
+}
+
+type fakeBroadcaster struct {
+	mu         sync.Mutex
+	subscribed map[string]bool
+	// Holds the subscriptions to the chatroom until it's closed, if set.
+	slowRoom string
+	release  chan struct{}
+}
+
+func (b *fakeBroadcaster) Broadcast(msg *ChatMessage) {}
+
+func (b *fakeBroadcaster) Subscribe(chatroomId string) error {
+	if chatroomId == b.slowRoom {
+		<-b.release
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.subscribed[chatroomId] = true
+	return nil
+}
+
+func (b *fakeBroadcaster) Unsubscribe(chatroomId string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.subscribed, chatroomId)
+	return nil
+}
+
+func (b *fakeBroadcaster) isSubscribed(chatroomId string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.subscribed[chatroomId]
+}
+
+func newTestHubManager(idleTimeout time.Duration) (*HubManager, *fakeBroadcaster) {
+	broadcaster := &fakeBroadcaster{subscribed: make(map[string]bool)}
+
+	config := DefaultHubConfig()
+	config.IdleTimeout = idleTimeout
+
+	manager, _ := NewHubManager(&fakeChatRepository{}, config)
+	manager.Broadcaster = broadcaster
+
+	return manager, broadcaster
+}
+
+func isStopped(manager *HubManager, chatroomId string) func() bool {
+	return func() bool {
+		_, ok := manager.Get(chatroomId)
+		return !ok
+	}
+}
+
+func TestHubManagerGetOrCreate(t *testing.T) {
+	manager, broadcaster := newTestHubManager(0)
+
+	_, ok := manager.Get("room")
+	assert.False(t, ok)
+	assert.False(t, manager.Deliver(&ChatMessage{ChatroomID: "room"}))
+
+	hub := manager.GetOrCreate("room")
+	assert.Same(t, hub, manager.GetOrCreate("room"))
+	assert.True(t, broadcaster.isSubscribed("room"))
+	assert.Len(t, manager.Hubs(), 1)
+}
+
+func TestHubManagerSubscribesOutsideTheLock(t *testing.T) {
+	manager, broadcaster := newTestHubManager(0)
+	broadcaster.slowRoom = "slow"
+	broadcaster.release = make(chan struct{})
+
+	created := make(chan *Hub, 2)
+	go func() { created <- manager.GetOrCreate("slow") }()
+	go func() { created <- manager.GetOrCreate("slow") }()
+
+	assert.Eventually(t, func() bool {
+		_, ok := manager.Get("slow")
+		return ok
+	}, time.Second, 5*time.Millisecond)
+
+	// Other chatrooms don't wait for the slow subscription, the clients of the slow one do.
+	manager.GetOrCreate("room")
+	assert.True(t, broadcaster.isSubscribed("room"))
+	assert.Len(t, created, 0)
+
+	close(broadcaster.release)
+	assert.Same(t, <-created, <-created)
+	assert.True(t, broadcaster.isSubscribed("slow"))
+}
+
+func TestHubManagerStopsIdleHubs(t *testing.T) {
+	manager, broadcaster := newTestHubManager(20 * time.Millisecond)
+
+	hub := manager.GetOrCreate("room")
+
+	assert.Eventually(t, isStopped(manager, "room"), time.Second, 5*time.Millisecond)
+	assert.Eventually(t, func() bool { return !broadcaster.isSubscribed("room") }, time.Second, 5*time.Millisecond)
+
+	// Sending to a stopped hub does not block.
+	hub.Send(&ChatMessage{ChatroomID: "room"})
+
+	client := &Client{UserName: "ray"}
+	joined := manager.Join("room", client)
+
+	assert.NotSame(t, hub, joined)
+	assert.Same(t, joined, client.Hub)
+	assert.True(t, broadcaster.isSubscribed("room"))
+}
+
+func TestHubManagerKeepsHubsWithClients(t *testing.T) {
+	manager, _ := newTestHubManager(20 * time.Millisecond)
+
+	client := &Client{UserName: "ray"}
+	hub := manager.Join("room", client)
+
+	assert.Never(t, isStopped(manager, "room"), 60*time.Millisecond, 5*time.Millisecond)
+
+	assert.True(t, manager.Deliver(&ChatMessage{ChatroomID: "room", Message: "hi"}))
+	assert.Equal(t, "hi", (<-client.Send).Message)
+
+	hub.Leave(client)
+
+	assert.Eventually(t, isStopped(manager, "room"), time.Second, 5*time.Millisecond)
+
+	_, open := <-client.Send
+	assert.False(t, open)
+}
+
+func TestHubManagerShutdown(t *testing.T) {
+	manager, _ := newTestHubManager(0)
+
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+
+		manager.Join("room", &Client{UserName: "ray", Conn: conn})
+	}))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	assert.Eventually(t, func() bool {
+		hub, ok := manager.Get("room")
+		if !ok {
+			return false
+		}
+
+		hub.mu.RLock()
+		defer hub.mu.RUnlock()
+		return len(hub.Clients) == 1
+	}, time.Second, 5*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	assert.NoError(t, manager.Shutdown(ctx))
+	assert.Empty(t, manager.Hubs())
+
+	_, _, err = conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway), err)
+}
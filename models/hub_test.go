@@ -0,0 +1,116 @@
+package models
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newSlowClientHub(t *testing.T, policy string) (*HubManager, *Client) {
+	config := DefaultHubConfig()
+	config.SendQueueSize = 2
+	config.SlowClientPolicy = policy
+
+	manager, err := NewHubManager(&fakeChatRepository{}, config)
+	assert.NoError(t, err)
+
+	// Nothing reads from the queue of the client, as if its connection was stuck.
+	client := &Client{UserName: "ray"}
+	manager.Join("room", client)
+
+	for i := 1; i <= 4; i++ {
+		manager.Deliver(&ChatMessage{Id: i, ChatroomID: "room", Message: fmt.Sprint(i)})
+	}
+
+	return manager, client
+}
+
+func receiveMessages(client *Client) []string {
+	messages := []string{}
+	for len(client.Send) > 0 {
+		msg, ok := <-client.Send
+		if !ok {
+			break
+		}
+
+		messages = append(messages, msg.Message)
+	}
+
+	return messages
+}
+
+func TestHubConfigValidate(t *testing.T) {
+	assert.NoError(t, DefaultHubConfig().Validate())
+
+	config := DefaultHubConfig()
+	config.SendQueueSize = 1
+	assert.Error(t, config.Validate())
+
+	config = DefaultHubConfig()
+	config.SlowClientPolicy = "ignore"
+	assert.Error(t, config.Validate())
+}
+
+func TestHubDisconnectsSlowClients(t *testing.T) {
+	manager, client := newSlowClientHub(t, SlowClientDisconnect)
+
+	assert.Eventually(t, func() bool {
+		return manager.Stats().DisconnectedClients == 1
+	}, time.Second, 5*time.Millisecond)
+
+	assert.Equal(t, []string{"1", "2"}, receiveMessages(client))
+	_, open := <-client.Send
+	assert.False(t, open)
+
+	stats := manager.Stats()
+	assert.Equal(t, 0, stats.Clients)
+	assert.EqualValues(t, 1, stats.DroppedMessages)
+}
+
+func TestHubDropsOldestMessages(t *testing.T) {
+	manager, client := newSlowClientHub(t, SlowClientDropOldest)
+
+	assert.Eventually(t, func() bool {
+		return manager.Stats().DroppedMessages == 2
+	}, time.Second, 5*time.Millisecond)
+
+	assert.Equal(t, []string{"3", "4"}, receiveMessages(client))
+	assert.Equal(t, 1, manager.Stats().Clients)
+}
+
+func TestHubCoalescesMessages(t *testing.T) {
+	manager, client := newSlowClientHub(t, SlowClientCoalesce)
+
+	assert.Eventually(t, func() bool {
+		return manager.Stats().DroppedMessages == 3
+	}, time.Second, 5*time.Millisecond)
+
+	skipped := <-client.Send
+	assert.Equal(t, MessageTypeSkipped, skipped.Type)
+	assert.JSONEq(t, `{"skipped_count":3}`, string(skipped.Payload))
+	assert.Equal(t, "4", (<-client.Send).Message)
+}
+
+func TestHubReplaysHistoryWithoutBlocking(t *testing.T) {
+	repo := &fakeChatRepository{
+		messages: []*ChatMessage{{Id: 1, ChatroomID: "room", Message: "old"}},
+		release:  make(chan struct{}),
+	}
+
+	manager, err := NewHubManager(repo, DefaultHubConfig())
+	assert.NoError(t, err)
+
+	client := &Client{UserName: "ray"}
+	manager.Join("room", client)
+
+	// The hub keeps delivering while the history loads.
+	manager.Deliver(&ChatMessage{Id: 2, ChatroomID: "room", Message: "new"})
+	assert.Equal(t, "new", (<-client.Send).Message)
+
+	close(repo.release)
+	history := <-client.history
+	assert.Len(t, history, 1)
+	assert.Equal(t, "old", history[0].Message)
+}
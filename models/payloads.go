@@ -0,0 +1,74 @@
+package models
+
+// Types of chat messages. The payload of the message depends on its type.
+const (
+	MessageTypeText       = "text"
+	MessageTypeQuotes     = "quotes"
+	MessageTypeAttachment = "attachment"
+	// The payload is the Poll. Posted when the poll is created and with the final results when it's closed.
+	MessageTypePoll = "poll"
+	// Current votes of a poll, broadcast after every vote and not saved. The payload is the Poll.
+	MessageTypePollTally = "poll_tally"
+	// Error of an action sent over the websocket, only sent to the client that sent the action and not saved.
+	MessageTypeError = "error"
+	// Sent instead of the messages a slow client couldn't receive, only to that client and not saved. The payload is
+	// a SkippedPayload.
+	MessageTypeSkipped = "skipped"
+)
+
+// Payload of the skipped messages.
+type SkippedPayload struct {
+	Count int `json:"skipped_count"`
+}
+
+// Payload of the attachment messages, the file is downloaded from the URL.
+type AttachmentPayload struct {
+	URL         string `json:"attachment_url"`
+	ContentType string `json:"attachment_content_type"`
+	Title       string `json:"attachment_title"`
+	Width       int    `json:"attachment_width,omitempty"`
+	Height      int    `json:"attachment_height,omitempty"`
+}
+
+// Column of a table payload. The key is the JSON field of the rows shown in the column.
+type TableColumn struct {
+	Key   string `json:"table_column_key"`
+	Label string `json:"table_column_label"`
+}
+
+// Payload of the quotes messages. Clients can render the quotes as a table using the columns in order.
+type QuoteTablePayload struct {
+	Columns []TableColumn `json:"quote_table_columns"`
+	Quotes  []QuoteRow    `json:"quote_table_quotes"`
+	Errors  []QuoteError  `json:"quote_table_errors,omitempty"`
+}
+
+type QuoteRow struct {
+	Symbol        string  `json:"quote_symbol"`
+	Date          string  `json:"quote_date"`
+	Time          string  `json:"quote_time"`
+	Open          float64 `json:"quote_open"`
+	High          float64 `json:"quote_high"`
+	Low           float64 `json:"quote_low"`
+	Close         float64 `json:"quote_close"`
+	Volume        int64   `json:"quote_volume"`
+	Change        float64 `json:"quote_change"`
+	ChangePercent float64 `json:"quote_change_percent"`
+}
+
+// Symbol of a multi symbol request that could not be quoted.
+type QuoteError struct {
+	Symbol  string `json:"quote_error_symbol"`
+	Message string `json:"quote_error_message"`
+}
+
+var QuoteTableColumns = []TableColumn{
+	{Key: "quote_symbol", Label: "Symbol"},
+	{Key: "quote_open", Label: "Open"},
+	{Key: "quote_high", Label: "High"},
+	{Key: "quote_low", Label: "Low"},
+	{Key: "quote_close", Label: "Close"},
+	{Key: "quote_volume", Label: "Volume"},
+	{Key: "quote_change", Label: "Change"},
+	{Key: "quote_change_percent", Label: "Change %"},
+}
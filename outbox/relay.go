@@ -0,0 +1,221 @@
+// Package outbox publishes to the broker the messages saved in the outbox table, so the messages written along with
+// the changes that caused them are not lost while the broker is down.
+package outbox
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/raynine/go-chatroom/broker"
+	"github.com/raynine/go-chatroom/interfaces"
+	"github.com/raynine/go-chatroom/models"
+)
+
+type Config struct {
+	// How often the pending messages are checked, besides when they are added by this instance.
+	PollInterval time.Duration
+	// Messages claimed at once.
+	BatchSize int
+	// How long the claimed messages are kept from the other relays. The relay stops publishing a batch before the claim
+	// expires and leaves the rest for the next claim. Messages that were published but could not be marked as sent, or
+	// failed and could not be scheduled for a retry, are published again up to ClaimLease later.
+	ClaimLease time.Duration
+	// Failed messages wait RetryDelay, doubled on every attempt up to MaxRetryDelay, before being published again.
+	RetryDelay    time.Duration
+	MaxRetryDelay time.Duration
+	// Sent messages are kept this long.
+	Retention time.Duration
+}
+
+func DefaultConfig() Config {
+	return Config{
+		PollInterval:  time.Second,
+		BatchSize:     100,
+		ClaimLease:    time.Minute,
+		RetryDelay:    time.Second,
+		MaxRetryDelay: 5 * time.Minute,
+		Retention:     24 * time.Hour,
+	}
+}
+
+func (c Config) Validate() error {
+	if c.PollInterval <= 0 || c.RetryDelay <= 0 || c.Retention <= 0 {
+		return fmt.Errorf("outbox poll interval, retry delay and retention must be greater than 0")
+	}
+
+	if c.MaxRetryDelay < c.RetryDelay {
+		return fmt.Errorf("outbox max retry delay can't be less than the retry delay")
+	}
+
+	if c.BatchSize < 1 {
+		return fmt.Errorf("outbox batch size must be at least 1")
+	}
+
+	if c.ClaimLease <= broker.PublishTimeout {
+		return fmt.Errorf("outbox claim lease must be greater than the publish timeout, %s", broker.PublishTimeout)
+	}
+
+	return nil
+}
+
+// Publishes the pending outbox messages to the broker, retrying the ones that fail. Messages may be published more
+// than once if the relay stops before marking them as sent.
+type Relay struct {
+	repo   interfaces.OutboxRepo
+	broker broker.Broker
+	config Config
+	now    func() time.Time
+
+	wake     chan struct{}
+	quit     chan struct{}
+	quitOnce sync.Once
+	done     chan struct{}
+}
+
+func NewRelay(repo interfaces.OutboxRepo, b broker.Broker, config Config) (*Relay, error) {
+	err := config.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Relay{
+		repo:   repo,
+		broker: b,
+		config: config,
+		now:    time.Now,
+		wake:   make(chan struct{}, 1),
+		quit:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}, nil
+}
+
+// Adds the message to the outbox in its own transaction and wakes up the relay.
+func (r *Relay) Publish(queue string, body []byte) error {
+	err := r.repo.AddOutboxMessages([]*models.OutboxMessage{{Queue: queue, Body: body}})
+	if err != nil {
+		return err
+	}
+
+	r.Wake()
+	return nil
+}
+
+// Publishes the pending messages right away instead of waiting for the poll interval.
+func (r *Relay) Wake() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Publishes the pending messages until the relay is closed, removing the old sent ones once per retention period.
+func (r *Relay) Run() {
+	defer close(r.done)
+
+	poll := time.NewTicker(r.config.PollInterval)
+	defer poll.Stop()
+
+	cleanup := time.NewTicker(r.config.Retention)
+	defer cleanup.Stop()
+
+	for {
+		// A full batch sent means there may be more pending, a failed one waits to not spin while the broker is down.
+		for r.relay() == r.config.BatchSize {
+			select {
+			case <-r.quit:
+				return
+			default:
+			}
+		}
+
+		select {
+		case <-r.quit:
+			return
+		case <-r.wake:
+		case <-poll.C:
+		case <-cleanup.C:
+			r.cleanup()
+		}
+	}
+}
+
+// Publishes a batch of pending messages. Returns how many were sent.
+func (r *Relay) relay() int {
+	msgs, err := r.repo.ClaimOutboxMessages(r.config.BatchSize, r.config.ClaimLease)
+	if err != nil {
+		return 0
+	}
+
+	// Once the claim expires another relay may take the messages still waiting, so they are left for the next claim
+	// when the last publish could outlast it.
+	deadline := r.now().Add(r.config.ClaimLease - broker.PublishTimeout)
+
+	sent := []int{}
+	for _, msg := range msgs {
+		if r.now().After(deadline) {
+			log.Printf("%d outbox messages will be published again after the claim expires", len(msgs)-len(sent))
+			break
+		}
+
+		err = r.broker.Publish(msg.Queue, msg.Body)
+		if err == nil {
+			sent = append(sent, msg.Id)
+			continue
+		}
+
+		log.Printf("An error ocurred while publishing outbox message %d to %s: %s", msg.Id, msg.Queue, err.Error())
+
+		err = r.repo.RetryOutboxMessage(msg.Id, r.now().Add(r.delay(msg.Attempts)), err.Error())
+		if err != nil {
+			log.Printf("Outbox message %d will be published again after the claim expires: %s", msg.Id, err.Error())
+		}
+	}
+
+	if len(sent) > 0 {
+		err = r.repo.MarkOutboxMessagesSent(sent)
+		if err != nil {
+			log.Printf("%d outbox messages will be published again after the claim expires: %s", len(sent), err.Error())
+		}
+	}
+
+	return len(sent)
+}
+
+// Delay before publishing a message again after the failed attempt.
+func (r *Relay) delay(attempts int) time.Duration {
+	delay := r.config.RetryDelay
+	for i := 1; i < attempts && delay < r.config.MaxRetryDelay; i++ {
+		delay *= 2
+	}
+
+	return min(delay, r.config.MaxRetryDelay)
+}
+
+func (r *Relay) cleanup() {
+	deleted, err := r.repo.DeleteSentOutboxMessages(r.now().Add(-r.config.Retention))
+	if err != nil {
+		return
+	}
+
+	if deleted > 0 {
+		log.Printf("Removed %d sent outbox messages", deleted)
+	}
+}
+
+// Stops the relay once it publishes the batch in progress, waiting for it until ctx is done. The pending messages are
+// published by the next relay that runs.
+func (r *Relay) Close(ctx context.Context) error {
+	r.quitOnce.Do(func() {
+		close(r.quit)
+	})
+
+	select {
+	case <-r.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
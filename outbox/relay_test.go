@@ -0,0 +1,172 @@
+package outbox
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/raynine/go-chatroom/broker"
+	"github.com/raynine/go-chatroom/models"
+	"github.com/stretchr/testify/assert"
+)
+
+type stubOutboxRepo struct {
+	mu      sync.Mutex
+	pending []*models.OutboxMessage
+	sent    []int
+	retries map[int]string
+}
+
+func newStubOutboxRepo() *stubOutboxRepo {
+	return &stubOutboxRepo{retries: make(map[int]string)}
+}
+
+func (r *stubOutboxRepo) AddOutboxMessages(msgs []*models.OutboxMessage) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, msg := range msgs {
+		msg.Id = len(r.pending) + len(r.sent) + 1
+		r.pending = append(r.pending, msg)
+	}
+
+	return nil
+}
+
+func (r *stubOutboxRepo) ClaimOutboxMessages(limit int, lease time.Duration) ([]*models.OutboxMessage, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	claimed := r.pending[:min(limit, len(r.pending))]
+	r.pending = r.pending[len(claimed):]
+
+	for _, msg := range claimed {
+		msg.Attempts++
+	}
+
+	return claimed, nil
+}
+
+func (r *stubOutboxRepo) MarkOutboxMessagesSent(ids []int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.sent = append(r.sent, ids...)
+	return nil
+}
+
+func (r *stubOutboxRepo) RetryOutboxMessage(id int, availableAt time.Time, lastError string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.retries[id] = lastError
+	return nil
+}
+
+func (r *stubOutboxRepo) DeleteSentOutboxMessages(before time.Time) (int64, error) {
+	return 0, nil
+}
+
+func (r *stubOutboxRepo) sentIds() []int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]int{}, r.sent...)
+}
+
+func TestConfigValidate(t *testing.T) {
+	assert.NoError(t, DefaultConfig().Validate())
+
+	config := DefaultConfig()
+	config.MaxRetryDelay = time.Millisecond
+	assert.Error(t, config.Validate())
+
+	config = DefaultConfig()
+	config.BatchSize = 0
+	assert.Error(t, config.Validate())
+
+	config = DefaultConfig()
+	config.ClaimLease = broker.PublishTimeout
+	assert.Error(t, config.Validate())
+}
+
+func TestRelayPublishes(t *testing.T) {
+	repo := newStubOutboxRepo()
+	b := broker.NewMemory()
+	defer b.Close()
+
+	relay, err := NewRelay(repo, b, DefaultConfig())
+	assert.NoError(t, err)
+
+	go relay.Run()
+
+	received := make(chan string, 1)
+	go b.Consume(models.CommandRequestsQueue, broker.DefaultRetryPolicy, func(body []byte) error {
+		received <- string(body)
+		return nil
+	})
+
+	// Woken up by the publish, without waiting for the poll interval.
+	assert.NoError(t, relay.Publish(models.CommandRequestsQueue, []byte(`{"chat_message_message":"/stock aapl.us"}`)))
+
+	select {
+	case body := <-received:
+		assert.JSONEq(t, `{"chat_message_message":"/stock aapl.us"}`, body)
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("outbox message was not published")
+	}
+
+	assert.Eventually(t, func() bool {
+		return len(repo.sentIds()) == 1
+	}, time.Second, 5*time.Millisecond)
+
+	assert.NoError(t, relay.Close(context.Background()))
+}
+
+func TestRelayRetriesWhileBrokerIsDown(t *testing.T) {
+	repo := newStubOutboxRepo()
+	b := broker.NewMemory()
+	b.Close()
+
+	relay, err := NewRelay(repo, b, DefaultConfig())
+	assert.NoError(t, err)
+
+	assert.NoError(t, repo.AddOutboxMessages([]*models.OutboxMessage{{Queue: models.ChatroomMessagesQueue, Body: []byte(`{}`)}}))
+
+	assert.Equal(t, 0, relay.relay())
+	assert.Empty(t, repo.sentIds())
+	assert.Equal(t, broker.ErrClosed.Error(), repo.retries[1])
+}
+
+func TestRelayStopsBeforeTheClaimExpires(t *testing.T) {
+	repo := newStubOutboxRepo()
+	b := broker.NewMemory()
+	defer b.Close()
+
+	relay, err := NewRelay(repo, b, DefaultConfig())
+	assert.NoError(t, err)
+
+	// The clock moves 20 seconds on every read, so only 2 publishes start before the one minute claim is about to expire.
+	now := time.Now()
+	relay.now = func() time.Time {
+		now = now.Add(20 * time.Second)
+		return now
+	}
+
+	for range 5 {
+		assert.NoError(t, repo.AddOutboxMessages([]*models.OutboxMessage{{Queue: models.ChatroomMessagesQueue, Body: []byte(`{}`)}}))
+	}
+
+	assert.Equal(t, 2, relay.relay())
+	assert.Equal(t, []int{1, 2}, repo.sentIds())
+}
+
+func TestRelayDelay(t *testing.T) {
+	relay := &Relay{config: Config{RetryDelay: time.Second, MaxRetryDelay: 5 * time.Second}}
+
+	assert.Equal(t, time.Second, relay.delay(1))
+	assert.Equal(t, 2*time.Second, relay.delay(2))
+	assert.Equal(t, 4*time.Second, relay.delay(3))
+	assert.Equal(t, 5*time.Second, relay.delay(10))
+}
@@ -0,0 +1,304 @@
+// Package persistence saves the chat messages in batches, so the chatrooms don't wait for a database round trip per
+// message.
+package persistence
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/raynine/go-chatroom/interfaces"
+	"github.com/raynine/go-chatroom/models"
+)
+
+// When the messages are delivered to the chatroom.
+const (
+	// Save returns once the batch of the message is committed.
+	DurabilityCommit = "commit"
+	// Save returns right away. The messages of a failed batch are delivered but lost.
+	DurabilityAsync = "async"
+)
+
+var ErrClosed = errors.New("message writer is closed")
+
+type Config struct {
+	// Messages saved in a single COPY, also the IDs reserved at once.
+	BatchSize int
+	// Time a batch waits for more messages before being saved.
+	FlushInterval time.Duration
+	Durability    string
+}
+
+func DefaultConfig() Config {
+	return Config{
+		BatchSize:     100,
+		FlushInterval: 10 * time.Millisecond,
+		Durability:    DurabilityCommit,
+	}
+}
+
+func (c Config) Validate() error {
+	if c.BatchSize < 1 {
+		return fmt.Errorf("message batch size must be at least 1")
+	}
+
+	if c.FlushInterval <= 0 {
+		return fmt.Errorf("message flush interval must be greater than 0")
+	}
+
+	switch c.Durability {
+	case DurabilityCommit, DurabilityAsync:
+		return nil
+	default:
+		return fmt.Errorf("unknown message durability: %s", c.Durability)
+	}
+}
+
+// A chat message or an outbox message.
+type pending struct {
+	msg    *models.ChatMessage
+	outbox *models.OutboxMessage
+	// Receives the result of the batch, nil for async messages.
+	saved chan error
+}
+
+// Numbers the messages with IDs reserved from the database and saves them in batches from a single goroutine, so
+// they are stored in the order they were numbered.
+type Writer struct {
+	repo   interfaces.MessageRepo
+	config Config
+
+	mu     sync.Mutex
+	ids    []int
+	closed bool
+	// Closed once the IDs being reserved are available, nil when no reservation is in progress.
+	reserving chan struct{}
+	pending   chan *pending
+	done      chan struct{}
+
+	// Called once a batch with outbox messages is saved, e.g. to wake up the relay. Must be set before Run.
+	Notify func()
+}
+
+func NewWriter(repo interfaces.MessageRepo, config Config) (*Writer, error) {
+	err := config.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Writer{
+		repo:    repo,
+		config:  config,
+		pending: make(chan *pending, config.BatchSize),
+		done:    make(chan struct{}),
+	}, nil
+}
+
+// Sets the ID and creation time of the message and queues it to be saved. Waits for the commit depending on the
+// durability. NUL bytes and invalid UTF-8 are removed from the text, Postgres would reject the message.
+func (w *Writer) Save(msg *models.ChatMessage) error {
+	msg.Message = sanitize(msg.Message)
+	return w.write(&pending{msg: msg})
+}
+
+func sanitize(text string) string {
+	return strings.ToValidUTF8(strings.ReplaceAll(text, "\x00", ""), "\uFFFD")
+}
+
+// Adds a message to the outbox in the batch of the messages saved before it, so it's published once they are
+// saved even if the broker is down. Waits for the commit depending on the durability.
+func (w *Writer) Publish(queue string, body []byte) error {
+	return w.write(&pending{outbox: &models.OutboxMessage{Queue: queue, Body: body}})
+}
+
+func (w *Writer) write(p *pending) error {
+	if w.config.Durability == DurabilityCommit {
+		p.saved = make(chan error, 1)
+	}
+
+	err := w.enqueue(p)
+	if err != nil {
+		return err
+	}
+
+	if p.saved == nil {
+		return nil
+	}
+
+	return <-p.saved
+}
+
+// Numbers and queues the message under the lock, so the queue is in the order of the IDs. Outbox messages are not
+// numbered.
+func (w *Writer) enqueue(p *pending) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for {
+		if w.closed {
+			return ErrClosed
+		}
+
+		if p.msg == nil {
+			w.pending <- p
+			return nil
+		}
+
+		if len(w.ids) > 0 {
+			break
+		}
+
+		err := w.reserve()
+		if err != nil {
+			return err
+		}
+	}
+
+	p.msg.Id = w.ids[0]
+	p.msg.CreatedAt = time.Now()
+	w.ids = w.ids[1:]
+
+	w.pending <- p
+	return nil
+}
+
+// Reserves the next IDs without holding the lock, which must be held when called. The other messages wait for the
+// reservation in progress instead of making their own, so the IDs are handed out in order.
+func (w *Writer) reserve() error {
+	if w.reserving != nil {
+		reserving := w.reserving
+
+		w.mu.Unlock()
+		<-reserving
+		w.mu.Lock()
+
+		return nil
+	}
+
+	reserving := make(chan struct{})
+	w.reserving = reserving
+	w.mu.Unlock()
+
+	ids, err := w.repo.ReserveMessageIds(w.config.BatchSize)
+
+	w.mu.Lock()
+	w.reserving = nil
+	close(reserving)
+
+	if err != nil {
+		return err
+	}
+
+	w.ids = ids
+	return nil
+}
+
+// Saves the queued messages until the writer is closed. A batch is saved once it's full or after the flush interval.
+func (w *Writer) Run() {
+	defer close(w.done)
+
+	batch := make([]*pending, 0, w.config.BatchSize)
+	var flush <-chan time.Time
+
+	for {
+		select {
+		case p, ok := <-w.pending:
+			if !ok {
+				w.save(batch)
+				return
+			}
+
+			batch = append(batch, p)
+			if len(batch) == 1 {
+				flush = time.After(w.config.FlushInterval)
+			}
+
+			if len(batch) < w.config.BatchSize {
+				continue
+			}
+		case <-flush:
+		}
+
+		w.save(batch)
+		batch = batch[:0]
+		flush = nil
+	}
+}
+
+func (w *Writer) save(batch []*pending) {
+	if len(batch) == 0 {
+		return
+	}
+
+	msgs := []*models.ChatMessage{}
+	outbox := []*models.OutboxMessage{}
+	for _, p := range batch {
+		if p.msg != nil {
+			msgs = append(msgs, p.msg)
+		} else {
+			outbox = append(outbox, p.outbox)
+		}
+	}
+
+	err := w.repo.AddMessages(msgs, outbox)
+	if err == nil {
+		w.finish(batch, len(outbox) > 0, err)
+		return
+	}
+
+	log.Printf("An error ocurred while saving %d messages: %s", len(batch), err.Error())
+
+	if len(batch) == 1 {
+		w.finish(batch, false, err)
+		return
+	}
+
+	// A single bad message fails the whole batch, they are saved one at a time so only that one gets the error.
+	for _, p := range batch {
+		if p.msg != nil {
+			err = w.repo.AddMessages([]*models.ChatMessage{p.msg}, nil)
+		} else {
+			err = w.repo.AddMessages(nil, []*models.OutboxMessage{p.outbox})
+		}
+
+		if err != nil {
+			log.Printf("An error ocurred while saving a message of the failed batch: %s", err.Error())
+		}
+
+		w.finish([]*pending{p}, err == nil && p.outbox != nil, err)
+	}
+}
+
+// Hands the result to the messages waiting for it and notifies the saved outbox messages.
+func (w *Writer) finish(batch []*pending, notify bool, err error) {
+	if notify && w.Notify != nil {
+		w.Notify()
+	}
+
+	for _, p := range batch {
+		if p.saved != nil {
+			p.saved <- err
+		}
+	}
+}
+
+// Stops taking messages and waits until the queued ones are saved or ctx is done.
+func (w *Writer) Close(ctx context.Context) error {
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.pending)
+	}
+	w.mu.Unlock()
+
+	select {
+	case <-w.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
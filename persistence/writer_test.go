@@ -0,0 +1,205 @@
+package persistence
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/raynine/go-chatroom/models"
+	"github.com/stretchr/testify/assert"
+)
+
+type stubMessageRepo struct {
+	mu      sync.Mutex
+	nextId  int
+	batches [][]*models.ChatMessage
+	outbox  []*models.OutboxMessage
+	err     error
+	// Batches with a message with this text fail, like a row the database rejects.
+	reject string
+}
+
+func (r *stubMessageRepo) ReserveMessageIds(count int) ([]int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ids := make([]int, count)
+	for i := range ids {
+		r.nextId++
+		ids[i] = r.nextId
+	}
+
+	return ids, nil
+}
+
+func (r *stubMessageRepo) AddMessages(msgs []*models.ChatMessage, outbox []*models.OutboxMessage) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.err != nil {
+		return r.err
+	}
+
+	for _, msg := range msgs {
+		if r.reject != "" && msg.Message == r.reject {
+			return errors.New("invalid input syntax")
+		}
+	}
+
+	if len(msgs) > 0 {
+		r.batches = append(r.batches, append([]*models.ChatMessage{}, msgs...))
+	}
+
+	r.outbox = append(r.outbox, outbox...)
+	return nil
+}
+
+func (r *stubMessageRepo) savedIds() [][]int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ids := [][]int{}
+	for _, batch := range r.batches {
+		batchIds := []int{}
+		for _, msg := range batch {
+			batchIds = append(batchIds, msg.Id)
+		}
+
+		ids = append(ids, batchIds)
+	}
+
+	return ids
+}
+
+func newTestWriter(t *testing.T, repo *stubMessageRepo, durability string, flushInterval time.Duration) *Writer {
+	config := Config{BatchSize: 2, FlushInterval: flushInterval, Durability: durability}
+
+	writer, err := NewWriter(repo, config)
+	assert.NoError(t, err)
+
+	go writer.Run()
+	return writer
+}
+
+func TestConfigValidate(t *testing.T) {
+	assert.NoError(t, DefaultConfig().Validate())
+
+	config := DefaultConfig()
+	config.BatchSize = 0
+	assert.Error(t, config.Validate())
+
+	config = DefaultConfig()
+	config.Durability = "never"
+	assert.Error(t, config.Validate())
+}
+
+func TestWriterCommit(t *testing.T) {
+	repo := &stubMessageRepo{}
+	writer := newTestWriter(t, repo, DurabilityCommit, 20*time.Millisecond)
+
+	msgs := []*models.ChatMessage{{Message: "1"}, {Message: "2"}, {Message: "3"}}
+
+	wg := sync.WaitGroup{}
+	for _, msg := range msgs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, writer.Save(msg))
+		}()
+	}
+	wg.Wait()
+
+	// Two full batches would need a fourth message, the last one is saved by the flush interval.
+	assert.Equal(t, [][]int{{1, 2}, {3}}, repo.savedIds())
+
+	for _, msg := range msgs {
+		assert.NotZero(t, msg.Id)
+		assert.False(t, msg.CreatedAt.IsZero())
+	}
+
+	assert.NoError(t, writer.Close(context.Background()))
+	assert.ErrorIs(t, writer.Save(&models.ChatMessage{}), ErrClosed)
+}
+
+func TestWriterCommitError(t *testing.T) {
+	repo := &stubMessageRepo{err: errors.New("connection refused")}
+	writer := newTestWriter(t, repo, DurabilityCommit, 20*time.Millisecond)
+
+	assert.Error(t, writer.Save(&models.ChatMessage{Message: "hi"}))
+}
+
+func TestWriterAsync(t *testing.T) {
+	repo := &stubMessageRepo{}
+	writer := newTestWriter(t, repo, DurabilityAsync, time.Minute)
+
+	msg := &models.ChatMessage{Message: "hi"}
+	assert.NoError(t, writer.Save(msg))
+	assert.Equal(t, 1, msg.Id)
+	assert.Empty(t, repo.savedIds())
+
+	// Closing saves the queued messages.
+	assert.NoError(t, writer.Close(context.Background()))
+	assert.Equal(t, [][]int{{1}}, repo.savedIds())
+}
+
+func TestWriterPublish(t *testing.T) {
+	repo := &stubMessageRepo{}
+
+	config := Config{BatchSize: 2, FlushInterval: time.Minute, Durability: DurabilityCommit}
+	writer, err := NewWriter(repo, config)
+	assert.NoError(t, err)
+
+	notified := make(chan struct{}, 1)
+	writer.Notify = func() { notified <- struct{}{} }
+	go writer.Run()
+
+	msg := &models.ChatMessage{Message: "hi"}
+	go writer.Save(msg)
+
+	// The command fills the batch of the message, so both are saved together.
+	assert.Eventually(t, func() bool {
+		writer.mu.Lock()
+		defer writer.mu.Unlock()
+		return msg.Id != 0
+	}, time.Second, 5*time.Millisecond)
+	assert.NoError(t, writer.Publish(models.CommandRequestsQueue, []byte(`{}`)))
+
+	<-notified
+	assert.Equal(t, [][]int{{1}}, repo.savedIds())
+	assert.Len(t, repo.outbox, 1)
+	assert.Equal(t, models.CommandRequestsQueue, repo.outbox[0].Queue)
+}
+
+func TestWriterSanitize(t *testing.T) {
+	repo := &stubMessageRepo{}
+	writer := newTestWriter(t, repo, DurabilityCommit, 5*time.Millisecond)
+
+	msg := &models.ChatMessage{Message: "h\x00i\xff"}
+	assert.NoError(t, writer.Save(msg))
+	assert.Equal(t, "hi\uFFFD", msg.Message)
+}
+
+func TestWriterFailedBatch(t *testing.T) {
+	repo := &stubMessageRepo{reject: "bad"}
+	writer := newTestWriter(t, repo, DurabilityCommit, 20*time.Millisecond)
+
+	good := &models.ChatMessage{Message: "good"}
+	bad := &models.ChatMessage{Message: "bad"}
+
+	errs := make(chan error, 2)
+	go func() { errs <- writer.Save(good) }()
+	go func() { errs <- writer.Save(bad) }()
+
+	failed := 0
+	for range 2 {
+		if <-errs != nil {
+			failed++
+		}
+	}
+
+	// Only the bad message fails, the other one is saved on its own.
+	assert.Equal(t, 1, failed)
+	assert.Equal(t, [][]int{{good.Id}}, repo.savedIds())
+}
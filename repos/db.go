@@ -2,11 +2,14 @@ package repos
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"net/mail"
+	"time"
 
+	"github.com/lib/pq"
 	"github.com/raynine/go-chatroom/models"
 )
 
@@ -21,32 +24,265 @@ func NewChatRepo(db *sql.DB) *ChatRepo {
 }
 
 const (
-	getChatroomByIDQuery              = "SELECT * FROM public.chatrooms WHERE id = $1"
-	findUserByEmailQuery              = "SELECT * FROM public.users WHERE LOWER(email) = LOWER($1)"
+	userColumns                       = "id, username, email, password, email_verified, is_admin, is_service_account, display_name, avatar_url, status_text, time_zone"
+	getChatroomByIDQuery              = "SELECT id, name, owner_id FROM public.chatrooms WHERE id = $1"
+	findUserByEmailQuery              = "SELECT " + userColumns + " FROM public.users WHERE LOWER(email) = LOWER($1)"
 	checkIfEmailOrUsernameExistsQuery = "SELECT EXISTS(SELECT 1 FROM public.users WHERE LOWER(email) = LOWER($1) OR LOWER(username) = LOWER($2))"
-	GetUserByEmailQuery               = "SELECT * FROM public.users WHERE LOWER(email) = LOWER($1)"
-	addMessageQuery                   = `
+	GetUserByEmailQuery               = "SELECT " + userColumns + " FROM public.users WHERE LOWER(email) = LOWER($1)"
+	getUserByIDQuery                  = "SELECT " + userColumns + " FROM public.users WHERE id = $1"
+	getUserByUsernameQuery            = "SELECT " + userColumns + " FROM public.users WHERE LOWER(username) = LOWER($1)"
+	setEmailVerifiedQuery             = "UPDATE public.users SET email_verified = $2 WHERE id = $1"
+	checkIfUsernameTakenQuery         = "SELECT EXISTS(SELECT 1 FROM public.users WHERE LOWER(username) = LOWER($1) AND id <> $2)"
+	updateUserPasswordQuery           = "UPDATE public.users SET password = $2 WHERE id = $1"
+	updateUserProfileQuery            = `
+			UPDATE public.users
+			SET username = $2, display_name = $3, avatar_url = $4, status_text = $5, time_zone = $6
+			WHERE id = $1
+		`
+	addEmailVerificationQuery = `
+			INSERT INTO
+				public.email_verifications(token_hash, user_id, expires_at)
+			VALUES ($1, $2, $3)
+		`
+	consumeEmailVerificationQuery = `
+			DELETE FROM
+				public.email_verifications
+			WHERE token_hash = $1 AND expires_at > CURRENT_TIMESTAMP
+			RETURNING user_id
+		`
+	deleteUserEmailVerificationsQuery = "DELETE FROM public.email_verifications WHERE user_id = $1"
+	addLoginLockoutQuery              = `
+			INSERT INTO
+				public.login_lockouts(id, user_id, email, ip_address, reason, locked_until, created_at)
+			VALUES (default, $1, $2, $3, $4, $5, CURRENT_TIMESTAMP) returning id
+		`
+	unlockLoginLockoutsQuery = `
+			UPDATE public.login_lockouts
+			SET unlocked_at = CURRENT_TIMESTAMP, unlocked_by = $2
+			WHERE user_id = $1 AND unlocked_at IS NULL AND locked_until > CURRENT_TIMESTAMP
+		`
+	getUserLoginLockoutsQuery = `
+			SELECT id, user_id, email, ip_address, reason, locked_until, created_at, unlocked_at, unlocked_by
+			FROM public.login_lockouts
+			WHERE user_id = $1
+			ORDER BY created_at DESC
+			LIMIT 50
+		`
+	addMessageQuery = `
+			INSERT INTO 
+				public.messages(id, user_id, chatroom_id, message, type, payload, created_at)
+			VALUES (default, $1, $2, $3, $4, $5, CURRENT_TIMESTAMP) returning id
+		`
+	addMessageWithIdQuery = `
 			INSERT INTO 
-				public.messages(id, user_id, chatroom_id, message, created_at)
-			VALUES (default, $1, $2, $3, CURRENT_TIMESTAMP) returning id
+				public.messages(id, user_id, chatroom_id, message, type, payload, created_at)
+			VALUES ($1, $2, $3, $4, $5, $6, CURRENT_TIMESTAMP)
+			ON CONFLICT (id) DO NOTHING
+			returning id
+		`
+	reserveMessageIdsQuery = `
+			SELECT nextval(pg_get_serial_sequence('public.messages', 'id')) FROM generate_series(1, $1)
 		`
+	// COPY must be the first word of the query to run as a copy in.
+	addMessagesQuery = `COPY public.messages (id, user_id, chatroom_id, message, type, payload, created_at)
+			FROM STDIN`
 	addUserQuery = `
 			INSERT INTO 
 				public.users(id, username, email, password)
 			VALUES (default, $1, $2, $3) returning id
 		`
+	addServiceAccountQuery = `
+			INSERT INTO
+				public.users(id, username, email, password, email_verified, is_service_account)
+			VALUES (default, $1, $2, '!', true, true) returning id
+		`
+	addAPITokenQuery = `
+			INSERT INTO
+				public.api_tokens(id, user_id, name, token_hash, scopes, created_at)
+			VALUES (default, $1, $2, $3, $4, CURRENT_TIMESTAMP) returning id
+		`
+	getAPITokenByHashQuery = `
+			SELECT api_tokens.id, api_tokens.user_id, users.username, api_tokens.name, api_tokens.scopes,
+				api_tokens.created_at, api_tokens.last_used_at, api_tokens.revoked_at
+			FROM public.api_tokens
+			INNER JOIN public.users ON users.id = api_tokens.user_id
+			WHERE api_tokens.token_hash = $1 AND api_tokens.revoked_at IS NULL AND users.disabled_at IS NULL
+		`
+	getUserAPITokensQuery = `
+			SELECT api_tokens.id, api_tokens.user_id, users.username, api_tokens.name, api_tokens.scopes,
+				api_tokens.created_at, api_tokens.last_used_at, api_tokens.revoked_at
+			FROM public.api_tokens
+			INNER JOIN public.users ON users.id = api_tokens.user_id
+			WHERE api_tokens.user_id = $1
+			ORDER BY api_tokens.created_at DESC
+		`
+	getUserTokenHashesQuery = `
+			SELECT api_tokens.token_hash
+			FROM public.api_tokens
+			INNER JOIN public.users ON users.id = api_tokens.user_id
+			WHERE api_tokens.user_id = $1 AND $2 = ANY(api_tokens.scopes) AND api_tokens.revoked_at IS NULL
+				AND users.disabled_at IS NULL
+		`
+	touchAPITokenQuery  = "UPDATE public.api_tokens SET last_used_at = CURRENT_TIMESTAMP WHERE id = $1"
+	revokeAPITokenQuery = "UPDATE public.api_tokens SET revoked_at = CURRENT_TIMESTAMP WHERE id = $1 AND revoked_at IS NULL"
+	addPriceAlertQuery  = `
+			INSERT INTO
+				public.price_alerts(id, user_id, chatroom_id, symbol, operator, target, created_at)
+			VALUES (default, $1, $2, $3, $4, $5, CURRENT_TIMESTAMP) returning id
+		`
+	getUserPriceAlertsQuery = `
+			SELECT price_alerts.id, price_alerts.user_id, price_alerts.chatroom_id, price_alerts.symbol,
+				price_alerts.operator, price_alerts.target, price_alerts.created_at, price_alerts.triggered_at,
+				users.username
+			FROM public.price_alerts
+			INNER JOIN public.users ON users.id = price_alerts.user_id
+			WHERE price_alerts.user_id = $1 AND price_alerts.chatroom_id = $2 AND price_alerts.triggered_at IS NULL
+			ORDER BY price_alerts.id
+		`
+	getActivePriceAlertsQuery = `
+			SELECT price_alerts.id, price_alerts.user_id, price_alerts.chatroom_id, price_alerts.symbol,
+				price_alerts.operator, price_alerts.target, price_alerts.created_at, price_alerts.triggered_at,
+				users.username
+			FROM public.price_alerts
+			INNER JOIN public.users ON users.id = price_alerts.user_id
+			WHERE price_alerts.triggered_at IS NULL
+			ORDER BY price_alerts.id
+		`
+	deletePriceAlertQuery    = "DELETE FROM public.price_alerts WHERE id = $1 AND user_id = $2 AND chatroom_id = $3"
+	triggerPriceAlertQuery   = "UPDATE public.price_alerts SET triggered_at = CURRENT_TIMESTAMP WHERE id = $1 AND triggered_at IS NULL"
+	addScheduledMessageQuery = `
+			INSERT INTO
+				public.scheduled_messages(id, user_id, chatroom_id, kind, message, deliver_at, created_at)
+			VALUES (default, $1, $2, $3, $4, $5, CURRENT_TIMESTAMP) returning id
+		`
+	markScheduledMessageDeliveredQuery = `
+			UPDATE public.scheduled_messages SET delivered_at = CURRENT_TIMESTAMP, claimed_until = NULL WHERE id = $1
+		`
+	claimDueScheduledMessagesQuery = `
+			WITH due AS (
+				SELECT id FROM public.scheduled_messages
+				WHERE delivered_at IS NULL AND deliver_at <= CURRENT_TIMESTAMP
+					AND (claimed_until IS NULL OR claimed_until <= CURRENT_TIMESTAMP)
+				ORDER BY deliver_at
+				LIMIT $1
+				FOR UPDATE SKIP LOCKED
+			), claimed AS (
+				UPDATE public.scheduled_messages SET claimed_until = CURRENT_TIMESTAMP + $2 * INTERVAL '1 millisecond'
+				FROM due WHERE scheduled_messages.id = due.id
+				RETURNING scheduled_messages.id, scheduled_messages.user_id, scheduled_messages.chatroom_id,
+					scheduled_messages.kind, scheduled_messages.message, scheduled_messages.deliver_at,
+					scheduled_messages.created_at, scheduled_messages.delivered_at
+			)
+			SELECT claimed.id, claimed.user_id, claimed.chatroom_id, claimed.kind, claimed.message,
+				claimed.deliver_at, claimed.created_at, claimed.delivered_at, users.username
+			FROM claimed
+			INNER JOIN public.users ON users.id = claimed.user_id
+			ORDER BY claimed.deliver_at
+		`
+	releaseScheduledMessageQuery = "UPDATE public.scheduled_messages SET claimed_until = NULL WHERE id = $1"
+	markOutboxSentQuery          = "UPDATE public.outbox SET sent_at = CURRENT_TIMESTAMP WHERE id = ANY($1)"
+	retryOutboxMessageQuery      = "UPDATE public.outbox SET available_at = $2, last_error = $3 WHERE id = $1"
+	deleteSentOutboxQuery        = "DELETE FROM public.outbox WHERE sent_at < $1"
+	addOutboxMessagesQuery       = `
+			INSERT INTO public.outbox(queue, body)
+			SELECT queue, body FROM unnest($1::varchar[], $2::bytea[]) WITH ORDINALITY AS pending(queue, body, position)
+			ORDER BY position
+		`
+	claimOutboxMessagesQuery = `
+			WITH pending AS (
+				SELECT id FROM public.outbox
+				WHERE sent_at IS NULL AND available_at <= CURRENT_TIMESTAMP
+				ORDER BY id
+				LIMIT $1
+				FOR UPDATE SKIP LOCKED
+			), claimed AS (
+				UPDATE public.outbox
+				SET attempts = attempts + 1, available_at = CURRENT_TIMESTAMP + $2 * INTERVAL '1 millisecond'
+				FROM pending WHERE outbox.id = pending.id
+				RETURNING outbox.id, outbox.queue, outbox.body, outbox.attempts, outbox.created_at
+			)
+			SELECT id, queue, body, attempts, created_at FROM claimed ORDER BY id
+		`
 	addChatroomQuery = `
 		INSERT INTO
-			public.chatrooms(id, name)
-		VALUES(default, $1) returning id
+			public.chatrooms(id, name, owner_id)
+		VALUES(default, $1, $2) returning id
 	`
 	getAllChatRoomsQuery = `
-			SELECT * FROM
+			SELECT id, name, owner_id FROM
 				public.chatrooms
 	`
+	addIncomingWebhookQuery = `
+			INSERT INTO
+				public.incoming_webhooks(id, chatroom_id, user_id, created_by, token_hash, created_at)
+			VALUES (default, $1, $2, $3, $4, CURRENT_TIMESTAMP) returning id
+		`
+	getIncomingWebhookByHashQuery = `
+			SELECT incoming_webhooks.id, incoming_webhooks.chatroom_id, incoming_webhooks.user_id, users.username,
+				incoming_webhooks.created_by, incoming_webhooks.created_at, incoming_webhooks.last_used_at,
+				incoming_webhooks.revoked_at
+			FROM public.incoming_webhooks
+			INNER JOIN public.users ON users.id = incoming_webhooks.user_id
+			WHERE incoming_webhooks.token_hash = $1 AND incoming_webhooks.revoked_at IS NULL
+		`
+	getChatroomIncomingWebhooksQuery = `
+			SELECT incoming_webhooks.id, incoming_webhooks.chatroom_id, incoming_webhooks.user_id, users.username,
+				incoming_webhooks.created_by, incoming_webhooks.created_at, incoming_webhooks.last_used_at,
+				incoming_webhooks.revoked_at
+			FROM public.incoming_webhooks
+			INNER JOIN public.users ON users.id = incoming_webhooks.user_id
+			WHERE incoming_webhooks.chatroom_id = $1
+			ORDER BY incoming_webhooks.id
+		`
+	touchIncomingWebhookQuery  = "UPDATE public.incoming_webhooks SET last_used_at = CURRENT_TIMESTAMP WHERE id = $1"
+	revokeIncomingWebhookQuery = `
+			WITH revoked AS (
+				UPDATE public.incoming_webhooks SET revoked_at = CURRENT_TIMESTAMP
+				WHERE id = $1 AND chatroom_id = $2 AND revoked_at IS NULL
+				RETURNING user_id
+			), tokens AS (
+				UPDATE public.api_tokens SET revoked_at = CURRENT_TIMESTAMP
+				WHERE user_id IN (SELECT user_id FROM revoked) AND revoked_at IS NULL
+			)
+			UPDATE public.users SET disabled_at = CURRENT_TIMESTAMP WHERE id IN (SELECT user_id FROM revoked)
+		`
+	addChatroomWebhookQuery = `
+			INSERT INTO
+				public.chatroom_webhooks(id, chatroom_id, created_by, url, secret, trigger_word, created_at)
+			VALUES (default, $1, $2, $3, $4, $5, CURRENT_TIMESTAMP) returning id
+		`
+	getChatroomWebhooksQuery = `
+			SELECT id, chatroom_id, created_by, url, secret, trigger_word, created_at
+			FROM public.chatroom_webhooks
+			WHERE chatroom_id = $1
+			ORDER BY id
+		`
+	deleteChatroomWebhookQuery = "DELETE FROM public.chatroom_webhooks WHERE id = $1 AND chatroom_id = $2"
+	addWebhookDeliveryQuery    = `
+			INSERT INTO
+				public.webhook_deliveries(id, webhook_id, message_id, status, created_at, updated_at)
+			VALUES (default, $1, $2, $3, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP) returning id
+		`
+	updateWebhookDeliveryQuery = `
+			UPDATE public.webhook_deliveries
+			SET status = $2, attempts = $3, response_status = $4, error = $5, updated_at = CURRENT_TIMESTAMP
+			WHERE id = $1
+		`
+	getWebhookDeliveriesQuery = `
+			SELECT webhook_deliveries.id, webhook_deliveries.webhook_id, webhook_deliveries.message_id,
+				webhook_deliveries.status, webhook_deliveries.attempts, webhook_deliveries.response_status,
+				webhook_deliveries.error, webhook_deliveries.created_at, webhook_deliveries.updated_at
+			FROM public.webhook_deliveries
+			INNER JOIN public.chatroom_webhooks ON chatroom_webhooks.id = webhook_deliveries.webhook_id
+			WHERE webhook_deliveries.webhook_id = $1 AND chatroom_webhooks.chatroom_id = $2
+			ORDER BY webhook_deliveries.created_at DESC
+			LIMIT $3
+		`
 	getChatroomMessagesQuery = `
-			SELECT messages.*,
-			users.username
+			SELECT messages.id, messages.user_id, messages.chatroom_id, messages.message, messages.created_at,
+			messages.type, messages.payload,
+			users.username,
+			users.is_service_account
 				 FROM
 			public.messages
 			INNER JOIN public.users ON users.id = messages.user_id
@@ -54,8 +290,31 @@ const (
 			ORDER BY created_at ASC
 			LIMIT 50
 	`
+	addPollQuery = `
+			INSERT INTO
+				public.polls(id, chatroom_id, created_by, question, options, multiple_choice, created_at)
+			VALUES (default, $1, $2, $3, $4, $5, CURRENT_TIMESTAMP) returning id, created_at
+		`
+	pollColumns       = "id, chatroom_id, created_by, question, options, multiple_choice, created_at, closed_at"
+	getPollQuery      = "SELECT " + pollColumns + " FROM public.polls WHERE id = $1 AND chatroom_id = $2"
+	lockPollQuery     = getPollQuery + " FOR UPDATE"
+	getPollVotesQuery = `
+			SELECT option_index, COUNT(*),
+				(SELECT COUNT(DISTINCT user_id) FROM public.poll_votes WHERE poll_id = $1)
+			FROM public.poll_votes
+			WHERE poll_id = $1
+			GROUP BY option_index
+		`
+	deletePollVotesQuery = "DELETE FROM public.poll_votes WHERE poll_id = $1 AND user_id = $2"
+	addPollVotesQuery    = "INSERT INTO public.poll_votes(poll_id, user_id, option_index) SELECT $1, $2, unnest($3::int[])"
+	closePollQuery       = "UPDATE public.polls SET closed_at = CURRENT_TIMESTAMP WHERE id = $1 returning closed_at"
 )
 
+// Checks the database is reachable, used by the health checks.
+func (repo *ChatRepo) Ping() error {
+	return repo.db.Ping()
+}
+
 // Adds the provided chatroom to the Database. Will validate the chatroom name
 func (repo *ChatRepo) AddChatroom(chatroom *models.Chatroom) (*string, error) {
 
@@ -77,7 +336,7 @@ func (repo *ChatRepo) AddChatroom(chatroom *models.Chatroom) (*string, error) {
 
 	defer tx.Rollback()
 
-	err = repo.db.QueryRow(addChatroomQuery, chatroom.Name).Scan(&newId)
+	err = repo.db.QueryRow(addChatroomQuery, chatroom.Name, chatroom.OwnerID).Scan(&newId)
 	if err != nil {
 		log.Printf("An error ocurred while creating chatroom: %s", err.Error())
 		return nil, &models.CustomError{
@@ -94,7 +353,7 @@ func (repo *ChatRepo) AddChatroom(chatroom *models.Chatroom) (*string, error) {
 func (repo *ChatRepo) GetChatroomByID(id string) (*models.Chatroom, error) {
 	chatroom := &models.Chatroom{}
 
-	err := repo.db.QueryRow(getChatroomByIDQuery, id).Scan(&chatroom.Id, &chatroom.Name)
+	err := repo.db.QueryRow(getChatroomByIDQuery, id).Scan(&chatroom.Id, &chatroom.Name, &chatroom.OwnerID)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil
@@ -113,7 +372,7 @@ func (repo *ChatRepo) GetChatroomByID(id string) (*models.Chatroom, error) {
 func (repo *ChatRepo) FindUserByEmail(email string) (*models.User, error) {
 	user := &models.User{}
 
-	err := repo.db.QueryRow(findUserByEmailQuery, email).Scan(&user.Id, &user.Username, &user.Email, &user.Password)
+	err := scanUser(repo.db.QueryRow(findUserByEmailQuery, email), user)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil
@@ -148,12 +407,28 @@ func (repo *ChatRepo) checkIfEmailOrUsernameExists(email, username string) (bool
 	return exists, nil
 }
 
+// Validates if the username is used by any user besides the provided one. Compares the same way as
+// checkIfEmailOrUsernameExists, ignoring casing.
+func (repo *ChatRepo) checkIfUsernameTaken(username string, userId int) (bool, error) {
+	taken := false
+
+	err := repo.db.QueryRow(checkIfUsernameTakenQuery, username, userId).Scan(&taken)
+	if err != nil {
+		log.Printf("An error ocurred while searching for username %s: %s", username, err.Error())
+		return false, &models.CustomError{
+			Message: "error while searching for user",
+		}
+	}
+
+	return taken, nil
+}
+
 // Gets the user with the provided email. Throws an error if the user is not found.
 func (repo *ChatRepo) GetUserByEmail(email string) (*models.User, error) {
 	appContext := "ChatRepo.GetUserByEmail"
 	user := &models.User{}
 
-	err := repo.db.QueryRow(GetUserByEmailQuery, email).Scan(&user.Id, &user.Username, &user.Email, &user.Password)
+	err := scanUser(repo.db.QueryRow(GetUserByEmailQuery, email), user)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, &models.CustomError{
@@ -173,158 +448,1801 @@ func (repo *ChatRepo) GetUserByEmail(email string) (*models.User, error) {
 	return user, nil
 }
 
-// Adds the message to the DB. Will throw errors if the provided userId or chatroomId do not exist due to foreign key constraints
-func (repo *ChatRepo) AddMessage(chatMessage models.ChatMessage) (*int, error) {
-	var newId *int
+// Gets the user with the provided ID. Returns nil if the user is not found.
+func (repo *ChatRepo) GetUserByID(id int) (*models.User, error) {
+	user := &models.User{}
 
-	tx, err := repo.db.Begin()
+	err := scanUser(repo.db.QueryRow(getUserByIDQuery, id), user)
 	if err != nil {
-		log.Printf("An error ocurred while starting transaction: %s", err.Error())
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+
+		log.Printf("An error ocurred while searching for user ID %d: %s", id, err.Error())
 		return nil, &models.CustomError{
-			Message: "error while adding message",
+			Message: "error while searching for user",
 		}
 	}
 
-	defer tx.Rollback()
+	return user, nil
+}
 
-	err = repo.db.QueryRow(addMessageQuery, chatMessage.UserID, chatMessage.ChatroomID, chatMessage.Message).Scan(&newId)
+// Gets the user with the provided username. Returns nil if the user is not found.
+func (repo *ChatRepo) GetUserByUsername(username string) (*models.User, error) {
+	user := &models.User{}
+
+	err := scanUser(repo.db.QueryRow(getUserByUsernameQuery, username), user)
 	if err != nil {
-		log.Printf("An error ocurred while inserting message: %s", err.Error())
-		return nil, &models.CustomError{
-			Message: "error while inserting message",
+		if err == sql.ErrNoRows {
+			return nil, nil
 		}
 
+		log.Printf("An error ocurred while searching for username %s: %s", username, err.Error())
+		return nil, &models.CustomError{
+			Message:    "error while searching for user",
+			AppContext: "ChatRepo.GetUserByUsername",
+		}
 	}
 
-	tx.Commit()
-
-	return newId, nil
+	return user, nil
 }
 
-// Adds an user. We first validate the email, username and password. Then we check if the email or password is already used.
-func (repo *ChatRepo) AddUser(user *models.User) (*int, error) {
-	err := user.Validate(false)
+// Updates the username and profile fields of the user. The username must not be used by another user.
+func (repo *ChatRepo) UpdateUserProfile(user *models.User) error {
+	taken, err := repo.checkIfUsernameTaken(user.Username, user.Id)
 	if err != nil {
-		log.Println(err.Error())
-		return nil, err
+		return err
 	}
 
-	_, err = mail.ParseAddress(user.Email)
+	if taken {
+		return &models.CustomError{
+			Message: fmt.Sprintf("username: %s is already registered", user.Username),
+			Code:    http.StatusConflict,
+		}
+	}
+
+	_, err = repo.db.Exec(
+		updateUserProfileQuery,
+		user.Id,
+		user.Username,
+		user.DisplayName,
+		user.AvatarURL,
+		user.StatusText,
+		user.TimeZone,
+	)
 	if err != nil {
-		return nil, &models.CustomError{
-			Message: fmt.Sprintf("invalid email: %s", user.Email),
+		log.Printf("An error ocurred while updating profile of user %d: %s", user.Id, err.Error())
+		return &models.CustomError{
+			Message: "error while updating user",
 		}
 	}
 
-	exists, err := repo.checkIfEmailOrUsernameExists(user.Email, user.Username)
+	return nil
+}
+
+// Replaces the password hash of the user.
+func (repo *ChatRepo) UpdateUserPassword(userId int, passwordHash string) error {
+	_, err := repo.db.Exec(updateUserPasswordQuery, userId, passwordHash)
 	if err != nil {
-		return nil, err
+		log.Printf("An error ocurred while updating password of user %d: %s", userId, err.Error())
+		return &models.CustomError{
+			Message: "error while updating user",
+		}
 	}
 
-	if exists {
-		return nil, &models.CustomError{
-			Message: fmt.Sprintf("email: %s or username: %s is already registered", user.Email, user.Username),
+	return nil
+}
+
+// Marks the email of the user as verified or unverified. Used by admins to override the verification flow.
+func (repo *ChatRepo) SetEmailVerified(userId int, verified bool) error {
+	result, err := repo.db.Exec(setEmailVerifiedQuery, userId, verified)
+	if err != nil {
+		log.Printf("An error ocurred while updating email verification of user %d: %s", userId, err.Error())
+		return &models.CustomError{
+			Message: "error while updating user",
 		}
+	}
 
+	affected, err := result.RowsAffected()
+	if err == nil && affected == 0 {
+		return &models.CustomError{
+			Message: fmt.Sprintf("User with ID: %d does not exists", userId),
+			Code:    http.StatusNotFound,
+		}
 	}
 
-	var newId *int
+	return nil
+}
+
+// Stores the hash of a verification token for the user. The plain token is only sent to the user email.
+func (repo *ChatRepo) AddEmailVerification(userId int, tokenHash string, expiresAt time.Time) error {
+	_, err := repo.db.Exec(addEmailVerificationQuery, tokenHash, userId, expiresAt)
+	if err != nil {
+		log.Printf("An error ocurred while creating email verification for user %d: %s", userId, err.Error())
+		return &models.CustomError{
+			Message: "error while creating email verification",
+		}
+	}
+
+	return nil
+}
+
+// Consumes the verification token with the provided hash and marks the owner email as verified.
+// Every pending token of the user gets deleted so old links can not be reused.
+func (repo *ChatRepo) VerifyEmail(tokenHash string) (int, error) {
+	appContext := "ChatRepo.VerifyEmail"
+	var userId int
 
 	tx, err := repo.db.Begin()
 	if err != nil {
 		log.Printf("An error ocurred while starting transaction: %s", err.Error())
-		return nil, &models.CustomError{
-			Message: "error while creating user",
+		return 0, &models.CustomError{
+			Message:    "error while verifying email",
+			AppContext: appContext,
 		}
 	}
 
 	defer tx.Rollback()
 
-	err = repo.db.QueryRow(addUserQuery, user.Username, user.Email, user.Password).Scan(&newId)
+	err = tx.QueryRow(consumeEmailVerificationQuery, tokenHash).Scan(&userId)
 	if err != nil {
-		log.Printf("An error ocurred while creating user: %s", err.Error())
-		return nil, &models.CustomError{
-			Message: "error while creating user",
+		if err == sql.ErrNoRows {
+			return 0, &models.CustomError{
+				Message:    "Invalid or expired verification token",
+				Code:       http.StatusBadRequest,
+				AppContext: appContext,
+			}
+		}
+
+		log.Printf("An error ocurred while consuming verification token: %s", err.Error())
+		return 0, &models.CustomError{
+			Message:    "error while verifying email",
+			AppContext: appContext,
 		}
 	}
 
-	tx.Commit()
+	_, err = tx.Exec(setEmailVerifiedQuery, userId, true)
+	if err != nil {
+		log.Printf("An error ocurred while verifying email of user %d: %s", userId, err.Error())
+		return 0, &models.CustomError{
+			Message:    "error while verifying email",
+			AppContext: appContext,
+		}
+	}
+
+	_, err = tx.Exec(deleteUserEmailVerificationsQuery, userId)
+	if err != nil {
+		log.Printf("An error ocurred while deleting verification tokens of user %d: %s", userId, err.Error())
+		return 0, &models.CustomError{
+			Message:    "error while verifying email",
+			AppContext: appContext,
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Printf("An error ocurred while commiting email verification: %s", err.Error())
+		return 0, &models.CustomError{
+			Message:    "error while verifying email",
+			AppContext: appContext,
+		}
+	}
+
+	return userId, nil
+}
+
+// Records an account or IP lockout. The user ID is empty when the locked email does not belong to any user.
+func (repo *ChatRepo) AddLoginLockout(lockout *models.LoginLockout) (*int, error) {
+	var newId *int
+
+	err := repo.db.QueryRow(
+		addLoginLockoutQuery,
+		lockout.UserID,
+		lockout.Email,
+		lockout.IPAddress,
+		lockout.Reason,
+		lockout.LockedUntil,
+	).Scan(&newId)
+	if err != nil {
+		log.Printf("An error ocurred while recording login lockout of %s: %s", lockout.Email, err.Error())
+		return nil, &models.CustomError{
+			Message: "error while recording login lockout",
+		}
+	}
 
 	return newId, nil
 }
 
-// Gets all the chatrooms in the system.
-func (repo *ChatRepo) GetAllChatRooms() ([]*models.Chatroom, error) {
-	rows, err := repo.db.Query(getAllChatRoomsQuery)
+// Marks the active lockouts of the user as unlocked by the provided admin.
+func (repo *ChatRepo) UnlockLoginLockouts(userId, adminId int) error {
+	_, err := repo.db.Exec(unlockLoginLockoutsQuery, userId, adminId)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, nil
+		log.Printf("An error ocurred while unlocking user %d: %s", userId, err.Error())
+		return &models.CustomError{
+			Message: "error while unlocking user",
 		}
+	}
 
-		log.Printf("An error ocurred while getting all chatrooms: %s", err.Error())
+	return nil
+}
+
+// Gets the last 50 lockouts of the user, newest first.
+func (repo *ChatRepo) GetUserLoginLockouts(userId int) ([]*models.LoginLockout, error) {
+	rows, err := repo.db.Query(getUserLoginLockoutsQuery, userId)
+	if err != nil {
+		log.Printf("An error ocurred while getting lockouts of user %d: %s", userId, err.Error())
 		return nil, &models.CustomError{
-			Message: "error while getting all chatrooms",
+			Message: "error while getting login lockouts",
 		}
 	}
 
-	response := []*models.Chatroom{}
+	defer rows.Close()
+
+	response := []*models.LoginLockout{}
 
 	for rows.Next() {
-		chatroom := &models.Chatroom{}
+		lockout := &models.LoginLockout{}
 
 		err = rows.Scan(
-			&chatroom.Id,
-			&chatroom.Name,
+			&lockout.Id,
+			&lockout.UserID,
+			&lockout.Email,
+			&lockout.IPAddress,
+			&lockout.Reason,
+			&lockout.LockedUntil,
+			&lockout.CreatedAt,
+			&lockout.UnlockedAt,
+			&lockout.UnlockedBy,
 		)
 		if err != nil {
-			log.Printf("An error ocurred while getting scanning chatrooms: %s", err.Error())
+			log.Printf("An error ocurred while scanning login lockouts: %s", err.Error())
 			return nil, &models.CustomError{
-				Message: "error while getting scanning chatrooms",
+				Message: "error while scanning login lockouts",
 			}
 		}
 
-		response = append(response, chatroom)
+		response = append(response, lockout)
 	}
 
 	return response, nil
 }
 
-// Gets the last 50 messages from the Chatroom. It's when a user joins a chatroom.
-func (repo *ChatRepo) GetChatroomMessages(chatroomId string) ([]*models.ChatMessage, error) {
-	rows, err := repo.db.Query(getChatroomMessagesQuery, chatroomId)
+// Adds the message to the DB. Will throw errors if the provided userId or chatroomId do not exist due to foreign key constraints.
+// A message that already has its ID, from ReserveMessageIds, is only saved once. Returns nil if it was already saved.
+func (repo *ChatRepo) AddMessage(chatMessage models.ChatMessage) (*int, error) {
+	var newId *int
+
+	tx, err := repo.db.Begin()
+	if err != nil {
+		log.Printf("An error ocurred while starting transaction: %s", err.Error())
+		return nil, &models.CustomError{
+			Message: "error while adding message",
+		}
+	}
+
+	defer tx.Rollback()
+
+	args := []any{
+		chatMessage.UserID,
+		chatMessage.ChatroomID,
+		chatMessage.Message,
+		messageType(chatMessage),
+		nullablePayload(chatMessage.Payload),
+	}
+
+	query := addMessageQuery
+	if chatMessage.Id != 0 {
+		query = addMessageWithIdQuery
+		args = append([]any{chatMessage.Id}, args...)
+	}
+
+	err = repo.db.QueryRow(query, args...).Scan(&newId)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil
 		}
 
-		log.Printf("An error ocurred while getting chatroom messages: %s", err.Error())
+		log.Printf("An error ocurred while inserting message: %s", err.Error())
 		return nil, &models.CustomError{
-			Message: "error while getting chatroom messages",
+			Message: "error while inserting message",
 		}
+
 	}
 
-	response := []*models.ChatMessage{}
+	tx.Commit()
+
+	return newId, nil
+}
+
+// Takes the next IDs of the messages sequence, so the server can number the messages before saving them.
+func (repo *ChatRepo) ReserveMessageIds(count int) ([]int, error) {
+	rows, err := repo.db.Query(reserveMessageIdsQuery, count)
+	if err != nil {
+		log.Printf("An error ocurred while reserving message ids: %s", err.Error())
+		return nil, &models.CustomError{
+			Message: "error while reserving message ids",
+		}
+	}
+	defer rows.Close()
 
+	ids := make([]int, 0, count)
 	for rows.Next() {
-		message := &models.ChatMessage{}
+		var id int
 
-		err = rows.Scan(
-			&message.Id,
-			&message.UserID,
-			&message.ChatroomID,
-			&message.Message,
-			&message.CreatedAt,
-			&message.UserName,
-		)
+		err = rows.Scan(&id)
 		if err != nil {
-			log.Printf("An error ocurred while getting scanning chatroom messages: %s", err.Error())
+			log.Printf("An error ocurred while scanning message ids: %s", err.Error())
 			return nil, &models.CustomError{
-				Message: "error while scanning chatroom messages",
+				Message: "error while reserving message ids",
 			}
 		}
 
-		response = append(response, message)
+		ids = append(ids, id)
 	}
 
-	return response, nil
+	return ids, rows.Err()
+}
+
+// Saves the messages with a single COPY, and the outbox messages they caused in the same transaction. The messages must
+// already have their ID, from ReserveMessageIds, and creation time.
+func (repo *ChatRepo) AddMessages(chatMessages []*models.ChatMessage, outbox []*models.OutboxMessage) error {
+	tx, err := repo.db.Begin()
+	if err != nil {
+		log.Printf("An error ocurred while starting transaction: %s", err.Error())
+		return &models.CustomError{
+			Message: "error while adding messages",
+		}
+	}
+
+	defer tx.Rollback()
+
+	if len(chatMessages) > 0 {
+		err = copyMessages(tx, chatMessages)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(outbox) > 0 {
+		err = addOutboxMessages(tx, outbox)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Printf("An error ocurred while committing messages: %s", err.Error())
+		return &models.CustomError{
+			Message: "error while inserting messages",
+		}
+	}
+
+	return nil
+}
+
+func copyMessages(tx *sql.Tx, chatMessages []*models.ChatMessage) error {
+	stmt, err := tx.Prepare(addMessagesQuery)
+	if err != nil {
+		log.Printf("An error ocurred while preparing messages copy: %s", err.Error())
+		return &models.CustomError{
+			Message: "error while adding messages",
+		}
+	}
+	defer stmt.Close()
+
+	for _, chatMessage := range chatMessages {
+		// The text format of COPY would take the payload bytes as bytea.
+		var payload any
+		if len(chatMessage.Payload) > 0 {
+			payload = string(chatMessage.Payload)
+		}
+
+		_, err = stmt.Exec(
+			chatMessage.Id,
+			chatMessage.UserID,
+			chatMessage.ChatroomID,
+			chatMessage.Message,
+			messageType(*chatMessage),
+			payload,
+			chatMessage.CreatedAt,
+		)
+		if err != nil {
+			log.Printf("An error ocurred while copying message %d: %s", chatMessage.Id, err.Error())
+			return &models.CustomError{
+				Message: "error while adding messages",
+			}
+		}
+	}
+
+	_, err = stmt.Exec()
+	if err != nil {
+		log.Printf("An error ocurred while inserting messages: %s", err.Error())
+		return &models.CustomError{
+			Message: "error while inserting messages",
+		}
+	}
+
+	return nil
+}
+
+func addOutboxMessages(tx *sql.Tx, outbox []*models.OutboxMessage) error {
+	queues := make([]string, len(outbox))
+	bodies := make([][]byte, len(outbox))
+	for i, msg := range outbox {
+		queues[i] = msg.Queue
+		bodies[i] = msg.Body
+	}
+
+	_, err := tx.Exec(addOutboxMessagesQuery, pq.Array(queues), pq.Array(bodies))
+	if err != nil {
+		log.Printf("An error ocurred while adding outbox messages: %s", err.Error())
+		return &models.CustomError{
+			Message: "error while adding outbox messages",
+		}
+	}
+
+	return nil
+}
+
+// Saves the outbox messages announcing the new row in its transaction. announce may be nil.
+func addAnnouncement(tx *sql.Tx, announce models.Announcement, id int) error {
+	if announce == nil {
+		return nil
+	}
+
+	outbox, err := announce(id)
+	if err != nil {
+		log.Printf("An error ocurred while building the outbox messages of row %d: %s", id, err.Error())
+		return &models.CustomError{
+			Message: "error while adding outbox messages",
+		}
+	}
+
+	if len(outbox) == 0 {
+		return nil
+	}
+
+	return addOutboxMessages(tx, outbox)
+}
+
+// Adds the messages to the outbox, to be published by the relay.
+func (repo *ChatRepo) AddOutboxMessages(outbox []*models.OutboxMessage) error {
+	return repo.AddMessages(nil, outbox)
+}
+
+// Takes the next pending outbox messages, in the order they were added. Claimed messages are not taken again until
+// the lease expires, in case the relay stops before publishing them.
+func (repo *ChatRepo) ClaimOutboxMessages(limit int, lease time.Duration) ([]*models.OutboxMessage, error) {
+	rows, err := repo.db.Query(claimOutboxMessagesQuery, limit, lease.Milliseconds())
+	if err != nil {
+		log.Printf("An error ocurred while claiming outbox messages: %s", err.Error())
+		return nil, &models.CustomError{
+			Message: "error while claiming outbox messages",
+		}
+	}
+
+	defer rows.Close()
+
+	response := []*models.OutboxMessage{}
+
+	for rows.Next() {
+		msg := &models.OutboxMessage{}
+
+		err = rows.Scan(&msg.Id, &msg.Queue, &msg.Body, &msg.Attempts, &msg.CreatedAt)
+		if err != nil {
+			log.Printf("An error ocurred while scanning outbox messages: %s", err.Error())
+			return nil, &models.CustomError{
+				Message: "error while scanning outbox messages",
+			}
+		}
+
+		response = append(response, msg)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		log.Printf("An error ocurred while claiming outbox messages: %s", err.Error())
+		return nil, &models.CustomError{
+			Message: "error while claiming outbox messages",
+		}
+	}
+
+	return response, nil
+}
+
+func (repo *ChatRepo) MarkOutboxMessagesSent(ids []int) error {
+	_, err := repo.db.Exec(markOutboxSentQuery, pq.Array(ids))
+	if err != nil {
+		log.Printf("An error ocurred while marking outbox messages as sent: %s", err.Error())
+		return &models.CustomError{
+			Message: "error while marking outbox messages as sent",
+		}
+	}
+
+	return nil
+}
+
+// Leaves the message pending until availableAt, recording why it could not be published.
+func (repo *ChatRepo) RetryOutboxMessage(id int, availableAt time.Time, lastError string) error {
+	_, err := repo.db.Exec(retryOutboxMessageQuery, id, availableAt, lastError)
+	if err != nil {
+		log.Printf("An error ocurred while retrying outbox message %d: %s", id, err.Error())
+		return &models.CustomError{
+			Message: "error while retrying outbox message",
+		}
+	}
+
+	return nil
+}
+
+// Removes the messages sent before the provided time. Returns how many were removed.
+func (repo *ChatRepo) DeleteSentOutboxMessages(before time.Time) (int64, error) {
+	result, err := repo.db.Exec(deleteSentOutboxQuery, before)
+	if err != nil {
+		log.Printf("An error ocurred while deleting sent outbox messages: %s", err.Error())
+		return 0, &models.CustomError{
+			Message: "error while deleting sent outbox messages",
+		}
+	}
+
+	return result.RowsAffected()
+}
+
+// Adds an user. The password must be already hashed. We first validate the email, username and password. Then we check if the email or password is already used.
+func (repo *ChatRepo) AddUser(user *models.User) (*int, error) {
+	err := user.ValidateRequiredFields()
+	if err != nil {
+		log.Println(err.Error())
+		return nil, err
+	}
+
+	_, err = mail.ParseAddress(user.Email)
+	if err != nil {
+		return nil, &models.CustomError{
+			Message: fmt.Sprintf("invalid email: %s", user.Email),
+		}
+	}
+
+	exists, err := repo.checkIfEmailOrUsernameExists(user.Email, user.Username)
+	if err != nil {
+		return nil, err
+	}
+
+	if exists {
+		return nil, &models.CustomError{
+			Message: fmt.Sprintf("email: %s or username: %s is already registered", user.Email, user.Username),
+		}
+
+	}
+
+	var newId *int
+
+	tx, err := repo.db.Begin()
+	if err != nil {
+		log.Printf("An error ocurred while starting transaction: %s", err.Error())
+		return nil, &models.CustomError{
+			Message: "error while creating user",
+		}
+	}
+
+	defer tx.Rollback()
+
+	err = repo.db.QueryRow(addUserQuery, user.Username, user.Email, user.Password).Scan(&newId)
+	if err != nil {
+		log.Printf("An error ocurred while creating user: %s", err.Error())
+		return nil, &models.CustomError{
+			Message: "error while creating user",
+		}
+	}
+
+	tx.Commit()
+
+	return newId, nil
+}
+
+// Domain used to build the email of service accounts, since every user requires a unique email.
+const serviceAccountEmailDomain = "service-accounts.local"
+
+// Adds a service account. Service accounts have their email verified and an unusable password,
+// they can only authenticate with API tokens.
+func (repo *ChatRepo) AddServiceAccount(username string) (*int, error) {
+	err := (&models.User{Username: username}).ValidateServiceAccount()
+	if err != nil {
+		return nil, err
+	}
+
+	email := fmt.Sprintf("%s@%s", username, serviceAccountEmailDomain)
+
+	exists, err := repo.checkIfEmailOrUsernameExists(email, username)
+	if err != nil {
+		return nil, err
+	}
+
+	if exists {
+		return nil, &models.CustomError{
+			Message: fmt.Sprintf("username: %s is already registered", username),
+			Code:    http.StatusConflict,
+		}
+	}
+
+	var newId *int
+
+	err = repo.db.QueryRow(addServiceAccountQuery, username, email).Scan(&newId)
+	if err != nil {
+		log.Printf("An error ocurred while creating service account: %s", err.Error())
+		return nil, &models.CustomError{
+			Message: "error while creating service account",
+		}
+	}
+
+	return newId, nil
+}
+
+// Adds an API token. The token must be validated and hashed before calling this method.
+func (repo *ChatRepo) AddAPIToken(token *models.APIToken) (*int, error) {
+	var newId *int
+
+	err := repo.db.QueryRow(addAPITokenQuery, token.UserID, token.Name, token.TokenHash, pq.Array(token.Scopes)).Scan(&newId)
+	if err != nil {
+		log.Printf("An error ocurred while creating API token: %s", err.Error())
+		return nil, &models.CustomError{
+			Message: "error while creating API token",
+		}
+	}
+
+	return newId, nil
+}
+
+// Gets the active API token with the provided hash. Returns nil if the token does not exist or was revoked.
+func (repo *ChatRepo) GetAPITokenByHash(tokenHash string) (*models.APIToken, error) {
+	token := &models.APIToken{}
+
+	err := scanAPIToken(repo.db.QueryRow(getAPITokenByHashQuery, tokenHash), token)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+
+		log.Printf("An error ocurred while searching for API token: %s", err.Error())
+		return nil, &models.CustomError{
+			Message: "error while searching for API token",
+		}
+	}
+
+	return token, nil
+}
+
+// Gets every API token of the user, including the revoked ones.
+func (repo *ChatRepo) GetUserAPITokens(userId int) ([]*models.APIToken, error) {
+	rows, err := repo.db.Query(getUserAPITokensQuery, userId)
+	if err != nil {
+		log.Printf("An error ocurred while getting API tokens of user %d: %s", userId, err.Error())
+		return nil, &models.CustomError{
+			Message: "error while getting API tokens",
+		}
+	}
+
+	defer rows.Close()
+
+	response := []*models.APIToken{}
+
+	for rows.Next() {
+		token := &models.APIToken{}
+
+		err = scanAPIToken(rows, token)
+		if err != nil {
+			log.Printf("An error ocurred while scanning API tokens: %s", err.Error())
+			return nil, &models.CustomError{
+				Message: "error while scanning API tokens",
+			}
+		}
+
+		response = append(response, token)
+	}
+
+	return response, nil
+}
+
+// Gets the hashes of the active API tokens of the user with the provided scope, e.g. to check what they signed.
+func (repo *ChatRepo) GetUserTokenHashes(userId int, scope string) ([]string, error) {
+	rows, err := repo.db.Query(getUserTokenHashesQuery, userId, scope)
+	if err != nil {
+		log.Printf("An error ocurred while getting API tokens of user %d: %s", userId, err.Error())
+		return nil, &models.CustomError{
+			Message: "error while getting API tokens",
+		}
+	}
+
+	defer rows.Close()
+
+	hashes := []string{}
+
+	for rows.Next() {
+		var hash string
+
+		err = rows.Scan(&hash)
+		if err != nil {
+			log.Printf("An error ocurred while scanning API tokens: %s", err.Error())
+			return nil, &models.CustomError{
+				Message: "error while scanning API tokens",
+			}
+		}
+
+		hashes = append(hashes, hash)
+	}
+
+	return hashes, rows.Err()
+}
+
+// Updates the last time the token was used.
+func (repo *ChatRepo) TouchAPIToken(id int) error {
+	_, err := repo.db.Exec(touchAPITokenQuery, id)
+	if err != nil {
+		log.Printf("An error ocurred while updating API token %d: %s", id, err.Error())
+		return &models.CustomError{
+			Message: "error while updating API token",
+		}
+	}
+
+	return nil
+}
+
+// Revokes the API token. Revoked tokens are kept for auditing but can not be used anymore.
+func (repo *ChatRepo) RevokeAPIToken(id int) error {
+	result, err := repo.db.Exec(revokeAPITokenQuery, id)
+	if err != nil {
+		log.Printf("An error ocurred while revoking API token %d: %s", id, err.Error())
+		return &models.CustomError{
+			Message: "error while revoking API token",
+		}
+	}
+
+	affected, err := result.RowsAffected()
+	if err == nil && affected == 0 {
+		return &models.CustomError{
+			Message: fmt.Sprintf("Active API token with ID: %d does not exists", id),
+			Code:    http.StatusNotFound,
+		}
+	}
+
+	return nil
+}
+
+func scanAPIToken(row rowScanner, token *models.APIToken) error {
+	return row.Scan(
+		&token.Id,
+		&token.UserID,
+		&token.UserName,
+		&token.Name,
+		pq.Array(&token.Scopes),
+		&token.CreatedAt,
+		&token.LastUsedAt,
+		&token.RevokedAt,
+	)
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// Scans a row selected with userColumns into the provided user.
+func scanUser(row rowScanner, user *models.User) error {
+	return row.Scan(
+		&user.Id,
+		&user.Username,
+		&user.Email,
+		&user.Password,
+		&user.EmailVerified,
+		&user.IsAdmin,
+		&user.IsServiceAccount,
+		&user.DisplayName,
+		&user.AvatarURL,
+		&user.StatusText,
+		&user.TimeZone,
+	)
+}
+
+// Gets all the chatrooms in the system.
+func (repo *ChatRepo) GetAllChatRooms() ([]*models.Chatroom, error) {
+	rows, err := repo.db.Query(getAllChatRoomsQuery)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+
+		log.Printf("An error ocurred while getting all chatrooms: %s", err.Error())
+		return nil, &models.CustomError{
+			Message: "error while getting all chatrooms",
+		}
+	}
+
+	response := []*models.Chatroom{}
+
+	for rows.Next() {
+		chatroom := &models.Chatroom{}
+
+		err = rows.Scan(
+			&chatroom.Id,
+			&chatroom.Name,
+			&chatroom.OwnerID,
+		)
+		if err != nil {
+			log.Printf("An error ocurred while getting scanning chatrooms: %s", err.Error())
+			return nil, &models.CustomError{
+				Message: "error while getting scanning chatrooms",
+			}
+		}
+
+		response = append(response, chatroom)
+	}
+
+	return response, nil
+}
+
+// Gets the last 50 messages from the Chatroom. It's when a user joins a chatroom.
+func (repo *ChatRepo) GetChatroomMessages(chatroomId string) ([]*models.ChatMessage, error) {
+	rows, err := repo.db.Query(getChatroomMessagesQuery, chatroomId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+
+		log.Printf("An error ocurred while getting chatroom messages: %s", err.Error())
+		return nil, &models.CustomError{
+			Message: "error while getting chatroom messages",
+		}
+	}
+
+	response := []*models.ChatMessage{}
+
+	for rows.Next() {
+		message := &models.ChatMessage{}
+		var payload []byte
+
+		err = rows.Scan(
+			&message.Id,
+			&message.UserID,
+			&message.ChatroomID,
+			&message.Message,
+			&message.CreatedAt,
+			&message.Type,
+			&payload,
+			&message.UserName,
+			&message.IsBot,
+		)
+		if err != nil {
+			log.Printf("An error ocurred while getting scanning chatroom messages: %s", err.Error())
+			return nil, &models.CustomError{
+				Message: "error while scanning chatroom messages",
+			}
+		}
+
+		message.Payload = payload
+		response = append(response, message)
+	}
+
+	return response, nil
+}
+
+// Gets the type of the message, messages without one are plain text.
+func messageType(chatMessage models.ChatMessage) string {
+	if chatMessage.Type == "" {
+		return models.MessageTypeText
+	}
+
+	return chatMessage.Type
+}
+
+// Stores NULL instead of an empty payload.
+func nullablePayload(payload json.RawMessage) any {
+	if len(payload) == 0 {
+		return nil
+	}
+
+	return []byte(payload)
+}
+
+// Adds the alert along with the outbox messages announcing it.
+func (repo *ChatRepo) AddPriceAlert(alert *models.PriceAlert, announce models.Announcement) (*int, error) {
+	var newId *int
+
+	tx, err := repo.db.Begin()
+	if err != nil {
+		log.Printf("An error ocurred while starting transaction: %s", err.Error())
+		return nil, &models.CustomError{
+			Message: "error while creating price alert",
+		}
+	}
+
+	defer tx.Rollback()
+
+	err = tx.QueryRow(addPriceAlertQuery, alert.UserID, alert.ChatroomID, alert.Symbol, alert.Operator, alert.Target).Scan(&newId)
+	if err != nil {
+		log.Printf("An error ocurred while creating price alert: %s", err.Error())
+		return nil, &models.CustomError{
+			Message: "error while creating price alert",
+		}
+	}
+
+	err = addAnnouncement(tx, announce, *newId)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Printf("An error ocurred while committing price alert: %s", err.Error())
+		return nil, &models.CustomError{
+			Message: "error while creating price alert",
+		}
+	}
+
+	return newId, nil
+}
+
+// Gets the alerts of the user in the chatroom that have not been triggered.
+func (repo *ChatRepo) GetUserPriceAlerts(userId int, chatroomId string) ([]*models.PriceAlert, error) {
+	return repo.getPriceAlerts(getUserPriceAlertsQuery, userId, chatroomId)
+}
+
+// Gets the alerts of every user that have not been triggered.
+func (repo *ChatRepo) GetActivePriceAlerts() ([]*models.PriceAlert, error) {
+	return repo.getPriceAlerts(getActivePriceAlertsQuery)
+}
+
+func (repo *ChatRepo) getPriceAlerts(query string, args ...any) ([]*models.PriceAlert, error) {
+	rows, err := repo.db.Query(query, args...)
+	if err != nil {
+		log.Printf("An error ocurred while getting price alerts: %s", err.Error())
+		return nil, &models.CustomError{
+			Message: "error while getting price alerts",
+		}
+	}
+
+	defer rows.Close()
+
+	response := []*models.PriceAlert{}
+
+	for rows.Next() {
+		alert := &models.PriceAlert{}
+
+		err = rows.Scan(
+			&alert.Id,
+			&alert.UserID,
+			&alert.ChatroomID,
+			&alert.Symbol,
+			&alert.Operator,
+			&alert.Target,
+			&alert.CreatedAt,
+			&alert.TriggeredAt,
+			&alert.UserName,
+		)
+		if err != nil {
+			log.Printf("An error ocurred while scanning price alerts: %s", err.Error())
+			return nil, &models.CustomError{
+				Message: "error while scanning price alerts",
+			}
+		}
+
+		response = append(response, alert)
+	}
+
+	return response, nil
+}
+
+// Deletes an alert of the user in the chatroom along with the outbox messages announcing it. Returns a not found
+// error if the user has no such alert.
+func (repo *ChatRepo) DeletePriceAlert(id int, userId int, chatroomId string, outbox []*models.OutboxMessage) error {
+	tx, err := repo.db.Begin()
+	if err != nil {
+		log.Printf("An error ocurred while starting transaction: %s", err.Error())
+		return &models.CustomError{
+			Message: "error while deleting price alert",
+		}
+	}
+
+	defer tx.Rollback()
+
+	result, err := tx.Exec(deletePriceAlertQuery, id, userId, chatroomId)
+	if err != nil {
+		log.Printf("An error ocurred while deleting price alert %d: %s", id, err.Error())
+		return &models.CustomError{
+			Message: "error while deleting price alert",
+		}
+	}
+
+	affected, err := result.RowsAffected()
+	if err == nil && affected == 0 {
+		return &models.CustomError{
+			Message: fmt.Sprintf("Price alert with ID: %d does not exists", id),
+			Code:    http.StatusNotFound,
+		}
+	}
+
+	if len(outbox) > 0 {
+		err = addOutboxMessages(tx, outbox)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Printf("An error ocurred while committing the deletion of price alert %d: %s", id, err.Error())
+		return &models.CustomError{
+			Message: "error while deleting price alert",
+		}
+	}
+
+	return nil
+}
+
+// Marks the alert as triggered and saves the outbox messages announcing it. Returns false if it was already triggered,
+// so an alert is only announced once.
+func (repo *ChatRepo) TriggerPriceAlert(id int, outbox []*models.OutboxMessage) (bool, error) {
+	tx, err := repo.db.Begin()
+	if err != nil {
+		log.Printf("An error ocurred while starting transaction: %s", err.Error())
+		return false, &models.CustomError{
+			Message: "error while triggering price alert",
+		}
+	}
+
+	defer tx.Rollback()
+
+	result, err := tx.Exec(triggerPriceAlertQuery, id)
+	if err != nil {
+		log.Printf("An error ocurred while triggering price alert %d: %s", id, err.Error())
+		return false, &models.CustomError{
+			Message: "error while triggering price alert",
+		}
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	if affected == 0 {
+		return false, nil
+	}
+
+	if len(outbox) > 0 {
+		err = addOutboxMessages(tx, outbox)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Printf("An error ocurred while committing the trigger of price alert %d: %s", id, err.Error())
+		return false, &models.CustomError{
+			Message: "error while triggering price alert",
+		}
+	}
+
+	return true, nil
+}
+
+// Adds the scheduled message along with the outbox messages announcing it, announce may be nil.
+func (repo *ChatRepo) AddScheduledMessage(message *models.ScheduledMessage, announce models.Announcement) (*int, error) {
+	var newId *int
+
+	tx, err := repo.db.Begin()
+	if err != nil {
+		log.Printf("An error ocurred while starting transaction: %s", err.Error())
+		return nil, &models.CustomError{
+			Message: "error while creating scheduled message",
+		}
+	}
+
+	defer tx.Rollback()
+
+	err = tx.QueryRow(
+		addScheduledMessageQuery,
+		message.UserID,
+		message.ChatroomID,
+		message.Kind,
+		message.Message,
+		message.DeliverAt.UTC(),
+	).Scan(&newId)
+	if err != nil {
+		log.Printf("An error ocurred while creating scheduled message: %s", err.Error())
+		return nil, &models.CustomError{
+			Message: "error while creating scheduled message",
+		}
+	}
+
+	err = addAnnouncement(tx, announce, *newId)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Printf("An error ocurred while committing scheduled message: %s", err.Error())
+		return nil, &models.CustomError{
+			Message: "error while creating scheduled message",
+		}
+	}
+
+	return newId, nil
+}
+
+// Marks up to limit due messages as delivered and returns them. Rows claimed by another instance are skipped,
+// so every message is delivered by a single instance.
+func (repo *ChatRepo) ClaimDueScheduledMessages(limit int, lease time.Duration) ([]*models.ScheduledMessage, error) {
+	rows, err := repo.db.Query(claimDueScheduledMessagesQuery, limit, lease.Milliseconds())
+	if err != nil {
+		log.Printf("An error ocurred while claiming scheduled messages: %s", err.Error())
+		return nil, &models.CustomError{
+			Message: "error while claiming scheduled messages",
+		}
+	}
+
+	defer rows.Close()
+
+	response := []*models.ScheduledMessage{}
+
+	for rows.Next() {
+		message := &models.ScheduledMessage{}
+
+		err = rows.Scan(
+			&message.Id,
+			&message.UserID,
+			&message.ChatroomID,
+			&message.Kind,
+			&message.Message,
+			&message.DeliverAt,
+			&message.CreatedAt,
+			&message.DeliveredAt,
+			&message.UserName,
+		)
+		if err != nil {
+			log.Printf("An error ocurred while scanning scheduled messages: %s", err.Error())
+			return nil, &models.CustomError{
+				Message: "error while scanning scheduled messages",
+			}
+		}
+
+		response = append(response, message)
+	}
+
+	return response, nil
+}
+
+// Marks a claimed message as delivered, saving the outbox messages that post it in the same transaction.
+func (repo *ChatRepo) MarkScheduledMessageDelivered(id int, outbox []*models.OutboxMessage) error {
+	tx, err := repo.db.Begin()
+	if err != nil {
+		log.Printf("An error ocurred while starting transaction: %s", err.Error())
+		return &models.CustomError{
+			Message: "error while marking scheduled message as delivered",
+		}
+	}
+
+	defer tx.Rollback()
+
+	_, err = tx.Exec(markScheduledMessageDeliveredQuery, id)
+	if err != nil {
+		log.Printf("An error ocurred while marking scheduled message %d as delivered: %s", id, err.Error())
+		return &models.CustomError{
+			Message: "error while marking scheduled message as delivered",
+		}
+	}
+
+	if len(outbox) > 0 {
+		err = addOutboxMessages(tx, outbox)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Printf("An error ocurred while committing the delivery of scheduled message %d: %s", id, err.Error())
+		return &models.CustomError{
+			Message: "error while marking scheduled message as delivered",
+		}
+	}
+
+	return nil
+}
+
+// Marks a claimed message as pending again, so it is retried when its delivery failed.
+func (repo *ChatRepo) ReleaseScheduledMessage(id int) error {
+	_, err := repo.db.Exec(releaseScheduledMessageQuery, id)
+	if err != nil {
+		log.Printf("An error ocurred while releasing scheduled message %d: %s", id, err.Error())
+		return &models.CustomError{
+			Message: "error while releasing scheduled message",
+		}
+	}
+
+	return nil
+}
+
+func (repo *ChatRepo) AddChatroomWebhook(webhook *models.ChatroomWebhook) (*int, error) {
+	var newId *int
+
+	err := repo.db.QueryRow(
+		addChatroomWebhookQuery,
+		webhook.ChatroomID,
+		webhook.CreatedBy,
+		webhook.URL,
+		webhook.Secret,
+		webhook.TriggerWord,
+	).Scan(&newId)
+	if err != nil {
+		log.Printf("An error ocurred while creating chatroom webhook: %s", err.Error())
+		return nil, &models.CustomError{
+			Message: "error while creating chatroom webhook",
+		}
+	}
+
+	return newId, nil
+}
+
+// Gets the webhooks of the chatroom, including their secrets so the deliveries can be signed.
+func (repo *ChatRepo) GetChatroomWebhooks(chatroomId string) ([]*models.ChatroomWebhook, error) {
+	rows, err := repo.db.Query(getChatroomWebhooksQuery, chatroomId)
+	if err != nil {
+		log.Printf("An error ocurred while getting webhooks of chatroom %s: %s", chatroomId, err.Error())
+		return nil, &models.CustomError{
+			Message: "error while getting chatroom webhooks",
+		}
+	}
+
+	defer rows.Close()
+
+	response := []*models.ChatroomWebhook{}
+
+	for rows.Next() {
+		webhook := &models.ChatroomWebhook{}
+
+		err = rows.Scan(
+			&webhook.Id,
+			&webhook.ChatroomID,
+			&webhook.CreatedBy,
+			&webhook.URL,
+			&webhook.Secret,
+			&webhook.TriggerWord,
+			&webhook.CreatedAt,
+		)
+		if err != nil {
+			log.Printf("An error ocurred while scanning chatroom webhooks: %s", err.Error())
+			return nil, &models.CustomError{
+				Message: "error while scanning chatroom webhooks",
+			}
+		}
+
+		response = append(response, webhook)
+	}
+
+	return response, nil
+}
+
+// Deletes the webhook of the chatroom along with its delivery log.
+func (repo *ChatRepo) DeleteChatroomWebhook(id int, chatroomId string) error {
+	result, err := repo.db.Exec(deleteChatroomWebhookQuery, id, chatroomId)
+	if err != nil {
+		log.Printf("An error ocurred while deleting chatroom webhook %d: %s", id, err.Error())
+		return &models.CustomError{
+			Message: "error while deleting chatroom webhook",
+		}
+	}
+
+	affected, err := result.RowsAffected()
+	if err == nil && affected == 0 {
+		return &models.CustomError{
+			Message: fmt.Sprintf("Webhook with ID: %d does not exists", id),
+			Code:    http.StatusNotFound,
+		}
+	}
+
+	return nil
+}
+
+func (repo *ChatRepo) AddWebhookDelivery(delivery *models.WebhookDelivery) (*int, error) {
+	var newId *int
+
+	var messageId *int
+	if delivery.MessageID != 0 {
+		messageId = &delivery.MessageID
+	}
+
+	err := repo.db.QueryRow(addWebhookDeliveryQuery, delivery.WebhookID, messageId, delivery.Status).Scan(&newId)
+	if err != nil {
+		log.Printf("An error ocurred while creating webhook delivery: %s", err.Error())
+		return nil, &models.CustomError{
+			Message: "error while creating webhook delivery",
+		}
+	}
+
+	return newId, nil
+}
+
+// Updates the status, attempts and last result of the delivery.
+func (repo *ChatRepo) UpdateWebhookDelivery(delivery *models.WebhookDelivery) error {
+	_, err := repo.db.Exec(
+		updateWebhookDeliveryQuery,
+		delivery.Id,
+		delivery.Status,
+		delivery.Attempts,
+		delivery.ResponseStatus,
+		delivery.Error,
+	)
+	if err != nil {
+		log.Printf("An error ocurred while updating webhook delivery %d: %s", delivery.Id, err.Error())
+		return &models.CustomError{
+			Message: "error while updating webhook delivery",
+		}
+	}
+
+	return nil
+}
+
+// Gets the latest deliveries of the webhook, up to limit.
+func (repo *ChatRepo) GetWebhookDeliveries(webhookId int, chatroomId string, limit int) ([]*models.WebhookDelivery, error) {
+	rows, err := repo.db.Query(getWebhookDeliveriesQuery, webhookId, chatroomId, limit)
+	if err != nil {
+		log.Printf("An error ocurred while getting deliveries of webhook %d: %s", webhookId, err.Error())
+		return nil, &models.CustomError{
+			Message: "error while getting webhook deliveries",
+		}
+	}
+
+	defer rows.Close()
+
+	response := []*models.WebhookDelivery{}
+
+	for rows.Next() {
+		delivery := &models.WebhookDelivery{}
+		var messageId *int
+
+		err = rows.Scan(
+			&delivery.Id,
+			&delivery.WebhookID,
+			&messageId,
+			&delivery.Status,
+			&delivery.Attempts,
+			&delivery.ResponseStatus,
+			&delivery.Error,
+			&delivery.CreatedAt,
+			&delivery.UpdatedAt,
+		)
+		if err != nil {
+			log.Printf("An error ocurred while scanning webhook deliveries: %s", err.Error())
+			return nil, &models.CustomError{
+				Message: "error while scanning webhook deliveries",
+			}
+		}
+
+		if messageId != nil {
+			delivery.MessageID = *messageId
+		}
+
+		response = append(response, delivery)
+	}
+
+	return response, nil
+}
+
+// Creates the service account of the integration and its incoming webhook in a single transaction. The token must be
+// hashed before calling this method.
+func (repo *ChatRepo) AddIncomingWebhook(webhook *models.IncomingWebhook) (*int, error) {
+	email := fmt.Sprintf("%s@%s", webhook.UserName, serviceAccountEmailDomain)
+
+	exists, err := repo.checkIfEmailOrUsernameExists(email, webhook.UserName)
+	if err != nil {
+		return nil, err
+	}
+
+	if exists {
+		return nil, &models.CustomError{
+			Message: fmt.Sprintf("username: %s is already registered", webhook.UserName),
+			Code:    http.StatusConflict,
+		}
+	}
+
+	tx, err := repo.db.Begin()
+	if err != nil {
+		log.Printf("An error ocurred while starting transaction: %s", err.Error())
+		return nil, &models.CustomError{
+			Message: "error while creating incoming webhook",
+		}
+	}
+
+	defer tx.Rollback()
+
+	var userId int
+
+	err = tx.QueryRow(addServiceAccountQuery, webhook.UserName, email).Scan(&userId)
+	if err != nil {
+		log.Printf("An error ocurred while creating incoming webhook user: %s", err.Error())
+		return nil, &models.CustomError{
+			Message: "error while creating incoming webhook",
+		}
+	}
+
+	var newId *int
+
+	err = tx.QueryRow(addIncomingWebhookQuery, webhook.ChatroomID, userId, webhook.CreatedBy, webhook.TokenHash).Scan(&newId)
+	if err != nil {
+		log.Printf("An error ocurred while creating incoming webhook: %s", err.Error())
+		return nil, &models.CustomError{
+			Message: "error while creating incoming webhook",
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Printf("An error ocurred while committing incoming webhook: %s", err.Error())
+		return nil, &models.CustomError{
+			Message: "error while creating incoming webhook",
+		}
+	}
+
+	webhook.UserID = userId
+
+	return newId, nil
+}
+
+// Gets the active incoming webhook with the provided token hash. Returns nil if it does not exist or was revoked.
+func (repo *ChatRepo) GetIncomingWebhookByHash(tokenHash string) (*models.IncomingWebhook, error) {
+	webhook := &models.IncomingWebhook{}
+
+	err := scanIncomingWebhook(repo.db.QueryRow(getIncomingWebhookByHashQuery, tokenHash), webhook)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+
+		log.Printf("An error ocurred while searching for incoming webhook: %s", err.Error())
+		return nil, &models.CustomError{
+			Message: "error while searching for incoming webhook",
+		}
+	}
+
+	return webhook, nil
+}
+
+// Gets every incoming webhook of the chatroom, including the revoked ones.
+func (repo *ChatRepo) GetChatroomIncomingWebhooks(chatroomId string) ([]*models.IncomingWebhook, error) {
+	rows, err := repo.db.Query(getChatroomIncomingWebhooksQuery, chatroomId)
+	if err != nil {
+		log.Printf("An error ocurred while getting incoming webhooks of chatroom %s: %s", chatroomId, err.Error())
+		return nil, &models.CustomError{
+			Message: "error while getting incoming webhooks",
+		}
+	}
+
+	defer rows.Close()
+
+	response := []*models.IncomingWebhook{}
+
+	for rows.Next() {
+		webhook := &models.IncomingWebhook{}
+
+		err = scanIncomingWebhook(rows, webhook)
+		if err != nil {
+			log.Printf("An error ocurred while scanning incoming webhooks: %s", err.Error())
+			return nil, &models.CustomError{
+				Message: "error while scanning incoming webhooks",
+			}
+		}
+
+		response = append(response, webhook)
+	}
+
+	return response, nil
+}
+
+// Updates the last time the incoming webhook was used.
+func (repo *ChatRepo) TouchIncomingWebhook(id int) error {
+	_, err := repo.db.Exec(touchIncomingWebhookQuery, id)
+	if err != nil {
+		log.Printf("An error ocurred while updating incoming webhook %d: %s", id, err.Error())
+		return &models.CustomError{
+			Message: "error while updating incoming webhook",
+		}
+	}
+
+	return nil
+}
+
+// Revokes the incoming webhook of the chatroom, its token stops working right away. Its service account is disabled
+// along with any API token it has.
+func (repo *ChatRepo) RevokeIncomingWebhook(id int, chatroomId string) error {
+	result, err := repo.db.Exec(revokeIncomingWebhookQuery, id, chatroomId)
+	if err != nil {
+		log.Printf("An error ocurred while revoking incoming webhook %d: %s", id, err.Error())
+		return &models.CustomError{
+			Message: "error while revoking incoming webhook",
+		}
+	}
+
+	affected, err := result.RowsAffected()
+	if err == nil && affected == 0 {
+		return &models.CustomError{
+			Message: fmt.Sprintf("Active incoming webhook with ID: %d does not exists", id),
+			Code:    http.StatusNotFound,
+		}
+	}
+
+	return nil
+}
+
+func scanIncomingWebhook(row rowScanner, webhook *models.IncomingWebhook) error {
+	return row.Scan(
+		&webhook.Id,
+		&webhook.ChatroomID,
+		&webhook.UserID,
+		&webhook.UserName,
+		&webhook.CreatedBy,
+		&webhook.CreatedAt,
+		&webhook.LastUsedAt,
+		&webhook.RevokedAt,
+	)
+}
+
+// Adds the poll to the DB along with the outbox messages announcing it. The created at of the poll is set by the DB,
+// the poll has its ID and votes by the time announce is called.
+func (repo *ChatRepo) AddPoll(poll *models.Poll, announce models.Announcement) (*int, error) {
+	var newId *int
+
+	tx, err := repo.db.Begin()
+	if err != nil {
+		log.Printf("An error ocurred while starting transaction: %s", err.Error())
+		return nil, &models.CustomError{
+			Message: "error while creating poll",
+		}
+	}
+
+	defer tx.Rollback()
+
+	err = tx.QueryRow(addPollQuery, poll.ChatroomID, poll.CreatedBy, poll.Question, pq.Array(poll.Options), poll.MultipleChoice).
+		Scan(&newId, &poll.CreatedAt)
+	if err != nil {
+		log.Printf("An error ocurred while creating poll: %s", err.Error())
+		return nil, &models.CustomError{
+			Message: "error while creating poll",
+		}
+	}
+
+	poll.Id = *newId
+	poll.Votes = make([]int, len(poll.Options))
+
+	err = addAnnouncement(tx, announce, poll.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Printf("An error ocurred while committing poll: %s", err.Error())
+		return nil, &models.CustomError{
+			Message: "error while creating poll",
+		}
+	}
+
+	return newId, nil
+}
+
+// Gets the poll of the chatroom with its current votes. Returns nil if the poll does not exist.
+func (repo *ChatRepo) GetPoll(id int, chatroomId string) (*models.Poll, error) {
+	poll := &models.Poll{}
+
+	err := scanPoll(repo.db.QueryRow(getPollQuery, id, chatroomId), poll)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+
+		log.Printf("An error ocurred while searching for poll %d: %s", id, err.Error())
+		return nil, &models.CustomError{
+			Message: "error while searching for poll",
+		}
+	}
+
+	err = loadPollVotes(repo.db, poll)
+	if err != nil {
+		log.Printf("An error ocurred while getting the votes of poll %d: %s", id, err.Error())
+		return nil, &models.CustomError{
+			Message: "error while searching for poll",
+		}
+	}
+
+	return poll, nil
+}
+
+// Replaces the vote of the user with the provided options and returns the poll with the updated votes. The poll is
+// locked while voting, so the votes of the user are never mixed.
+func (repo *ChatRepo) VotePoll(id int, chatroomId string, userId int, options []int) (*models.Poll, error) {
+	tx, poll, err := repo.lockPoll(id, chatroomId)
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback()
+
+	err = poll.ValidateVote(options)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec(deletePollVotesQuery, id, userId)
+	if err != nil {
+		log.Printf("An error ocurred while removing the votes of user %d in poll %d: %s", userId, id, err.Error())
+		return nil, &models.CustomError{
+			Message: "error while voting",
+		}
+	}
+
+	_, err = tx.Exec(addPollVotesQuery, id, userId, pq.Array(options))
+	if err != nil {
+		log.Printf("An error ocurred while voting in poll %d: %s", id, err.Error())
+		return nil, &models.CustomError{
+			Message: "error while voting",
+		}
+	}
+
+	err = loadPollVotes(tx, poll)
+	if err != nil {
+		log.Printf("An error ocurred while getting the votes of poll %d: %s", id, err.Error())
+		return nil, &models.CustomError{
+			Message: "error while voting",
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Printf("An error ocurred while committing vote in poll %d: %s", id, err.Error())
+		return nil, &models.CustomError{
+			Message: "error while voting",
+		}
+	}
+
+	return poll, nil
+}
+
+// Closes the poll and saves the message with its final votes, built by results, in the same transaction so the poll
+// is never closed without them. Only the user who created the poll can close it.
+func (repo *ChatRepo) ClosePoll(id int, chatroomId string, userId int, results func(*models.Poll) *models.ChatMessage) (*models.ChatMessage, error) {
+	tx, poll, err := repo.lockPoll(id, chatroomId)
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback()
+
+	if poll.CreatedBy != userId {
+		return nil, &models.CustomError{
+			Message: "Only the creator of the poll can close it",
+			Code:    http.StatusForbidden,
+		}
+	}
+
+	if poll.ClosedAt != nil {
+		return nil, &models.CustomError{
+			Message: fmt.Sprintf("Poll %d is already closed", id),
+			Code:    http.StatusConflict,
+		}
+	}
+
+	err = tx.QueryRow(closePollQuery, id).Scan(&poll.ClosedAt)
+	if err != nil {
+		log.Printf("An error ocurred while closing poll %d: %s", id, err.Error())
+		return nil, &models.CustomError{
+			Message: "error while closing poll",
+		}
+	}
+
+	err = loadPollVotes(tx, poll)
+	if err != nil {
+		log.Printf("An error ocurred while getting the votes of poll %d: %s", id, err.Error())
+		return nil, &models.CustomError{
+			Message: "error while closing poll",
+		}
+	}
+
+	msg := results(poll)
+
+	err = tx.QueryRow(addMessageQuery, msg.UserID, msg.ChatroomID, msg.Message, messageType(*msg), nullablePayload(msg.Payload)).
+		Scan(&msg.Id)
+	if err != nil {
+		log.Printf("An error ocurred while saving the results of poll %d: %s", id, err.Error())
+		return nil, &models.CustomError{
+			Message: "error while closing poll",
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Printf("An error ocurred while committing closed poll %d: %s", id, err.Error())
+		return nil, &models.CustomError{
+			Message: "error while closing poll",
+		}
+	}
+
+	return msg, nil
+}
+
+// Starts a transaction that locks the poll. The transaction must be rolled back or committed by the caller.
+func (repo *ChatRepo) lockPoll(id int, chatroomId string) (*sql.Tx, *models.Poll, error) {
+	tx, err := repo.db.Begin()
+	if err != nil {
+		log.Printf("An error ocurred while starting transaction: %s", err.Error())
+		return nil, nil, &models.CustomError{
+			Message: "error while searching for poll",
+		}
+	}
+
+	poll := &models.Poll{}
+
+	err = scanPoll(tx.QueryRow(lockPollQuery, id, chatroomId), poll)
+	if err != nil {
+		tx.Rollback()
+
+		if err == sql.ErrNoRows {
+			return nil, nil, &models.CustomError{
+				Message: fmt.Sprintf("Poll with ID: %d does not exists", id),
+				Code:    http.StatusNotFound,
+			}
+		}
+
+		log.Printf("An error ocurred while searching for poll %d: %s", id, err.Error())
+		return nil, nil, &models.CustomError{
+			Message: "error while searching for poll",
+		}
+	}
+
+	return tx, poll, nil
+}
+
+type rowsQueryer interface {
+	Query(query string, args ...any) (*sql.Rows, error)
+}
+
+// Counts the votes of every option of the poll and the users that voted.
+func loadPollVotes(db rowsQueryer, poll *models.Poll) error {
+	rows, err := db.Query(getPollVotesQuery, poll.Id)
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	poll.Votes = make([]int, len(poll.Options))
+	poll.Voters = 0
+
+	for rows.Next() {
+		var option, votes int
+
+		err := rows.Scan(&option, &votes, &poll.Voters)
+		if err != nil {
+			return err
+		}
+
+		if option >= 0 && option < len(poll.Votes) {
+			poll.Votes[option] = votes
+		}
+	}
+
+	return rows.Err()
+}
+
+func scanPoll(row rowScanner, poll *models.Poll) error {
+	return row.Scan(
+		&poll.Id,
+		&poll.ChatroomID,
+		&poll.CreatedBy,
+		&poll.Question,
+		pq.Array(&poll.Options),
+		&poll.MultipleChoice,
+		&poll.CreatedAt,
+		&poll.ClosedAt,
+	)
 }
@@ -2,8 +2,11 @@ package repos
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/raynine/go-chatroom/models"
@@ -12,6 +15,27 @@ import (
 
 var chatRoomId string = "78fa7046-f8fc-4435-aed5-798b31cfd3e1"
 
+var userRowColumns = []string{
+	"id", "username", "email", "password", "email_verified", "is_admin", "is_service_account",
+	"display_name", "avatar_url", "status_text", "time_zone",
+}
+
+func userRow(user *models.User) *sqlmock.Rows {
+	return sqlmock.NewRows(userRowColumns).AddRow(
+		user.Id,
+		user.Username,
+		user.Email,
+		user.Password,
+		user.EmailVerified,
+		user.IsAdmin,
+		user.IsServiceAccount,
+		user.DisplayName,
+		user.AvatarURL,
+		user.StatusText,
+		user.TimeZone,
+	)
+}
+
 func setupTestDB(t *testing.T) (*sql.DB, sqlmock.Sqlmock, *ChatRepo) {
 	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
 	if err != nil {
@@ -49,7 +73,7 @@ func TestGetChatroomByID(t *testing.T) {
 	t.Run("Success", func(t *testing.T) {
 		mock.ExpectQuery(getChatroomByIDQuery).
 			WithArgs(chatRoomId).
-			WillReturnRows(sqlmock.NewRows([]string{"id", "name"}).AddRow(chatRoomId, "CHATROOMTEST"))
+			WillReturnRows(sqlmock.NewRows([]string{"id", "name", "owner_id"}).AddRow(chatRoomId, "CHATROOMTEST", 23))
 
 		response, err := repo.GetChatroomByID(chatRoomId)
 		assert.Nil(t, err)
@@ -91,13 +115,7 @@ func TestFindUserByEmail(t *testing.T) {
 	t.Run("Success", func(t *testing.T) {
 		mock.ExpectQuery(findUserByEmailQuery).
 			WithArgs(user.Email).
-			WillReturnRows(sqlmock.NewRows([]string{"id", "username", "email", "password"}).
-				AddRow(
-					user.Id,
-					user.Username,
-					user.Email,
-					user.Password,
-				))
+			WillReturnRows(userRow(user))
 
 		response, err := repo.FindUserByEmail(user.Email)
 		assert.Nil(t, err)
@@ -182,13 +200,7 @@ func TestGetUserByEmail(t *testing.T) {
 	t.Run("Success", func(t *testing.T) {
 		mock.ExpectQuery(GetUserByEmailQuery).
 			WithArgs(user.Email).
-			WillReturnRows(sqlmock.NewRows([]string{"id", "username", "email", "password"}).
-				AddRow(
-					user.Id,
-					user.Username,
-					user.Email,
-					user.Password,
-				))
+			WillReturnRows(userRow(user))
 
 		response, err := repo.GetUserByEmail(user.Email)
 		assert.Nil(t, err)
@@ -198,6 +210,115 @@ func TestGetUserByEmail(t *testing.T) {
 	})
 }
 
+func TestGetUserByUsername(t *testing.T) {
+	db, mock, repo := setupTestDB(t)
+	defer db.Close()
+
+	user := &models.User{
+		Username:         "stockbot",
+		Email:            "stockbot@bot.com",
+		Password:         "!",
+		Id:               1,
+		IsServiceAccount: true,
+	}
+
+	t.Run("User does not exists", func(t *testing.T) {
+		mock.ExpectQuery(getUserByUsernameQuery).WithArgs("nobot").WillReturnError(sql.ErrNoRows)
+
+		response, err := repo.GetUserByUsername("nobot")
+		assert.Nil(t, response)
+		assert.Nil(t, err)
+	})
+
+	t.Run("Success", func(t *testing.T) {
+		mock.ExpectQuery(getUserByUsernameQuery).
+			WithArgs(user.Username).
+			WillReturnRows(userRow(user))
+
+		response, err := repo.GetUserByUsername(user.Username)
+		assert.Nil(t, err)
+		assert.Equal(t, user.Id, response.Id)
+		assert.True(t, response.IsServiceAccount)
+	})
+}
+
+func TestGetUserByID(t *testing.T) {
+	db, mock, repo := setupTestDB(t)
+	defer db.Close()
+
+	user := &models.User{
+		Username:      "Raytest",
+		Email:         "test@example.com",
+		Password:      "hashedpassword",
+		Id:            23,
+		EmailVerified: true,
+	}
+
+	t.Run("User does not exists", func(t *testing.T) {
+		mock.ExpectQuery(getUserByIDQuery).WithArgs(user.Id).WillReturnError(sql.ErrNoRows)
+
+		response, err := repo.GetUserByID(user.Id)
+		assert.Nil(t, response)
+		assert.Nil(t, err)
+	})
+
+	t.Run("Error while searching for user", func(t *testing.T) {
+		mock.ExpectQuery(getUserByIDQuery).WithArgs(user.Id).WillReturnError(sql.ErrConnDone)
+
+		response, err := repo.GetUserByID(user.Id)
+		assert.Nil(t, response)
+		assert.Equal(t, "error while searching for user", err.Error())
+	})
+
+	t.Run("Success", func(t *testing.T) {
+		mock.ExpectQuery(getUserByIDQuery).
+			WithArgs(user.Id).
+			WillReturnRows(userRow(user))
+
+		response, err := repo.GetUserByID(user.Id)
+		assert.Nil(t, err)
+		assert.Equal(t, user.Id, response.Id)
+		assert.True(t, response.EmailVerified)
+	})
+}
+
+func TestVerifyEmail(t *testing.T) {
+	db, mock, repo := setupTestDB(t)
+	defer db.Close()
+
+	tokenHash := "4f2c1e"
+
+	t.Run("Invalid or expired token", func(t *testing.T) {
+		mock.ExpectBegin()
+
+		mock.ExpectQuery(consumeEmailVerificationQuery).WithArgs(tokenHash).WillReturnError(sql.ErrNoRows)
+
+		mock.ExpectRollback()
+
+		userId, err := repo.VerifyEmail(tokenHash)
+		assert.Equal(t, "Invalid or expired verification token", err.Error())
+		assert.Equal(t, 0, userId)
+	})
+
+	t.Run("Success", func(t *testing.T) {
+		mock.ExpectBegin()
+
+		mock.ExpectQuery(consumeEmailVerificationQuery).WithArgs(tokenHash).
+			WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(23))
+
+		mock.ExpectExec(setEmailVerifiedQuery).WithArgs(23, true).WillReturnResult(sqlmock.NewResult(0, 1))
+
+		mock.ExpectExec(deleteUserEmailVerificationsQuery).WithArgs(23).WillReturnResult(sqlmock.NewResult(0, 0))
+
+		mock.ExpectCommit()
+
+		userId, err := repo.VerifyEmail(tokenHash)
+		assert.NoError(t, err)
+		assert.Equal(t, 23, userId)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
 func TestAddMessage(t *testing.T) {
 	db, mock, repo := setupTestDB(t)
 	defer db.Close()
@@ -211,7 +332,7 @@ func TestAddMessage(t *testing.T) {
 	t.Run("Error while inserting message", func(t *testing.T) {
 		mock.ExpectBegin()
 
-		mock.ExpectQuery(addMessageQuery).WithArgs(message.UserID, message.ChatroomID, message.Message).WillReturnError(sql.ErrConnDone)
+		mock.ExpectQuery(addMessageQuery).WithArgs(message.UserID, message.ChatroomID, message.Message, models.MessageTypeText, nil).WillReturnError(sql.ErrConnDone)
 
 		mock.ExpectRollback()
 
@@ -223,7 +344,7 @@ func TestAddMessage(t *testing.T) {
 	t.Run("Success", func(t *testing.T) {
 		mock.ExpectBegin()
 
-		mock.ExpectQuery(addMessageQuery).WithArgs(message.UserID, message.ChatroomID, message.Message).
+		mock.ExpectQuery(addMessageQuery).WithArgs(message.UserID, message.ChatroomID, message.Message, models.MessageTypeText, nil).
 			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(23))
 
 		mock.ExpectCommit()
@@ -232,6 +353,105 @@ func TestAddMessage(t *testing.T) {
 		assert.NoError(t, err)
 		assert.Equal(t, 23, *id)
 	})
+
+	t.Run("Message already saved", func(t *testing.T) {
+		reserved := message
+		reserved.Id = 41
+
+		mock.ExpectBegin()
+
+		mock.ExpectQuery(addMessageWithIdQuery).WithArgs(41, message.UserID, message.ChatroomID, message.Message, models.MessageTypeText, nil).
+			WillReturnRows(sqlmock.NewRows([]string{"id"}))
+
+		mock.ExpectRollback()
+
+		id, err := repo.AddMessage(reserved)
+		assert.NoError(t, err)
+		assert.Nil(t, id)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestReserveMessageIds(t *testing.T) {
+	db, mock, repo := setupTestDB(t)
+	defer db.Close()
+
+	t.Run("Error while reserving ids", func(t *testing.T) {
+		mock.ExpectQuery(reserveMessageIdsQuery).WithArgs(3).WillReturnError(sql.ErrConnDone)
+
+		ids, err := repo.ReserveMessageIds(3)
+		assert.Contains(t, err.Error(), "error while reserving message ids")
+		assert.Nil(t, ids)
+	})
+
+	t.Run("Success", func(t *testing.T) {
+		mock.ExpectQuery(reserveMessageIdsQuery).WithArgs(3).
+			WillReturnRows(sqlmock.NewRows([]string{"nextval"}).AddRow(7).AddRow(8).AddRow(9))
+
+		ids, err := repo.ReserveMessageIds(3)
+		assert.NoError(t, err)
+		assert.Equal(t, []int{7, 8, 9}, ids)
+	})
+}
+
+func TestAddMessages(t *testing.T) {
+	db, mock, repo := setupTestDB(t)
+	defer db.Close()
+
+	createdAt := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	messages := []*models.ChatMessage{
+		{Id: 7, UserID: 23, ChatroomID: chatRoomId, Message: "Hello World!", CreatedAt: createdAt},
+		{Id: 8, UserID: 23, ChatroomID: chatRoomId, Message: "Poll", Type: models.MessageTypePoll, Payload: []byte(`{"poll_id":1}`), CreatedAt: createdAt},
+	}
+
+	t.Run("Error while copying messages", func(t *testing.T) {
+		mock.ExpectBegin()
+
+		mock.ExpectPrepare(addMessagesQuery).ExpectExec().
+			WithArgs(7, 23, chatRoomId, "Hello World!", models.MessageTypeText, nil, createdAt).
+			WillReturnError(sql.ErrConnDone)
+
+		mock.ExpectRollback()
+
+		err := repo.AddMessages(messages, nil)
+		assert.Contains(t, err.Error(), "error while adding messages")
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("Success", func(t *testing.T) {
+		mock.ExpectBegin()
+
+		prepare := mock.ExpectPrepare(addMessagesQuery)
+		prepare.ExpectExec().WithArgs(7, 23, chatRoomId, "Hello World!", models.MessageTypeText, nil, createdAt).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		prepare.ExpectExec().WithArgs(8, 23, chatRoomId, "Poll", models.MessageTypePoll, `{"poll_id":1}`, createdAt).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		prepare.ExpectExec().WithoutArgs().WillReturnResult(sqlmock.NewResult(0, 2))
+
+		mock.ExpectCommit()
+
+		err := repo.AddMessages(messages, nil)
+		assert.NoError(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+	t.Run("Success with outbox messages", func(t *testing.T) {
+		mock.ExpectBegin()
+
+		prepare := mock.ExpectPrepare(addMessagesQuery)
+		prepare.ExpectExec().WithArgs(7, 23, chatRoomId, "Hello World!", models.MessageTypeText, nil, createdAt).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		prepare.ExpectExec().WithoutArgs().WillReturnResult(sqlmock.NewResult(0, 1))
+
+		mock.ExpectExec(addOutboxMessagesQuery).WithArgs(`{"command_requests"}`, sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+
+		mock.ExpectCommit()
+
+		outbox := []*models.OutboxMessage{{Queue: models.CommandRequestsQueue, Body: []byte(`{}`)}}
+		err := repo.AddMessages(messages[:1], outbox)
+		assert.NoError(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
 }
 
 func TestAddUser(t *testing.T) {
@@ -325,8 +545,10 @@ func TestAddChatroom(t *testing.T) {
 	db, mock, repo := setupTestDB(t)
 	defer db.Close()
 
+	ownerId := 23
 	chatroom := &models.Chatroom{
-		Name: "THEBESTCHATROOM",
+		Name:    "THEBESTCHATROOM",
+		OwnerID: &ownerId,
 	}
 
 	t.Run("Invalid user email", func(t *testing.T) {
@@ -351,7 +573,7 @@ func TestAddChatroom(t *testing.T) {
 	t.Run("Error while inserting chatroom", func(t *testing.T) {
 		mock.ExpectBegin()
 
-		mock.ExpectQuery(addChatroomQuery).WithArgs(chatroom.Name).WillReturnError(sql.ErrConnDone)
+		mock.ExpectQuery(addChatroomQuery).WithArgs(chatroom.Name, ownerId).WillReturnError(sql.ErrConnDone)
 
 		mock.ExpectRollback()
 
@@ -363,7 +585,7 @@ func TestAddChatroom(t *testing.T) {
 	t.Run("Success", func(t *testing.T) {
 		mock.ExpectBegin()
 
-		mock.ExpectQuery(addChatroomQuery).WithArgs(chatroom.Name).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(chatRoomId))
+		mock.ExpectQuery(addChatroomQuery).WithArgs(chatroom.Name, ownerId).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(chatRoomId))
 
 		mock.ExpectCommit()
 
@@ -373,3 +595,570 @@ func TestAddChatroom(t *testing.T) {
 	})
 
 }
+
+func TestAddLoginLockout(t *testing.T) {
+	db, mock, repo := setupTestDB(t)
+	defer db.Close()
+
+	userId := 23
+	lockout := &models.LoginLockout{
+		UserID:      &userId,
+		Email:       "test@example.com",
+		IPAddress:   "10.0.0.1",
+		Reason:      models.LockoutReasonAccount,
+		LockedUntil: time.Now().Add(time.Minute),
+	}
+
+	t.Run("Error while recording lockout", func(t *testing.T) {
+		mock.ExpectQuery(addLoginLockoutQuery).
+			WithArgs(lockout.UserID, lockout.Email, lockout.IPAddress, lockout.Reason, lockout.LockedUntil).
+			WillReturnError(sql.ErrConnDone)
+
+		id, err := repo.AddLoginLockout(lockout)
+		assert.Equal(t, "error while recording login lockout", err.Error())
+		assert.Nil(t, id)
+	})
+
+	t.Run("Success", func(t *testing.T) {
+		mock.ExpectQuery(addLoginLockoutQuery).
+			WithArgs(lockout.UserID, lockout.Email, lockout.IPAddress, lockout.Reason, lockout.LockedUntil).
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(4))
+
+		id, err := repo.AddLoginLockout(lockout)
+		assert.NoError(t, err)
+		assert.Equal(t, 4, *id)
+	})
+}
+
+func TestGetAPITokenByHash(t *testing.T) {
+	db, mock, repo := setupTestDB(t)
+	defer db.Close()
+
+	tokenHash := "9b74c9897bac770ffc029102a200c5de"
+	columns := []string{"id", "user_id", "username", "name", "scopes", "created_at", "last_used_at", "revoked_at"}
+
+	t.Run("Token does not exists", func(t *testing.T) {
+		mock.ExpectQuery(getAPITokenByHashQuery).WithArgs(tokenHash).WillReturnError(sql.ErrNoRows)
+
+		token, err := repo.GetAPITokenByHash(tokenHash)
+		assert.Nil(t, token)
+		assert.Nil(t, err)
+	})
+
+	t.Run("Success", func(t *testing.T) {
+		mock.ExpectQuery(getAPITokenByHashQuery).WithArgs(tokenHash).
+			WillReturnRows(sqlmock.NewRows(columns).
+				AddRow(3, 1, "stockbot", "default", "{chatrooms:connect,chatrooms:read}", time.Now(), nil, nil))
+
+		token, err := repo.GetAPITokenByHash(tokenHash)
+		assert.NoError(t, err)
+		assert.Equal(t, "stockbot", token.UserName)
+		assert.Equal(t, []string{models.ScopeChatroomsConnect, models.ScopeChatroomsRead}, token.Scopes)
+	})
+}
+
+func TestAddServiceAccount(t *testing.T) {
+	db, mock, repo := setupTestDB(t)
+	defer db.Close()
+
+	t.Run("Invalid username", func(t *testing.T) {
+		for _, username := range []string{"", "stock bot", "stockbot@example.com", strings.Repeat("a", 51)} {
+			id, err := repo.AddServiceAccount(username)
+			assert.Nil(t, id)
+			assert.Equal(t, "Invalid username, it must have between 1 and 50 letters, numbers, dots, dashes or underscores", err.Error())
+		}
+
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("Success", func(t *testing.T) {
+		mock.ExpectQuery(checkIfEmailOrUsernameExistsQuery).
+			WithArgs("stockbot@service-accounts.local", "stockbot").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+		mock.ExpectQuery(addServiceAccountQuery).
+			WithArgs("stockbot", "stockbot@service-accounts.local").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(41))
+
+		id, err := repo.AddServiceAccount("stockbot")
+		assert.NoError(t, err)
+		assert.Equal(t, 41, *id)
+	})
+}
+
+func TestGetUserTokenHashes(t *testing.T) {
+	db, mock, repo := setupTestDB(t)
+	defer db.Close()
+
+	mock.ExpectQuery(getUserTokenHashesQuery).WithArgs(7, models.ScopeBotsRegister).
+		WillReturnRows(sqlmock.NewRows([]string{"token_hash"}).AddRow("9b74c989").AddRow("a200c5de"))
+
+	hashes, err := repo.GetUserTokenHashes(7, models.ScopeBotsRegister)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"9b74c989", "a200c5de"}, hashes)
+}
+
+func TestRevokeAPIToken(t *testing.T) {
+	db, mock, repo := setupTestDB(t)
+	defer db.Close()
+
+	t.Run("Token does not exists", func(t *testing.T) {
+		mock.ExpectExec(revokeAPITokenQuery).WithArgs(3).WillReturnResult(sqlmock.NewResult(0, 0))
+
+		err := repo.RevokeAPIToken(3)
+		assert.Equal(t, "Active API token with ID: 3 does not exists", err.Error())
+	})
+
+	t.Run("Success", func(t *testing.T) {
+		mock.ExpectExec(revokeAPITokenQuery).WithArgs(3).WillReturnResult(sqlmock.NewResult(0, 1))
+
+		err := repo.RevokeAPIToken(3)
+		assert.NoError(t, err)
+	})
+}
+
+func TestUpdateUserProfile(t *testing.T) {
+	db, mock, repo := setupTestDB(t)
+	defer db.Close()
+
+	user := &models.User{
+		Id:          23,
+		Username:    "Raytest",
+		DisplayName: "Ray",
+		AvatarURL:   "https://example.com/ray.png",
+		StatusText:  "Trading",
+		TimeZone:    "America/Santo_Domingo",
+	}
+
+	t.Run("Username is taken", func(t *testing.T) {
+		mock.ExpectQuery(checkIfUsernameTakenQuery).
+			WithArgs(user.Username, user.Id).WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+
+		err := repo.UpdateUserProfile(user)
+		assert.Equal(t, "username: Raytest is already registered", err.Error())
+	})
+
+	t.Run("Success", func(t *testing.T) {
+		mock.ExpectQuery(checkIfUsernameTakenQuery).
+			WithArgs(user.Username, user.Id).WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+
+		mock.ExpectExec(updateUserProfileQuery).
+			WithArgs(user.Id, user.Username, user.DisplayName, user.AvatarURL, user.StatusText, user.TimeZone).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+
+		err := repo.UpdateUserProfile(user)
+		assert.NoError(t, err)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestGetActivePriceAlerts(t *testing.T) {
+	db, mock, repo := setupTestDB(t)
+	defer db.Close()
+
+	columns := []string{"id", "user_id", "chatroom_id", "symbol", "operator", "target", "created_at", "triggered_at", "username"}
+
+	mock.ExpectQuery(getActivePriceAlertsQuery).
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow(4, 23, "8d7ca8ba-3b9b-4b3a-a2a0-5b0d0d5d2f5c", "aapl.us", ">", "200.5000", time.Now(), nil, "Raytest"))
+
+	alerts, err := repo.GetActivePriceAlerts()
+	assert.NoError(t, err)
+	assert.Len(t, alerts, 1)
+	assert.Equal(t, 200.5, alerts[0].Target)
+	assert.Equal(t, "Raytest", alerts[0].UserName)
+	assert.Nil(t, alerts[0].TriggeredAt)
+}
+
+func TestTriggerPriceAlert(t *testing.T) {
+	db, mock, repo := setupTestDB(t)
+	defer db.Close()
+
+	outbox := []*models.OutboxMessage{{Queue: models.ChatroomMessagesQueue, Body: []byte(`{}`)}}
+
+	t.Run("Already triggered", func(t *testing.T) {
+		mock.ExpectBegin()
+		mock.ExpectExec(triggerPriceAlertQuery).WithArgs(4).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectRollback()
+
+		triggered, err := repo.TriggerPriceAlert(4, outbox)
+		assert.NoError(t, err)
+		assert.False(t, triggered)
+	})
+
+	t.Run("Success", func(t *testing.T) {
+		mock.ExpectBegin()
+		mock.ExpectExec(triggerPriceAlertQuery).WithArgs(4).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(addOutboxMessagesQuery).WithArgs(`{"chatroom_messages"}`, sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		triggered, err := repo.TriggerPriceAlert(4, outbox)
+		assert.NoError(t, err)
+		assert.True(t, triggered)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestDeletePriceAlert(t *testing.T) {
+	db, mock, repo := setupTestDB(t)
+	defer db.Close()
+
+	chatroomId := "8d7ca8ba-3b9b-4b3a-a2a0-5b0d0d5d2f5c"
+	mock.ExpectBegin()
+	mock.ExpectExec(deletePriceAlertQuery).WithArgs(4, 23, chatroomId).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+
+	err := repo.DeletePriceAlert(4, 23, chatroomId, nil)
+	assert.Equal(t, "Price alert with ID: 4 does not exists", err.Error())
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestClaimDueScheduledMessages(t *testing.T) {
+	db, mock, repo := setupTestDB(t)
+	defer db.Close()
+
+	columns := []string{"id", "user_id", "chatroom_id", "kind", "message", "deliver_at", "created_at", "delivered_at", "username"}
+	deliverAt := time.Date(2025, 1, 2, 15, 30, 0, 0, time.UTC)
+
+	mock.ExpectQuery(claimDueScheduledMessagesQuery).WithArgs(100, int64(60000)).
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow(7, 23, "8d7ca8ba-3b9b-4b3a-a2a0-5b0d0d5d2f5c", models.ScheduledMessageKindReminder, "check the market", deliverAt, deliverAt, nil, "Raytest"))
+
+	messages, err := repo.ClaimDueScheduledMessages(100, time.Minute)
+	assert.NoError(t, err)
+	assert.Len(t, messages, 1)
+	assert.Equal(t, "Raytest", messages[0].UserName)
+	assert.Equal(t, deliverAt, messages[0].DeliverAt)
+	assert.Nil(t, messages[0].DeliveredAt)
+	assert.Equal(t, models.ScheduledMessageKindReminder, messages[0].Kind)
+}
+
+func TestMarkScheduledMessageDelivered(t *testing.T) {
+	db, mock, repo := setupTestDB(t)
+	defer db.Close()
+
+	outbox := []*models.OutboxMessage{{Queue: models.ChatroomMessagesQueue, Body: []byte(`{}`)}}
+
+	mock.ExpectBegin()
+	mock.ExpectExec(markScheduledMessageDeliveredQuery).WithArgs(7).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(addOutboxMessagesQuery).WithArgs(`{"chatroom_messages"}`, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	err := repo.MarkScheduledMessageDelivered(7, outbox)
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestAddOutboxMessages(t *testing.T) {
+	db, mock, repo := setupTestDB(t)
+	defer db.Close()
+
+	outbox := []*models.OutboxMessage{{Queue: models.ChatroomMessagesQueue, Body: []byte(`{}`)}}
+
+	mock.ExpectBegin()
+	mock.ExpectExec(addOutboxMessagesQuery).WithArgs(`{"chatroom_messages"}`, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	err := repo.AddOutboxMessages(outbox)
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestClaimOutboxMessages(t *testing.T) {
+	db, mock, repo := setupTestDB(t)
+	defer db.Close()
+
+	columns := []string{"id", "queue", "body", "attempts", "created_at"}
+	createdAt := time.Date(2025, 1, 2, 15, 30, 0, 0, time.UTC)
+
+	mock.ExpectQuery(claimOutboxMessagesQuery).WithArgs(100, int64(60000)).
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow(3, models.CommandRequestsQueue, []byte(`{"chat_message_message":"/stock aapl.us"}`), 1, createdAt))
+
+	msgs, err := repo.ClaimOutboxMessages(100, time.Minute)
+	assert.NoError(t, err)
+	assert.Len(t, msgs, 1)
+	assert.Equal(t, models.CommandRequestsQueue, msgs[0].Queue)
+	assert.Equal(t, 1, msgs[0].Attempts)
+	assert.JSONEq(t, `{"chat_message_message":"/stock aapl.us"}`, string(msgs[0].Body))
+
+	t.Run("Error while reading the rows", func(t *testing.T) {
+		mock.ExpectQuery(claimOutboxMessagesQuery).WithArgs(100, int64(60000)).
+			WillReturnRows(sqlmock.NewRows(columns).
+				AddRow(3, models.CommandRequestsQueue, []byte(`{}`), 1, createdAt).
+				RowError(0, sql.ErrConnDone))
+
+		msgs, err := repo.ClaimOutboxMessages(100, time.Minute)
+		assert.Contains(t, err.Error(), "error while claiming outbox messages")
+		assert.Nil(t, msgs)
+	})
+}
+
+func TestMarkOutboxMessagesSent(t *testing.T) {
+	db, mock, repo := setupTestDB(t)
+	defer db.Close()
+
+	mock.ExpectExec(markOutboxSentQuery).WithArgs(`{3,4}`).WillReturnError(sql.ErrConnDone)
+
+	err := repo.MarkOutboxMessagesSent([]int{3, 4})
+	assert.Contains(t, err.Error(), "error while marking outbox messages as sent")
+
+	mock.ExpectExec(markOutboxSentQuery).WithArgs(`{3,4}`).WillReturnResult(sqlmock.NewResult(0, 2))
+
+	err = repo.MarkOutboxMessagesSent([]int{3, 4})
+	assert.NoError(t, err)
+}
+
+func TestRetryOutboxMessage(t *testing.T) {
+	db, mock, repo := setupTestDB(t)
+	defer db.Close()
+
+	availableAt := time.Date(2025, 1, 2, 15, 30, 0, 0, time.UTC)
+
+	mock.ExpectExec(retryOutboxMessageQuery).WithArgs(3, availableAt, "broker is not connected").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	err := repo.RetryOutboxMessage(3, availableAt, "broker is not connected")
+	assert.NoError(t, err)
+}
+
+func TestDeleteSentOutboxMessages(t *testing.T) {
+	db, mock, repo := setupTestDB(t)
+	defer db.Close()
+
+	before := time.Date(2025, 1, 2, 15, 30, 0, 0, time.UTC)
+
+	mock.ExpectExec(deleteSentOutboxQuery).WithArgs(before).WillReturnResult(sqlmock.NewResult(0, 12))
+
+	deleted, err := repo.DeleteSentOutboxMessages(before)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 12, deleted)
+}
+
+func TestGetWebhookDeliveries(t *testing.T) {
+	db, mock, repo := setupTestDB(t)
+	defer db.Close()
+
+	columns := []string{"id", "webhook_id", "message_id", "status", "attempts", "response_status", "error", "created_at", "updated_at"}
+
+	mock.ExpectQuery(getWebhookDeliveriesQuery).WithArgs(2, chatRoomId, 50).
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow(5, 2, 9, models.WebhookDeliveryFailed, 5, 502, "endpoint answered with status code 502", time.Now(), time.Now()).
+			AddRow(4, 2, nil, models.WebhookDeliverySucceeded, 1, 200, "", time.Now(), time.Now()))
+
+	deliveries, err := repo.GetWebhookDeliveries(2, chatRoomId, 50)
+	assert.NoError(t, err)
+	assert.Len(t, deliveries, 2)
+	assert.Equal(t, 9, deliveries[0].MessageID)
+	assert.Equal(t, 502, *deliveries[0].ResponseStatus)
+	assert.Equal(t, 0, deliveries[1].MessageID)
+}
+
+func TestAddIncomingWebhook(t *testing.T) {
+	db, mock, repo := setupTestDB(t)
+	defer db.Close()
+
+	webhook := &models.IncomingWebhook{
+		ChatroomID: chatRoomId,
+		UserName:   "ci",
+		CreatedBy:  23,
+		TokenHash:  "9b74c9897bac770ffc029102a200c5de",
+	}
+
+	t.Run("Username is taken", func(t *testing.T) {
+		mock.ExpectQuery(checkIfEmailOrUsernameExistsQuery).
+			WithArgs("ci@service-accounts.local", "ci").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+
+		id, err := repo.AddIncomingWebhook(webhook)
+		assert.Nil(t, id)
+		assert.Equal(t, "username: ci is already registered", err.Error())
+	})
+
+	t.Run("Success", func(t *testing.T) {
+		mock.ExpectQuery(checkIfEmailOrUsernameExistsQuery).
+			WithArgs("ci@service-accounts.local", "ci").WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+		mock.ExpectBegin()
+		mock.ExpectQuery(addServiceAccountQuery).
+			WithArgs("ci", "ci@service-accounts.local").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(41))
+		mock.ExpectQuery(addIncomingWebhookQuery).
+			WithArgs(chatRoomId, 41, 23, webhook.TokenHash).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(3))
+		mock.ExpectCommit()
+
+		id, err := repo.AddIncomingWebhook(webhook)
+		assert.NoError(t, err)
+		assert.Equal(t, 3, *id)
+		assert.Equal(t, 41, webhook.UserID)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestRevokeIncomingWebhook(t *testing.T) {
+	db, mock, repo := setupTestDB(t)
+	defer db.Close()
+
+	mock.ExpectExec(revokeIncomingWebhookQuery).WithArgs(3, chatRoomId).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	err := repo.RevokeIncomingWebhook(3, chatRoomId)
+	assert.Equal(t, "Active incoming webhook with ID: 3 does not exists", err.Error())
+
+	// The service account of the webhook is disabled in the same statement.
+	mock.ExpectExec(revokeIncomingWebhookQuery).WithArgs(4, chatRoomId).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	err = repo.RevokeIncomingWebhook(4, chatRoomId)
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestAddPoll(t *testing.T) {
+	db, mock, repo := setupTestDB(t)
+	defer db.Close()
+
+	createdAt := time.Date(2025, 1, 2, 15, 30, 0, 0, time.UTC)
+	newPoll := func() *models.Poll {
+		return &models.Poll{ChatroomID: chatRoomId, CreatedBy: 23, Question: "Lunch today?", Options: []string{"Pizza", "Sushi"}}
+	}
+
+	t.Run("Announcement fails", func(t *testing.T) {
+		mock.ExpectBegin()
+		mock.ExpectQuery(addPollQuery).WithArgs(chatRoomId, 23, "Lunch today?", `{"Pizza","Sushi"}`, false).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(3, createdAt))
+		mock.ExpectRollback()
+
+		id, err := repo.AddPoll(newPoll(), func(id int) ([]*models.OutboxMessage, error) {
+			return nil, sql.ErrConnDone
+		})
+		assert.Contains(t, err.Error(), "error while adding outbox messages")
+		assert.Nil(t, id)
+	})
+
+	t.Run("Success", func(t *testing.T) {
+		mock.ExpectBegin()
+		mock.ExpectQuery(addPollQuery).WithArgs(chatRoomId, 23, "Lunch today?", `{"Pizza","Sushi"}`, false).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(3, createdAt))
+		mock.ExpectExec(addOutboxMessagesQuery).WithArgs(`{"chatroom_messages"}`, sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		poll := newPoll()
+		id, err := repo.AddPoll(poll, func(id int) ([]*models.OutboxMessage, error) {
+			assert.Equal(t, 3, poll.Id)
+			return []*models.OutboxMessage{{Queue: models.ChatroomMessagesQueue, Body: []byte(`{}`)}}, nil
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, 3, *id)
+		assert.Equal(t, []int{0, 0}, poll.Votes)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestVotePoll(t *testing.T) {
+	db, mock, repo := setupTestDB(t)
+	defer db.Close()
+
+	columns := []string{"id", "chatroom_id", "created_by", "question", "options", "multiple_choice", "created_at", "closed_at"}
+	createdAt := time.Date(2025, 1, 2, 15, 30, 0, 0, time.UTC)
+
+	t.Run("Poll does not exists", func(t *testing.T) {
+		mock.ExpectBegin()
+		mock.ExpectQuery(lockPollQuery).WithArgs(3, chatRoomId).WillReturnError(sql.ErrNoRows)
+		mock.ExpectRollback()
+
+		poll, err := repo.VotePoll(3, chatRoomId, 23, []int{0})
+		assert.Nil(t, poll)
+		assert.Equal(t, "Poll with ID: 3 does not exists", err.Error())
+	})
+
+	t.Run("Poll is closed", func(t *testing.T) {
+		mock.ExpectBegin()
+		mock.ExpectQuery(lockPollQuery).WithArgs(3, chatRoomId).
+			WillReturnRows(sqlmock.NewRows(columns).AddRow(3, chatRoomId, 23, "Lunch?", "{Pizza,Sushi}", false, createdAt, createdAt))
+		mock.ExpectRollback()
+
+		poll, err := repo.VotePoll(3, chatRoomId, 23, []int{0})
+		assert.Nil(t, poll)
+		assert.Equal(t, "Poll 3 is closed", err.Error())
+	})
+
+	t.Run("Success", func(t *testing.T) {
+		mock.ExpectBegin()
+		mock.ExpectQuery(lockPollQuery).WithArgs(3, chatRoomId).
+			WillReturnRows(sqlmock.NewRows(columns).AddRow(3, chatRoomId, 23, "Lunch?", "{Pizza,Sushi}", false, createdAt, nil))
+		mock.ExpectExec(deletePollVotesQuery).WithArgs(3, 24).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(addPollVotesQuery).WithArgs(3, 24, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectQuery(getPollVotesQuery).WithArgs(3).
+			WillReturnRows(sqlmock.NewRows([]string{"option_index", "count", "voters"}).AddRow(1, 2, 3).AddRow(0, 1, 3))
+		mock.ExpectCommit()
+
+		poll, err := repo.VotePoll(3, chatRoomId, 24, []int{1})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"Pizza", "Sushi"}, poll.Options)
+		assert.Equal(t, []int{1, 2}, poll.Votes)
+		assert.Equal(t, 3, poll.Voters)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func TestClosePoll(t *testing.T) {
+	db, mock, repo := setupTestDB(t)
+	defer db.Close()
+
+	columns := []string{"id", "chatroom_id", "created_by", "question", "options", "multiple_choice", "created_at", "closed_at"}
+	createdAt := time.Date(2025, 1, 2, 15, 30, 0, 0, time.UTC)
+	results := func(poll *models.Poll) *models.ChatMessage {
+		msg := poll.ChatMessage(models.MessageTypePoll)
+		msg.UserID = 23
+		return msg
+	}
+
+	t.Run("Only the creator can close it", func(t *testing.T) {
+		mock.ExpectBegin()
+		mock.ExpectQuery(lockPollQuery).WithArgs(3, chatRoomId).
+			WillReturnRows(sqlmock.NewRows(columns).AddRow(3, chatRoomId, 23, "Lunch?", "{Pizza,Sushi}", true, createdAt, nil))
+		mock.ExpectRollback()
+
+		msg, err := repo.ClosePoll(3, chatRoomId, 24, results)
+		assert.Nil(t, msg)
+		assert.Equal(t, "Only the creator of the poll can close it", err.Error())
+	})
+
+	t.Run("Results are not saved", func(t *testing.T) {
+		mock.ExpectBegin()
+		mock.ExpectQuery(lockPollQuery).WithArgs(3, chatRoomId).
+			WillReturnRows(sqlmock.NewRows(columns).AddRow(3, chatRoomId, 23, "Lunch?", "{Pizza,Sushi}", true, createdAt, nil))
+		mock.ExpectQuery(closePollQuery).WithArgs(3).WillReturnRows(sqlmock.NewRows([]string{"closed_at"}).AddRow(createdAt))
+		mock.ExpectQuery(getPollVotesQuery).WithArgs(3).
+			WillReturnRows(sqlmock.NewRows([]string{"option_index", "count", "voters"}))
+		mock.ExpectQuery(addMessageQuery).WillReturnError(fmt.Errorf("connection reset"))
+		mock.ExpectRollback()
+
+		msg, err := repo.ClosePoll(3, chatRoomId, 23, results)
+		assert.Nil(t, msg)
+		assert.Equal(t, "error while closing poll", err.Error())
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("Success", func(t *testing.T) {
+		closedAt := createdAt.Add(time.Hour)
+
+		mock.ExpectBegin()
+		mock.ExpectQuery(lockPollQuery).WithArgs(3, chatRoomId).
+			WillReturnRows(sqlmock.NewRows(columns).AddRow(3, chatRoomId, 23, "Lunch?", "{Pizza,Sushi}", true, createdAt, nil))
+		mock.ExpectQuery(closePollQuery).WithArgs(3).WillReturnRows(sqlmock.NewRows([]string{"closed_at"}).AddRow(closedAt))
+		mock.ExpectQuery(getPollVotesQuery).WithArgs(3).
+			WillReturnRows(sqlmock.NewRows([]string{"option_index", "count", "voters"}).AddRow(0, 2, 2))
+		mock.ExpectQuery(addMessageQuery).WithArgs(23, chatRoomId, sqlmock.AnyArg(), models.MessageTypePoll, sqlmock.AnyArg()).
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(42))
+		mock.ExpectCommit()
+
+		msg, err := repo.ClosePoll(3, chatRoomId, 23, results)
+		assert.NoError(t, err)
+		assert.Equal(t, 42, msg.Id)
+
+		poll := &models.Poll{}
+		json.Unmarshal(msg.Payload, poll)
+		assert.Equal(t, closedAt, *poll.ClosedAt)
+		assert.Equal(t, []int{2, 0}, poll.Votes)
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
@@ -1,16 +1,213 @@
 package utils
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/bcrypt"
 )
 
+const (
+	HashAlgorithmArgon2id = "argon2id"
+	HashAlgorithmBcrypt   = "bcrypt"
+)
+
+// Algorithm and parameters used to hash new passwords. Hashes created with other parameters are still
+// accepted, and NeedsRehash reports them so they can be upgraded on the next successful login.
+type HashingPolicy struct {
+	Algorithm         string
+	BcryptCost        int
+	Argon2Memory      uint32 // In KiB.
+	Argon2Iterations  uint32
+	Argon2Parallelism uint8
+	Argon2SaltLength  uint32
+	Argon2KeyLength   uint32
+}
+
+// Argon2id with the parameters recommended by OWASP.
+func DefaultHashingPolicy() HashingPolicy {
+	return HashingPolicy{
+		Algorithm:         HashAlgorithmArgon2id,
+		BcryptCost:        bcrypt.DefaultCost,
+		Argon2Memory:      19 * 1024,
+		Argon2Iterations:  2,
+		Argon2Parallelism: 1,
+		Argon2SaltLength:  16,
+		Argon2KeyLength:   32,
+	}
+}
+
+func (p HashingPolicy) Validate() error {
+	switch p.Algorithm {
+	case HashAlgorithmArgon2id:
+		if p.Argon2Memory == 0 || p.Argon2Iterations == 0 || p.Argon2Parallelism == 0 {
+			return fmt.Errorf("argon2id memory, iterations and parallelism must be greater than 0")
+		}
+
+		if p.Argon2SaltLength < 8 || p.Argon2KeyLength < 16 {
+			return fmt.Errorf("argon2id salt must have at least 8 bytes and key at least 16 bytes")
+		}
+	case HashAlgorithmBcrypt:
+		if p.BcryptCost < bcrypt.MinCost || p.BcryptCost > bcrypt.MaxCost {
+			return fmt.Errorf("bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+	default:
+		return fmt.Errorf("unknown hashing algorithm: %s", p.Algorithm)
+	}
+
+	return nil
+}
+
+var hashingPolicy = DefaultHashingPolicy()
+
+// Sets the policy used to hash new passwords. Must be called before serving requests.
+func SetHashingPolicy(policy HashingPolicy) error {
+	err := policy.Validate()
+	if err != nil {
+		return err
+	}
+
+	hashingPolicy = policy
+	return nil
+}
+
 func HashPassword(password string) (string, error) {
-	bytes, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if hashingPolicy.Algorithm == HashAlgorithmBcrypt {
+		bytes, err := bcrypt.GenerateFromPassword([]byte(password), hashingPolicy.BcryptCost)
+		return string(bytes), err
+	}
+
+	salt := make([]byte, hashingPolicy.Argon2SaltLength)
+
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
 
-	return string(bytes), err
+	params := argon2Params{
+		memory:      hashingPolicy.Argon2Memory,
+		iterations:  hashingPolicy.Argon2Iterations,
+		parallelism: hashingPolicy.Argon2Parallelism,
+	}
+
+	key := argon2.IDKey([]byte(password), salt, params.iterations, params.memory, params.parallelism, hashingPolicy.Argon2KeyLength)
+
+	return fmt.Sprintf(
+		"$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version,
+		params.memory,
+		params.iterations,
+		params.parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
 }
 
+// Compares the password against an argon2id or bcrypt hash.
 func CheckPassword(password, hash string) bool {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		params, salt, key, err := decodeArgon2Hash(hash)
+		if err != nil {
+			return false
+		}
+
+		otherKey := argon2.IDKey([]byte(password), salt, params.iterations, params.memory, params.parallelism, uint32(len(key)))
+		return subtle.ConstantTimeCompare(key, otherKey) == 1
+	}
+
 	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
 	return err == nil
 }
+
+// Reports if the hash was created with a different algorithm or parameters than the current policy.
+func NeedsRehash(hash string) bool {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		if hashingPolicy.Algorithm != HashAlgorithmArgon2id {
+			return true
+		}
+
+		params, salt, key, err := decodeArgon2Hash(hash)
+		if err != nil {
+			return true
+		}
+
+		return params.memory != hashingPolicy.Argon2Memory ||
+			params.iterations != hashingPolicy.Argon2Iterations ||
+			params.parallelism != hashingPolicy.Argon2Parallelism ||
+			uint32(len(salt)) != hashingPolicy.Argon2SaltLength ||
+			uint32(len(key)) != hashingPolicy.Argon2KeyLength
+	}
+
+	if hashingPolicy.Algorithm != HashAlgorithmBcrypt {
+		return true
+	}
+
+	cost, err := bcrypt.Cost([]byte(hash))
+	if err != nil {
+		return true
+	}
+
+	return cost != hashingPolicy.BcryptCost
+}
+
+type argon2Params struct {
+	memory      uint32
+	iterations  uint32
+	parallelism uint8
+}
+
+// Decodes a hash in the $argon2id$v=19$m=<memory>,t=<iterations>,p=<parallelism>$<salt>$<key> format.
+func decodeArgon2Hash(hash string) (*argon2Params, []byte, []byte, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return nil, nil, nil, fmt.Errorf("invalid argon2id hash")
+	}
+
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return nil, nil, nil, fmt.Errorf("unsupported argon2id version")
+	}
+
+	params := &argon2Params{}
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.iterations, &params.parallelism)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid argon2id parameters: %s", err.Error())
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid argon2id salt: %s", err.Error())
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid argon2id key: %s", err.Error())
+	}
+
+	return params, salt, key, nil
+}
+
+// Generates a random URL safe token with the provided amount of random bytes.
+func GenerateToken(size int) (string, error) {
+	bytes := make([]byte, size)
+
+	_, err := rand.Read(bytes)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(bytes), nil
+}
+
+// Hashes a token so only its digest gets stored in the DB.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
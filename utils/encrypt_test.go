@@ -0,0 +1,88 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func setHashingPolicy(t *testing.T, policy HashingPolicy) {
+	previous := hashingPolicy
+	t.Cleanup(func() { hashingPolicy = previous })
+
+	err := SetHashingPolicy(policy)
+	assert.NoError(t, err)
+}
+
+func TestHashPassword(t *testing.T) {
+	t.Run("Argon2id", func(t *testing.T) {
+		setHashingPolicy(t, DefaultHashingPolicy())
+
+		hash, err := HashPassword("correct horse 1")
+		assert.NoError(t, err)
+		assert.Contains(t, hash, "$argon2id$v=19$m=19456,t=2,p=1$")
+		assert.True(t, CheckPassword("correct horse 1", hash))
+		assert.False(t, CheckPassword("correct horse 2", hash))
+		assert.False(t, NeedsRehash(hash))
+	})
+
+	t.Run("Bcrypt", func(t *testing.T) {
+		policy := DefaultHashingPolicy()
+		policy.Algorithm = HashAlgorithmBcrypt
+		policy.BcryptCost = bcrypt.MinCost
+		setHashingPolicy(t, policy)
+
+		hash, err := HashPassword("correct horse 1")
+		assert.NoError(t, err)
+		assert.True(t, CheckPassword("correct horse 1", hash))
+		assert.False(t, NeedsRehash(hash))
+	})
+
+	t.Run("Invalid policy", func(t *testing.T) {
+		policy := DefaultHashingPolicy()
+		policy.Algorithm = "md5"
+
+		err := SetHashingPolicy(policy)
+		assert.Equal(t, "unknown hashing algorithm: md5", err.Error())
+	})
+
+	t.Run("Unusable hash never matches", func(t *testing.T) {
+		assert.False(t, CheckPassword("!", "!"))
+		assert.False(t, CheckPassword("", "$argon2id$broken"))
+	})
+}
+
+func TestNeedsRehash(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("correct horse 1"), bcrypt.MinCost)
+	assert.NoError(t, err)
+
+	t.Run("Bcrypt hash with argon2id policy", func(t *testing.T) {
+		setHashingPolicy(t, DefaultHashingPolicy())
+
+		assert.True(t, NeedsRehash(string(bcryptHash)))
+	})
+
+	t.Run("Bcrypt hash with a different cost", func(t *testing.T) {
+		policy := DefaultHashingPolicy()
+		policy.Algorithm = HashAlgorithmBcrypt
+		policy.BcryptCost = bcrypt.MinCost + 1
+		setHashingPolicy(t, policy)
+
+		assert.True(t, NeedsRehash(string(bcryptHash)))
+	})
+
+	t.Run("Argon2id hash with different parameters", func(t *testing.T) {
+		setHashingPolicy(t, DefaultHashingPolicy())
+
+		hash, err := HashPassword("correct horse 1")
+		assert.NoError(t, err)
+
+		policy := DefaultHashingPolicy()
+		policy.Argon2Iterations = 3
+		setHashingPolicy(t, policy)
+
+		assert.True(t, NeedsRehash(hash))
+		assert.True(t, CheckPassword("correct horse 1", hash))
+	})
+}
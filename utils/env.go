@@ -0,0 +1,81 @@
+package utils
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Reads a string env, falling back to the default value if it's empty.
+func GetEnvString(name string, defaultValue string) string {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+
+	return value
+}
+
+// Reads an integer env, falling back to the default value if it's empty or invalid.
+func GetEnvInt(name string, defaultValue int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Invalid value for %s: %s, using default %d", name, value, defaultValue)
+		return defaultValue
+	}
+
+	return parsed
+}
+
+// Reads a duration env such as "15m" or "1s", falling back to the default value if it's empty or invalid.
+func GetEnvDuration(name string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Invalid value for %s: %s, using default %s", name, value, defaultValue)
+		return defaultValue
+	}
+
+	return parsed
+}
+
+// Reads a boolean env, falling back to the default value if it's empty or invalid.
+func GetEnvBool(name string, defaultValue bool) bool {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("Invalid value for %s: %s, using default %t", name, value, defaultValue)
+		return defaultValue
+	}
+
+	return parsed
+}
+
+// Reads a comma separated env, ignoring the empty values.
+func GetEnvList(name string) []string {
+	values := []string{}
+
+	for _, value := range strings.Split(os.Getenv(name), ",") {
+		value = strings.TrimSpace(value)
+		if value != "" {
+			values = append(values, value)
+		}
+	}
+
+	return values
+}
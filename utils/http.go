@@ -5,12 +5,15 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"slices"
 	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/raynine/go-chatroom/interfaces"
 	"github.com/raynine/go-chatroom/models"
 )
 
@@ -75,11 +78,30 @@ func GetUserDataFromContext(ctx context.Context) (int, string, error) {
 	return userID, userName, nil
 }
 
+// Gets the IP address of the client. The X-Forwarded-For header is only used when the server runs behind a trusted
+// proxy.
+func GetClientIP(r *http.Request, trustForwardedFor bool) string {
+	if trustForwardedFor {
+		forwardedFor := r.Header.Get("X-Forwarded-For")
+		if forwardedFor != "" {
+			return strings.TrimSpace(strings.Split(forwardedFor, ",")[0])
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
 func CreateJWTToken(user *models.User) (string, error) {
 	claims := jwt.MapClaims{
 		"user_id":        user.Id,
 		"user_email":     user.Email,
 		"user_user_name": user.Username,
+		"user_is_admin":  user.IsAdmin,
 		"exp":            time.Now().Add(time.Minute * 30).Unix(),
 	}
 
@@ -89,63 +111,143 @@ func CreateJWTToken(user *models.User) (string, error) {
 	return token.SignedString([]byte(secretKey))
 }
 
-func AuthMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		authorization := r.Header.Get("Authorization")
-		if authorization == "" {
-			w.WriteHeader(http.StatusUnauthorized)
-			return
-		}
+// Prefix of the API tokens, used to tell them apart from JWTs.
+const APITokenPrefix = "gct_"
+
+// Authenticates the request with either a JWT or an API token of a service account. API token requests
+// get their scopes stored in the context so the routes can be limited with RequireScope.
+func AuthMiddleware(repo interfaces.DBRepo) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			authorization := r.Header.Get("Authorization")
+			if authorization == "" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
 
-		token := strings.Replace(authorization, "Bearer ", "", 1)
+			token := strings.Replace(authorization, "Bearer ", "", 1)
 
-		authToken, err := jwt.Parse(token, func(token *jwt.Token) (any, error) {
-			_, ok := token.Method.(*jwt.SigningMethodHMAC)
-			if !ok {
-				return nil, fmt.Errorf("unexpected signing method")
+			var ctx context.Context
+			var err error
+			if strings.HasPrefix(token, APITokenPrefix) {
+				ctx, err = apiTokenContext(r.Context(), repo, token)
+			} else {
+				ctx, err = jwtContext(r.Context(), token)
 			}
 
-			secretKey := os.Getenv("SECRET_KEY")
+			if err != nil {
+				log.Println(err.Error())
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
 
-			return []byte(secretKey), nil
+			next.ServeHTTP(w, r.WithContext(ctx))
 		})
-		if err != nil {
-			log.Println("Error parsing JWT: ", err.Error())
-			w.WriteHeader(http.StatusUnauthorized)
-			return
-		}
-
-		if !authToken.Valid {
-			log.Println("Auth token is not valid")
-			w.WriteHeader(http.StatusUnauthorized)
-			return
-		}
+	}
+}
 
-		claims, ok := authToken.Claims.(jwt.MapClaims)
+func jwtContext(ctx context.Context, token string) (context.Context, error) {
+	authToken, err := jwt.Parse(token, func(token *jwt.Token) (any, error) {
+		_, ok := token.Method.(*jwt.SigningMethodHMAC)
 		if !ok {
-			log.Println("Auth token is not a valid JWT Claims struct")
-			w.WriteHeader(http.StatusUnauthorized)
-			return
+			return nil, fmt.Errorf("unexpected signing method")
 		}
 
-		claimUserId, ok := claims["user_id"].(float64)
-		if !ok {
-			log.Println("Claim do not include user_id")
-			w.WriteHeader(http.StatusUnauthorized)
+		secretKey := os.Getenv("SECRET_KEY")
+
+		return []byte(secretKey), nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing JWT: %s", err.Error())
+	}
+
+	if !authToken.Valid {
+		return nil, fmt.Errorf("Auth token is not valid")
+	}
+
+	claims, ok := authToken.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil, fmt.Errorf("Auth token is not a valid JWT Claims struct")
+	}
+
+	claimUserId, ok := claims["user_id"].(float64)
+	if !ok {
+		return nil, fmt.Errorf("Claim do not include user_id")
+	}
+
+	userId := int(claimUserId)
+
+	userName, ok := claims["user_user_name"].(string)
+	if !ok {
+		return nil, fmt.Errorf("Claim do not include user_name")
+	}
+
+	isAdmin, _ := claims["user_is_admin"].(bool)
+
+	ctx = context.WithValue(ctx, "user_id", userId)
+	ctx = context.WithValue(ctx, "user_user_name", userName)
+	ctx = context.WithValue(ctx, "user_is_admin", isAdmin)
+
+	return ctx, nil
+}
+
+func apiTokenContext(ctx context.Context, repo interfaces.DBRepo, token string) (context.Context, error) {
+	apiToken, err := repo.GetAPITokenByHash(HashToken(token))
+	if err != nil {
+		return nil, err
+	}
+
+	if apiToken == nil {
+		return nil, fmt.Errorf("API token does not exist or was revoked")
+	}
+
+	err = repo.TouchAPIToken(apiToken.Id)
+	if err != nil {
+		log.Printf("An error ocurred while updating API token last use: %s", err.Error())
+	}
+
+	ctx = context.WithValue(ctx, "user_id", apiToken.UserID)
+	ctx = context.WithValue(ctx, "user_user_name", apiToken.UserName)
+	ctx = context.WithValue(ctx, "user_is_admin", false)
+	ctx = context.WithValue(ctx, "token_scopes", apiToken.Scopes)
+
+	return ctx, nil
+}
+
+// Rejects API token requests that were not granted the scope. JWT requests are always allowed.
+func RequireScope(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		scopes, isAPIToken := r.Context().Value("token_scopes").([]string)
+		if isAPIToken && !slices.Contains(scopes, scope) {
+			EncodeErrorResponse(w, &models.CustomError{
+				Message:    fmt.Sprintf("Token is missing the %s scope", scope),
+				Code:       http.StatusForbidden,
+				AppContext: "RequireScope",
+			})
 			return
 		}
 
-		userId := int(claimUserId)
+		next(w, r)
+	}
+}
 
-		userName, ok := claims["user_user_name"].(string)
-		if !ok {
-			log.Println("Claim do not include user_name")
-			w.WriteHeader(http.StatusUnauthorized)
+// Only lets through users with the admin flag. Must be used after the AuthMiddleware.
+func AdminMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !IsAdminFromContext(r.Context()) {
+			EncodeErrorResponse(w, &models.CustomError{
+				Message:    "Admin privileges required",
+				Code:       http.StatusForbidden,
+				AppContext: "AdminMiddleware",
+			})
 			return
 		}
 
-		ctx := context.WithValue(r.Context(), "user_id", userId)
-		ctx = context.WithValue(ctx, "user_user_name", userName)
-		next.ServeHTTP(w, r.WithContext(ctx))
+		next.ServeHTTP(w, r)
 	})
 }
+
+func IsAdminFromContext(ctx context.Context) bool {
+	isAdmin, _ := ctx.Value("user_is_admin").(bool)
+	return isAdmin
+}
@@ -0,0 +1,256 @@
+package utils
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/raynine/go-chatroom/models"
+)
+
+// Amount of tracked keys before stale entries get pruned.
+const throttlePruneThreshold = 1024
+
+// Most keys tracked at once. New keys are refused while it's full of recent failures, so spraying unique emails can't
+// grow the throttler without limit.
+const throttleMaxKeys = 64 * 1024
+
+type loginAttempts struct {
+	failures int
+	// Allowed attempts whose password check has not finished yet.
+	pending     int
+	lastFailure time.Time
+	nextAttempt time.Time
+	lockedUntil time.Time
+}
+
+// Tracks failed logins for a set of keys. Every failure doubles the time the key must wait before trying again,
+// and reaching maxAttempts locks the key for the lockout duration.
+type LoginThrottler struct {
+	mu              sync.Mutex
+	attempts        map[string]*loginAttempts
+	maxAttempts     int
+	lockoutDuration time.Duration
+	backoffBase     time.Duration
+	now             func() time.Time
+	// Size the map must reach before pruning it again, so the stale entries are not searched on every new key.
+	pruneAt int
+}
+
+func NewLoginThrottler(maxAttempts int, lockoutDuration, backoffBase time.Duration) *LoginThrottler {
+	return &LoginThrottler{
+		attempts:        make(map[string]*loginAttempts),
+		maxAttempts:     maxAttempts,
+		lockoutDuration: lockoutDuration,
+		backoffBase:     backoffBase,
+		now:             time.Now,
+		pruneAt:         throttlePruneThreshold,
+	}
+}
+
+// Returns false and the time left to wait if the key is not allowed to try to login. An allowed attempt is reserved
+// as if it failed until Failure or Release is called, so parallel attempts can't skip the backoff or the lockout.
+func (t *LoginThrottler) Allow(key string) (time.Duration, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+
+	attempts, ok := t.attempts[key]
+	if ok && !attempts.lockedUntil.IsZero() && !now.Before(attempts.lockedUntil) {
+		// The lockout already expired, the key starts from scratch.
+		delete(t.attempts, key)
+		ok = false
+	}
+
+	if !ok {
+		if !t.makeRoom(now) {
+			return t.backoffBase, false
+		}
+
+		attempts = &loginAttempts{}
+		t.attempts[key] = attempts
+	}
+
+	if now.Before(attempts.lockedUntil) {
+		return attempts.lockedUntil.Sub(now), false
+	}
+
+	if now.Before(attempts.nextAttempt) {
+		return attempts.nextAttempt.Sub(now), false
+	}
+
+	if attempts.failures+attempts.pending >= t.maxAttempts {
+		return t.backoffBase, false
+	}
+
+	attempts.pending++
+	attempts.nextAttempt = now.Add(t.backoff(attempts.failures + attempts.pending))
+
+	return 0, true
+}
+
+// Records a failed login, confirming the attempt reserved by Allow. Returns true and the end of the lockout if the
+// failure locked the key.
+func (t *LoginThrottler) Failure(key string) (time.Time, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+
+	attempts, ok := t.attempts[key]
+	if !ok {
+		if !t.makeRoom(now) {
+			return time.Time{}, false
+		}
+
+		attempts = &loginAttempts{}
+		t.attempts[key] = attempts
+	}
+
+	if attempts.pending > 0 {
+		attempts.pending--
+	}
+
+	attempts.failures++
+	attempts.lastFailure = now
+
+	if attempts.failures >= t.maxAttempts {
+		attempts.lockedUntil = now.Add(t.lockoutDuration)
+		return attempts.lockedUntil, true
+	}
+
+	attempts.nextAttempt = now.Add(t.backoff(attempts.failures + attempts.pending))
+
+	return time.Time{}, false
+}
+
+// Gives back an attempt reserved by Allow that did not fail, e.g. the password matched or could not be checked.
+func (t *LoginThrottler) Release(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	attempts, ok := t.attempts[key]
+	if !ok || attempts.pending == 0 {
+		return
+	}
+
+	attempts.pending--
+	if attempts.pending > 0 {
+		return
+	}
+
+	if attempts.failures == 0 {
+		delete(t.attempts, key)
+		return
+	}
+
+	attempts.nextAttempt = attempts.lastFailure.Add(t.backoff(attempts.failures))
+}
+
+// Time to wait after the given amount of failures, doubled on every failure up to the lockout duration.
+func (t *LoginThrottler) backoff(failures int) time.Duration {
+	backoff := t.backoffBase << (failures - 1)
+	if backoff <= 0 || backoff > t.lockoutDuration {
+		backoff = t.lockoutDuration
+	}
+
+	return backoff
+}
+
+// Forgets every failure of the key. Used after a successful login or when an admin unlocks an account.
+func (t *LoginThrottler) Reset(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.attempts, key)
+}
+
+// Prunes the stale keys once the map doubled since the last time. Returns false if there's no room for a new key.
+func (t *LoginThrottler) makeRoom(now time.Time) bool {
+	if len(t.attempts) >= t.pruneAt {
+		t.prune(now)
+		t.pruneAt = min(max(throttlePruneThreshold, 2*len(t.attempts)), throttleMaxKeys)
+	}
+
+	return len(t.attempts) < throttleMaxKeys
+}
+
+// Removes the keys that are not locked, have no attempt in progress and have not failed during the last lockout
+// window.
+func (t *LoginThrottler) prune(now time.Time) {
+	for key, attempts := range t.attempts {
+		if attempts.pending == 0 && now.After(attempts.lockedUntil) && now.Sub(attempts.lastFailure) > t.lockoutDuration {
+			delete(t.attempts, key)
+		}
+	}
+}
+
+// Throttles logins by account and by IP address. Unknown emails are tracked the same way as existing ones
+// so the throttling does not reveal which accounts exist.
+type LoginGuard struct {
+	accounts *LoginThrottler
+	ips      *LoginThrottler
+}
+
+func NewLoginGuard(accounts, ips *LoginThrottler) *LoginGuard {
+	return &LoginGuard{
+		accounts: accounts,
+		ips:      ips,
+	}
+}
+
+// Returns false and the time left to wait if either the account or the IP address are throttled. An allowed login
+// must end with Failure, Success or Release.
+func (g *LoginGuard) Allow(email, ip string) (time.Duration, bool) {
+	wait, ok := g.ips.Allow(ip)
+	if !ok {
+		return wait, false
+	}
+
+	wait, ok = g.accounts.Allow(accountKey(email))
+	if !ok {
+		g.ips.Release(ip)
+		return wait, false
+	}
+
+	return 0, true
+}
+
+// Records a failed login for the account and the IP address. Returns the lockouts caused by this failure.
+func (g *LoginGuard) Failure(email, ip string) map[string]time.Time {
+	lockouts := map[string]time.Time{}
+
+	lockedUntil, locked := g.accounts.Failure(accountKey(email))
+	if locked {
+		lockouts[models.LockoutReasonAccount] = lockedUntil
+	}
+
+	lockedUntil, locked = g.ips.Failure(ip)
+	if locked {
+		lockouts[models.LockoutReasonIP] = lockedUntil
+	}
+
+	return lockouts
+}
+
+// Clears the failures of the account. The IP failures are kept so a valid login can not be used
+// to keep guessing other accounts from the same address.
+func (g *LoginGuard) Success(email, ip string) {
+	g.accounts.Reset(accountKey(email))
+	g.ips.Release(ip)
+}
+
+// Gives back an allowed login whose password could not be checked.
+func (g *LoginGuard) Release(email, ip string) {
+	g.accounts.Release(accountKey(email))
+	g.ips.Release(ip)
+}
+
+func (g *LoginGuard) Unlock(email string) {
+	g.accounts.Reset(accountKey(email))
+}
+
+func accountKey(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
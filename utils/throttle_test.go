@@ -0,0 +1,194 @@
+package utils
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/raynine/go-chatroom/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestThrottler(now *time.Time) *LoginThrottler {
+	throttler := NewLoginThrottler(3, time.Minute, time.Second)
+	throttler.now = func() time.Time { return *now }
+	return throttler
+}
+
+func TestLoginThrottler(t *testing.T) {
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	t.Run("Unknown key is allowed", func(t *testing.T) {
+		throttler := newTestThrottler(&now)
+
+		_, ok := throttler.Allow("test@example.com")
+		assert.True(t, ok)
+	})
+
+	t.Run("Failures back off exponentially", func(t *testing.T) {
+		throttler := newTestThrottler(&now)
+		current := now
+		throttler.now = func() time.Time { return current }
+
+		_, locked := throttler.Failure("test@example.com")
+		assert.False(t, locked)
+
+		wait, ok := throttler.Allow("test@example.com")
+		assert.False(t, ok)
+		assert.Equal(t, time.Second, wait)
+
+		current = current.Add(time.Second)
+		_, ok = throttler.Allow("test@example.com")
+		assert.True(t, ok)
+
+		throttler.Failure("test@example.com")
+		wait, ok = throttler.Allow("test@example.com")
+		assert.False(t, ok)
+		assert.Equal(t, 2*time.Second, wait)
+	})
+
+	t.Run("Reaching the threshold locks the key", func(t *testing.T) {
+		throttler := newTestThrottler(&now)
+		current := now
+		throttler.now = func() time.Time { return current }
+
+		throttler.Failure("test@example.com")
+		throttler.Failure("test@example.com")
+		lockedUntil, locked := throttler.Failure("test@example.com")
+		assert.True(t, locked)
+		assert.Equal(t, current.Add(time.Minute), lockedUntil)
+
+		wait, ok := throttler.Allow("test@example.com")
+		assert.False(t, ok)
+		assert.Equal(t, time.Minute, wait)
+
+		current = current.Add(time.Minute)
+		_, ok = throttler.Allow("test@example.com")
+		assert.True(t, ok)
+	})
+
+	t.Run("Reset unlocks the key", func(t *testing.T) {
+		throttler := newTestThrottler(&now)
+
+		for range 3 {
+			throttler.Failure("test@example.com")
+		}
+
+		throttler.Reset("test@example.com")
+
+		_, ok := throttler.Allow("test@example.com")
+		assert.True(t, ok)
+	})
+}
+
+func TestLoginThrottlerParallelAttempts(t *testing.T) {
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	// Without a backoff only the attempts limit stops the parallel logins.
+	throttler := NewLoginThrottler(3, time.Minute, 0)
+	throttler.now = func() time.Time { return now }
+	guard := NewLoginGuard(throttler, NewLoginThrottler(100, time.Minute, 0))
+
+	checked := atomic.Int32{}
+	start := make(chan struct{})
+
+	wg := sync.WaitGroup{}
+	for range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+
+			_, ok := guard.Allow("test@example.com", "10.0.0.1")
+			if !ok {
+				return
+			}
+
+			// Stands for the password check, every login is wrong.
+			checked.Add(1)
+			time.Sleep(10 * time.Millisecond)
+			guard.Failure("test@example.com", "10.0.0.1")
+		}()
+	}
+
+	close(start)
+	wg.Wait()
+
+	assert.LessOrEqual(t, checked.Load(), int32(3))
+
+	_, ok := guard.Allow("test@example.com", "10.0.0.2")
+	assert.False(t, ok)
+}
+
+func TestLoginThrottlerRelease(t *testing.T) {
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	throttler := newTestThrottler(&now)
+
+	_, ok := throttler.Allow("test@example.com")
+	assert.True(t, ok)
+
+	// The attempt in progress holds the key until it's released.
+	_, ok = throttler.Allow("test@example.com")
+	assert.False(t, ok)
+
+	throttler.Release("test@example.com")
+
+	_, ok = throttler.Allow("test@example.com")
+	assert.True(t, ok)
+}
+
+func TestLoginThrottlerMaxKeys(t *testing.T) {
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	throttler := newTestThrottler(&now)
+
+	for i := range throttleMaxKeys {
+		_, ok := throttler.Allow(fmt.Sprintf("user%d@example.com", i))
+		assert.True(t, ok)
+		throttler.Failure(fmt.Sprintf("user%d@example.com", i))
+	}
+
+	_, ok := throttler.Allow("new@example.com")
+	assert.False(t, ok)
+	assert.Len(t, throttler.attempts, throttleMaxKeys)
+
+	// Once the failures are stale they are pruned to make room.
+	now = now.Add(2 * time.Minute)
+	_, ok = throttler.Allow("new@example.com")
+	assert.True(t, ok)
+}
+
+func TestLoginGuard(t *testing.T) {
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	t.Run("Account keys are case insensitive", func(t *testing.T) {
+		guard := NewLoginGuard(newTestThrottler(&now), newTestThrottler(&now))
+
+		guard.Failure("Test@Example.com", "10.0.0.1")
+
+		_, ok := guard.Allow("test@example.com", "10.0.0.2")
+		assert.False(t, ok)
+	})
+
+	t.Run("Failure reports lockouts", func(t *testing.T) {
+		guard := NewLoginGuard(newTestThrottler(&now), NewLoginThrottler(10, time.Minute, time.Second))
+
+		guard.Failure("test@example.com", "10.0.0.1")
+		guard.Failure("test@example.com", "10.0.0.1")
+		lockouts := guard.Failure("test@example.com", "10.0.0.1")
+
+		assert.Len(t, lockouts, 1)
+		assert.Contains(t, lockouts, models.LockoutReasonAccount)
+	})
+
+	t.Run("Success keeps the IP failures", func(t *testing.T) {
+		guard := NewLoginGuard(newTestThrottler(&now), newTestThrottler(&now))
+
+		guard.Failure("test@example.com", "10.0.0.1")
+		guard.Success("test@example.com", "10.0.0.1")
+
+		_, ok := guard.Allow("other@example.com", "10.0.0.1")
+		assert.False(t, ok)
+	})
+}
@@ -0,0 +1,383 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/raynine/go-chatroom/interfaces"
+	"github.com/raynine/go-chatroom/models"
+)
+
+// Headers sent with every delivery. The signature is the hex HMAC-SHA256 of "<timestamp>.<body>" using the webhook
+// secret, prefixed with "sha256=".
+const (
+	SignatureHeader  = "X-Chatroom-Signature"
+	TimestampHeader  = "X-Chatroom-Timestamp"
+	WebhookIDHeader  = "X-Chatroom-Webhook-Id"
+	DeliveryIDHeader = "X-Chatroom-Delivery-Id"
+)
+
+const (
+	// Max size of the endpoint responses that are read to post a reply.
+	maxResponseSize = 64 << 10
+	// Messages waiting to be routed to the webhooks. New messages are dropped when it's full.
+	queueSize = 1000
+)
+
+// Body of the deliveries.
+type Event struct {
+	DeliveryID int                 `json:"webhook_delivery_id"`
+	WebhookID  int                 `json:"chatroom_webhook_id"`
+	Message    *models.ChatMessage `json:"chat_message"`
+}
+
+type job struct {
+	webhook  *models.ChatroomWebhook
+	delivery *models.WebhookDelivery
+	body     []byte
+}
+
+// Sends the messages posted in the chatrooms to their webhooks. Failed deliveries are retried with exponential
+// backoff and every attempt is recorded in the delivery log.
+type Dispatcher struct {
+	repo        interfaces.WebhookRepo
+	client      *http.Client
+	maxAttempts int
+	backoff     time.Duration
+	messages    chan *models.ChatMessage
+	jobs        chan *job
+	reply       func(chatroomId string, msg *models.ChatMessage)
+	now         func() time.Time
+
+	// Closed to stop routing and sending, see Close.
+	quit     chan struct{}
+	quitOnce sync.Once
+	running  sync.WaitGroup
+}
+
+// Creates the client used to send the deliveries. It refuses to connect to loopback, private, link-local and
+// unspecified addresses, checked once the host is resolved, so webhooks can't reach the internal network. Redirects
+// are not followed, the endpoint answering with one fails the delivery.
+func NewClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, Control: checkAddress}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// A proxy would connect to the endpoint on our behalf, skipping the address check.
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// Dialer control that rejects the resolved addresses of the internal network.
+func checkAddress(network, address string, conn syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return &permanentError{message: err.Error()}
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return &permanentError{message: fmt.Sprintf("address %s is not allowed", host)}
+	}
+
+	return nil
+}
+
+func NewDispatcher(repo interfaces.WebhookRepo, client *http.Client, maxAttempts int, backoff time.Duration) *Dispatcher {
+	if client == nil {
+		client = NewClient(0)
+	}
+
+	return &Dispatcher{
+		repo:        repo,
+		client:      client,
+		maxAttempts: max(maxAttempts, 1),
+		backoff:     backoff,
+		messages:    make(chan *models.ChatMessage, queueSize),
+		jobs:        make(chan *job, queueSize),
+		now:         time.Now,
+		quit:        make(chan struct{}),
+	}
+}
+
+// Starts routing the messages and the workers that send them. The JSON responses of the endpoints are passed to reply,
+// which posts them in the chatroom.
+func (d *Dispatcher) Start(workers int, reply func(chatroomId string, msg *models.ChatMessage)) {
+	d.reply = reply
+
+	d.running.Add(1)
+	go d.route()
+
+	for range max(workers, 1) {
+		d.running.Add(1)
+		go d.work()
+	}
+}
+
+// Stops routing the messages and waits for the deliveries in progress until ctx is done. The queued messages and
+// the retries that were waiting are not sent, their deliveries stay pending in the log.
+func (d *Dispatcher) Close(ctx context.Context) error {
+	d.quitOnce.Do(func() {
+		close(d.quit)
+	})
+
+	stopped := make(chan struct{})
+	go func() {
+		d.running.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Queues the message for the webhooks of its chatroom. Messages generated by webhooks are ignored.
+func (d *Dispatcher) MessagePosted(msg *models.ChatMessage) {
+	if msg.WebhookID != 0 {
+		return
+	}
+
+	message := *msg
+
+	select {
+	case d.messages <- &message:
+	default:
+		log.Printf("Webhooks queue is full, message %d of chatroom %s was not delivered", msg.Id, msg.ChatroomID)
+	}
+}
+
+func (d *Dispatcher) route() {
+	defer d.running.Done()
+
+	for {
+		var msg *models.ChatMessage
+
+		select {
+		case <-d.quit:
+			return
+		case msg = <-d.messages:
+		}
+
+		webhooks, err := d.repo.GetChatroomWebhooks(msg.ChatroomID)
+		if err != nil {
+			log.Printf("An error ocurred while getting webhooks of chatroom %s: %s", msg.ChatroomID, err.Error())
+			continue
+		}
+
+		for _, webhook := range webhooks {
+			if !webhook.Matches(msg.Message) {
+				continue
+			}
+
+			job, err := d.newJob(webhook, msg)
+			if err != nil {
+				log.Printf("An error ocurred while creating delivery for webhook %d: %s", webhook.Id, err.Error())
+				continue
+			}
+
+			select {
+			case d.jobs <- job:
+			case <-d.quit:
+				return
+			}
+		}
+	}
+}
+
+// Records the pending delivery and builds the body sent in every attempt.
+func (d *Dispatcher) newJob(webhook *models.ChatroomWebhook, msg *models.ChatMessage) (*job, error) {
+	delivery := &models.WebhookDelivery{
+		WebhookID: webhook.Id,
+		MessageID: msg.Id,
+		Status:    models.WebhookDeliveryPending,
+	}
+
+	id, err := d.repo.AddWebhookDelivery(delivery)
+	if err != nil {
+		return nil, err
+	}
+
+	delivery.Id = *id
+
+	body, err := json.Marshal(Event{DeliveryID: delivery.Id, WebhookID: webhook.Id, Message: msg})
+	if err != nil {
+		return nil, err
+	}
+
+	return &job{webhook: webhook, delivery: delivery, body: body}, nil
+}
+
+func (d *Dispatcher) work() {
+	defer d.running.Done()
+
+	for {
+		select {
+		case <-d.quit:
+			return
+		case job := <-d.jobs:
+			d.attempt(job)
+		}
+	}
+}
+
+// Sends the delivery once. Retryable failures are queued again after the backoff until the max attempts are reached.
+func (d *Dispatcher) attempt(job *job) {
+	delivery := job.delivery
+	delivery.Attempts++
+
+	reply, err := d.send(job)
+	if err == nil {
+		delivery.Status = models.WebhookDeliverySucceeded
+		delivery.Error = ""
+		d.updateDelivery(delivery)
+
+		if reply != nil && d.reply != nil {
+			reply.WebhookID = job.webhook.Id
+			d.reply(job.webhook.ChatroomID, reply)
+		}
+
+		return
+	}
+
+	delivery.Error = err.Error()
+
+	var permanent *permanentError
+	if errors.As(err, &permanent) || delivery.Attempts >= d.maxAttempts {
+		log.Printf("Delivery %d to webhook %d failed after %d attempts: %s", delivery.Id, job.webhook.Id, delivery.Attempts, err.Error())
+		delivery.Status = models.WebhookDeliveryFailed
+		d.updateDelivery(delivery)
+		return
+	}
+
+	d.updateDelivery(delivery)
+
+	time.AfterFunc(d.backoff*time.Duration(1<<(delivery.Attempts-1)), func() {
+		select {
+		case d.jobs <- job:
+		case <-d.quit:
+		}
+	})
+}
+
+func (d *Dispatcher) updateDelivery(delivery *models.WebhookDelivery) {
+	err := d.repo.UpdateWebhookDelivery(delivery)
+	if err != nil {
+		log.Printf("An error ocurred while updating webhook delivery %d: %s", delivery.Id, err.Error())
+	}
+}
+
+// Error that is not worth retrying, such as the endpoint rejecting the request.
+type permanentError struct {
+	message string
+}
+
+func (e *permanentError) Error() string {
+	return e.message
+}
+
+// Posts the signed delivery to the endpoint. Returns the reply the endpoint wants posted in the chatroom, if any.
+func (d *Dispatcher) send(job *job) (*models.ChatMessage, error) {
+	req, err := http.NewRequest(http.MethodPost, job.webhook.URL, bytes.NewReader(job.body))
+	if err != nil {
+		return nil, &permanentError{message: err.Error()}
+	}
+
+	timestamp := strconv.FormatInt(d.now().Unix(), 10)
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "go-chatroom-webhooks")
+	req.Header.Set(WebhookIDHeader, strconv.Itoa(job.webhook.Id))
+	req.Header.Set(DeliveryIDHeader, strconv.Itoa(job.delivery.Id))
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(SignatureHeader, Sign(job.webhook.Secret, timestamp, job.body))
+
+	res, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer res.Body.Close()
+
+	job.delivery.ResponseStatus = &res.StatusCode
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		// Timeouts, rate limits and server errors may go away, other statuses won't change on a retry.
+		if res.StatusCode == http.StatusRequestTimeout || res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500 {
+			return nil, fmt.Errorf("endpoint answered with status code %d", res.StatusCode)
+		}
+
+		return nil, &permanentError{message: fmt.Sprintf("endpoint answered with status code %d", res.StatusCode)}
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if mediaType != "application/json" {
+		return nil, nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, maxResponseSize))
+	if err != nil || len(bytes.TrimSpace(body)) == 0 {
+		return nil, nil
+	}
+
+	response := &models.ChatMessage{}
+
+	err = json.Unmarshal(body, response)
+	if err != nil {
+		log.Printf("Webhook %d answered with invalid JSON: %s", job.webhook.Id, err.Error())
+		return nil, nil
+	}
+
+	if response.Message == "" && len(response.Payload) == 0 {
+		return nil, nil
+	}
+
+	err = response.ValidateIntegration()
+	if err != nil {
+		log.Printf("Reply of webhook %d was not posted: %s", job.webhook.Id, err.Error())
+		return nil, nil
+	}
+
+	// Only the content is taken from the response, the author and chatroom are set by the bot.
+	return &models.ChatMessage{
+		Message: response.Message,
+		Type:    response.Type,
+		Payload: response.Payload,
+	}, nil
+}
+
+// Signs the delivery body, endpoints compute the same value to check the request comes from the chatroom.
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
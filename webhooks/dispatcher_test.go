@@ -0,0 +1,224 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/raynine/go-chatroom/models"
+	"github.com/stretchr/testify/assert"
+)
+
+type stubWebhookRepo struct {
+	mu         sync.Mutex
+	webhooks   []*models.ChatroomWebhook
+	deliveries []models.WebhookDelivery
+}
+
+func (r *stubWebhookRepo) AddChatroomWebhook(webhook *models.ChatroomWebhook) (*int, error) {
+	return nil, nil
+}
+
+func (r *stubWebhookRepo) GetChatroomWebhooks(chatroomId string) ([]*models.ChatroomWebhook, error) {
+	return r.webhooks, nil
+}
+
+func (r *stubWebhookRepo) DeleteChatroomWebhook(id int, chatroomId string) error {
+	return nil
+}
+
+func (r *stubWebhookRepo) AddWebhookDelivery(delivery *models.WebhookDelivery) (*int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	id := len(r.deliveries) + 1
+	r.deliveries = append(r.deliveries, *delivery)
+	return &id, nil
+}
+
+func (r *stubWebhookRepo) UpdateWebhookDelivery(delivery *models.WebhookDelivery) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.deliveries[delivery.Id-1] = *delivery
+	return nil
+}
+
+func (r *stubWebhookRepo) GetWebhookDeliveries(webhookId int, chatroomId string, limit int) ([]*models.WebhookDelivery, error) {
+	return nil, nil
+}
+
+func (r *stubWebhookRepo) delivery(id int) models.WebhookDelivery {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.deliveries[id-1]
+}
+
+// Starts an endpoint that answers with the provided statuses in order, repeating the last one.
+func newEndpoint(t *testing.T, statuses []int, body string) (*httptest.Server, chan *http.Request) {
+	requests := make(chan *http.Request, 10)
+	calls := 0
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload, _ := io.ReadAll(r.Body)
+		r.Body = io.NopCloser(bytes.NewReader(payload))
+		requests <- r
+
+		status := statuses[min(calls, len(statuses)-1)]
+		calls++
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		fmt.Fprint(w, body)
+	}))
+
+	t.Cleanup(server.Close)
+
+	return server, requests
+}
+
+func TestDispatcher(t *testing.T) {
+	message := &models.ChatMessage{Id: 9, ChatroomID: "room", UserName: "ray", Message: "deploy api"}
+
+	t.Run("Signs the delivery and posts the reply", func(t *testing.T) {
+		server, requests := newEndpoint(t, []int{http.StatusOK}, `{"chat_message_message": "deploying api"}`)
+		repo := &stubWebhookRepo{webhooks: []*models.ChatroomWebhook{
+			{Id: 1, ChatroomID: "room", URL: server.URL, Secret: "whsec_test", TriggerWord: "deploy"},
+			{Id: 2, ChatroomID: "room", URL: server.URL, Secret: "whsec_test", TriggerWord: "rollback"},
+		}}
+
+		replies := make(chan *models.ChatMessage, 1)
+		dispatcher := NewDispatcher(repo, server.Client(), 3, time.Millisecond)
+		dispatcher.Start(1, func(chatroomId string, msg *models.ChatMessage) {
+			assert.Equal(t, "room", chatroomId)
+			replies <- msg
+		})
+
+		dispatcher.MessagePosted(message)
+
+		reply := <-replies
+		assert.Equal(t, "deploying api", reply.Message)
+		assert.Equal(t, 1, reply.WebhookID)
+
+		req := <-requests
+		body, _ := io.ReadAll(req.Body)
+		assert.Equal(t, Sign("whsec_test", req.Header.Get(TimestampHeader), body), req.Header.Get(SignatureHeader))
+
+		event := Event{}
+		assert.NoError(t, json.Unmarshal(body, &event))
+		assert.Equal(t, 1, event.DeliveryID)
+		assert.Equal(t, "deploy api", event.Message.Message)
+
+		// The reply of the webhook is not delivered to the webhooks again.
+		dispatcher.MessagePosted(reply)
+		assert.Len(t, dispatcher.messages, 0)
+
+		assert.Len(t, repo.deliveries, 1)
+		assert.Equal(t, models.WebhookDeliverySucceeded, repo.delivery(1).Status)
+	})
+
+	t.Run("Retries server errors", func(t *testing.T) {
+		server, requests := newEndpoint(t, []int{http.StatusBadGateway, http.StatusOK}, "")
+		repo := &stubWebhookRepo{}
+		webhook := &models.ChatroomWebhook{Id: 1, ChatroomID: "room", URL: server.URL, Secret: "whsec_test"}
+
+		dispatcher := NewDispatcher(repo, server.Client(), 3, time.Millisecond)
+		job, err := dispatcher.newJob(webhook, message)
+		assert.NoError(t, err)
+
+		dispatcher.attempt(job)
+		<-requests
+		assert.Equal(t, models.WebhookDeliveryPending, repo.delivery(1).Status)
+		assert.Equal(t, "endpoint answered with status code 502", repo.delivery(1).Error)
+
+		dispatcher.attempt(<-dispatcher.jobs)
+		<-requests
+		assert.Equal(t, models.WebhookDeliverySucceeded, repo.delivery(1).Status)
+		assert.Equal(t, 2, repo.delivery(1).Attempts)
+	})
+
+	t.Run("Does not retry client errors", func(t *testing.T) {
+		server, requests := newEndpoint(t, []int{http.StatusNotFound}, "")
+		repo := &stubWebhookRepo{}
+		webhook := &models.ChatroomWebhook{Id: 1, ChatroomID: "room", URL: server.URL, Secret: "whsec_test"}
+
+		dispatcher := NewDispatcher(repo, server.Client(), 3, time.Millisecond)
+		job, _ := dispatcher.newJob(webhook, message)
+
+		dispatcher.attempt(job)
+		<-requests
+		assert.Equal(t, models.WebhookDeliveryFailed, repo.delivery(1).Status)
+		assert.Equal(t, http.StatusNotFound, *repo.delivery(1).ResponseStatus)
+	})
+
+	t.Run("Close stops the workers", func(t *testing.T) {
+		server, requests := newEndpoint(t, []int{http.StatusOK}, "")
+		repo := &stubWebhookRepo{webhooks: []*models.ChatroomWebhook{{Id: 1, ChatroomID: "room", URL: server.URL}}}
+
+		dispatcher := NewDispatcher(repo, server.Client(), 3, time.Millisecond)
+		dispatcher.Start(2, nil)
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		assert.NoError(t, dispatcher.Close(ctx))
+
+		dispatcher.MessagePosted(message)
+		assert.Never(t, func() bool { return len(requests) > 0 }, 50*time.Millisecond, 5*time.Millisecond)
+	})
+
+	t.Run("Refuses internal addresses", func(t *testing.T) {
+		server, requests := newEndpoint(t, []int{http.StatusOK}, "")
+		repo := &stubWebhookRepo{}
+		webhook := &models.ChatroomWebhook{Id: 1, ChatroomID: "room", URL: server.URL, Secret: "whsec_test"}
+
+		dispatcher := NewDispatcher(repo, NewClient(time.Second), 3, time.Millisecond)
+		job, _ := dispatcher.newJob(webhook, message)
+
+		dispatcher.attempt(job)
+		assert.Len(t, requests, 0)
+		assert.Equal(t, models.WebhookDeliveryFailed, repo.delivery(1).Status)
+		assert.Equal(t, 1, repo.delivery(1).Attempts)
+		assert.Contains(t, repo.delivery(1).Error, "is not allowed")
+	})
+
+	t.Run("Does not follow redirects", func(t *testing.T) {
+		target, requests := newEndpoint(t, []int{http.StatusOK}, "")
+		server := httptest.NewServer(http.RedirectHandler(target.URL, http.StatusFound))
+		t.Cleanup(server.Close)
+
+		repo := &stubWebhookRepo{}
+		webhook := &models.ChatroomWebhook{Id: 1, ChatroomID: "room", URL: server.URL, Secret: "whsec_test"}
+
+		client := server.Client()
+		client.CheckRedirect = NewClient(time.Second).CheckRedirect
+
+		dispatcher := NewDispatcher(repo, client, 3, time.Millisecond)
+		job, _ := dispatcher.newJob(webhook, message)
+
+		dispatcher.attempt(job)
+		assert.Len(t, requests, 0)
+		assert.Equal(t, models.WebhookDeliveryFailed, repo.delivery(1).Status)
+		assert.Equal(t, http.StatusFound, *repo.delivery(1).ResponseStatus)
+	})
+
+	t.Run("Drops replies integrations can't post", func(t *testing.T) {
+		server, _ := newEndpoint(t, []int{http.StatusOK}, `{"chat_message_message": "vote", "chat_message_type": "poll"}`)
+		repo := &stubWebhookRepo{}
+		webhook := &models.ChatroomWebhook{Id: 1, ChatroomID: "room", URL: server.URL, Secret: "whsec_test"}
+
+		dispatcher := NewDispatcher(repo, server.Client(), 3, time.Millisecond)
+		job, _ := dispatcher.newJob(webhook, message)
+
+		reply, err := dispatcher.send(job)
+		assert.NoError(t, err)
+		assert.Nil(t, reply)
+	})
+}